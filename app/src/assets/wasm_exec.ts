@@ -42,30 +42,183 @@ declare global {
     sendMsg: Function
 
     tungsten: {
-      genTx: (uuid: string) => TxSession
-      importTx: (tx: Uint8Array) => TxSession
+      genTx: (uuid: string) => {tx: TxSession | null, error: TungstenError | null}
+      importTx: (tx: Uint8Array) => {tx: TxSession | null, error: TungstenError | null}
+      importEncrypted: (tx: Uint8Array, passphrase: string) => {tx: TxSession | null, error: TungstenError | null}
 
       // TODO: Remove temp functions
       doubleTx: () => TxSession[]
 
       ephem: {
         // Unless otherwise stated: local=EphemPriv, remote=EphemPub
-        genKeypair: () => {priv: Uint8Array, pub: Uint8Array}
-        genSecret: (local: Uint8Array, remote: Uint8Array) => {ciphertext: Uint8Array, secret: Uint8Array}
-        receiveSecret: (local: Uint8Array, remote: Uint8Array, ciphertext: Uint8Array) => Uint8Array
-        genFingerprint: (local: Uint8Array, remote: Uint8Array) => string
+        genKeypair: () => {priv: Uint8Array, pub: Uint8Array, error: TungstenError | null}
+        genSecret: (local: Uint8Array, remote: Uint8Array) => {ciphertext: Uint8Array, secret: Uint8Array, error: TungstenError | null}
+        receiveSecret: (local: Uint8Array, remote: Uint8Array, ciphertext: Uint8Array) => {secret: Uint8Array, error: TungstenError | null}
+        genFingerprint: (local: Uint8Array, remote: Uint8Array, secret: Uint8Array) => {fingerprint: string, error: TungstenError | null}
+
+        // An authenticated handshake (see /tungsten/handshake.go), bound to
+        // identities if the tx session of a guild both parties are in and the
+        // peer's id are given. Bound handshakes don't need the fingerprint
+        // compared.
+        handshake: (tx?: TxSession | null, peer?: string) => {handshake: Handshake | null, error: TungstenError | null}
+
+        // QR code payload for linking a new device (see /tungsten/devices.go)
+        linkOffer: (device: string, pub: Uint8Array) => {offer: Uint8Array | null, error: TungstenError | null}
+        readLinkOffer: (offer: Uint8Array) => {device: string | null, pub: Uint8Array | null, error: TungstenError | null}
       }
+
+      // Encrypting files in pieces (see /tungsten/attachment.go). The encrypted
+      // file is uploaded, and the attachment sent in a message's payload. The
+      // plaintext from an opener is only complete once close returns no error.
+      sealAttachment: () => {writer: AttachmentWriter | null, error: TungstenError | null}
+      openAttachment: (attachment: Uint8Array) => {opener: AttachmentOpener | null, error: TungstenError | null}
     }
   }
 
+  // The responder calls hello then respond, and the initiator initiate then
+  // finish, each sending msg to the other party. The secret is available once
+  // respond or finish returns no error.
+  interface Handshake {
+    hello: () => {msg: Uint8Array | null, error: TungstenError | null}
+    initiate: (hello: Uint8Array) => {msg: Uint8Array | null, error: TungstenError | null}
+    respond: (init: Uint8Array) => {msg: Uint8Array | null, error: TungstenError | null}
+    finish: (finish: Uint8Array) => {msg: Uint8Array | null, error: TungstenError | null}
+    secret: () => {secret: Uint8Array | null, error: TungstenError | null}
+    fingerprint: () => {fingerprint: string | null, error: TungstenError | null}
+    destroy: () => void
+  }
+
+  interface AttachmentWriter {
+    write: (data: Uint8Array) => {data: Uint8Array | null, error: TungstenError | null}
+    close: () => {data: Uint8Array | null, attachment: Uint8Array | null, error: TungstenError | null}
+  }
+
+  interface AttachmentOpener {
+    size: number
+    write: (data: Uint8Array) => {data: Uint8Array | null, error: TungstenError | null}
+    close: () => {data: Uint8Array | null, error: TungstenError | null}
+  }
+
+  // Codes are defined in /tungsten/errors.go
+  interface TungstenError {
+    code: string
+    message: string
+  }
+
   interface TxSession {
-    sendMessage: (ratchetId: string, data: Uint8Array) => Uint8Array
+    handle: number
+    sendMessage: (ratchetId: string, data: Uint8Array) => {
+      msg: Uint8Array | null,
+      error: TungstenError | null
+    }
     receiveMessage: (data: Uint8Array) => {
+      type: number | null,  // MSG_TYPE_* in /tungsten/msg.go
+      ratchet: string | null,  // for data messages, and announced or retired ratchets
       msg: Uint8Array,
-      error: boolean
+      skipped: number,  // messages missed before this one, which may still arrive
+      member: Member | null,  // introduced by a create user message
+      removed: Removal | null,  // removed by a remove member message
+      error: TungstenError | null
     }
-    generateUpdate: () => Uint8Array
-    export: () => Uint8Array
+    generateUpdate: () => {
+      msg: Uint8Array | null,
+      error: TungstenError | null
+    }
+    export: () => {export: Uint8Array | null, error: TungstenError | null}
+    // Argon2id costs default to {time: 3, memory: 65536 (KiB), threads: 1}
+    exportEncrypted: (passphrase: string, params?: KDFParams) => {
+      export: Uint8Array | null,
+      error: TungstenError | null
+    }
+
+    // Session initiation, after both users have an ephem secret. The new
+    // member sends introduce, the existing member sends createUser to the
+    // group, and the new member joins with the same message.
+    introduce: (secret: Uint8Array) => {msg: Uint8Array | null, error: TungstenError | null}
+    createUser: (secret: Uint8Array, intro: Uint8Array) => {msg: Uint8Array | null, error: TungstenError | null}
+    joinGroup: (secret: Uint8Array, msg: Uint8Array) => {error: TungstenError | null}
+
+    // Both the removal and the update must be sent to the group
+    removeMember: (id: string) => {
+      removal: Uint8Array | null,
+      update: Uint8Array | null,
+      error: TungstenError | null
+    }
+
+    // A ratchet per channel, using the channel id. The message announcing or
+    // retiring it must be sent to the group. Only the recipients can read a
+    // ratchet, or every member if they aren't given.
+    addRatchet: (id: string, recipients?: string[] | null) => {msg: Uint8Array | null, error: TungstenError | null}
+    retireRatchet: (id: string) => {msg: Uint8Array | null, error: TungstenError | null}
+    setRecipients: (id: string, recipients: string[] | null) => {msg: Uint8Array | null, error: TungstenError | null}
+
+    // PADDING_* in /tungsten/padding.go (0 padmé, 1 buckets, 2 none)
+    setPadding: (policy: number) => {error: TungstenError | null}
+
+    // Whether our updates use the ratchet tree, for large guilds
+    setTreeMode: (enabled: boolean) => {error: TungstenError | null}
+
+    // When generateUpdate should be called: after maxMessages messages with a
+    // ratchet, maxAge milliseconds after its last update, or after a member
+    // joins (0 or false disables each). due is a bitmask of UPDATE_DUE_* in
+    // /tungsten/policy.go (1 messages, 2 age, 4 members, 8 header key not
+    // shared yet), or 0 if an update isn't due, and nextUpdate is when maxAge
+    // will make one due.
+    setUpdatePolicy: (maxMessages: number, maxAge: number, onMembershipChange: boolean) => {error: TungstenError | null}
+    updateStatus: () => {
+      due: number,
+      nextUpdate: number | null,
+      ratchets: {id: string, epoch: number, sent: number, updated: number | null, due: number}[],
+      error: TungstenError | null
+    }
+
+    // Replaces our signing keys. The message must be sent to the group, and
+    // mirrorSession called for our other devices.
+    rotateKeys: () => {msg: Uint8Array | null, error: TungstenError | null}
+
+    // Verifying a member's long-term keys. The safety number is the same on
+    // both sides, and the code is shown as a QR code for the member to scan.
+    // verifySafetyCode returns a safety_mismatch error if it doesn't match.
+    safetyNumber: (id: string) => {safetyNumber: string | null, error: TungstenError | null}
+    safetyCode: (id: string) => {code: Uint8Array | null, error: TungstenError | null}
+    verifySafetyCode: (id: string, code: Uint8Array) => {error: TungstenError | null}
+
+    // On the device group session (user.deviceTx), with a guild session.
+    // Messages are sent over the device group, and mirrorSession must be
+    // called after anything that changes the guild session's keys.
+    shareSession: (sessionId: string, tx: TxSession) => {msg: Uint8Array | null, error: TungstenError | null}
+    mirrorSession: (sessionId: string, tx: TxSession) => {msg: Uint8Array | null, error: TungstenError | null}
+    // The plaintext of a device group message. tx is a new session if we
+    // didn't have it in sessions.
+    applyMirror: (plain: Uint8Array, sessions: {[sessionId: string]: TxSession}) => {
+      sessionId: string | null,
+      tx: TxSession | null,
+      error: TungstenError | null
+    }
+
+    // Wipes the session's keys, such as when leaving a guild or logging out.
+    // The session can't be used or passed as an argument afterwards.
+    destroy: () => {error: TungstenError | null}
+  }
+
+  // A member introduced by someone else, who won't receive our ratchet updates
+  // until accepted
+  interface Member {
+    id: string
+    accept: () => {error: TungstenError | null}
+  }
+
+  // A member removed by someone else. Only apply it once the sender is known
+  // to be allowed to remove them, then send the update to the group.
+  interface Removal {
+    id: string
+    apply: () => {update: Uint8Array | null, error: TungstenError | null}
+  }
+
+  interface KDFParams {
+    time?: number
+    memory?: number
+    threads?: number
   }
 
   // interface RxSession {
@@ -33,7 +33,13 @@ export const useGuildsStore = defineStore({
       // Import our crypto sessions before assigning to state
       if (state.txSessions != null) {
         for (const guild in state.txSessions) {
-          state.txSessions[guild] = window.tungsten.importTx(btou(state.txSessions[guild]))
+          const { tx, error } = window.tungsten.importTx(btou(state.txSessions[guild]))
+          if (error) {
+            console.log("failed to import tx session:", guild, error.code)
+            delete state.txSessions[guild]
+          } else {
+            state.txSessions[guild] = tx
+          }
         }
       }
 
@@ -51,7 +57,12 @@ export const useGuildsStore = defineStore({
       for (const guild in this.txSessions) {
         // It's fine to store tx sessions as base64 as they are relatively
         // small and are being stored locally
-        copy.txSessions[guild] = utob(this.txSessions[guild].export())
+        const { export: e, error } = this.txSessions[guild].export()
+        if (e == null) {
+          console.log("failed to export tx session:", error?.code)
+          continue
+        }
+        copy.txSessions[guild] = utob(e)
       }
 
       return JSON.stringify(copy)
@@ -14,7 +14,11 @@ export const useUserStore = defineStore({
     overwrite(state: any) {
       // Import things properly before assigning to state
       if (state.deviceTx != undefined) { 
-        state.deviceTx = window.tungsten.importTx(btou(state.deviceTx))
+        const { tx, error } = window.tungsten.importTx(btou(state.deviceTx))
+        if (error) {
+          console.log("failed to import device tx session:", error.code)
+        }
+        state.deviceTx = tx
       }
       if (state.token != undefined) {
         state.token = btou(state.token)
@@ -31,7 +35,13 @@ export const useUserStore = defineStore({
       
       // Modify it to export things properly
       if (this.deviceTx != null) {
-        copy.deviceTx = utob(this.deviceTx.export())
+        const { export: e, error } = this.deviceTx.export()
+        if (e == null) {
+          console.log("failed to export device tx session:", error?.code)
+          copy.deviceTx = null
+        } else {
+          copy.deviceTx = utob(e)
+        }
       }
       if (this.token != null) {
         copy.token = utob(this.token)
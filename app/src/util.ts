@@ -81,6 +81,17 @@ export function sendMutation(guildId: string, channelId: string, msg: Mutation)
   const guilds = useGuildsStore()
   const ephem = useEphemeralStore()
 
+  const { msg: message, error } = guilds.txSessions[guildId].sendMessage(
+    channelId,
+    new TextEncoder().encode(
+      JSON.stringify(msg)
+    )
+  )
+  if (error) {
+    console.log("failed to encrypt mutation:", error.code)
+    return
+  }
+
   const evtId = uuidV4()
   ephem.pendingMutations[evtId] = msg
 
@@ -90,12 +101,7 @@ export function sendMutation(guildId: string, channelId: string, msg: Mutation)
       evt: encode({
         guildId: uuidParse(guildId),
         evtId: uuidParse(evtId),
-        message: guilds.txSessions[guildId].sendMessage(
-          channelId,
-          new TextEncoder().encode(
-            JSON.stringify(msg)
-          )
-        ),
+        message: message,
       }),
     })
   )
@@ -0,0 +1,105 @@
+package tungsten
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestRestrictedRatchet(t *testing.T) {
+	alice, bob := testPair(t)
+	carol, _ := testAdd(t, alice, bob)
+	id := uuid.New()
+
+	if err := alice.AddRatchet(uuid.New(), []uuid.UUID{uuid.New()}, new(bytes.Buffer)); err != ErrUnknownMember {
+		t.Fatalf("got %v, want ErrUnknownMember", err)
+	}
+
+	announce := new(bytes.Buffer)
+	if err := alice.AddRatchet(id, []uuid.UUID{bob.UUID}, announce); err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, bob, announce.Bytes(), "")
+	testReceive(t, carol, announce.Bytes(), "")
+	if findRatchet(carol.child(alice.UUID).Ratchets, id) != nil {
+		t.Fatal("member that isn't a recipient has the ratchet")
+	}
+
+	// Only the recipient can read it, including after an update
+	msg := testSendOn(t, alice, id, "staff only")
+	testReceive(t, bob, msg, "staff only")
+	if _, err := carol.ReceiveMessage(msg); err != ErrUnknownRatchet {
+		t.Fatalf("got %v, want ErrUnknownRatchet", err)
+	}
+	update := testUpdate(t, alice)
+	testReceive(t, bob, update, "")
+	testReceive(t, carol, update, "")
+	if findRatchet(carol.child(alice.UUID).Ratchets, id) != nil {
+		t.Fatal("update gave the ratchet to a member that isn't a recipient")
+	}
+	before := testSendOn(t, alice, id, "before the change")
+	testReceive(t, bob, testSendOn(t, alice, id, "after update"), "after update")
+
+	// The restriction is kept by both sides across an export
+	alice, bob = testReexport(t, alice), testReexport(t, bob)
+	if rat := findRatchet(alice.Ratchets, id); !rat.Restricted || len(rat.Recipients) != 1 {
+		t.Fatal("export lost the sender's restriction")
+	}
+	if rat := findRatchet(bob.child(alice.UUID).Ratchets, id); rat == nil || !rat.Restricted {
+		t.Fatal("export lost the recipient's restriction")
+	}
+
+	// Changing the recipients rekeys the ratchet, so the removed recipient can't
+	// read later messages and the added one can't read earlier ones
+	announce.Reset()
+	if err := alice.SetRecipients(id, []uuid.UUID{carol.UUID}, announce); err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, bob, announce.Bytes(), "")
+	testReceive(t, carol, announce.Bytes(), "")
+	if findRatchet(bob.child(alice.UUID).Ratchets, id) != nil {
+		t.Fatal("removed recipient still has the ratchet")
+	}
+	msg = testSendOn(t, alice, id, "new staff")
+	testReceive(t, carol, msg, "new staff")
+	if _, err := bob.ReceiveMessage(msg); err == nil {
+		t.Fatal("removed recipient read a later message")
+	}
+	if _, err := carol.ReceiveMessage(before); err == nil {
+		t.Fatal("added recipient read an earlier message")
+	}
+
+	// Without a restriction, every member reads it
+	announce.Reset()
+	if err := alice.SetRecipients(id, nil, announce); err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, bob, announce.Bytes(), "")
+	testReceive(t, carol, announce.Bytes(), "")
+	msg = testSendOn(t, alice, id, "everyone")
+	testReceive(t, bob, msg, "everyone")
+	testReceive(t, carol, msg, "everyone")
+}
+
+// A member that joins after a restricted ratchet was added isn't given it
+func TestRestrictedRatchetNotShared(t *testing.T) {
+	alice, bob := testPair(t)
+	id := uuid.New()
+
+	announce := new(bytes.Buffer)
+	if err := alice.AddRatchet(id, []uuid.UUID{bob.UUID}, announce); err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, bob, announce.Bytes(), "")
+
+	carol, _ := testAdd(t, alice, bob)
+	for _, v := range carol.Children {
+		if findRatchet(v.Ratchets, id) != nil {
+			t.Fatal("new member was given a restricted ratchet")
+		}
+	}
+	if _, err := carol.ReceiveMessage(testSendOn(t, alice, id, "staff only")); err != ErrUnknownRatchet {
+		t.Fatalf("got %v, want ErrUnknownRatchet", err)
+	}
+}
@@ -0,0 +1,136 @@
+package tungsten
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+// Payloads, envelopes and encapsulated keys are sealed with XChaCha20-Poly1305,
+// with associated data binding them to where they were sent, so that a
+// ciphertext can't be cut from one message and pasted into another for a
+// different recipient or ratchet. The signatures only show who sent a message,
+// not that its ciphertexts were made for it.
+
+// sealAEAD seals plain with XChaCha20-Poly1305
+func sealAEAD(key *[32]byte, nonce, plain, ad []byte) []byte {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		panic(err) // The key is always the right size
+	}
+	return aead.Seal(nil, nonce, plain, ad)
+}
+
+// openAEAD opens a ciphertext from sealAEAD, returning ErrMACFailure if it or
+// its associated data were changed
+func openAEAD(key *[32]byte, nonce, ciphertext, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(key[:])
+	if err != nil {
+		panic(err)
+	}
+
+	plain, err := aead.Open(nil, nonce, ciphertext, ad)
+	if err != nil {
+		return nil, ErrMACFailure
+	}
+	return plain, nil
+}
+
+// ad returns the associated data of the payload, which is the header: every
+// field before the nonce
+func (m *Data) ad() []byte {
+	b := new(bytes.Buffer)
+	b.Write([]byte{m.MsgType})
+	b.Write(m.SenderID[:])
+	b.Write(m.RatchetID[:])
+	binary.Write(b, binary.BigEndian, m.Epoch)
+	binary.Write(b, binary.BigEndian, m.Counter)
+	return b.Bytes()
+}
+
+// ad returns the associated data of the payload, which is the header: every
+// field before the keys
+func (m *AnnounceRatchet) ad() []byte {
+	b := new(bytes.Buffer)
+	b.Write([]byte{m.MsgType})
+	b.Write(m.SenderID[:])
+	b.Write(m.RatchetID[:])
+	binary.Write(b, binary.BigEndian, m.Epoch)
+	binary.Write(b, binary.BigEndian, m.PrevCounter)
+	binary.Write(b, binary.BigEndian, m.Restricted)
+	binary.Write(b, binary.BigEndian, int64(len(m.Recipients)))
+	for _, v := range m.Recipients {
+		b.Write(v[:])
+	}
+	return b.Bytes()
+}
+
+// ad returns the associated data of the state and the bundle, which is the
+// header: every field before the state
+func (m *CreateUser) ad() []byte {
+	b := new(bytes.Buffer)
+	b.Write([]byte{m.MsgType})
+	b.Write(m.SenderID[:])
+	b.Write(m.MemberID[:])
+	return b.Bytes()
+}
+
+// The sender's part of the associated data of an encapsulated key
+type encapAD struct {
+	Sender   uuid.UUID
+	Pubkey   x25519.Key // Of the privkey that the DH part was sealed with
+	PubkeyPQ PQPubkey   // The sender's KEM pubkey at the time
+}
+
+// to returns the associated data of a key encapsulated to recipient (a UUID,
+// or a node pubkey in the ratchet tree), for the kind of key named by info, and
+// the purpose of the key, such as the ratchet it advances
+func (a *encapAD) to(recipient, info, purpose []byte) []byte {
+	b := new(bytes.Buffer)
+	a.Marshal(b)
+	b.Write(recipient)
+	b.Write(info)
+	b.Write(purpose)
+	return b.Bytes()
+}
+
+func (a *encapAD) Marshal(w io.Writer) {
+	w.Write(a.Sender[:])
+	w.Write(a.Pubkey[:])
+	a.PubkeyPQ.Marshal(w)
+}
+
+// ratchetPurpose is the purpose of a key for a ratchet at an epoch
+func ratchetPurpose(ratchet uuid.UUID, epoch uint32) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte(nil), ratchet[:]...), epoch)
+}
+
+// senderAD returns our part of the associated data of keys we encapsulate
+// with our current privkey
+func (t *TxSession) senderAD() *encapAD {
+	ad := &encapAD{Sender: t.UUID, PubkeyPQ: t.CurrentPubkeyPQ}
+	x25519.KeyGen(&ad.Pubkey, &t.CurrentPrivkey)
+	return ad
+}
+
+// senderAD returns the member's part of the associated data of keys they
+// encapsulated with their current privkey
+func (r *RxSession) senderAD() *encapAD {
+	return &encapAD{Sender: r.UUID, Pubkey: r.CurrentPubkey, PubkeyPQ: r.CurrentPubkeyPQ}
+}
+
+// senderAD returns the sender's part of the associated data of the keys in an
+// update, which are encapsulated with its new privkey
+func (u *RatchetUpdate) senderAD() *encapAD {
+	return &encapAD{Sender: u.SenderID, Pubkey: u.NewPubkey, PubkeyPQ: u.NewPubkeyPQ}
+}
+
+// timestampPurpose is the purpose of a key replaced by an update, such as the
+// header key, which is bound to the update's timestamp
+func timestampPurpose(ts int64) []byte {
+	return binary.BigEndian.AppendUint64(nil, uint64(ts))
+}
@@ -0,0 +1,185 @@
+package tungsten
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// testOpenEnvelope opens the envelope of a message we sent, returning its body
+// key and the message inside
+func testOpenEnvelope(t *testing.T, sender *TxSession, msg []byte) (*Envelope, [32]byte, []byte) {
+	t.Helper()
+	e := new(Envelope)
+	if err := e.Unmarshal(bytes.NewReader(msg)); err != nil {
+		t.Fatal(err)
+	}
+	// Updates are sealed with the previous header key, which members still have
+	for _, key := range []*[32]byte{&sender.HeaderKey, &sender.PrevHeaderKey} {
+		b, err := openAEAD(key, e.Nonce[:], e.Header[:], e.headerAD(sender.UUID))
+		if err != nil {
+			continue
+		}
+		var bodyKey [32]byte
+		copy(bodyKey[:], b)
+		if body, ok := e.openWith(bodyKey, sender.UUID); ok {
+			return e, bodyKey, body
+		}
+	}
+	t.Fatal("couldn't open our own envelope")
+	return nil, [32]byte{}, nil
+}
+
+// testReseal seals a message in the envelope again, as its sender could
+func testReseal(e *Envelope, bodyKey [32]byte, m marshaler) []byte {
+	b := new(bytes.Buffer)
+	m.Marshal(b)
+	e.Body = sealAEAD(&bodyKey, e.Nonce[:], b.Bytes(), e.bodyAD())
+	out := new(bytes.Buffer)
+	e.Marshal(out)
+	return out.Bytes()
+}
+
+func TestEnvelopeBinding(t *testing.T) {
+	alice, bob := testPair(t)
+	first, second := testSend(t, alice, "first"), testSend(t, alice, "second")
+	e1, _, _ := testOpenEnvelope(t, alice, first)
+	e2, _, _ := testOpenEnvelope(t, alice, second)
+
+	// Neither part of an envelope opens in another
+	for _, swap := range []func(a, b *Envelope){
+		func(a, b *Envelope) { a.Body = b.Body },
+		func(a, b *Envelope) { a.Header = b.Header },
+		func(a, b *Envelope) { a.Nonce = b.Nonce },
+	} {
+		pasted := *e1
+		swap(&pasted, e2)
+		b := new(bytes.Buffer)
+		pasted.Marshal(b)
+		if _, err := bob.ReceiveMessage(b.Bytes()); err != ErrUnknownSender {
+			t.Fatalf("got %v, want ErrUnknownSender", err)
+		}
+	}
+	testReceive(t, bob, first, "first")
+	testReceive(t, bob, second, "second")
+}
+
+// A member's keys for every ratchet in an update are encapsulated with the same
+// DH key, so only the associated data keeps the sender from moving them between
+// ratchets. Nor can they be moved to the header key.
+func TestUpdateBinding(t *testing.T) {
+	alice, bob := testPair(t)
+	announce := new(bytes.Buffer)
+	if err := alice.AddRatchet(uuid.New(), nil, announce); err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, bob, announce.Bytes(), "")
+	update := testUpdate(t, alice)
+
+	tests := []struct {
+		name  string
+		paste func(m *RatchetUpdate)
+	}{
+		{"ratchets", func(m *RatchetUpdate) {
+			a, b := &m.Updates[0], &m.Updates[1]
+			a.DH, b.DH = b.DH, a.DH
+			a.PQ, b.PQ = b.PQ, a.PQ
+		}},
+		{"header key", func(m *RatchetUpdate) {
+			m.HeaderKeys[0].DH, m.HeaderKeys[0].PQ = m.Updates[0].DH, m.Updates[0].PQ
+		}},
+	}
+	for _, tt := range tests {
+		e, bodyKey, body := testOpenEnvelope(t, alice, update)
+		m := new(RatchetUpdate)
+		if err := m.Unmarshal(bytes.NewReader(body)); err != nil {
+			t.Fatal(err)
+		}
+		if len(m.Updates) != 2 || len(m.HeaderKeys) != 1 {
+			t.Fatalf("update has %d ratchets and %d header keys", len(m.Updates), len(m.HeaderKeys))
+		}
+		tt.paste(m)
+		m.Sign(alice.SigningKey, alice.SigningKeyPQ)
+
+		if _, err := bob.ReceiveMessage(testReseal(e, bodyKey, m)); err != ErrMACFailure {
+			t.Fatalf("%s: got %v, want ErrMACFailure", tt.name, err)
+		}
+	}
+	testReceive(t, bob, update, "")
+	testReceive(t, bob, testSend(t, alice, "after update"), "after update")
+}
+
+func TestEncapBinding(t *testing.T) {
+	c := new(Config)
+	pub, priv, err := genPQ(c, c.suite())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := &encapAD{Sender: uuid.New(), PubkeyPQ: pub}
+	recipient, ratchet := uuid.New(), uuid.New()
+	data := sender.to(recipient[:], DH_HKDF_INFO, ratchetPurpose(ratchet, 1))
+
+	var key [32]byte
+	encap, encapPQ := DHKey{1}, PQKey{2}
+	sealed, err := sealDH(c, &key, encap, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealedPQ, err := sealPQ(c, &pub, encapPQ, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out, err := openDH(&key, sealed, data); err != nil || out != encap {
+		t.Fatalf("DH opened to another key: %v", err)
+	}
+	if out, err := openPQ(&priv, sealedPQ, data); err != nil || out != encapPQ {
+		t.Fatalf("PQ opened to another key: %v", err)
+	}
+
+	other := uuid.New()
+	otherSender := *sender
+	otherSender.Sender = other
+	tests := []struct {
+		name string
+		ad   []byte
+	}{
+		{"sender", otherSender.to(recipient[:], DH_HKDF_INFO, ratchetPurpose(ratchet, 1))},
+		{"recipient", sender.to(other[:], DH_HKDF_INFO, ratchetPurpose(ratchet, 1))},
+		{"kind of key", sender.to(recipient[:], HEADER_HKDF_INFO, ratchetPurpose(ratchet, 1))},
+		{"ratchet", sender.to(recipient[:], DH_HKDF_INFO, ratchetPurpose(other, 1))},
+		{"epoch", sender.to(recipient[:], DH_HKDF_INFO, ratchetPurpose(ratchet, 2))},
+	}
+	for _, tt := range tests {
+		if _, err := openDH(&key, sealed, tt.ad); err != ErrMACFailure {
+			t.Errorf("DH, other %s: got %v, want ErrMACFailure", tt.name, err)
+		}
+		if _, err := openPQ(&priv, sealedPQ, tt.ad); err != ErrMACFailure {
+			t.Errorf("PQ, other %s: got %v, want ErrMACFailure", tt.name, err)
+		}
+	}
+}
+
+func TestPayloadBinding(t *testing.T) {
+	m := &Data{MsgType: MSG_TYPE_DATA, SenderID: uuid.New(), RatchetID: uuid.New(), Epoch: 1, Counter: 2}
+	var key [32]byte
+	sealed := sealAEAD(&key, m.Nonce[:], []byte("payload"), m.ad())
+	if out, err := openAEAD(&key, m.Nonce[:], sealed, m.ad()); err != nil || string(out) != "payload" {
+		t.Fatalf("opened to another payload: %v", err)
+	}
+
+	// Every field of the header is bound to the payload
+	for _, change := range []func(m *Data){
+		func(m *Data) { m.MsgType++ },
+		func(m *Data) { m.SenderID = uuid.New() },
+		func(m *Data) { m.RatchetID = uuid.New() },
+		func(m *Data) { m.Epoch++ },
+		func(m *Data) { m.Counter++ },
+	} {
+		pasted := *m
+		change(&pasted)
+		if _, err := openAEAD(&key, m.Nonce[:], sealed, pasted.ad()); err != ErrMACFailure {
+			t.Fatalf("got %v, want ErrMACFailure", err)
+		}
+	}
+}
@@ -0,0 +1,341 @@
+package tungsten
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"hash"
+	"io"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// Attachments are encrypted separately from messages, so that large files can
+// be streamed rather than held in memory. Each file has a random key, and is
+// split into chunks that are each sealed with a nonce made from a random
+// prefix, the index of the chunk and whether it is the last, so that chunks
+// can't be reordered and a truncated file is detected. The encrypted file is
+// uploaded to the server, and the key and digest of the encrypted file are
+// sent to the group in the payload of a data message.
+
+const ATTACHMENT_VERSION = 0x00
+
+// Chunks are sealed with this much plaintext, except the last
+const ATTACHMENT_CHUNK_SIZE = 64 * 1024
+
+// The largest chunk size accepted when opening an attachment
+const MAX_ATTACHMENT_CHUNK_SIZE = 16 * 1024 * 1024
+
+// Length of version, chunk size and nonce prefix
+const attachmentHeaderSize = 1 + 4 + 15
+
+// What is needed to open an attachment, sent in a data message
+type Attachment struct {
+	Version byte
+	Key     [32]byte
+	Digest  [32]byte // SHA-256 of the encrypted file
+	Size    int64    // Of the plaintext
+}
+
+func (a *Attachment) Marshal(w io.Writer) {
+	w.Write([]byte{a.Version})
+	w.Write(a.Key[:])
+	w.Write(a.Digest[:])
+	binary.Write(w, binary.BigEndian, a.Size)
+}
+
+func (a *Attachment) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+
+	b := make([]byte, 1)
+	er.Read(b)
+	a.Version = b[0]
+	if er.err == nil && a.Version != ATTACHMENT_VERSION {
+		return ErrUnsupported
+	}
+
+	er.Read(a.Key[:])
+	er.Read(a.Digest[:])
+	binary.Read(er, binary.BigEndian, &a.Size)
+	return er.err
+}
+
+// ReadAttachment reads an attachment from the payload of a data message
+func ReadAttachment(plain []byte) (*Attachment, error) {
+	a := new(Attachment)
+	if err := a.Unmarshal(bytes.NewReader(plain)); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// chunkNonce returns the nonce of the chunk at index
+func chunkNonce(prefix *[15]byte, index uint64, last bool) *[24]byte {
+	var nonce [24]byte
+	copy(nonce[:], prefix[:])
+	binary.BigEndian.PutUint64(nonce[15:], index)
+	if last {
+		nonce[23] = 1
+	}
+	return &nonce
+}
+
+// AttachmentWriter encrypts a file written to it. The last chunk is only
+// written by Close, after which Attachment returns what is needed to open it.
+type AttachmentWriter struct {
+	w      io.Writer // Also writes to digest
+	digest hash.Hash
+
+	key    [32]byte
+	prefix [15]byte
+	index  uint64
+	buf    []byte
+	size   int64
+
+	attachment *Attachment
+	err        error
+}
+
+// SealAttachment starts encrypting a file to w, with a new random key
+func SealAttachment(w io.Writer) (*AttachmentWriter, error) {
+	return new(Config).SealAttachment(w)
+}
+
+// SealAttachment is SealAttachment with the config's random source
+func (c *Config) SealAttachment(w io.Writer) (*AttachmentWriter, error) {
+	a := &AttachmentWriter{digest: sha256.New()}
+	a.w = io.MultiWriter(w, a.digest)
+
+	if err := c.read(a.key[:]); err != nil {
+		return nil, err
+	}
+	if err := c.read(a.prefix[:]); err != nil {
+		return nil, err
+	}
+
+	header := make([]byte, attachmentHeaderSize)
+	header[0] = ATTACHMENT_VERSION
+	binary.BigEndian.PutUint32(header[1:], ATTACHMENT_CHUNK_SIZE)
+	copy(header[5:], a.prefix[:])
+	if _, err := a.w.Write(header); err != nil {
+		return nil, err
+	}
+
+	return a, nil
+}
+
+func (a *AttachmentWriter) Write(p []byte) (int, error) {
+	if a.err != nil {
+		return 0, a.err
+	}
+	if a.attachment != nil {
+		return 0, ErrInvalidArg
+	}
+
+	a.buf = append(a.buf, p...)
+	a.size += int64(len(p))
+
+	// A full chunk is only sealed once more follows it, as the last chunk may
+	// be full too
+	n := 0
+	for len(a.buf)-n > ATTACHMENT_CHUNK_SIZE && a.err == nil {
+		a.err = a.seal(a.buf[n:n+ATTACHMENT_CHUNK_SIZE], false)
+		n += ATTACHMENT_CHUNK_SIZE
+	}
+	a.buf = append(a.buf[:0], a.buf[n:]...)
+
+	if a.err != nil {
+		return 0, a.err
+	}
+	return len(p), nil
+}
+
+// Close writes the last chunk
+func (a *AttachmentWriter) Close() error {
+	if a.err != nil || a.attachment != nil {
+		return a.err
+	}
+
+	if a.err = a.seal(a.buf, true); a.err != nil {
+		return a.err
+	}
+	a.buf = nil
+
+	a.attachment = &Attachment{Version: ATTACHMENT_VERSION, Key: a.key, Size: a.size}
+	copy(a.attachment.Digest[:], a.digest.Sum(nil))
+	return nil
+}
+
+// Attachment returns what is needed to open the file, or nil if it hasn't been
+// closed
+func (a *AttachmentWriter) Attachment() *Attachment {
+	return a.attachment
+}
+
+func (a *AttachmentWriter) seal(chunk []byte, last bool) error {
+	out := secretbox.Seal(nil, chunk, chunkNonce(&a.prefix, a.index, last), &a.key)
+	a.index++
+
+	_, err := a.w.Write(out)
+	return err
+}
+
+// AttachmentOpener decrypts an encrypted file written to it, writing the
+// plaintext to w as each chunk is opened. The file is only complete once
+// Close returns nil, which checks that it wasn't truncated and matches the
+// digest.
+type AttachmentOpener struct {
+	w          io.Writer
+	attachment *Attachment
+	digest     hash.Hash
+
+	header    bool
+	chunkSize int
+	prefix    [15]byte
+	index     uint64
+	buf       []byte
+
+	closed bool
+	err    error
+}
+
+// OpenAttachment starts decrypting a file encrypted by SealAttachment to w
+func OpenAttachment(w io.Writer, a *Attachment) *AttachmentOpener {
+	return &AttachmentOpener{w: w, attachment: a, digest: sha256.New()}
+}
+
+func (o *AttachmentOpener) Write(p []byte) (int, error) {
+	if o.err != nil {
+		return 0, o.err
+	}
+	if o.closed {
+		return 0, ErrInvalidArg
+	}
+
+	o.digest.Write(p)
+	o.buf = append(o.buf, p...)
+
+	n := 0
+	if !o.header {
+		if len(o.buf) < attachmentHeaderSize {
+			return len(p), nil
+		}
+		if o.err = o.readHeader(); o.err != nil {
+			return 0, o.err
+		}
+		n = attachmentHeaderSize
+	}
+
+	// As with sealing, a chunk is only the last if nothing follows it
+	sealed := o.chunkSize + secretbox.Overhead
+	for len(o.buf)-n > sealed && o.err == nil {
+		o.err = o.open(o.buf[n:n+sealed], false)
+		n += sealed
+	}
+	o.buf = append(o.buf[:0], o.buf[n:]...)
+
+	if o.err != nil {
+		return 0, o.err
+	}
+	return len(p), nil
+}
+
+func (o *AttachmentOpener) readHeader() error {
+	if o.buf[0] != ATTACHMENT_VERSION {
+		return ErrUnsupported
+	}
+
+	o.chunkSize = int(binary.BigEndian.Uint32(o.buf[1:]))
+	if o.chunkSize == 0 || o.chunkSize > MAX_ATTACHMENT_CHUNK_SIZE {
+		return ErrUnsupported
+	}
+
+	copy(o.prefix[:], o.buf[5:])
+	o.header = true
+	return nil
+}
+
+// Close opens the last chunk, and checks the digest of the file
+func (o *AttachmentOpener) Close() error {
+	if o.err != nil || o.closed {
+		return o.err
+	}
+	o.closed = true
+
+	if !o.header || len(o.buf) < secretbox.Overhead {
+		o.err = ErrTruncated
+		return o.err
+	}
+
+	// Whatever is left must be the last chunk. If it opens as any other, the
+	// file was truncated after it.
+	if err := o.open(o.buf, true); err != nil {
+		if _, ok := secretbox.Open(nil, o.buf, chunkNonce(&o.prefix, o.index, false), &o.attachment.Key); ok {
+			err = ErrTruncated
+		}
+		o.err = err
+		return o.err
+	}
+	o.buf = nil
+
+	digest := o.digest.Sum(nil)
+	if subtle.ConstantTimeCompare(digest, o.attachment.Digest[:]) != 1 {
+		o.err = ErrMACFailure
+	}
+	return o.err
+}
+
+func (o *AttachmentOpener) open(chunk []byte, last bool) error {
+	plain, ok := secretbox.Open(nil, chunk, chunkNonce(&o.prefix, o.index, last), &o.attachment.Key)
+	if !ok {
+		return ErrMACFailure
+	}
+	o.index++
+
+	_, err := o.w.Write(plain)
+	return err
+}
+
+// attachmentReader decrypts an encrypted file as it is read
+type attachmentReader struct {
+	r     io.Reader
+	o     *AttachmentOpener
+	out   bytes.Buffer
+	chunk []byte
+	eof   bool
+}
+
+// NewAttachmentReader returns a reader of the plaintext of an encrypted file
+// read from r. It returns an error instead of io.EOF if the file was truncated
+// or doesn't match the digest.
+func NewAttachmentReader(r io.Reader, a *Attachment) io.Reader {
+	ar := &attachmentReader{r: r, chunk: make([]byte, ATTACHMENT_CHUNK_SIZE)}
+	ar.o = OpenAttachment(&ar.out, a)
+	return ar
+}
+
+func (ar *attachmentReader) Read(p []byte) (int, error) {
+	for ar.out.Len() == 0 && !ar.eof {
+		n, err := ar.r.Read(ar.chunk)
+		if n > 0 {
+			if _, err := ar.o.Write(ar.chunk[:n]); err != nil {
+				return 0, err
+			}
+		}
+
+		if err == io.EOF {
+			ar.eof = true
+			if err := ar.o.Close(); err != nil {
+				return 0, err
+			}
+		} else if err != nil {
+			return 0, err
+		}
+	}
+
+	if ar.out.Len() == 0 {
+		return 0, io.EOF
+	}
+	return ar.out.Read(p)
+}
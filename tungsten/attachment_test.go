@@ -0,0 +1,182 @@
+package tungsten
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"golang.org/x/crypto/nacl/secretbox"
+)
+
+// testSealAttachment encrypts a file, written in pieces of step bytes
+func testSealAttachment(t *testing.T, plain []byte, step int) ([]byte, *Attachment) {
+	t.Helper()
+	b := new(bytes.Buffer)
+	w, err := SealAttachment(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(plain); i += step {
+		if _, err := w.Write(plain[i:min(i+step, len(plain))]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if w.Attachment() != nil {
+		t.Fatal("attachment returned before close")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write([]byte{0}); err != ErrInvalidArg {
+		t.Fatalf("write after close: got %v, want ErrInvalidArg", err)
+	}
+	return b.Bytes(), w.Attachment()
+}
+
+func TestAttachment(t *testing.T) {
+	tests := []struct {
+		name   string
+		size   int
+		chunks int
+	}{
+		{"empty", 0, 1},
+		{"one byte", 1, 1},
+		{"short of a chunk", ATTACHMENT_CHUNK_SIZE - 1, 1},
+		{"one chunk", ATTACHMENT_CHUNK_SIZE, 1},
+		{"over a chunk", ATTACHMENT_CHUNK_SIZE + 1, 2},
+		{"three chunks", 3 * ATTACHMENT_CHUNK_SIZE, 3},
+	}
+	readers := []struct {
+		name string
+		r    func(io.Reader) io.Reader
+	}{
+		{"whole", func(r io.Reader) io.Reader { return r }},
+		{"one byte", iotest.OneByteReader},
+		{"half", iotest.HalfReader},
+		{"data with EOF", iotest.DataErrReader},
+	}
+	for _, tt := range tests {
+		plain := make([]byte, tt.size)
+		rand.Read(plain)
+		for _, step := range []int{1000, 2 * ATTACHMENT_CHUNK_SIZE} {
+			enc, a := testSealAttachment(t, plain, step)
+			if a.Size != int64(tt.size) {
+				t.Fatalf("%s: size %d", tt.name, a.Size)
+			}
+			if want := attachmentHeaderSize + tt.chunks*secretbox.Overhead + tt.size; len(enc) != want {
+				t.Fatalf("%s: encrypted to %d bytes, want %d", tt.name, len(enc), want)
+			}
+
+			// The attachment is sent in a data message
+			b := new(bytes.Buffer)
+			a.Marshal(b)
+			sent, err := ReadAttachment(b.Bytes())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *sent != *a {
+				t.Fatalf("%s: attachment read as another", tt.name)
+			}
+
+			for _, r := range readers {
+				out, err := io.ReadAll(NewAttachmentReader(r.r(bytes.NewReader(enc)), sent))
+				if err != nil {
+					t.Fatalf("%s, %s reads: %v", tt.name, r.name, err)
+				}
+				if !bytes.Equal(out, plain) {
+					t.Fatalf("%s, %s reads: opened to another file", tt.name, r.name)
+				}
+			}
+		}
+	}
+}
+
+func TestAttachmentTampered(t *testing.T) {
+	// The last chunk is half full
+	plain := make([]byte, 5*ATTACHMENT_CHUNK_SIZE/2)
+	rand.Read(plain)
+	enc, a := testSealAttachment(t, plain, len(plain))
+	sealed := ATTACHMENT_CHUNK_SIZE + secretbox.Overhead
+	chunk := func(i int) []byte {
+		return enc[attachmentHeaderSize+i*sealed : attachmentHeaderSize+(i+1)*sealed]
+	}
+
+	tests := []struct {
+		name   string
+		tamper func(enc []byte, a *Attachment) []byte
+		err    error
+	}{
+		{"empty", func(enc []byte, a *Attachment) []byte { return nil }, ErrTruncated},
+		{"header only", func(enc []byte, a *Attachment) []byte { return enc[:attachmentHeaderSize] }, ErrTruncated},
+		{"truncated at a chunk", func(enc []byte, a *Attachment) []byte {
+			return enc[:attachmentHeaderSize+2*sealed]
+		}, ErrTruncated},
+		{"truncated in a chunk", func(enc []byte, a *Attachment) []byte { return enc[:len(enc)-5] }, ErrMACFailure},
+		{"trailing data", func(enc []byte, a *Attachment) []byte { return append(enc, 0) }, ErrMACFailure},
+		{"reordered chunks", func(enc []byte, a *Attachment) []byte {
+			out := append([]byte(nil), enc[:attachmentHeaderSize]...)
+			out = append(out, chunk(1)...)
+			out = append(out, chunk(0)...)
+			return append(out, enc[attachmentHeaderSize+2*sealed:]...)
+		}, ErrMACFailure},
+		{"flipped byte", func(enc []byte, a *Attachment) []byte {
+			enc[attachmentHeaderSize+sealed+1] ^= 1
+			return enc
+		}, ErrMACFailure},
+		{"flipped prefix", func(enc []byte, a *Attachment) []byte {
+			enc[attachmentHeaderSize-1] ^= 1
+			return enc
+		}, ErrMACFailure},
+		{"version", func(enc []byte, a *Attachment) []byte {
+			enc[0] = ATTACHMENT_VERSION + 1
+			return enc
+		}, ErrUnsupported},
+		{"chunk size", func(enc []byte, a *Attachment) []byte {
+			copy(enc[1:5], []byte{0xff, 0xff, 0xff, 0xff})
+			return enc
+		}, ErrUnsupported},
+		{"wrong key", func(enc []byte, a *Attachment) []byte {
+			a.Key[0] ^= 1
+			return enc
+		}, ErrMACFailure},
+		{"wrong digest", func(enc []byte, a *Attachment) []byte {
+			a.Digest[0] ^= 1
+			return enc
+		}, ErrMACFailure},
+	}
+	for _, tt := range tests {
+		attachment := *a
+		tampered := tt.tamper(append([]byte(nil), enc...), &attachment)
+		if _, err := io.ReadAll(NewAttachmentReader(bytes.NewReader(tampered), &attachment)); err != tt.err {
+			t.Errorf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+	}
+
+	// Nothing more is written once closed
+	o := OpenAttachment(io.Discard, a)
+	if _, err := o.Write(enc); err != nil {
+		t.Fatal(err)
+	}
+	if err := o.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := o.Write(enc); err != ErrInvalidArg {
+		t.Fatalf("got %v, want ErrInvalidArg", err)
+	}
+}
+
+func TestReadAttachmentInvalid(t *testing.T) {
+	b := new(bytes.Buffer)
+	(&Attachment{Version: ATTACHMENT_VERSION, Size: 1}).Marshal(b)
+	if _, err := ReadAttachment(b.Bytes()[:b.Len()-1]); err != ErrTruncated {
+		t.Fatalf("got %v, want ErrTruncated", err)
+	}
+
+	unsupported := append([]byte(nil), b.Bytes()...)
+	unsupported[0] = ATTACHMENT_VERSION + 1
+	if _, err := ReadAttachment(unsupported); err != ErrUnsupported {
+		t.Fatalf("got %v, want ErrUnsupported", err)
+	}
+}
@@ -0,0 +1,82 @@
+package tungsten
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Ratchets per session, such as one per channel
+const benchRatchets = 4
+
+// benchGroup returns a session with n-1 other members, the session of one of
+// them, and some ratchets
+func benchGroup(b *testing.B, n int) (*TxSession, *TxSession) {
+	t, err := GenTx(uuid.New())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	var member *TxSession
+	for i := 1; i < n; i++ {
+		m, err := GenTx(uuid.New())
+		if err != nil {
+			b.Fatal(err)
+		}
+		RxFromTx(t, m)
+		if member == nil {
+			RxFromTx(m, t)
+			member = m
+		}
+	}
+
+	for i := 1; i < benchRatchets; i++ {
+		announce := new(bytes.Buffer)
+		if err := t.AddRatchet(uuid.New(), nil, announce); err != nil {
+			b.Fatal(err)
+		}
+		if _, err := member.ReceiveMessage(announce.Bytes()); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return t, member
+}
+
+func benchmarkGenerateUpdate(b *testing.B, n int) {
+	t, _ := benchGroup(b, n)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := t.GenerateUpdate(io.Discard); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkGenerateUpdate10(b *testing.B)   { benchmarkGenerateUpdate(b, 10) }
+func BenchmarkGenerateUpdate100(b *testing.B)  { benchmarkGenerateUpdate(b, 100) }
+func BenchmarkGenerateUpdate1000(b *testing.B) { benchmarkGenerateUpdate(b, 1000) }
+
+// BenchmarkReceiveUpdate opens an update with a key for each of the sender's
+// ratchets
+func BenchmarkReceiveUpdate(b *testing.B) {
+	t, member := benchGroup(b, 2)
+
+	updates := make([][]byte, b.N)
+	for i := range updates {
+		u := new(bytes.Buffer)
+		if err := t.GenerateUpdate(u); err != nil {
+			b.Fatal(err)
+		}
+		updates[i] = u.Bytes()
+	}
+
+	b.ResetTimer()
+	for _, u := range updates {
+		if _, err := member.ReceiveMessage(u); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+//go:build !js
+
+// Command bench benchmarks GenerateUpdate in groups of 10, 100 and 1000
+// members, with a single worker and with the default pool.
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"testing"
+
+	"carbide/tungsten"
+
+	"github.com/google/uuid"
+)
+
+// Ratchets per session, such as one per channel
+const ratchets = 4
+
+func main() {
+	for _, n := range []int{10, 100, 1000} {
+		t, err := group(n)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+
+		var serial testing.BenchmarkResult
+		for _, workers := range []int{1, 0} {
+			tungsten.Workers = workers
+			res := testing.Benchmark(func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := t.GenerateUpdate(io.Discard); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+
+			name := "serial"
+			speedup := ""
+			if workers == 0 {
+				name = "parallel"
+				speedup = fmt.Sprintf("\t%.1fx", float64(serial.NsPerOp())/float64(res.NsPerOp()))
+			} else {
+				serial = res
+			}
+			fmt.Printf("GenerateUpdate/%d/%s\t%s%s\n", n, name, res, speedup)
+		}
+	}
+}
+
+// group returns a session with n-1 other members and some ratchets
+func group(n int) (*tungsten.TxSession, error) {
+	t, err := tungsten.GenTx(uuid.New())
+	if err != nil {
+		return nil, err
+	}
+
+	for i := 1; i < n; i++ {
+		m, err := tungsten.GenTx(uuid.New())
+		if err != nil {
+			return nil, err
+		}
+		tungsten.RxFromTx(t, m)
+	}
+
+	for i := 1; i < ratchets; i++ {
+		if err := t.AddRatchet(uuid.New(), nil, io.Discard); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
@@ -0,0 +1,1188 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"syscall/js"
+	"time"
+
+	"carbide/tungsten"
+
+	"github.com/google/uuid"
+)
+
+// The signatures of all of these functions are available under
+// tungsten in /app/src/assets/wasm_exec.ts
+
+// This file is my least favourite.
+
+func genGlobalJS() {
+	obj := js.ValueOf(map[string]interface{}{})
+
+	obj.Set("genTx", js.FuncOf(genTxWrapped))
+	obj.Set("importTx", js.FuncOf(importTxWrapped))
+	obj.Set("importEncrypted", js.FuncOf(importEncryptedWrapped))
+	obj.Set("ephem", populateEphem())
+	obj.Set("sealAttachment", js.FuncOf(sealAttachmentWrapped))
+	obj.Set("openAttachment", js.FuncOf(openAttachmentWrapped))
+
+	// TODO: Remove temp functions
+	obj.Set("doubleTx", js.FuncOf(doubleTxWrapped))
+
+	js.Global().Set("tungsten", obj)
+}
+
+// jsError converts an error into {code, message}, or null if there isn't one
+func jsError(err error) any {
+	if err == nil {
+		return nil
+	}
+
+	code := "unknown"
+	var e *tungsten.Error
+	if errors.As(err, &e) {
+		code = e.Code
+	}
+
+	return map[string]interface{}{
+		"code":    code,
+		"message": err.Error(),
+	}
+}
+
+func genTxWrapped(this js.Value, args []js.Value) any {
+	if len(args) < 1 {
+		return js.ValueOf(map[string]interface{}{"tx": nil, "error": jsError(tungsten.ErrInvalidArg)})
+	}
+
+	id, err := uuid.Parse(args[0].String())
+	if err != nil {
+		return js.ValueOf(map[string]interface{}{"tx": nil, "error": jsError(tungsten.ErrInvalidArg)})
+	}
+
+	tx, err := tungsten.GenTx(id)
+	if err != nil {
+		return js.ValueOf(map[string]interface{}{"tx": nil, "error": jsError(err)})
+	}
+
+	return js.ValueOf(map[string]interface{}{"tx": populateTxMethods(tx), "error": nil})
+}
+
+func importTxWrapped(this js.Value, args []js.Value) any {
+	if len(args) < 1 {
+		return js.ValueOf(map[string]interface{}{"tx": nil, "error": jsError(tungsten.ErrInvalidArg)})
+	}
+
+	buf := make([]byte, args[0].Length())
+	js.CopyBytesToGo(buf, args[0])
+
+	tx, err := tungsten.ImportTx(bytes.NewBuffer(buf))
+	if err != nil {
+		return js.ValueOf(map[string]interface{}{"tx": nil, "error": jsError(err)})
+	}
+
+	return js.ValueOf(map[string]interface{}{"tx": populateTxMethods(tx), "error": nil})
+}
+
+func importEncryptedWrapped(this js.Value, args []js.Value) any {
+	if len(args) < 2 {
+		return js.ValueOf(map[string]interface{}{"tx": nil, "error": jsError(tungsten.ErrInvalidArg)})
+	}
+
+	buf := make([]byte, args[0].Length())
+	js.CopyBytesToGo(buf, args[0])
+
+	tx, err := tungsten.ImportEncrypted(bytes.NewBuffer(buf), []byte(args[1].String()))
+	if err != nil {
+		return js.ValueOf(map[string]interface{}{"tx": nil, "error": jsError(err)})
+	}
+
+	return js.ValueOf(map[string]interface{}{"tx": populateTxMethods(tx), "error": nil})
+}
+
+// kdfParamsArg reads optional {time, memory, threads}, using the defaults for
+// anything missing
+func kdfParamsArg(args []js.Value, i int) tungsten.KDFParams {
+	params := tungsten.DefaultKDFParams
+	if len(args) <= i || args[i].IsUndefined() || args[i].IsNull() {
+		return params
+	}
+
+	if v := args[i].Get("time"); v.Type() == js.TypeNumber {
+		params.Time = uint32(v.Int())
+	}
+	if v := args[i].Get("memory"); v.Type() == js.TypeNumber {
+		params.Memory = uint32(v.Int())
+	}
+	if v := args[i].Get("threads"); v.Type() == js.TypeNumber {
+		params.Threads = uint8(v.Int())
+	}
+
+	return params
+}
+
+// TODO: Remove temp function
+func doubleTxWrapped(this js.Value, args []js.Value) any {
+	alice, _ := tungsten.GenTx(uuid.New())
+	bob, _ := tungsten.GenTx(uuid.New())
+
+	tungsten.RxFromTx(bob, alice)
+	tungsten.RxFromTx(alice, bob)
+
+	arr := js.ValueOf([]interface{}{})
+	arr.SetIndex(0, populateTxMethods(alice))
+	arr.SetIndex(1, populateTxMethods(bob))
+
+	return arr
+}
+
+// Every tx session passed to js, so that one can be passed back as an argument
+var txHandles = map[int]*tungsten.TxSession{}
+
+// Handles aren't reused, as destroyed sessions are removed from txHandles
+var nextHandle int
+
+// txArg finds the tx session of a js tx object
+func txArg(v js.Value) (*tungsten.TxSession, error) {
+	if v.Type() != js.TypeObject || v.Get("handle").Type() != js.TypeNumber {
+		return nil, tungsten.ErrInvalidArg
+	}
+
+	tx, ok := txHandles[v.Get("handle").Int()]
+	if !ok {
+		return nil, tungsten.ErrInvalidArg
+	}
+	return tx, nil
+}
+
+func populateTxMethods(tx *tungsten.TxSession) js.Value {
+	handle := nextHandle
+	nextHandle++
+	txHandles[handle] = tx
+
+	send := func(this js.Value, args []js.Value) any {
+		if len(args) < 2 {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		msg := make([]byte, args[1].Length())
+		js.CopyBytesToGo(msg, args[1])
+
+		ratchetID, err := uuid.Parse(args[0].String())
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		b := new(bytes.Buffer)
+		err = tx.SendMessage(ratchetID, msg, b)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(b.Len())
+		js.CopyBytesToJS(out, b.Bytes())
+		return js.ValueOf(map[string]interface{}{"msg": out, "error": nil})
+	}
+
+	receive := func(this js.Value, args []js.Value) any {
+		var err error = tungsten.ErrInvalidArg
+		var rec *tungsten.Received
+		var in []byte
+		if len(args) > 0 {
+			in = make([]byte, args[0].Length())
+			js.CopyBytesToGo(in, args[0])
+			rec, err = tx.ReceiveMessage(in)
+		}
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{
+				"type":    nil,
+				"ratchet": nil,
+				"msg":     js.Global().Get("Uint8Array").New(0),
+				"skipped": 0,
+				"member":  nil,
+				"removed": nil,
+				"error":   jsError(err),
+			})
+		}
+
+		outBytes := js.Global().Get("Uint8Array").New(len(rec.Plain))
+		js.CopyBytesToJS(outBytes, rec.Plain)
+
+		var member any
+		if rec.Member != nil {
+			member = populateMember(tx, rec.Member)
+		}
+
+		var removed any
+		if rec.Removed != uuid.Nil {
+			removed = populateRemoval(tx, rec.Removed, in)
+		}
+
+		var ratchet any
+		if rec.MsgType == tungsten.MSG_TYPE_DATA || rec.MsgType == tungsten.MSG_TYPE_ANNOUNCE_RATCHET || rec.MsgType == tungsten.MSG_TYPE_RETIRE_RATCHET {
+			ratchet = rec.RatchetID.String()
+		}
+
+		return js.ValueOf(map[string]interface{}{
+			"type":    int(rec.MsgType),
+			"ratchet": ratchet,
+			"msg":     outBytes,
+			"skipped": rec.Skipped,
+			"member":  member,
+			"removed": removed,
+			"error":   nil,
+		})
+	}
+
+	genUpdate := func(this js.Value, args []js.Value) any {
+		b := new(bytes.Buffer)
+		err := tx.GenerateUpdate(b)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(b.Len())
+		js.CopyBytesToJS(out, b.Bytes())
+		return js.ValueOf(map[string]interface{}{"msg": out, "error": nil})
+	}
+
+	export := func(this js.Value, args []js.Value) any {
+		b := new(bytes.Buffer)
+		err := tx.Export(b)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"export": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(b.Len())
+		js.CopyBytesToJS(out, b.Bytes())
+		return js.ValueOf(map[string]interface{}{"export": out, "error": nil})
+	}
+
+	exportEncrypted := func(this js.Value, args []js.Value) any {
+		if len(args) < 1 {
+			return js.ValueOf(map[string]interface{}{"export": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		b := new(bytes.Buffer)
+		err := tx.ExportEncrypted(b, []byte(args[0].String()), kdfParamsArg(args, 1))
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"export": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(b.Len())
+		js.CopyBytesToJS(out, b.Bytes())
+		return js.ValueOf(map[string]interface{}{"export": out, "error": nil})
+	}
+
+	introduce := func(this js.Value, args []js.Value) any {
+		if len(args) < 1 {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		secret, err := secretArg(args[0])
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		b := new(bytes.Buffer)
+		err = tx.Introduce(secret, b)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(b.Len())
+		js.CopyBytesToJS(out, b.Bytes())
+		return js.ValueOf(map[string]interface{}{"msg": out, "error": nil})
+	}
+
+	createUser := func(this js.Value, args []js.Value) any {
+		if len(args) < 2 {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		secret, err := secretArg(args[0])
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		intro := make([]byte, args[1].Length())
+		js.CopyBytesToGo(intro, args[1])
+
+		b := new(bytes.Buffer)
+		_, err = tx.CreateUser(secret, intro, b)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(b.Len())
+		js.CopyBytesToJS(out, b.Bytes())
+		return js.ValueOf(map[string]interface{}{"msg": out, "error": nil})
+	}
+
+	joinGroup := func(this js.Value, args []js.Value) any {
+		if len(args) < 2 {
+			return js.ValueOf(map[string]interface{}{"error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		secret, err := secretArg(args[0])
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"error": jsError(err)})
+		}
+
+		msg := make([]byte, args[1].Length())
+		js.CopyBytesToGo(msg, args[1])
+
+		return js.ValueOf(map[string]interface{}{"error": jsError(tx.JoinGroup(secret, msg))})
+	}
+
+	removeMember := func(this js.Value, args []js.Value) any {
+		if len(args) < 1 {
+			return js.ValueOf(map[string]interface{}{"removal": nil, "update": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		id, err := uuid.Parse(args[0].String())
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"removal": nil, "update": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		removal, update := new(bytes.Buffer), new(bytes.Buffer)
+		err = tx.RemoveMember(id, removal, update)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"removal": nil, "update": nil, "error": jsError(err)})
+		}
+
+		outRemoval := js.Global().Get("Uint8Array").New(removal.Len())
+		js.CopyBytesToJS(outRemoval, removal.Bytes())
+		outUpdate := js.Global().Get("Uint8Array").New(update.Len())
+		js.CopyBytesToJS(outUpdate, update.Bytes())
+		return js.ValueOf(map[string]interface{}{"removal": outRemoval, "update": outUpdate, "error": nil})
+	}
+
+	addRatchet := func(this js.Value, args []js.Value) any {
+		if len(args) < 1 {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		id, err := uuid.Parse(args[0].String())
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		recipients, err := uuidsArg(args, 1)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		b := new(bytes.Buffer)
+		err = tx.AddRatchet(id, recipients, b)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(b.Len())
+		js.CopyBytesToJS(out, b.Bytes())
+		return js.ValueOf(map[string]interface{}{"msg": out, "error": nil})
+	}
+
+	retireRatchet := func(this js.Value, args []js.Value) any {
+		if len(args) < 1 {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		id, err := uuid.Parse(args[0].String())
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		b := new(bytes.Buffer)
+		err = tx.RetireRatchet(id, b)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(b.Len())
+		js.CopyBytesToJS(out, b.Bytes())
+		return js.ValueOf(map[string]interface{}{"msg": out, "error": nil})
+	}
+
+	setRecipients := func(this js.Value, args []js.Value) any {
+		if len(args) < 1 {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		id, err := uuid.Parse(args[0].String())
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		recipients, err := uuidsArg(args, 1)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		b := new(bytes.Buffer)
+		err = tx.SetRecipients(id, recipients, b)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(b.Len())
+		js.CopyBytesToJS(out, b.Bytes())
+		return js.ValueOf(map[string]interface{}{"msg": out, "error": nil})
+	}
+
+	setPadding := func(this js.Value, args []js.Value) any {
+		if len(args) < 1 || args[0].Type() != js.TypeNumber {
+			return js.ValueOf(map[string]interface{}{"error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		return js.ValueOf(map[string]interface{}{"error": jsError(tx.SetPadding(byte(args[0].Int())))})
+	}
+
+	setTreeMode := func(this js.Value, args []js.Value) any {
+		if len(args) < 1 || args[0].Type() != js.TypeBoolean {
+			return js.ValueOf(map[string]interface{}{"error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		tx.SetTreeMode(args[0].Bool())
+		return js.ValueOf(map[string]interface{}{"error": nil})
+	}
+
+	setUpdatePolicy := func(this js.Value, args []js.Value) any {
+		if len(args) < 3 || args[0].Type() != js.TypeNumber || args[1].Type() != js.TypeNumber || args[2].Type() != js.TypeBoolean {
+			return js.ValueOf(map[string]interface{}{"error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		tx.SetUpdatePolicy(tungsten.UpdatePolicy{
+			MaxMessages:        uint32(args[0].Int()),
+			MaxAge:             time.Duration(args[1].Int()) * time.Millisecond,
+			OnMembershipChange: args[2].Bool(),
+		})
+		return js.ValueOf(map[string]interface{}{"error": nil})
+	}
+
+	updateStatus := func(this js.Value, args []js.Value) any {
+		var ratchets []interface{}
+		for _, v := range tx.UpdateStatus() {
+			var updated any
+			if !v.Updated.IsZero() {
+				updated = v.Updated.UnixMilli()
+			}
+
+			ratchets = append(ratchets, map[string]interface{}{
+				"id":      v.RatchetID.String(),
+				"epoch":   v.Epoch,
+				"sent":    v.Sent,
+				"updated": updated,
+				"due":     v.Due,
+			})
+		}
+
+		var next any
+		if n := tx.NextUpdate(); !n.IsZero() {
+			next = n.UnixMilli()
+		}
+
+		return js.ValueOf(map[string]interface{}{
+			"due":        tx.UpdateDue(),
+			"nextUpdate": next,
+			"ratchets":   ratchets,
+			"error":      nil,
+		})
+	}
+
+	rotateKeys := func(this js.Value, args []js.Value) any {
+		b := new(bytes.Buffer)
+		err := tx.RotateKeys(b)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(b.Len())
+		js.CopyBytesToJS(out, b.Bytes())
+		return js.ValueOf(map[string]interface{}{"msg": out, "error": nil})
+	}
+
+	safetyNumber := func(this js.Value, args []js.Value) any {
+		if len(args) < 1 {
+			return js.ValueOf(map[string]interface{}{"safetyNumber": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		id, err := uuid.Parse(args[0].String())
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"safetyNumber": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		number, err := tx.SafetyNumber(id)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"safetyNumber": nil, "error": jsError(err)})
+		}
+		return js.ValueOf(map[string]interface{}{"safetyNumber": number, "error": nil})
+	}
+
+	safetyCode := func(this js.Value, args []js.Value) any {
+		if len(args) < 1 {
+			return js.ValueOf(map[string]interface{}{"code": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		id, err := uuid.Parse(args[0].String())
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"code": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		b := new(bytes.Buffer)
+		err = tx.SafetyCode(id, b)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"code": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(b.Len())
+		js.CopyBytesToJS(out, b.Bytes())
+		return js.ValueOf(map[string]interface{}{"code": out, "error": nil})
+	}
+
+	verifySafetyCode := func(this js.Value, args []js.Value) any {
+		if len(args) < 2 {
+			return js.ValueOf(map[string]interface{}{"error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		id, err := uuid.Parse(args[0].String())
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		code := make([]byte, args[1].Length())
+		js.CopyBytesToGo(code, args[1])
+		return js.ValueOf(map[string]interface{}{"error": jsError(tx.VerifySafetyCode(id, code))})
+	}
+
+	// Device group methods. tx is the device group session, and the session
+	// argument is a guild session.
+	shareSession := func(this js.Value, args []js.Value) any {
+		if len(args) < 2 {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		id, err := uuid.Parse(args[0].String())
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		session, err := txArg(args[1])
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		b := new(bytes.Buffer)
+		err = tx.ShareSession(id, session, b)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(b.Len())
+		js.CopyBytesToJS(out, b.Bytes())
+		return js.ValueOf(map[string]interface{}{"msg": out, "error": nil})
+	}
+
+	mirrorSession := func(this js.Value, args []js.Value) any {
+		if len(args) < 2 {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		id, err := uuid.Parse(args[0].String())
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		session, err := txArg(args[1])
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		b := new(bytes.Buffer)
+		err = tx.MirrorSession(id, session, b)
+		if err != nil || b.Len() == 0 {
+			return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(b.Len())
+		js.CopyBytesToJS(out, b.Bytes())
+		return js.ValueOf(map[string]interface{}{"msg": out, "error": nil})
+	}
+
+	applyMirror := func(this js.Value, args []js.Value) any {
+		if len(args) < 2 {
+			return js.ValueOf(map[string]interface{}{"sessionId": nil, "tx": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		plain := make([]byte, args[0].Length())
+		js.CopyBytesToGo(plain, args[0])
+
+		m, err := tungsten.ReadMirror(plain)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"sessionId": nil, "tx": nil, "error": jsError(err)})
+		}
+
+		// Find our copy of the session, if we have it
+		sessionObj := args[1].Get(m.SessionID.String())
+		var session *tungsten.TxSession
+		if !sessionObj.IsUndefined() && !sessionObj.IsNull() {
+			session, err = txArg(sessionObj)
+			if err != nil {
+				return js.ValueOf(map[string]interface{}{"sessionId": nil, "tx": nil, "error": jsError(err)})
+			}
+		}
+
+		out, err := m.Apply(session, tx.UUID)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"sessionId": nil, "tx": nil, "error": jsError(err)})
+		}
+
+		if session == nil {
+			sessionObj = populateTxMethods(out)
+		}
+		return js.ValueOf(map[string]interface{}{"sessionId": m.SessionID.String(), "tx": sessionObj, "error": nil})
+	}
+
+	destroy := func(this js.Value, args []js.Value) any {
+		tx.Destroy()
+		delete(txHandles, handle)
+		return js.ValueOf(map[string]interface{}{"error": nil})
+	}
+
+	return js.ValueOf(map[string]interface{}{
+		"handle":           handle,
+		"sendMessage":      js.FuncOf(send),
+		"receiveMessage":   js.FuncOf(receive),
+		"generateUpdate":   js.FuncOf(genUpdate),
+		"export":           js.FuncOf(export),
+		"exportEncrypted":  js.FuncOf(exportEncrypted),
+		"introduce":        js.FuncOf(introduce),
+		"createUser":       js.FuncOf(createUser),
+		"joinGroup":        js.FuncOf(joinGroup),
+		"removeMember":     js.FuncOf(removeMember),
+		"addRatchet":       js.FuncOf(addRatchet),
+		"retireRatchet":    js.FuncOf(retireRatchet),
+		"setRecipients":    js.FuncOf(setRecipients),
+		"setPadding":       js.FuncOf(setPadding),
+		"setTreeMode":      js.FuncOf(setTreeMode),
+		"setUpdatePolicy":  js.FuncOf(setUpdatePolicy),
+		"updateStatus":     js.FuncOf(updateStatus),
+		"rotateKeys":       js.FuncOf(rotateKeys),
+		"safetyNumber":     js.FuncOf(safetyNumber),
+		"safetyCode":       js.FuncOf(safetyCode),
+		"verifySafetyCode": js.FuncOf(verifySafetyCode),
+		"shareSession":     js.FuncOf(shareSession),
+		"mirrorSession":    js.FuncOf(mirrorSession),
+		"applyMirror":      js.FuncOf(applyMirror),
+		"destroy":          js.FuncOf(destroy),
+	})
+}
+
+// populateMember wraps a member introduced by another member, who hasn't been
+// accepted yet
+func populateMember(tx *tungsten.TxSession, member *tungsten.RxSession) js.Value {
+	accept := func(this js.Value, args []js.Value) any {
+		return js.ValueOf(map[string]interface{}{"error": jsError(tx.AcceptMember(member))})
+	}
+
+	return js.ValueOf(map[string]interface{}{
+		"id":     member.UUID.String(),
+		"accept": js.FuncOf(accept),
+	})
+}
+
+// populateRemoval wraps a member removed by another member, who hasn't been
+// removed by us yet, with the remove member message that named them
+func populateRemoval(tx *tungsten.TxSession, id uuid.UUID, msg []byte) js.Value {
+	apply := func(this js.Value, args []js.Value) any {
+		b := new(bytes.Buffer)
+		err := tx.ApplyRemoval(msg, b)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"update": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(b.Len())
+		js.CopyBytesToJS(out, b.Bytes())
+		return js.ValueOf(map[string]interface{}{"update": out, "error": nil})
+	}
+
+	return js.ValueOf(map[string]interface{}{
+		"id":    id.String(),
+		"apply": js.FuncOf(apply),
+	})
+}
+
+// uuidsArg reads an optional array of uuids, which is nil if it isn't given
+func uuidsArg(args []js.Value, i int) ([]uuid.UUID, error) {
+	if len(args) <= i || args[i].IsUndefined() || args[i].IsNull() {
+		return nil, nil
+	}
+
+	out := []uuid.UUID{}
+	for j := 0; j < args[i].Length(); j++ {
+		u, err := uuid.Parse(args[i].Index(j).String())
+		if err != nil {
+			return nil, tungsten.ErrInvalidArg
+		}
+		out = append(out, u)
+	}
+	return out, nil
+}
+
+// secretArg reads an ephem shared secret
+func secretArg(v js.Value) ([32]byte, error) {
+	var secret [32]byte
+	if v.Length() != len(secret) {
+		return secret, tungsten.ErrInvalidArg
+	}
+
+	js.CopyBytesToGo(secret[:], v)
+	return secret, nil
+}
+
+func populateEphem() js.Value {
+	genKeypair := func(this js.Value, args []js.Value) any {
+		priv, pub, err := tungsten.GenEphem()
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"error": jsError(err)})
+		}
+
+		privBuf := new(bytes.Buffer)
+		priv.Marshal(privBuf)
+		outPriv := js.Global().Get("Uint8Array").New(privBuf.Len())
+		js.CopyBytesToJS(outPriv, privBuf.Bytes())
+
+		pubBuf := new(bytes.Buffer)
+		pub.Marshal(pubBuf)
+		outPub := js.Global().Get("Uint8Array").New(pubBuf.Len())
+		js.CopyBytesToJS(outPub, pubBuf.Bytes())
+
+		return js.ValueOf(map[string]interface{}{
+			"priv":  outPriv,
+			"pub":   outPub,
+			"error": nil,
+		})
+	}
+
+	genSecret := func(this js.Value, args []js.Value) any {
+		local, remote, err := ephemArgs(args)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"error": jsError(err)})
+		}
+
+		ctext, secret, err := tungsten.GenerateSharedSecret(local, remote)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"error": jsError(err)})
+		}
+
+		cout := js.Global().Get("Uint8Array").New(len(ctext))
+		js.CopyBytesToJS(cout, ctext)
+
+		sout := js.Global().Get("Uint8Array").New(len(secret))
+		js.CopyBytesToJS(sout, secret[:])
+
+		return js.ValueOf(map[string]interface{}{
+			"ciphertext": cout,
+			"secret":     sout,
+			"error":      nil,
+		})
+	}
+
+	receiveSecret := func(this js.Value, args []js.Value) any {
+		if len(args) < 3 {
+			return js.ValueOf(map[string]interface{}{"error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		local, remote, err := ephemArgs(args)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"error": jsError(err)})
+		}
+
+		ctext := make([]byte, args[2].Length())
+		js.CopyBytesToGo(ctext, args[2])
+
+		secret, err := tungsten.ReceiveSharedSecret(local, remote, ctext)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"error": jsError(err)})
+		}
+
+		sout := js.Global().Get("Uint8Array").New(len(secret))
+		js.CopyBytesToJS(sout, secret[:])
+		return js.ValueOf(map[string]interface{}{"secret": sout, "error": nil})
+	}
+
+	genFingerprint := func(this js.Value, args []js.Value) any {
+		if len(args) < 3 {
+			return js.ValueOf(map[string]interface{}{"error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		local, remote, err := ephemArgs(args)
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"error": jsError(err)})
+		}
+
+		secret := make([]byte, args[2].Length())
+		js.CopyBytesToGo(secret, args[2])
+
+		fingerprint := tungsten.GenerateFingerprint(local, remote, secret)
+		return js.ValueOf(map[string]interface{}{"fingerprint": fingerprint, "error": nil})
+	}
+
+	return js.ValueOf(map[string]interface{}{
+		"handshake":      js.FuncOf(handshakeWrapped),
+		"offerLink":      js.FuncOf(offerLinkWrapped),
+		"acceptLink":     js.FuncOf(acceptLinkWrapped),
+		"genKeypair":     js.FuncOf(genKeypair),
+		"genSecret":      js.FuncOf(genSecret),
+		"receiveSecret":  js.FuncOf(receiveSecret),
+		"genFingerprint": js.FuncOf(genFingerprint),
+	})
+}
+
+// handshakeWrapped starts an ephem handshake, which is bound to identities if
+// a tx session and the peer's id are given
+func handshakeWrapped(this js.Value, args []js.Value) any {
+	var tx *tungsten.TxSession
+	peer := uuid.Nil
+	if len(args) > 0 && !args[0].IsUndefined() && !args[0].IsNull() {
+		var err error
+		if tx, err = txArg(args[0]); err != nil {
+			return js.ValueOf(map[string]interface{}{"handshake": nil, "error": jsError(err)})
+		}
+		if len(args) < 2 || args[1].Type() != js.TypeString {
+			return js.ValueOf(map[string]interface{}{"handshake": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+		if peer, err = uuid.Parse(args[1].String()); err != nil {
+			return js.ValueOf(map[string]interface{}{"handshake": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+	}
+
+	h, err := tungsten.NewHandshake(tx, peer)
+	if err != nil {
+		return js.ValueOf(map[string]interface{}{"handshake": nil, "error": jsError(err)})
+	}
+
+	// step reads the other party's message, if there is one, and writes ours
+	step := func(f func(in []byte, b *bytes.Buffer) error) js.Func {
+		return js.FuncOf(func(this js.Value, args []js.Value) any {
+			var in []byte
+			if len(args) > 0 {
+				var err error
+				if in, err = bytesArg(args[0]); err != nil {
+					return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+				}
+			}
+
+			b := new(bytes.Buffer)
+			if err := f(in, b); err != nil {
+				return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+			}
+			return js.ValueOf(map[string]interface{}{"msg": drain(b), "error": nil})
+		})
+	}
+
+	secret := func(this js.Value, args []js.Value) any {
+		s, err := h.Secret()
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"secret": nil, "error": jsError(err)})
+		}
+
+		out := js.Global().Get("Uint8Array").New(len(s))
+		js.CopyBytesToJS(out, s[:])
+		return js.ValueOf(map[string]interface{}{"secret": out, "error": nil})
+	}
+
+	fingerprint := func(this js.Value, args []js.Value) any {
+		f, err := h.Fingerprint()
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"fingerprint": nil, "error": jsError(err)})
+		}
+		return js.ValueOf(map[string]interface{}{"fingerprint": f, "error": nil})
+	}
+
+	destroy := func(this js.Value, args []js.Value) any {
+		h.Destroy()
+		return nil
+	}
+
+	handshake := js.ValueOf(map[string]interface{}{
+		"hello": step(func(_ []byte, b *bytes.Buffer) error { return h.Hello(b) }),
+		"initiate": step(func(in []byte, b *bytes.Buffer) error {
+			return h.Initiate(in, b)
+		}),
+		"respond": step(func(in []byte, b *bytes.Buffer) error {
+			return h.Respond(in, b)
+		}),
+		"finish": step(func(in []byte, _ *bytes.Buffer) error {
+			return h.Finish(in)
+		}),
+		"secret":      js.FuncOf(secret),
+		"fingerprint": js.FuncOf(fingerprint),
+		"destroy":     js.FuncOf(destroy),
+	})
+	return js.ValueOf(map[string]interface{}{"handshake": handshake, "error": nil})
+}
+
+// offerLinkWrapped starts linking this device, given its device group tx
+// session, returning the offer to be shown as a QR code
+func offerLinkWrapped(this js.Value, args []js.Value) any {
+	if len(args) < 1 {
+		return js.ValueOf(map[string]interface{}{"link": nil, "offer": nil, "error": jsError(tungsten.ErrInvalidArg)})
+	}
+	d, err := txArg(args[0])
+	if err != nil {
+		return js.ValueOf(map[string]interface{}{"link": nil, "offer": nil, "error": jsError(err)})
+	}
+
+	b := new(bytes.Buffer)
+	l, err := tungsten.OfferLink(d, b)
+	if err != nil {
+		return js.ValueOf(map[string]interface{}{"link": nil, "offer": nil, "error": jsError(err)})
+	}
+	return js.ValueOf(map[string]interface{}{"link": populateLink(l, d), "offer": drain(b), "error": nil})
+}
+
+// acceptLinkWrapped reads the offer of a new device, given this device's
+// device group tx session, returning the init to be sent back to it
+func acceptLinkWrapped(this js.Value, args []js.Value) any {
+	if len(args) < 2 {
+		return js.ValueOf(map[string]interface{}{"link": nil, "msg": nil, "error": jsError(tungsten.ErrInvalidArg)})
+	}
+	d, err := txArg(args[0])
+	if err != nil {
+		return js.ValueOf(map[string]interface{}{"link": nil, "msg": nil, "error": jsError(err)})
+	}
+	offer, err := bytesArg(args[1])
+	if err != nil {
+		return js.ValueOf(map[string]interface{}{"link": nil, "msg": nil, "error": jsError(err)})
+	}
+
+	b := new(bytes.Buffer)
+	l, err := tungsten.AcceptLink(d, offer, b)
+	if err != nil {
+		return js.ValueOf(map[string]interface{}{"link": nil, "msg": nil, "error": jsError(err)})
+	}
+	return js.ValueOf(map[string]interface{}{"link": populateLink(l, d), "msg": drain(b), "error": nil})
+}
+
+// populateLink wraps a device link, on the device whose device group tx
+// session is d
+func populateLink(l *tungsten.DeviceLink, d *tungsten.TxSession) js.Value {
+	// step reads the other device's message, if there is one, and writes ours
+	step := func(f func(in []byte, b *bytes.Buffer) error) js.Func {
+		return js.FuncOf(func(this js.Value, args []js.Value) any {
+			var in []byte
+			if len(args) > 0 {
+				var err error
+				if in, err = bytesArg(args[0]); err != nil {
+					return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+				}
+			}
+
+			b := new(bytes.Buffer)
+			if err := f(in, b); err != nil {
+				return js.ValueOf(map[string]interface{}{"msg": nil, "error": jsError(err)})
+			}
+			return js.ValueOf(map[string]interface{}{"msg": drain(b), "error": nil})
+		})
+	}
+
+	fingerprint := func(this js.Value, args []js.Value) any {
+		f, err := l.Fingerprint()
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"fingerprint": nil, "error": jsError(err)})
+		}
+		return js.ValueOf(map[string]interface{}{"fingerprint": f, "error": nil})
+	}
+
+	confirm := func(this js.Value, args []js.Value) any {
+		return js.ValueOf(map[string]interface{}{"error": jsError(l.Confirm())})
+	}
+
+	destroy := func(this js.Value, args []js.Value) any {
+		l.Destroy()
+		return nil
+	}
+
+	return js.ValueOf(map[string]interface{}{
+		"device": l.Device.String(),
+		"respond": step(func(in []byte, b *bytes.Buffer) error {
+			return l.Respond(in, b)
+		}),
+		"finish": step(func(in []byte, _ *bytes.Buffer) error {
+			return l.Finish(in)
+		}),
+		"introduce": step(func(_ []byte, b *bytes.Buffer) error {
+			return l.Introduce(d, b)
+		}),
+		"addDevice": step(func(in []byte, b *bytes.Buffer) error {
+			_, err := l.AddDevice(d, in, b)
+			return err
+		}),
+		"joinGroup": step(func(in []byte, _ *bytes.Buffer) error {
+			return l.JoinGroup(d, in)
+		}),
+		"fingerprint": js.FuncOf(fingerprint),
+		"confirm":     js.FuncOf(confirm),
+		"destroy":     js.FuncOf(destroy),
+	})
+}
+
+// ephemArgs unmarshals the local EphemPriv and remote EphemPub arguments
+func ephemArgs(args []js.Value) (*tungsten.EphemPriv, *tungsten.EphemPub, error) {
+	if len(args) < 2 {
+		return nil, nil, tungsten.ErrInvalidArg
+	}
+
+	localBuf := make([]byte, args[0].Length())
+	js.CopyBytesToGo(localBuf, args[0])
+	local, err := tungsten.ImportEphemPriv(bytes.NewBuffer(localBuf))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	remoteBuf := make([]byte, args[1].Length())
+	js.CopyBytesToGo(remoteBuf, args[1])
+	remote, err := tungsten.ImportEphemPub(bytes.NewBuffer(remoteBuf))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return local, remote, nil
+}
+
+// bytesArg copies a Uint8Array argument
+func bytesArg(v js.Value) ([]byte, error) {
+	if v.Type() != js.TypeObject {
+		return nil, tungsten.ErrInvalidArg
+	}
+
+	b := make([]byte, v.Length())
+	js.CopyBytesToGo(b, v)
+	return b, nil
+}
+
+// drain moves whatever has been written to b into a Uint8Array
+func drain(b *bytes.Buffer) js.Value {
+	out := js.Global().Get("Uint8Array").New(b.Len())
+	js.CopyBytesToJS(out, b.Bytes())
+	b.Reset()
+	return out
+}
+
+// sealAttachmentWrapped starts encrypting a file, which is passed in pieces to
+// write, returning the encrypted file in pieces as they are sealed
+func sealAttachmentWrapped(this js.Value, args []js.Value) any {
+	b := new(bytes.Buffer)
+	aw, err := tungsten.SealAttachment(b)
+	if err != nil {
+		return js.ValueOf(map[string]interface{}{"writer": nil, "error": jsError(err)})
+	}
+
+	write := func(this js.Value, args []js.Value) any {
+		if len(args) < 1 {
+			return js.ValueOf(map[string]interface{}{"data": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		p, err := bytesArg(args[0])
+		if err == nil {
+			_, err = aw.Write(p)
+		}
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"data": nil, "error": jsError(err)})
+		}
+		return js.ValueOf(map[string]interface{}{"data": drain(b), "error": nil})
+	}
+
+	finish := func(this js.Value, args []js.Value) any {
+		if err := aw.Close(); err != nil {
+			return js.ValueOf(map[string]interface{}{"data": nil, "attachment": nil, "error": jsError(err)})
+		}
+
+		a := new(bytes.Buffer)
+		aw.Attachment().Marshal(a)
+		return js.ValueOf(map[string]interface{}{"data": drain(b), "attachment": drain(a), "error": nil})
+	}
+
+	writer := js.ValueOf(map[string]interface{}{
+		"write": js.FuncOf(write),
+		"close": js.FuncOf(finish),
+	})
+	return js.ValueOf(map[string]interface{}{"writer": writer, "error": nil})
+}
+
+// openAttachmentWrapped starts decrypting a file, which is passed in pieces to
+// write, returning the plaintext in pieces as they are opened
+func openAttachmentWrapped(this js.Value, args []js.Value) any {
+	if len(args) < 1 {
+		return js.ValueOf(map[string]interface{}{"opener": nil, "error": jsError(tungsten.ErrInvalidArg)})
+	}
+
+	p, err := bytesArg(args[0])
+	if err != nil {
+		return js.ValueOf(map[string]interface{}{"opener": nil, "error": jsError(err)})
+	}
+	a, err := tungsten.ReadAttachment(p)
+	if err != nil {
+		return js.ValueOf(map[string]interface{}{"opener": nil, "error": jsError(err)})
+	}
+
+	b := new(bytes.Buffer)
+	o := tungsten.OpenAttachment(b, a)
+
+	write := func(this js.Value, args []js.Value) any {
+		if len(args) < 1 {
+			return js.ValueOf(map[string]interface{}{"data": nil, "error": jsError(tungsten.ErrInvalidArg)})
+		}
+
+		p, err := bytesArg(args[0])
+		if err == nil {
+			_, err = o.Write(p)
+		}
+		if err != nil {
+			return js.ValueOf(map[string]interface{}{"data": nil, "error": jsError(err)})
+		}
+		return js.ValueOf(map[string]interface{}{"data": drain(b), "error": nil})
+	}
+
+	finish := func(this js.Value, args []js.Value) any {
+		if err := o.Close(); err != nil {
+			return js.ValueOf(map[string]interface{}{"data": nil, "error": jsError(err)})
+		}
+		return js.ValueOf(map[string]interface{}{"data": drain(b), "error": nil})
+	}
+
+	opener := js.ValueOf(map[string]interface{}{
+		"size":  a.Size,
+		"write": js.FuncOf(write),
+		"close": js.FuncOf(finish),
+	})
+	return js.ValueOf(map[string]interface{}{"opener": opener, "error": nil})
+}
+
+// func populateRxMethods(rx *RxSession) js.Value {
+// 	receive := func(this js.Value, args []js.Value) any {
+// 		if len(args) != 1 {
+// 			panic("sendMessage requires 1 parameter")
+// 		}
+
+// 		msg, err := base64.StdEncoding.DecodeString(args[0])
+// 		if err != nil {
+// 			panic(err)
+// 		}
+
+// 		b := new(bytes.Buffer)
+// 		rx.ReceiveMessage(msg)
+
+// 		return js.ValueOf(base64.StdEncoding.EncodeToString(b.Bytes()))
+// 	}
+
+// 	obj := js.ValueOf(map[string]interface{}{
+// 		"receiveMessage": js.FuncOf(receive),
+// 	})
+
+// 	return obj
+// }
@@ -0,0 +1,33 @@
+//go:build js && wasm
+
+package main
+
+func main() {
+	// alice := GenTx()
+	// bob := GenTx()
+
+	// RxFromTx(bob, alice)
+	// RxFromTx(alice, bob)
+
+	// b := new(bytes.Buffer)
+	// alice.GenerateUpdate(b)
+	// bob.Children[0].ReceiveMessage(b.Bytes())
+
+	// b = new(bytes.Buffer)
+	// bob.GenerateUpdate(b)
+	// alice.Children[0].ReceiveMessage(b.Bytes())
+
+	// b = new(bytes.Buffer)
+	// alice.SendMessage([]byte("hello world"), b)
+	// out := bob.Children[0].ReceiveMessage(b.Bytes())
+	// fmt.Println(string(out))
+
+	// b = new(bytes.Buffer)
+	// bob.SendMessage([]byte("hi"), b)
+	// out = alice.Children[0].ReceiveMessage(b.Bytes())
+	// fmt.Println(string(out))
+
+	genGlobalJS()
+	c := make(chan int)
+	<-c
+}
@@ -0,0 +1,345 @@
+//go:build !js
+
+// Command vectors prints known-answer test vectors for the message formats as
+// JSON, for checking other implementations against. Every random value comes
+// from a ChaCha20 keystream with a fixed key, and the clock is fixed, so the
+// output is the same every time.
+//
+// Each message is received, in order, by the session that didn't send it,
+// starting from the exports.
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"carbide/tungsten"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/chacha20"
+)
+
+// The key of the keystream is the SHA-256 of this
+const seed = "tungsten test vectors"
+
+var epoch = time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var (
+	aliceID   = uuid.MustParse("00000000-0000-4000-8000-00000000a11c")
+	bobID     = uuid.MustParse("00000000-0000-4000-8000-000000000b0b")
+	ratchetID = uuid.MustParse("00000000-0000-4000-8000-0000000c4a77")
+)
+
+// keystream reads a ChaCha20 keystream
+type keystream struct {
+	c *chacha20.Cipher
+}
+
+func (k *keystream) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	k.c.XORKeyStream(b, b)
+	return len(b), nil
+}
+
+type Ephem struct {
+	AlicePriv   string `json:"alice_priv"`
+	BobPriv     string `json:"bob_priv"`
+	Ciphertext  string `json:"ciphertext"`
+	Secret      string `json:"secret"`
+	Fingerprint string `json:"fingerprint"`
+}
+
+type Combine struct {
+	Label   string   `json:"label"`
+	DH      string   `json:"dh"`
+	PQ      string   `json:"pq"`
+	Context []string `json:"context"`
+	Key     string   `json:"key"`
+}
+
+type Handshake struct {
+	Hello  string `json:"hello"`
+	Init   string `json:"init"`
+	Finish string `json:"finish"`
+	Secret string `json:"secret"`
+}
+
+type Message struct {
+	Name   string `json:"name"`
+	Sender string `json:"sender"`
+	Msg    string `json:"msg"`
+	Plain  string `json:"plain,omitempty"`
+}
+
+type Attachment struct {
+	Plain      string `json:"plain"`
+	File       string `json:"file"`
+	Attachment string `json:"attachment"`
+}
+
+type Vectors struct {
+	Seed       string     `json:"seed"`
+	Time       string     `json:"time"`
+	Suite      uint16     `json:"suite"`
+	Combine    []Combine  `json:"combine"`
+	Ephem      Ephem      `json:"ephem"`
+	Handshake  Handshake  `json:"handshake"`
+	Alice      string     `json:"alice"`
+	Bob        string     `json:"bob"`
+	Messages   []Message  `json:"messages"`
+	Attachment Attachment `json:"attachment"`
+}
+
+func main() {
+	if err := write(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// write writes the vectors as indented JSON
+func write(w io.Writer) error {
+	v, err := vectors()
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func vectors() (*Vectors, error) {
+	key := sha256.Sum256([]byte(seed))
+	c, err := chacha20.NewUnauthenticatedCipher(key[:], make([]byte, chacha20.NonceSize))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &tungsten.Config{
+		Rand:  &keystream{c},
+		Now:   func() time.Time { return epoch },
+		Suite: tungsten.DEFAULT_SUITE,
+	}
+	v := &Vectors{Seed: seed, Time: epoch.Format(time.RFC3339), Suite: uint16(cfg.Suite)}
+
+	// The hybrid combiner, with an empty context and a context of several items,
+	// and with the label of each key sealed to several members
+	combines := []struct {
+		label []byte
+		n     []int
+	}{
+		{tungsten.EPHEM_COMBINE_LABEL, nil},
+		{tungsten.RATCHET_COMBINE_LABEL, []int{0, 16, 64}},
+		{tungsten.CREATE_USER_COMBINE_LABEL, []int{64, 16, 8}},
+		{tungsten.ANNOUNCE_COMBINE_LABEL, []int{64, 20, 8}},
+		{tungsten.HEADER_COMBINE_LABEL, []int{64, 8, 8}},
+		{tungsten.TREE_NODE_COMBINE_LABEL, []int{2}},
+	}
+	for _, s := range combines {
+		label, n := s.label, s.n
+
+		var dh tungsten.DHKey
+		var pq tungsten.PQKey
+		cfg.Rand.Read(dh[:])
+		cfg.Rand.Read(pq[:])
+		c := Combine{Label: hex.EncodeToString(label), DH: hex.EncodeToString(dh[:]), PQ: hex.EncodeToString(pq[:]), Context: []string{}}
+
+		var context [][]byte
+		for _, l := range n {
+			item := make([]byte, l)
+			cfg.Rand.Read(item)
+			context = append(context, item)
+			c.Context = append(c.Context, hex.EncodeToString(item))
+		}
+
+		key := tungsten.Combine(label, dh, pq, context...)
+		c.Key = hex.EncodeToString(key[:])
+		v.Combine = append(v.Combine, c)
+	}
+
+	// Session initiation
+	alicePriv, _, err := cfg.GenEphem()
+	if err != nil {
+		return nil, err
+	}
+	bobPriv, bobPub, err := cfg.GenEphem()
+	if err != nil {
+		return nil, err
+	}
+	ciphertext, secret, err := cfg.GenerateSharedSecret(alicePriv, bobPub)
+	if err != nil {
+		return nil, err
+	}
+
+	b := new(bytes.Buffer)
+	alicePriv.Marshal(b)
+	v.Ephem.AlicePriv = hex.EncodeToString(b.Bytes())
+	b.Reset()
+	bobPriv.Marshal(b)
+	v.Ephem.BobPriv = hex.EncodeToString(b.Bytes())
+	v.Ephem.Ciphertext = hex.EncodeToString(ciphertext)
+	v.Ephem.Secret = hex.EncodeToString(secret[:])
+	v.Ephem.Fingerprint = tungsten.GenerateFingerprint(alicePriv, bobPub, secret[:])
+
+	// A handshake that isn't bound to identities, with bob as the responder
+	if v.Handshake, err = handshake(cfg); err != nil {
+		return nil, err
+	}
+
+	// Sessions
+	alice, err := cfg.GenTx(aliceID)
+	if err != nil {
+		return nil, err
+	}
+	bob, err := cfg.GenTx(bobID)
+	if err != nil {
+		return nil, err
+	}
+	tungsten.RxFromTx(alice, bob)
+	tungsten.RxFromTx(bob, alice)
+
+	if v.Alice, err = export(alice); err != nil {
+		return nil, err
+	}
+	if v.Bob, err = export(bob); err != nil {
+		return nil, err
+	}
+
+	// Messages
+	steps := []struct {
+		name   string
+		sender *tungsten.TxSession
+		plain  string
+		write  func(t *tungsten.TxSession, b *bytes.Buffer) error
+	}{
+		{"data", alice, "hello bob", nil},
+		{"ratchet_update", alice, "", func(t *tungsten.TxSession, b *bytes.Buffer) error {
+			return t.GenerateUpdate(b)
+		}},
+		{"data_after_update", alice, "hello again", nil},
+		{"data_reply", bob, "hello alice", nil},
+		{"announce_ratchet", bob, "", func(t *tungsten.TxSession, b *bytes.Buffer) error {
+			return t.AddRatchet(ratchetID, nil, b)
+		}},
+		{"data_new_ratchet", bob, "in a channel", nil},
+		{"ratchet_update_tree", alice, "", func(t *tungsten.TxSession, b *bytes.Buffer) error {
+			t.SetTreeMode(true)
+			return t.GenerateUpdate(b)
+		}},
+		{"data_after_tree_update", alice, "hello from the tree", nil},
+	}
+	for _, s := range steps {
+		b := new(bytes.Buffer)
+		if s.write != nil {
+			err = s.write(s.sender, b)
+		} else {
+			rat := uuid.Nil
+			if s.name == "data_new_ratchet" {
+				rat = ratchetID
+			}
+			err = s.sender.SendMessage(rat, []byte(s.plain), b)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.name, err)
+		}
+
+		// Check it opens, which also advances the receiver for the next message
+		receiver := alice
+		if s.sender == alice {
+			receiver = bob
+		}
+		r, err := receiver.ReceiveMessage(b.Bytes())
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", s.name, err)
+		}
+		if string(r.Plain) != s.plain {
+			return nil, fmt.Errorf("%s: wrong plaintext", s.name)
+		}
+
+		v.Messages = append(v.Messages, Message{
+			Name:   s.name,
+			Sender: s.sender.UUID.String(),
+			Msg:    hex.EncodeToString(b.Bytes()),
+			Plain:  hex.EncodeToString([]byte(s.plain)),
+		})
+	}
+
+	// An attachment of more than one chunk
+	plain := make([]byte, tungsten.ATTACHMENT_CHUNK_SIZE+100)
+	for i := range plain {
+		plain[i] = byte(i)
+	}
+
+	file := new(bytes.Buffer)
+	aw, err := cfg.SealAttachment(file)
+	if err != nil {
+		return nil, err
+	}
+	aw.Write(plain)
+	if err := aw.Close(); err != nil {
+		return nil, err
+	}
+
+	a := new(bytes.Buffer)
+	aw.Attachment().Marshal(a)
+	v.Attachment = Attachment{
+		Plain:      hex.EncodeToString(plain),
+		File:       hex.EncodeToString(file.Bytes()),
+		Attachment: hex.EncodeToString(a.Bytes()),
+	}
+
+	return v, nil
+}
+
+func handshake(cfg *tungsten.Config) (Handshake, error) {
+	var v Handshake
+	initiator, err := cfg.NewHandshake(nil, uuid.Nil)
+	if err != nil {
+		return v, err
+	}
+	responder, err := cfg.NewHandshake(nil, uuid.Nil)
+	if err != nil {
+		return v, err
+	}
+
+	hello, init, finish := new(bytes.Buffer), new(bytes.Buffer), new(bytes.Buffer)
+	if err := responder.Hello(hello); err != nil {
+		return v, err
+	}
+	if err := initiator.Initiate(hello.Bytes(), init); err != nil {
+		return v, err
+	}
+	if err := responder.Respond(init.Bytes(), finish); err != nil {
+		return v, err
+	}
+	if err := initiator.Finish(finish.Bytes()); err != nil {
+		return v, err
+	}
+
+	secret, err := initiator.Secret()
+	if err != nil {
+		return v, err
+	}
+	v.Hello = hex.EncodeToString(hello.Bytes())
+	v.Init = hex.EncodeToString(init.Bytes())
+	v.Finish = hex.EncodeToString(finish.Bytes())
+	v.Secret = hex.EncodeToString(secret[:])
+	return v, nil
+}
+
+func export(t *tungsten.TxSession) (string, error) {
+	b := new(bytes.Buffer)
+	if err := t.Export(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b.Bytes()), nil
+}
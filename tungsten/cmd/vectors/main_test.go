@@ -0,0 +1,38 @@
+//go:build !js
+
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite testdata/vectors.json")
+
+// TestVectors checks that the vectors are unchanged, so that a change to a
+// message format or derivation can't go unnoticed. Run with -update after an
+// intended change.
+func TestVectors(t *testing.T) {
+	b := new(bytes.Buffer)
+	if err := write(b); err != nil {
+		t.Fatal(err)
+	}
+
+	golden := filepath.Join("testdata", "vectors.json")
+	if *update {
+		if err := os.WriteFile(golden, b.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b.Bytes(), want) {
+		t.Fatal("vectors differ from testdata/vectors.json")
+	}
+}
@@ -0,0 +1,77 @@
+package tungsten
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/sha3"
+)
+
+// Keys are encapsulated by two methods, so that they stay secret if either is
+// broken. Like X-Wing, the parts are combined by hashing them together with
+// the context they were sent in, such as the ciphertexts and the public keys
+// they were encapsulated with, rather than only the parts themselves. A key
+// derived from a ciphertext can then not be used in another context, even if
+// one method has been broken.
+
+var RATCHET_COMBINE_LABEL = []byte("tungsten_ratchet_combine")
+var EPHEM_COMBINE_LABEL = []byte("tungsten_ephem_combine")
+var CREATE_USER_COMBINE_LABEL = []byte("tungsten_create_user_combine")
+var ANNOUNCE_COMBINE_LABEL = []byte("tungsten_announce_combine")
+var HEADER_COMBINE_LABEL = []byte("tungsten_header_combine")
+var TREE_NODE_COMBINE_LABEL = []byte("tungsten_tree_node_combine")
+
+// Combine combines the DH and post-quantum parts of an encapsulated key, bound
+// to its context, into a single key. The output is the SHA3-256 of the label,
+// the parts and each item of the context, where the label and each item are
+// prefixed by their length (big endian, 64-bit).
+func Combine(label []byte, dh DHKey, pq PQKey, context ...[]byte) [32]byte {
+	h := sha3.New256()
+	binary.Write(h, binary.BigEndian, int64(len(label)))
+	h.Write(label)
+	h.Write(dh[:])
+	h.Write(pq[:])
+	for _, v := range context {
+		binary.Write(h, binary.BigEndian, int64(len(v)))
+		h.Write(v)
+	}
+
+	var out [32]byte
+	h.Sum(out[:0])
+	return out
+}
+
+// ratchetContext is the context of the keys a ratchet update advances a
+// ratchet with: the sender and their new pubkeys, the ratchet and its new
+// epoch. The ciphertexts differ between recipients, so they are bound by the
+// associated data instead.
+func ratchetContext(sender *encapAD, ratchet uuid.UUID, epoch uint32) []byte {
+	b := new(bytes.Buffer)
+	sender.Marshal(b)
+	b.Write(ratchetPurpose(ratchet, epoch))
+	return b.Bytes()
+}
+
+// sharedContext is the context of a key sealed to several members by sealTo:
+// the sender and their pubkeys, the purpose of the key, and every recipient
+// with their ciphertexts. A recipient can't know the pubkeys that the sender
+// had for the others, so those are only bound through the ciphertexts made for
+// them.
+func sharedContext(sender *encapAD, purpose []byte, keys []UserKey) [][]byte {
+	s, r := new(bytes.Buffer), new(bytes.Buffer)
+	sender.Marshal(s)
+	writeUserKeys(r, keys)
+	return [][]byte{s.Bytes(), purpose, r.Bytes()}
+}
+
+// pathContext is the context of the header key derived from the commit secret
+// of an update path: the sender and their new pubkeys, the timestamp of the
+// update, and the path, with the pubkey of each node and the ciphertexts of its
+// secret.
+func pathContext(sender *encapAD, timestamp int64, path *UpdatePath) [][]byte {
+	s, p := new(bytes.Buffer), new(bytes.Buffer)
+	sender.Marshal(s)
+	writePath(p, path)
+	return [][]byte{s.Bytes(), timestampPurpose(timestamp), p.Bytes()}
+}
@@ -0,0 +1,79 @@
+package tungsten
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCombineContext(t *testing.T) {
+	var dh DHKey
+	var pq PQKey
+	key := Combine(RATCHET_COMBINE_LABEL, dh, pq, []byte("ab"), []byte("c"))
+
+	// The items are length-prefixed, so moving a byte between them changes the
+	// key, as do the label and each part
+	otherPQ := PQKey{1}
+	for _, other := range [][32]byte{
+		Combine(RATCHET_COMBINE_LABEL, dh, pq, []byte("a"), []byte("bc")),
+		Combine(RATCHET_COMBINE_LABEL, dh, pq, []byte("abc")),
+		Combine(EPHEM_COMBINE_LABEL, dh, pq, []byte("ab"), []byte("c")),
+		Combine(RATCHET_COMBINE_LABEL, dh, otherPQ, []byte("ab"), []byte("c")),
+	} {
+		if other == key {
+			t.Fatal("combined key doesn't depend on its inputs")
+		}
+	}
+}
+
+// A key sealed to several members is bound to every recipient and ciphertext
+// in the message, and to its purpose
+func TestSharedKeyContext(t *testing.T) {
+	alice, bob := testPair(t)
+	carol, err := GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	RxFromTx(alice, carol)
+
+	purpose := ratchetPurpose(uuid.New(), 1)
+	key, keys, err := sealTo(alice.Config, &alice.CurrentPrivkey, alice.Children, RATCHET_ANNOUNCE_HKDF_INFO, ANNOUNCE_COMBINE_LABEL,
+		alice.senderAD(), purpose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 2 {
+		t.Fatalf("%d keys, want 2", len(keys))
+	}
+
+	rx := bob.child(alice.UUID)
+	opened, err := rx.openFromSender(keys, RATCHET_ANNOUNCE_HKDF_INFO, ANNOUNCE_COMBINE_LABEL, rx.senderAD(), purpose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened != key {
+		t.Fatal("opened a different key")
+	}
+
+	// Without carol's ciphertexts, or with another label, bob derives another key
+	ownKey := []UserKey{*findKey(keys, bob.UUID)}
+	opened, err = rx.openFromSender(ownKey, RATCHET_ANNOUNCE_HKDF_INFO, ANNOUNCE_COMBINE_LABEL, rx.senderAD(), purpose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened == key {
+		t.Fatal("key isn't bound to the other recipients")
+	}
+	opened, err = rx.openFromSender(keys, RATCHET_ANNOUNCE_HKDF_INFO, CREATE_USER_COMBINE_LABEL, rx.senderAD(), purpose)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opened == key {
+		t.Fatal("key isn't bound to its label")
+	}
+
+	// With another purpose, the ciphertexts don't open
+	if _, err := rx.openFromSender(keys, RATCHET_ANNOUNCE_HKDF_INFO, ANNOUNCE_COMBINE_LABEL, rx.senderAD(), ratchetPurpose(uuid.New(), 1)); err != ErrMACFailure {
+		t.Fatalf("got %v, want ErrMACFailure", err)
+	}
+}
@@ -0,0 +1,58 @@
+package tungsten
+
+import (
+	"crypto/rand"
+	"io"
+	"time"
+)
+
+// Everything that reads randomness or the time does so through a Config, so
+// that callers can supply their own, such as to generate known-answer test
+// vectors for the message formats (see cmd/vectors). A nil *Config uses
+// crypto/rand and the system clock.
+type Config struct {
+	// The source of every random value. When it is set, keys are encapsulated
+	// serially, so that it is read in the same order every time and a
+	// deterministic reader gives deterministic output.
+	Rand io.Reader
+
+	// The current time, for timestamps
+	Now func() time.Time
+
+	// The algorithm suite of new keys. Zero is DEFAULT_SUITE.
+	Suite Suite
+}
+
+func (c *Config) rand() io.Reader {
+	if c == nil || c.Rand == nil {
+		return rand.Reader
+	}
+	return c.Rand
+}
+
+// read fills b with random bytes, returning ErrRandom if it can't
+func (c *Config) read(b []byte) error {
+	return readRandom(c.rand(), b)
+}
+
+func (c *Config) suite() Suite {
+	if c == nil || c.Suite == 0 {
+		return DEFAULT_SUITE
+	}
+	return c.Suite
+}
+
+func (c *Config) now() time.Time {
+	if c == nil || c.Now == nil {
+		return time.Now()
+	}
+	return c.Now()
+}
+
+// parallel is parallel, unless a random source was supplied
+func (c *Config) parallel(n int, f func(i int) error) error {
+	if c != nil && c.Rand != nil {
+		return serial(n, f)
+	}
+	return parallel(n, f)
+}
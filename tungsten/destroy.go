@@ -0,0 +1,145 @@
+package tungsten
+
+// Forward secrecy depends on old keys actually being gone, so keys are wiped
+// when they are replaced, and Destroy wipes every key a session holds. Wiping
+// is best effort: the runtime may have copied a key (such as when growing the
+// stack), and exports or anything else returned to the caller must be wiped
+// by the caller.
+
+// wipe zeroes b
+func wipe(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// wipeKeys zeroes the message keys in keys
+func wipeKeys(keys map[uint32]MessageKey) {
+	for i, k := range keys {
+		wipe(k[:])
+		delete(keys, i)
+	}
+}
+
+// Destroy wipes the chain key
+func (r *SymRatchet) Destroy() {
+	wipe(r.current[:])
+}
+
+// Destroy wipes the chain key
+func (r *RootRatchet) Destroy() {
+	wipe(r.current[:])
+}
+
+// Destroy wipes the chain keys
+func (r *Ratchet) Destroy() {
+	if r.Symmetric != nil {
+		r.Symmetric.Destroy()
+	}
+	if r.Root != nil {
+		r.Root.Destroy()
+	}
+}
+
+// setSymmetric replaces the symmetric ratchet, wiping the old chain key
+func (r *Ratchet) setSymmetric(sym *SymRatchet) {
+	if r.Symmetric != nil {
+		r.Symmetric.Destroy()
+	}
+	r.Symmetric = sym
+}
+
+// setChain replaces the symmetric ratchet with a new chain, wiping the old
+// chain key and chain
+func (r *Ratchet) setChain(chain *ChainKey) {
+	r.setSymmetric(NewSymRatchet(*chain))
+	wipe(chain[:])
+}
+
+func destroyRatchets(rats []*Ratchet) {
+	for _, v := range rats {
+		v.Destroy()
+	}
+}
+
+// destroy removes every key. Deleting from a map clears the entry.
+func (s SkippedKeys) destroy() {
+	for id := range s {
+		delete(s, id)
+	}
+}
+
+func (kp *NodeKeypair) destroy() {
+	wipe(kp.Privkey[:])
+	wipe(kp.PrivkeyPQ.Key)
+}
+
+func (tr *RatchetTree) destroy() {
+	for _, v := range tr.Nodes {
+		if v != nil && v.Keypair != nil {
+			v.Keypair.destroy()
+		}
+	}
+	for _, v := range tr.Retired {
+		v.destroy()
+	}
+}
+
+func (s *pathSecret) destroy() {
+	wipe(s.dh[:])
+	wipe(s.pq[:])
+}
+
+// Destroy wipes every key in the session, which can't send, receive or be
+// exported afterwards
+func (t *TxSession) Destroy() {
+	wipe(t.SigningKey)
+	wipe(t.SigningKeyPQ.Key)
+
+	wipe(t.CurrentPrivkey[:])
+	wipe(t.CurrentPrivkeyPQ.Key)
+	wipe(t.PrevPrivkey[:])
+	wipe(t.PrevPrivkeyPQ.Key)
+
+	wipe(t.HeaderKey[:])
+	wipe(t.PrevHeaderKey[:])
+	t.hints[0].destroy()
+	t.hints[1].destroy()
+
+	destroyRatchets(t.Ratchets)
+	t.Skipped.destroy()
+	for _, v := range t.Children {
+		v.Destroy()
+	}
+	if t.Tree != nil {
+		t.Tree.destroy()
+	}
+
+	// Material includes our keypairs
+	for _, v := range t.Material {
+		wipe(v.Body)
+	}
+
+	t.Ratchets = nil
+	t.Children = nil
+	t.Tree = nil
+	t.Material = nil
+	t.destroyed = true
+}
+
+// Destroy wipes the member's chain keys, header keys and skipped message keys
+func (r *RxSession) Destroy() {
+	wipe(r.HeaderKey[:])
+	wipe(r.PrevHeaderKey[:])
+	r.hints[0].destroy()
+	r.hints[1].destroy()
+	destroyRatchets(r.Ratchets)
+	r.Skipped.destroy()
+	r.Ratchets = nil
+}
+
+// Destroy wipes the private keys
+func (e *EphemPriv) Destroy() {
+	wipe(e.Privkey[:])
+	wipe(e.PrivkeyPQ.Key)
+}
@@ -0,0 +1,124 @@
+package tungsten
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// testWiped checks that every byte of a key is zero
+func testWiped(t *testing.T, name string, key []byte) {
+	t.Helper()
+	if len(key) == 0 {
+		t.Fatalf("%s is empty", name)
+	}
+	for _, v := range key {
+		if v != 0 {
+			t.Fatalf("%s wasn't wiped", name)
+		}
+	}
+}
+
+func TestDestroy(t *testing.T) {
+	alice, bob := testPair(t)
+	alice.SetTreeMode(true)
+	testReceive(t, bob, testUpdate(t, alice), "")
+	testReceive(t, alice, testSend(t, bob, "before destroy"), "before destroy")
+
+	signing, signingPQ := alice.SigningKey, alice.SigningKeyPQ.Key
+	priv, privPQ := &alice.CurrentPrivkey, alice.CurrentPrivkeyPQ.Key
+	header := &alice.HeaderKey
+	sym := alice.Ratchets[0].Symmetric
+	root := alice.Ratchets[0].Root
+	rx := alice.child(bob.UUID)
+	rxSym := rx.Ratchets[0].Symmetric
+	node := alice.Tree.Nodes[1].Keypair
+
+	alice.Destroy()
+	testWiped(t, "signing key", signing)
+	testWiped(t, "pq signing key", signingPQ)
+	testWiped(t, "privkey", priv[:])
+	testWiped(t, "pq privkey", privPQ)
+	testWiped(t, "header key", header[:])
+	testWiped(t, "chain key", sym.current[:])
+	testWiped(t, "root key", root.current[:])
+	testWiped(t, "member's chain key", rxSym.current[:])
+	testWiped(t, "member's header key", rx.HeaderKey[:])
+	testWiped(t, "node privkey", node.Privkey[:])
+	if alice.Ratchets != nil || alice.Children != nil || alice.Tree != nil {
+		t.Fatal("destroyed session kept its ratchets, members or tree")
+	}
+
+	// The session can't be used afterwards
+	b := new(bytes.Buffer)
+	if err := alice.SendMessage(uuid.Nil, []byte("after destroy"), b); err != ErrDestroyed {
+		t.Fatalf("send: got %v, want ErrDestroyed", err)
+	}
+	if _, err := alice.ReceiveMessage(testSend(t, bob, "after destroy")); err != ErrDestroyed {
+		t.Fatalf("receive: got %v, want ErrDestroyed", err)
+	}
+	if err := alice.GenerateUpdate(b); err != ErrDestroyed {
+		t.Fatalf("update: got %v, want ErrDestroyed", err)
+	}
+	if err := alice.RotateKeys(b); err != ErrDestroyed {
+		t.Fatalf("rotate: got %v, want ErrDestroyed", err)
+	}
+	if err := alice.Export(b); err != ErrDestroyed {
+		t.Fatalf("export: got %v, want ErrDestroyed", err)
+	}
+	if _, err := NewHandshake(alice, bob.UUID); err != ErrDestroyed {
+		t.Fatalf("handshake: got %v, want ErrDestroyed", err)
+	}
+	if b.Len() != 0 {
+		t.Fatal("destroyed session wrote a message")
+	}
+}
+
+// Keys are wiped as soon as they are replaced, not only by Destroy
+func TestDestroyReplaced(t *testing.T) {
+	alice, bob := testPair(t)
+	sym := alice.Ratchets[0].Symmetric
+	privPQ := alice.CurrentPrivkeyPQ.Key
+	testReceive(t, bob, testUpdate(t, alice), "")
+	testWiped(t, "replaced chain key", sym.current[:])
+
+	// The replaced keypair is kept as the previous one until the next update
+	if !bytes.Equal(alice.PrevPrivkeyPQ.Key, privPQ) {
+		t.Fatal("replaced privkey wasn't kept")
+	}
+	testReceive(t, bob, testUpdate(t, alice), "")
+	testWiped(t, "previous privkey", privPQ)
+
+	// A retired ratchet is wiped on both sides
+	id := uuid.New()
+	announce := new(bytes.Buffer)
+	if err := alice.AddRatchet(id, nil, announce); err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, bob, announce.Bytes(), "")
+	sent := findRatchet(alice.Ratchets, id).Symmetric
+	received := findRatchet(bob.child(alice.UUID).Ratchets, id).Symmetric
+	retire := new(bytes.Buffer)
+	if err := alice.RetireRatchet(id, retire); err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, bob, retire.Bytes(), "")
+	testWiped(t, "retired chain key", sent.current[:])
+	testWiped(t, "received retired chain key", received.current[:])
+
+	// Destroying a member leaves the rest of the session usable
+	bob.child(alice.UUID).Destroy()
+	if _, err := bob.ReceiveMessage(testSend(t, alice, "destroyed member")); err == nil {
+		t.Fatal("received with a destroyed member")
+	}
+	testReceive(t, alice, testSend(t, bob, "still sending"), "still sending")
+
+	priv, _, err := GenEphem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	priv.Destroy()
+	testWiped(t, "ephem privkey", priv.Privkey[:])
+	testWiped(t, "ephem pq privkey", priv.PrivkeyPQ.Key)
+}
@@ -0,0 +1,757 @@
+package tungsten
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/cloudflare/circl/sign/ed25519"
+	"github.com/google/uuid"
+)
+
+// Multiple devices, see "Multi-device support" in /design/encryption.adoc.
+// A user's devices form a tungsten group of their own (the device group), and
+// share the same tx session in each guild, so other members see them as one
+// identity. Each device only sends with its own ratchets, and key material
+// generated by one device is mirrored to the rest over the device group.
+//
+// Linking a new device, see DeviceLink:
+//
+//  1. The new device generates a tx session for the device group, and shows
+//     the offer written by OfferLink as a QR code
+//  2. An existing device scans it, and replies with the init of an ephem
+//     handshake (AcceptLink). The new device replies with the finish
+//     (DeviceLink.Respond), which the existing device reads (DeviceLink.Finish).
+//  3. Both devices show the fingerprint of the secret as a short code, and the
+//     user confirms that they match (DeviceLink.Confirm)
+//  4. The new device joins the device group as a new member would
+//     (DeviceLink.Introduce, DeviceLink.AddDevice and DeviceLink.JoinGroup)
+//  5. The existing device sends each guild session with ShareSession, and the
+//     new device adds a ratchet of its own to each
+
+// Kinds of key material
+const (
+	MATERIAL_SESSION  = iota // An entire session, when it is first shared
+	MATERIAL_KEYPAIR         // A keypair and root ratchet inputs, from GenerateUpdate
+	MATERIAL_RATCHET         // A new or replaced ratchet
+	MATERIAL_RETIRE          // A retired ratchet
+	MATERIAL_MEMBER          // A member added by CreateUser
+	MATERIAL_IDENTITY        // Signing keys from RotateKeys
+)
+
+// Key material generated by one device, to be mirrored to the others
+type KeyMaterial struct {
+	Kind      byte
+	Device    uuid.UUID
+	Timestamp int64 // Unix nanoseconds, so that offline devices can order it
+	Body      []byte
+}
+
+// A QR code payload offering to link a new device, with the hello of the
+// handshake
+type LinkOffer struct {
+	Device uuid.UUID // The new device's device group session
+	Hello  HandshakeHello
+}
+
+func (o *LinkOffer) Marshal(w io.Writer) {
+	w.Write(o.Device[:])
+	o.Hello.Marshal(w)
+}
+
+func (o *LinkOffer) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+	er.Read(o.Device[:])
+	if er.err != nil {
+		return er.err
+	}
+
+	return o.Hello.Unmarshal(r)
+}
+
+// A device link in progress, from either side. The new device doesn't have an
+// identity yet, so the handshake isn't bound to one, and the secret can only
+// be used once the user has confirmed that both devices show the same
+// fingerprint.
+type DeviceLink struct {
+	Device uuid.UUID // The new device's device group session
+
+	handshake *Handshake
+	confirmed bool
+}
+
+// OfferLink starts linking this device, whose device group session is d, and
+// writes the offer to be shown as a QR code
+func OfferLink(d *TxSession, w io.Writer) (*DeviceLink, error) {
+	h, err := d.Config.NewHandshake(nil, uuid.Nil)
+	if err != nil {
+		return nil, err
+	}
+
+	hello := new(bytes.Buffer)
+	if err := h.Hello(hello); err != nil {
+		return nil, h.fail(err)
+	}
+
+	b := new(bytes.Buffer)
+	b.Write(d.UUID[:])
+	b.Write(hello.Bytes())
+	if _, err := b.WriteTo(w); err != nil {
+		return nil, h.fail(err)
+	}
+
+	return &DeviceLink{Device: d.UUID, handshake: h}, nil
+}
+
+// AcceptLink reads the offer of a new device, scanned by this device, whose
+// device group session is d, and writes the init of the handshake to be sent
+// back to it
+func AcceptLink(d *TxSession, offer []byte, w io.Writer) (*DeviceLink, error) {
+	o := new(LinkOffer)
+	if err := o.Unmarshal(bytes.NewReader(offer)); err != nil {
+		return nil, err
+	}
+	if err := d.checkNewMember(o.Device); err != nil {
+		return nil, err
+	}
+
+	h, err := d.Config.NewHandshake(nil, uuid.Nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := h.Initiate(offer[len(o.Device):], w); err != nil {
+		return nil, err
+	}
+
+	return &DeviceLink{Device: o.Device, handshake: h}, nil
+}
+
+// Respond reads the init of the existing device, and writes the finish, on the
+// new device
+func (l *DeviceLink) Respond(init []byte, w io.Writer) error {
+	return l.handshake.Respond(init, w)
+}
+
+// Finish reads the finish of the new device, on the existing device
+func (l *DeviceLink) Finish(finish []byte) error {
+	return l.handshake.Finish(finish)
+}
+
+// Fingerprint returns the short code to be shown on both devices, once the
+// handshake is complete
+func (l *DeviceLink) Fingerprint() (string, error) {
+	return l.handshake.Fingerprint()
+}
+
+// Confirm records that the user has checked both devices show the same
+// fingerprint
+func (l *DeviceLink) Confirm() error {
+	if _, err := l.handshake.Secret(); err != nil {
+		return err
+	}
+	l.confirmed = true
+	return nil
+}
+
+// secret returns the secret of the handshake, once the user has confirmed it
+func (l *DeviceLink) secret() ([32]byte, error) {
+	if !l.confirmed {
+		return [32]byte{}, ErrHandshakeState
+	}
+	return l.handshake.Secret()
+}
+
+// Introduce writes the introduction of the new device's device group session
+// d, to be sent to the existing device
+func (l *DeviceLink) Introduce(d *TxSession, w io.Writer) error {
+	if d.UUID != l.Device {
+		return ErrInvalidArg
+	}
+
+	secret, err := l.secret()
+	if err != nil {
+		return err
+	}
+	return d.Introduce(secret, w)
+}
+
+// AddDevice adds the new device introduced by intro to the device group, from
+// the existing device's device group session d. See TxSession.CreateUser.
+func (l *DeviceLink) AddDevice(d *TxSession, intro []byte, w io.Writer) (*RxSession, error) {
+	if len(intro) < len(l.Device) {
+		return nil, ErrTruncated
+	}
+	if !bytes.Equal(intro[:len(l.Device)], l.Device[:]) {
+		return nil, ErrUnknownMember
+	}
+
+	secret, err := l.secret()
+	if err != nil {
+		return nil, err
+	}
+	return d.CreateUser(secret, intro, w)
+}
+
+// JoinGroup joins the device group with the create user message written by
+// AddDevice, on the new device
+func (l *DeviceLink) JoinGroup(d *TxSession, msg []byte) error {
+	secret, err := l.secret()
+	if err != nil {
+		return err
+	}
+	return d.JoinGroup(secret, msg)
+}
+
+// Destroy zeroes the keys of the link. It can't be used afterwards.
+func (l *DeviceLink) Destroy() {
+	l.handshake.Destroy()
+}
+
+// Key material for a session, sent as a data message over the device group.
+// SessionID is chosen by the application, such as the guild id.
+type Mirror struct {
+	SessionID uuid.UUID
+	Material  []KeyMaterial
+}
+
+func (m *Mirror) Marshal(w io.Writer) {
+	w.Write(m.SessionID[:])
+
+	binary.Write(w, binary.BigEndian, int64(len(m.Material)))
+	for _, v := range m.Material {
+		w.Write([]byte{v.Kind})
+		w.Write(v.Device[:])
+		binary.Write(w, binary.BigEndian, v.Timestamp)
+		writeBytes(w, v.Body)
+	}
+}
+
+func (m *Mirror) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+	er.Read(m.SessionID[:])
+
+	var l int64
+	binary.Read(er, binary.BigEndian, &l)
+	for i := int64(0); i < l && er.err == nil; i++ {
+		v := KeyMaterial{}
+
+		b := make([]byte, 1)
+		er.Read(b)
+		v.Kind = b[0]
+		er.Read(v.Device[:])
+		binary.Read(er, binary.BigEndian, &v.Timestamp)
+		v.Body = readBytes(er)
+
+		m.Material = append(m.Material, v)
+	}
+
+	return er.err
+}
+
+// ShareSession sends an entire session to our other devices, such as to a
+// newly linked device. If the session wasn't shared before, this device (the
+// device group session d) takes over its ratchets.
+func (d *TxSession) ShareSession(session uuid.UUID, t *TxSession, w io.Writer) error {
+	if t.Device == uuid.Nil {
+		t.Device = d.UUID
+		for _, v := range t.Ratchets {
+			if v.Device == uuid.Nil {
+				v.Device = d.UUID
+			}
+		}
+	}
+
+	b := new(bytes.Buffer)
+	if err := t.Export(b); err != nil {
+		return err
+	}
+
+	// The export includes any material that hasn't been mirrored
+	t.Material = nil
+	t.record(MATERIAL_SESSION, b.Bytes())
+
+	return d.MirrorSession(session, t, w)
+}
+
+// MirrorSession sends the key material generated in a session since it was
+// last mirrored to our other devices. It should be called after every call that
+// changes the session's keys, and writes nothing if there is no new material.
+func (d *TxSession) MirrorSession(session uuid.UUID, t *TxSession, w io.Writer) error {
+	if len(t.Material) == 0 {
+		return nil
+	}
+
+	m := &Mirror{SessionID: session, Material: t.Material}
+	b := new(bytes.Buffer)
+	m.Marshal(b)
+
+	// Sent with a ratchet of this device, as the device group may have been
+	// shared with our other devices too
+	rats := d.deviceRatchets()
+	if len(rats) == 0 {
+		return ErrUnknownRatchet
+	}
+	if err := d.SendMessage(rats[0].UUID, b.Bytes(), w); err != nil {
+		return err
+	}
+
+	t.Material = nil
+	return nil
+}
+
+// ReadMirror reads the plaintext of a device group message
+func ReadMirror(plain []byte) (*Mirror, error) {
+	m := new(Mirror)
+	if err := m.Unmarshal(bytes.NewReader(plain)); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Apply applies key material from another of our devices to t, our copy of
+// the session. If we don't have the session yet, t is nil, and the session is
+// created from the material. device is our device group session's UUID.
+func (m *Mirror) Apply(t *TxSession, device uuid.UUID) (*TxSession, error) {
+	for _, v := range m.Material {
+		if v.Kind == MATERIAL_SESSION {
+			if t != nil {
+				// We already have it
+				continue
+			}
+
+			var err error
+			t, err = ImportTx(bytes.NewReader(v.Body))
+			if err != nil {
+				return nil, err
+			}
+			t.Device = device
+			continue
+		}
+
+		if t == nil {
+			return nil, ErrUnknownSession
+		}
+
+		var err error
+		switch v.Kind {
+		case MATERIAL_KEYPAIR:
+			err = t.applyKeypair(&v)
+		case MATERIAL_RATCHET:
+			err = t.applyRatchet(&v)
+		case MATERIAL_RETIRE:
+			var id uuid.UUID
+			copy(id[:], v.Body)
+			t.Ratchets = dropRatchet(t.Ratchets, id)
+			t.ownRx().dropRatchet(id, RETIRED_EPOCH)
+		case MATERIAL_MEMBER:
+			err = t.applyMember(&v)
+		case MATERIAL_IDENTITY:
+			err = t.applyIdentity(&v)
+		default:
+			err = ErrUnknownMsgType
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t, nil
+}
+
+// record adds key material to be mirrored, if the session is shared with our
+// other devices
+func (t *TxSession) record(kind byte, body []byte) {
+	t.recordAt(kind, body, t.Config.now().UnixNano())
+}
+
+func (t *TxSession) recordAt(kind byte, body []byte, timestamp int64) {
+	if t.Device == uuid.Nil {
+		return
+	}
+
+	t.Material = append(t.Material, KeyMaterial{
+		Kind:      kind,
+		Device:    t.Device,
+		Timestamp: timestamp,
+		Body:      body,
+	})
+}
+
+// recordKeypair records a keypair from GenerateUpdate, with the timestamp of
+// the update
+func (t *TxSession) recordKeypair(timestamp int64, priv x25519.Key, privPQ PQPrivkey, pubPQ PQPubkey, headerKey [32]byte, rats []*Ratchet, encaps []DHKey, encapsPQ []PQKey, path *pathSecret) {
+	if t.Device == uuid.Nil {
+		return
+	}
+
+	b := new(bytes.Buffer)
+	b.Write(priv[:])
+	privPQ.Marshal(b)
+	pubPQ.Marshal(b)
+	b.Write(headerKey[:])
+
+	binary.Write(b, binary.BigEndian, int64(len(rats)))
+	for i, v := range rats {
+		b.Write(v.UUID[:])
+		binary.Write(b, binary.BigEndian, v.Symmetric.Index())
+		b.Write(encaps[i][:])
+		b.Write(encapsPQ[i][:])
+	}
+
+	// The secret of the first node above our leaf, in tree mode
+	if path != nil {
+		binary.Write(b, binary.BigEndian, uint32(len(t.Tree.Members)))
+		b.Write(path.dh[:])
+		b.Write(path.pq[:])
+	}
+
+	t.recordAt(MATERIAL_KEYPAIR, b.Bytes(), timestamp)
+}
+
+func (t *TxSession) applyKeypair(m *KeyMaterial) error {
+	body := bytes.NewReader(m.Body)
+	r := &errReader{r: body}
+
+	var priv x25519.Key
+	r.Read(priv[:])
+
+	var privPQ PQPrivkey
+	var pubPQ PQPubkey
+	readPQ(r, false, &privPQ)
+	readPQ(r, false, &pubPQ)
+
+	var headerKey [32]byte
+	r.Read(headerKey[:])
+
+	type advance struct {
+		ratchet     *Ratchet
+		prevCounter uint32
+		encap       DHKey
+		encapPQ     PQKey
+	}
+	var advances []advance
+
+	var count int64
+	binary.Read(r, binary.BigEndian, &count)
+	for i := int64(0); i < count && r.err == nil; i++ {
+		var id uuid.UUID
+		var a advance
+		r.Read(id[:])
+		binary.Read(r, binary.BigEndian, &a.prevCounter)
+		r.Read(a.encap[:])
+		r.Read(a.encapPQ[:])
+
+		// It may have been retired since
+		a.ratchet = findRatchet(t.Ratchets, id)
+		if a.ratchet != nil {
+			advances = append(advances, a)
+		}
+	}
+
+	var path *pathSecret
+	var leaves uint32
+	if body.Len() > 0 {
+		path = new(pathSecret)
+		binary.Read(r, binary.BigEndian, &leaves)
+		r.Read(path.dh[:])
+		r.Read(path.pq[:])
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	// Our nodes are only replaced if our other device had the same tree
+	if path != nil {
+		if tr := t.tree(); int(leaves) == len(tr.Members) {
+			if err := t.mergeOwnPath(tr, *path, pubPQ.Suite, m.Timestamp); err != nil {
+				return err
+			}
+		}
+	}
+
+	wipe(t.PrevPrivkey[:])
+	wipe(t.PrevPrivkeyPQ.Key)
+	if m.Timestamp > t.KeysUpdated {
+		t.PrevPrivkey = t.CurrentPrivkey
+		t.PrevPrivkeyPQ = t.CurrentPrivkeyPQ
+		t.CurrentPrivkey = priv
+		t.CurrentPrivkeyPQ = privPQ
+		t.CurrentPubkeyPQ = pubPQ
+		if !t.HeaderPending {
+			t.PrevHeaderKey = t.HeaderKey
+		}
+		t.HeaderKey = headerKey
+		t.HeaderPending = false
+		t.KeysUpdated = m.Timestamp
+	} else {
+		// Our current keypair was generated after this one
+		t.PrevPrivkey = priv
+		t.PrevPrivkeyPQ = privPQ
+		t.PrevHeaderKey = headerKey
+	}
+
+	// The ratchets are advanced in the context of the update our other device sent
+	ad := &encapAD{Sender: t.UUID, PubkeyPQ: pubPQ}
+	x25519.KeyGen(&ad.Pubkey, &priv)
+
+	own := t.ownRx()
+	for _, a := range advances {
+		w := a.ratchet
+
+		// Keep the keys of messages that haven't arrived from the old chain
+		sym, skipped, ok := skipTo(*w.Symmetric, a.prevCounter)
+		if ok {
+			w.setSymmetric(sym)
+			own.storeSkipped(w, skipped)
+		}
+
+		chain := w.Root.Advance(a.encap, a.encapPQ, ratchetContext(ad, w.UUID, w.Epoch+1))
+		wipe(a.encap[:])
+		wipe(a.encapPQ[:])
+		w.setChain(&chain)
+		w.Epoch++
+		w.Updated = m.Timestamp
+	}
+
+	return nil
+}
+
+func (t *TxSession) recordRatchet(rat *Ratchet, prevCounter uint32) {
+	if t.Device == uuid.Nil {
+		return
+	}
+
+	b := new(bytes.Buffer)
+	b.Write(rat.Device[:])
+	exportRatchet(b, rat)
+	binary.Write(b, binary.BigEndian, prevCounter)
+	exportRecipients(b, []*Ratchet{rat})
+
+	t.record(MATERIAL_RATCHET, b.Bytes())
+}
+
+func (t *TxSession) applyRatchet(m *KeyMaterial) error {
+	r := &errReader{r: bytes.NewReader(m.Body)}
+
+	var device uuid.UUID
+	r.Read(device[:])
+	rat := importRatchet(r)
+	var prevCounter uint32
+	binary.Read(r, binary.BigEndian, &prevCounter)
+	if r.err != nil {
+		return r.err
+	}
+
+	rest, _ := io.ReadAll(r.r)
+	if err := importRecipients(rest, []*Ratchet{rat}); err != nil {
+		return err
+	}
+	rat.Device = device
+	rat.Updated = m.Timestamp
+
+	old := findRatchet(t.Ratchets, rat.UUID)
+	if old == nil {
+		t.Ratchets = append(t.Ratchets, rat)
+		return nil
+	}
+
+	// Keep the keys of messages that haven't arrived from the replaced chain
+	sym, skipped, ok := skipTo(*old.Symmetric, prevCounter)
+	if ok {
+		old.setSymmetric(sym)
+		t.ownRx().storeSkipped(old, skipped)
+	}
+
+	old.Destroy()
+	*old = *rat
+	return nil
+}
+
+func (t *TxSession) recordRetire(id uuid.UUID) {
+	t.record(MATERIAL_RETIRE, id[:])
+}
+
+func (t *TxSession) recordMember(member *RxSession) error {
+	if t.Device == uuid.Nil {
+		return nil
+	}
+
+	b := new(bytes.Buffer)
+	if err := member.Export(b); err != nil {
+		return err
+	}
+	t.record(MATERIAL_MEMBER, b.Bytes())
+	return nil
+}
+
+func (t *TxSession) applyMember(m *KeyMaterial) error {
+	member, err := ImportRx(bytes.NewReader(m.Body))
+	if err != nil {
+		return err
+	}
+
+	err = t.AcceptMember(member)
+	if err == ErrDuplicateMember {
+		// We accepted them ourselves
+		return nil
+	}
+	return err
+}
+
+func (t *TxSession) recordIdentity(positions []RatchetPosition) {
+	if t.Device == uuid.Nil {
+		return
+	}
+
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.BigEndian, t.KeyGeneration)
+	b.Write(t.SigningKey)
+	t.SigningKeyPQ.Marshal(b)
+	writePositions(b, positions)
+
+	t.record(MATERIAL_IDENTITY, b.Bytes())
+}
+
+func (t *TxSession) applyIdentity(m *KeyMaterial) error {
+	r := &errReader{r: bytes.NewReader(m.Body)}
+
+	var generation uint32
+	binary.Read(r, binary.BigEndian, &generation)
+
+	signingKey := make(ed25519.PrivateKey, ed25519.PrivateKeySize)
+	r.Read(signingKey)
+
+	var signingKeyPQ PQSigningKey
+	readPQ(r, false, &signingKeyPQ)
+
+	positions := readPositions(r)
+	if r.err != nil {
+		return r.err
+	}
+
+	if generation <= t.KeyGeneration {
+		// We already have them
+		return nil
+	}
+
+	t.KeyHistory = append(t.KeyHistory, PastKey{
+		VerifyingPubkey:   t.verifyingPubkey(),
+		VerifyingPubkeyPQ: t.verifyingPubkeyPQ(),
+		Positions:         positions,
+	})
+	wipe(t.SigningKey)
+	wipe(t.SigningKeyPQ.Key)
+	t.SigningKey = signingKey
+	t.SigningKeyPQ = signingKeyPQ
+	t.KeyGeneration = generation
+	return nil
+}
+
+// deviceRatchets returns the ratchets that this device sends with
+func (t *TxSession) deviceRatchets() []*Ratchet {
+	var out []*Ratchet
+	for _, v := range t.Ratchets {
+		if v.Device == t.Device {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// ownRx returns an rx session for receiving the messages that our other
+// devices sent with their ratchets
+func (t *TxSession) ownRx() *RxSession {
+	if t.Skipped == nil {
+		t.Skipped = make(SkippedKeys)
+	}
+
+	r := &RxSession{
+		Parent:            t,
+		UUID:              t.UUID,
+		VerifyingPubkey:   t.verifyingPubkey(),
+		VerifyingPubkeyPQ: t.verifyingPubkeyPQ(),
+		KeyHistory:        t.KeyHistory,
+		Skipped:           t.Skipped,
+	}
+	for _, v := range t.Ratchets {
+		if v.Device != t.Device {
+			r.Ratchets = append(r.Ratchets, v)
+		}
+	}
+	return r
+}
+
+// receiveOwn receives a message sent by us. Data messages and removals from
+// our other devices are received as normal, and anything else is either from
+// this device or its key material is mirrored.
+func (t *TxSession) receiveOwn(msg []byte) (*Received, error) {
+	switch msg[0] {
+	case MSG_TYPE_DATA:
+		m := new(Data)
+		if err := m.Unmarshal(bytes.NewReader(msg)); err != nil {
+			return nil, err
+		}
+
+		rat := findRatchet(t.Ratchets, m.RatchetID)
+		if rat != nil && rat.Device == t.Device {
+			return nil, ErrOwnMessage
+		}
+
+	case MSG_TYPE_REMOVE_MEMBER:
+		if t.Device == uuid.Nil {
+			return nil, ErrOwnMessage
+		}
+
+	default:
+		return nil, ErrOwnMessage
+	}
+
+	return t.ownRx().ReceiveMessage(msg)
+}
+
+// exportDevices writes the devices section of a tx export
+func exportDevices(w io.Writer, t *TxSession) {
+	w.Write(t.Device[:])
+	binary.Write(w, binary.BigEndian, t.KeysUpdated)
+
+	var owned []*Ratchet
+	for _, v := range t.Ratchets {
+		if v.Device != uuid.Nil {
+			owned = append(owned, v)
+		}
+	}
+
+	binary.Write(w, binary.BigEndian, int64(len(owned)))
+	for _, v := range owned {
+		w.Write(v.UUID[:])
+		w.Write(v.Device[:])
+	}
+}
+
+// importDevices reads the devices section, if there is one
+func importDevices(b []byte, t *TxSession) error {
+	if len(b) == 0 {
+		return nil
+	}
+
+	r := &errReader{r: bytes.NewReader(b)}
+	r.Read(t.Device[:])
+	binary.Read(r, binary.BigEndian, &t.KeysUpdated)
+
+	var count int64
+	binary.Read(r, binary.BigEndian, &count)
+	for i := int64(0); i < count && r.err == nil; i++ {
+		var id, device uuid.UUID
+		r.Read(id[:])
+		r.Read(device[:])
+
+		rat := findRatchet(t.Ratchets, id)
+		if rat == nil {
+			return ErrCorruptExport
+		}
+		rat.Device = device
+	}
+
+	return r.err
+}
@@ -0,0 +1,349 @@
+package tungsten
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// testLink links a new device to the device group of an existing device,
+// returning the new device's device group session
+func testLink(t *testing.T, existing *TxSession) *TxSession {
+	t.Helper()
+	device, err := GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offer := new(bytes.Buffer)
+	newLink, err := OfferLink(device, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	init := new(bytes.Buffer)
+	existingLink, err := AcceptLink(existing, offer.Bytes(), init)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existingLink.Device != device.UUID {
+		t.Fatal("offer didn't name the new device")
+	}
+	finish := new(bytes.Buffer)
+	if err := newLink.Respond(init.Bytes(), finish); err != nil {
+		t.Fatal(err)
+	}
+	if err := existingLink.Finish(finish.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	newCode, err := newLink.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	existingCode, err := existingLink.Fingerprint()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if newCode != existingCode {
+		t.Fatal("devices show different fingerprints")
+	}
+	if err := newLink.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+	if err := existingLink.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+
+	intro := new(bytes.Buffer)
+	if err := newLink.Introduce(device, intro); err != nil {
+		t.Fatal(err)
+	}
+	msg := new(bytes.Buffer)
+	if _, err := existingLink.AddDevice(existing, intro.Bytes(), msg); err != nil {
+		t.Fatal(err)
+	}
+	if err := newLink.JoinGroup(device, msg.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return device
+}
+
+// testReadMirror receives a mirror sent over the device group
+func testReadMirror(t *testing.T, d *TxSession, msg []byte) *Mirror {
+	t.Helper()
+	r, err := d.ReceiveMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := ReadMirror(r.Plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+// testMirror mirrors the new key material of a session from one device to
+// another, returning the other device's copy of the session
+func testMirror(t *testing.T, from, to *TxSession, session uuid.UUID, fromSession, toSession *TxSession) *TxSession {
+	t.Helper()
+	b := new(bytes.Buffer)
+	if err := from.MirrorSession(session, fromSession, b); err != nil {
+		t.Fatal(err)
+	}
+	if b.Len() == 0 {
+		return toSession
+	}
+
+	m := testReadMirror(t, to, b.Bytes())
+	if m.SessionID != session {
+		t.Fatal("mirror is of another session")
+	}
+	out, err := m.Apply(toSession, to.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestLinkDevice(t *testing.T) {
+	phone, err := GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop := testLink(t, phone)
+	if phone.child(laptop.UUID) == nil || laptop.child(phone.UUID) == nil {
+		t.Fatal("devices aren't in each other's device group")
+	}
+	testReceive(t, laptop, testSend(t, phone, "linked"), "linked")
+	testReceive(t, phone, testSend(t, laptop, "linked"), "linked")
+}
+
+func TestLinkDeviceRejected(t *testing.T) {
+	phone, err := GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop, err := GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	offer := new(bytes.Buffer)
+	newLink, err := OfferLink(laptop, offer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	init := new(bytes.Buffer)
+	existingLink, err := AcceptLink(phone, offer.Bytes(), init)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The secret can't be used before the handshake is complete and the user
+	// has confirmed the fingerprint
+	if err := newLink.Confirm(); err != ErrHandshakeState {
+		t.Fatalf("got %v, want ErrHandshakeState", err)
+	}
+	finish := new(bytes.Buffer)
+	if err := newLink.Respond(init.Bytes(), finish); err != nil {
+		t.Fatal(err)
+	}
+	if err := existingLink.Finish(finish.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := newLink.Introduce(laptop, new(bytes.Buffer)); err != ErrHandshakeState {
+		t.Fatalf("got %v, want ErrHandshakeState", err)
+	}
+	if err := newLink.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+	if err := existingLink.Confirm(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the offered device can be introduced
+	other, err := GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newLink.Introduce(other, new(bytes.Buffer)); err != ErrInvalidArg {
+		t.Fatalf("got %v, want ErrInvalidArg", err)
+	}
+	secret, err := newLink.secret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	intro := new(bytes.Buffer)
+	if err := other.Introduce(secret, intro); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := existingLink.AddDevice(phone, intro.Bytes(), new(bytes.Buffer)); err != ErrUnknownMember {
+		t.Fatalf("got %v, want ErrUnknownMember", err)
+	}
+	if len(phone.Children) != 0 {
+		t.Fatal("device that wasn't offered was added")
+	}
+
+	// A device already in the group isn't offered again
+	offer.Reset()
+	if _, err := OfferLink(phone, offer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := AcceptLink(phone, offer.Bytes(), new(bytes.Buffer)); err != ErrDuplicateMember {
+		t.Fatalf("got %v, want ErrDuplicateMember", err)
+	}
+}
+
+func TestShareSession(t *testing.T) {
+	guild, bob := testPair(t)
+	phone, err := GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop := testLink(t, phone)
+	id := uuid.New()
+
+	// Material other than the session can't be applied before it is shared
+	m := &Mirror{SessionID: id, Material: []KeyMaterial{{Kind: MATERIAL_RETIRE, Body: make([]byte, 16)}}}
+	if _, err := m.Apply(nil, laptop.UUID); err != ErrUnknownSession {
+		t.Fatalf("got %v, want ErrUnknownSession", err)
+	}
+
+	b := new(bytes.Buffer)
+	if err := phone.ShareSession(id, guild, b); err != nil {
+		t.Fatal(err)
+	}
+	if len(guild.Material) != 0 {
+		t.Fatal("shared material wasn't cleared")
+	}
+	m = testReadMirror(t, laptop, b.Bytes())
+	if m.SessionID != id {
+		t.Fatal("mirror is of another session")
+	}
+	copied, err := m.Apply(nil, laptop.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if copied.UUID != guild.UUID || copied.Device != laptop.UUID {
+		t.Fatal("shared session has the wrong identity or device")
+	}
+
+	// Applying it again keeps our copy
+	if again, err := m.Apply(copied, laptop.UUID); err != nil || again != copied {
+		t.Fatal("applying the session again replaced our copy")
+	}
+
+	// The phone's messages are received by the laptop, which can't send with
+	// the phone's ratchets
+	msg := testSend(t, guild, "from the phone")
+	testReceive(t, bob, msg, "from the phone")
+	testReceive(t, copied, msg, "from the phone")
+	if err := copied.SendMessage(uuid.Nil, []byte("not mine"), new(bytes.Buffer)); err != ErrOtherDevice {
+		t.Fatalf("got %v, want ErrOtherDevice", err)
+	}
+
+	// Unknown kinds of material are refused
+	m = &Mirror{SessionID: id, Material: []KeyMaterial{{Kind: 0xff}}}
+	if _, err := m.Apply(copied, laptop.UUID); err != ErrUnknownMsgType {
+		t.Fatalf("got %v, want ErrUnknownMsgType", err)
+	}
+}
+
+func TestMirrorSession(t *testing.T) {
+	guild, bob := testPair(t)
+	phone, err := GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	laptop := testLink(t, phone)
+	id := uuid.New()
+
+	b := new(bytes.Buffer)
+	if err := phone.ShareSession(id, guild, b); err != nil {
+		t.Fatal(err)
+	}
+	m := testReadMirror(t, laptop, b.Bytes())
+	copied, err := m.Apply(nil, laptop.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Nothing is written without new material
+	b.Reset()
+	if err := phone.MirrorSession(id, guild, b); err != nil || b.Len() != 0 {
+		t.Fatal("mirrored without new material")
+	}
+
+	// A ratchet of the laptop's own is mirrored to the phone
+	ratchet := uuid.New()
+	announce := new(bytes.Buffer)
+	if err := copied.AddRatchet(ratchet, nil, announce); err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, bob, announce.Bytes(), "")
+	if _, err := guild.ReceiveMessage(announce.Bytes()); err != ErrOwnMessage {
+		t.Fatalf("got %v, want ErrOwnMessage", err)
+	}
+	guild = testMirror(t, laptop, phone, id, copied, guild)
+	msg := testSendOn(t, copied, ratchet, "from the laptop")
+	testReceive(t, bob, msg, "from the laptop")
+	testReceive(t, guild, msg, "from the laptop")
+
+	// Updates from either device are mirrored to the other
+	update := testUpdate(t, guild)
+	testReceive(t, bob, update, "")
+	copied = testMirror(t, phone, laptop, id, guild, copied)
+	msg = testSend(t, guild, "after the phone's update")
+	testReceive(t, bob, msg, "after the phone's update")
+	testReceive(t, copied, msg, "after the phone's update")
+
+	update = testUpdate(t, copied)
+	testReceive(t, bob, update, "")
+	guild = testMirror(t, laptop, phone, id, copied, guild)
+	msg = testSendOn(t, copied, ratchet, "after the laptop's update")
+	testReceive(t, bob, msg, "after the laptop's update")
+	testReceive(t, guild, msg, "after the laptop's update")
+
+	// Both copies receive the other member's messages
+	msg = testSend(t, bob, "hello both")
+	testReceive(t, guild, msg, "hello both")
+	testReceive(t, copied, msg, "hello both")
+}
+
+// Mirrors are sent with a ratchet of the sending device, when the device group
+// session is itself shared between devices
+func TestMirrorSessionDeviceRatchet(t *testing.T) {
+	phone, laptop := testPair(t)
+	guild, _ := testPair(t)
+	guild.Device = phone.UUID
+
+	// The default ratchet was taken over by another device
+	phone.Device = uuid.New()
+	if err := phone.SendMessage(uuid.Nil, []byte("not mine"), new(bytes.Buffer)); err != ErrOtherDevice {
+		t.Fatalf("got %v, want ErrOtherDevice", err)
+	}
+	guild.recordRetire(uuid.New())
+	if err := phone.MirrorSession(uuid.New(), guild, new(bytes.Buffer)); err != ErrUnknownRatchet {
+		t.Fatalf("got %v, want ErrUnknownRatchet", err)
+	}
+
+	ratchet := uuid.New()
+	announce := new(bytes.Buffer)
+	if err := phone.AddRatchet(ratchet, nil, announce); err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, laptop, announce.Bytes(), "")
+
+	b := new(bytes.Buffer)
+	if err := phone.MirrorSession(uuid.New(), guild, b); err != nil {
+		t.Fatal(err)
+	}
+	r, err := laptop.ReceiveMessage(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.RatchetID != ratchet {
+		t.Fatal("mirror wasn't sent with the device's own ratchet")
+	}
+}
@@ -0,0 +1,283 @@
+package tungsten
+
+import (
+	"crypto/sha256"
+	"io"
+
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Keys are encapsulated to another user twice: a DHKey is encrypted with a key
+// derived from a DH shared secret, and a PQKey is encrypted with the shared
+// secret of the post-quantum KEM of the user's suite. Both are sealed with
+// associated data, see aead.go.
+
+// dhKey derives the key for encapsulating DHKeys from the shared secret of
+// priv and pub
+func dhKey(priv, pub *x25519.Key, info []byte) ([32]byte, error) {
+	var shared x25519.Key
+	x25519.Shared(&shared, priv, pub)
+	return deriveKey(&shared, info)
+}
+
+func deriveKey(shared *x25519.Key, info []byte) ([32]byte, error) {
+	var derived [32]byte
+	keyReader := hkdf.New(sha256.New, shared[:], nil, info)
+	_, err := io.ReadFull(keyReader, derived[:])
+	return derived, err
+}
+
+// sharedSecrets computes the shared secret of priv with each of children once,
+// so that it can be used for every key encapsulated to them
+func sharedSecrets(priv *x25519.Key, children []*RxSession) map[uuid.UUID]*x25519.Key {
+	shared := make([]x25519.Key, len(children))
+	parallel(len(children), func(i int) error {
+		x25519.Shared(&shared[i], priv, &children[i].CurrentPubkey)
+		return nil
+	})
+
+	out := make(map[uuid.UUID]*x25519.Key, len(children))
+	for i, v := range children {
+		out[v.UUID] = &shared[i]
+	}
+	return out
+}
+
+// deriveKeys derives the key for encapsulating DHKeys to each member from the
+// shared secrets
+func deriveKeys(shared map[uuid.UUID]*x25519.Key, info []byte) (map[uuid.UUID]*[32]byte, error) {
+	out := make(map[uuid.UUID]*[32]byte, len(shared))
+	for k, v := range shared {
+		derived, err := deriveKey(v, info)
+		if err != nil {
+			return nil, err
+		}
+		out[k] = &derived
+	}
+	return out, nil
+}
+
+// sealDH encapsulates a DHKey (nonce is prepended to ciphertext)
+func sealDH(c *Config, key *[32]byte, encap DHKey, ad []byte) (DHKeyCiphertext, error) {
+	var out DHKeyCiphertext
+	nonce := out[:chacha20poly1305.NonceSizeX]
+	if err := c.read(nonce); err != nil {
+		return out, err
+	}
+
+	copy(out[len(nonce):], sealAEAD(key, nonce, encap[:], ad))
+	return out, nil
+}
+
+func openDH(key *[32]byte, ciphertext DHKeyCiphertext, ad []byte) (DHKey, error) {
+	var out DHKey
+	nonce := ciphertext[:chacha20poly1305.NonceSizeX]
+
+	plain, err := openAEAD(key, nonce, ciphertext[len(nonce):], ad)
+	if err != nil {
+		return out, err
+	}
+
+	copy(out[:], plain)
+	wipe(plain)
+	return out, nil
+}
+
+// sealPQ encapsulates a PQKey to pub (the KEM ciphertext is prepended). The
+// shared secret is only used once, so the nonce is zero.
+func sealPQ(c *Config, pub *PQPubkey, encapPQ PQKey, ad []byte) (PQKeyCiphertext, error) {
+	var out PQKeyCiphertext
+	ct, ss, err := pub.encapsulate(c)
+	if err != nil {
+		return out, err
+	}
+
+	var nonce [chacha20poly1305.NonceSizeX]byte
+	copy(out[:], ct[:])
+	copy(out[PQ_CIPHERTEXT_SIZE:], sealAEAD(&ss, nonce[:], encapPQ[:], ad))
+	wipe(ss[:])
+	return out, nil
+}
+
+func openPQ(priv *PQPrivkey, ciphertext PQKeyCiphertext, ad []byte) (PQKey, error) {
+	var out PQKey
+	ss, err := priv.decapsulate(ciphertext[:PQ_CIPHERTEXT_SIZE])
+	if err != nil {
+		return out, err
+	}
+
+	var nonce [chacha20poly1305.NonceSizeX]byte
+	plain, err := openAEAD(&ss, nonce[:], ciphertext[PQ_CIPHERTEXT_SIZE:], ad)
+	wipe(ss[:])
+	if err != nil {
+		return out, err
+	}
+
+	copy(out[:], plain)
+	wipe(plain)
+	return out, nil
+}
+
+// senderKeys opens the keys encapsulated to us in one message, by the member
+// whose current pubkeys are in ad. The keys for opening DHKeys are derived once
+// for the message, with our current and previous privkeys, rather than for
+// every key.
+type senderKeys struct {
+	t       *TxSession
+	ad      *encapAD
+	info    []byte
+	derived [2]*[32]byte
+}
+
+func (t *TxSession) senderKeys(ad *encapAD, info []byte) *senderKeys {
+	return &senderKeys{t: t, ad: ad, info: info}
+}
+
+// derive returns the key for opening DHKeys with our current (0) or previous
+// (1) privkey
+func (s *senderKeys) derive(i int) (*[32]byte, error) {
+	if s.derived[i] == nil {
+		priv := []*x25519.Key{&s.t.CurrentPrivkey, &s.t.PrevPrivkey}[i]
+		derived, err := dhKey(priv, &s.ad.Pubkey, s.info)
+		if err != nil {
+			return nil, err
+		}
+		s.derived[i] = &derived
+	}
+	return s.derived[i], nil
+}
+
+// open opens a pair of encapsulated keys. If the sender encapsulated them
+// before receiving our last update, they used our previous keypair, which is
+// tried when the DH part doesn't open.
+func (s *senderKeys) open(purpose []byte, dh DHKeyCiphertext, pq PQKeyCiphertext) (DHKey, PQKey, error) {
+	privsPQ := []*PQPrivkey{&s.t.CurrentPrivkeyPQ, &s.t.PrevPrivkeyPQ}
+	data := s.ad.to(s.t.UUID[:], s.info, purpose)
+
+	for i := range privsPQ {
+		derived, err := s.derive(i)
+		if err != nil {
+			return DHKey{}, PQKey{}, err
+		}
+
+		encap, err := openDH(derived, dh, data)
+		if err == nil {
+			encapPQ, err := openPQ(privsPQ[i], pq, data)
+			return encap, encapPQ, err
+		}
+	}
+
+	return DHKey{}, PQKey{}, ErrMACFailure
+}
+
+func (s *senderKeys) destroy() {
+	for _, v := range s.derived {
+		if v != nil {
+			wipe(v[:])
+		}
+	}
+}
+
+// sealTo generates a random key, encapsulated to each of children with our
+// privkey priv, whose pubkey is in ad. The key is the combination of the
+// encapsulated values, with label, see sharedContext.
+func sealTo(c *Config, priv *x25519.Key, children []*RxSession, info, label []byte, ad *encapAD, purpose []byte) ([32]byte, []UserKey, error) {
+	shared := sharedSecrets(priv, children)
+	defer func() {
+		for _, v := range shared {
+			wipe(v[:])
+		}
+	}()
+	return sealToShared(c, shared, children, info, label, ad, purpose)
+}
+
+// sealToShared is sealTo with the shared secrets of our privkey and children
+func sealToShared(c *Config, shared map[uuid.UUID]*x25519.Key, children []*RxSession, info, label []byte, ad *encapAD, purpose []byte) ([32]byte, []UserKey, error) {
+	var encap DHKey
+	var encapPQ PQKey
+	if err := c.read(encap[:]); err != nil {
+		return [32]byte{}, nil, err
+	}
+	if err := c.read(encapPQ[:]); err != nil {
+		return [32]byte{}, nil, err
+	}
+
+	derived, err := deriveKeys(shared, info)
+	if err != nil {
+		return [32]byte{}, nil, err
+	}
+
+	keys := make([]UserKey, len(children))
+	err = c.parallel(len(children), func(i int) error {
+		v := children[i]
+		data := ad.to(v.UUID[:], info, purpose)
+		outDH, err := sealDH(c, derived[v.UUID], encap, data)
+		if err != nil {
+			return err
+		}
+
+		outPQ, err := sealPQ(c, &v.CurrentPubkeyPQ, encapPQ, data)
+		if err != nil {
+			return err
+		}
+
+		keys[i] = UserKey{UserID: v.UUID, DH: outDH, PQ: outPQ}
+		return nil
+	})
+	if err != nil {
+		return [32]byte{}, nil, err
+	}
+
+	key := Combine(label, encap, encapPQ, sharedContext(ad, purpose, keys)...)
+	wipe(encap[:])
+	wipe(encapPQ[:])
+	for _, v := range derived {
+		wipe(v[:])
+	}
+	return key, keys, nil
+}
+
+// openFromSender opens the key sealed to us by sealTo, where ad has the
+// sender's pubkey for priv
+func (r *RxSession) openFromSender(keys []UserKey, info, label []byte, ad *encapAD, purpose []byte) ([32]byte, error) {
+	key := findKey(keys, r.Parent.UUID)
+	if key == nil {
+		return [32]byte{}, ErrUnknownSender
+	}
+
+	sender := r.Parent.senderKeys(ad, info)
+	defer sender.destroy()
+
+	encap, encapPQ, err := sender.open(purpose, key.DH, key.PQ)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	combined := Combine(label, encap, encapPQ, sharedContext(ad, purpose, keys)...)
+	wipe(encap[:])
+	wipe(encapPQ[:])
+	return combined, nil
+}
+
+// findKey returns the key encapsulated to a user, or nil if there isn't one
+func findKey(keys []UserKey, id uuid.UUID) *UserKey {
+	for i, v := range keys {
+		if v.UserID == id {
+			return &keys[i]
+		}
+	}
+	return nil
+}
+
+// serial calls f for each i in [0, n), stopping at the first error
+func serial(n int, f func(i int) error) error {
+	for i := 0; i < n; i++ {
+		if err := f(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
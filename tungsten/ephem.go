@@ -1,10 +1,7 @@
-package main
+package tungsten
 
 import (
 	"bytes"
-	"crypto/hmac"
-	"crypto/rand"
-	"crypto/sha256"
 	"fmt"
 	"io"
 	"math/big"
@@ -13,157 +10,242 @@ import (
 	"github.com/cloudflare/circl/dh/x25519"
 	"github.com/cloudflare/circl/pke/kyber/kyber768"
 	"golang.org/x/crypto/argon2"
-	"golang.org/x/crypto/hkdf"
-	"golang.org/x/crypto/nacl/secretbox"
 
 	_ "embed"
 )
 
 var DH_HKDF_EPHEM = []byte("dh_hkdf_ephem")
-var EPHEM_HMAC = []byte{0x03}
 var EPHEM_FINGERPRINT_SALT = []byte("ephem_fingerprint_salt")
 
 // The private part of an ephem keypair
 type EphemPriv struct {
 	Privkey   x25519.Key
-	PrivkeyPQ kyber768.PrivateKey
-	PubkeyPQ  kyber768.PublicKey
+	PrivkeyPQ PQPrivkey
+	PubkeyPQ  PQPubkey
 }
 
 func (e *EphemPriv) Marshal(w io.Writer) {
 	w.Write(e.Privkey[:])
+	e.PrivkeyPQ.Marshal(w)
+	e.PubkeyPQ.Marshal(w)
+}
 
-	pq := make([]byte, kyber768.PrivateKeySize)
-	e.PrivkeyPQ.Pack(pq)
-	w.Write(pq)
-
-	pq = make([]byte, kyber768.PublicKeySize)
-	e.PubkeyPQ.Pack(pq)
-	w.Write(pq)
+func (e *EphemPriv) Unmarshal(i io.Reader) error {
+	return e.unmarshal(i, false)
 }
 
-func (e *EphemPriv) Unmarshal(r io.Reader) {
+// unmarshal reads the keypair, with its post-quantum keys written without their
+// suite if legacy
+func (e *EphemPriv) unmarshal(i io.Reader, legacy bool) error {
+	r := &errReader{r: i}
 	r.Read(e.Privkey[:])
+	readPQ(r, legacy, &e.PrivkeyPQ)
+	readPQ(r, legacy, &e.PubkeyPQ)
 
-	pq := make([]byte, kyber768.PrivateKeySize)
-	io.ReadFull(r, pq)
-	e.PrivkeyPQ.Unpack(pq)
-
-	pq = make([]byte, kyber768.PublicKeySize)
-	io.ReadFull(r, pq)
-	e.PubkeyPQ.Unpack(pq)
+	return r.err
 }
 
 // The public part of an ephem keypair
 type EphemPub struct {
 	Pubkey   x25519.Key
-	PubkeyPQ kyber768.PublicKey
+	PubkeyPQ PQPubkey
 }
 
 func (e *EphemPub) Marshal(w io.Writer) {
 	w.Write(e.Pubkey[:])
+	e.PubkeyPQ.Marshal(w)
+}
 
-	pq := make([]byte, kyber768.PublicKeySize)
-	e.PubkeyPQ.Pack(pq)
-	w.Write(pq)
+func (e *EphemPub) Unmarshal(i io.Reader) error {
+	return e.unmarshal(i, false)
 }
 
-func (e *EphemPub) Unmarshal(r io.Reader) {
+func (e *EphemPub) unmarshal(i io.Reader, legacy bool) error {
+	r := &errReader{r: i}
 	r.Read(e.Pubkey[:])
+	readPQ(r, legacy, &e.PubkeyPQ)
+
+	return r.err
+}
+
+// Ephem keys stored before suites were introduced have no suite before their
+// post-quantum keys, which are of the legacy suite. They are told apart by
+// their length, which is never that of a key written with its suites.
+const (
+	EPHEM_PRIV_LEGACY_SIZE = 32 + kyber768.PrivateKeySize + kyber768.PublicKeySize
+	EPHEM_PUB_LEGACY_SIZE  = 32 + kyber768.PublicKeySize
+)
+
+// ImportEphemPriv reads a stored ephem keypair, in either layout. It must
+// consume the input exactly.
+func ImportEphemPriv(i io.Reader) (*EphemPriv, error) {
+	b, err := io.ReadAll(i)
+	if err != nil {
+		return nil, ErrTruncated
+	}
+	defer wipe(b)
+
+	e := new(EphemPriv)
+	r := bytes.NewReader(b)
+	if err := e.unmarshal(r, len(b) == EPHEM_PRIV_LEGACY_SIZE); err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, ErrTruncated
+	}
+	return e, nil
+}
 
-	pq := make([]byte, kyber768.PublicKeySize)
-	io.ReadFull(r, pq)
-	e.PubkeyPQ.Unpack(pq)
+// ImportEphemPub reads a stored ephem pubkey, in either layout. It must consume
+// the input exactly.
+func ImportEphemPub(i io.Reader) (*EphemPub, error) {
+	b, err := io.ReadAll(i)
+	if err != nil {
+		return nil, ErrTruncated
+	}
+
+	e := new(EphemPub)
+	r := bytes.NewReader(b)
+	if err := e.unmarshal(r, len(b) == EPHEM_PUB_LEGACY_SIZE); err != nil {
+		return nil, err
+	}
+	if r.Len() != 0 {
+		return nil, ErrTruncated
+	}
+	return e, nil
 }
 
 // GenEphem generates an ephem keypair
-func GenEphem() (*EphemPriv, *EphemPub) {
+func GenEphem() (*EphemPriv, *EphemPub, error) {
+	return new(Config).GenEphem()
+}
+
+// GenEphem generates an ephem keypair with the config's random source and
+// suite
+func (c *Config) GenEphem() (*EphemPriv, *EphemPub, error) {
 	priv := new(EphemPriv)
 	pub := new(EphemPub)
 
 	// Generate x25519 keys
-	io.ReadFull(rand.Reader, priv.Privkey[:])
+	if err := c.read(priv.Privkey[:]); err != nil {
+		return nil, nil, err
+	}
 	x25519.KeyGen(&pub.Pubkey, &priv.Privkey)
 
-	// Generate kyber keys
-	pubpq, privpq, err := kyber768.GenerateKey(rand.Reader)
+	// Generate post-quantum keys
+	pubpq, privpq, err := genPQ(c, c.suite())
 	if err != nil {
-		panic(err)
+		return nil, nil, err
 	}
-	pub.PubkeyPQ = *pubpq
-	priv.PrivkeyPQ = *privpq
+	pub.PubkeyPQ = pubpq
+	priv.PrivkeyPQ = privpq
+	priv.PubkeyPQ = pubpq
+
+	return priv, pub, nil
+}
+
+// Public returns the public part of the keypair
+func (e *EphemPriv) Public() *EphemPub {
+	pub := &EphemPub{PubkeyPQ: e.PubkeyPQ}
+	x25519.KeyGen(&pub.Pubkey, &e.Privkey)
+	return pub
+}
+
+// ephemAD is the associated data of the keys encapsulated by sender to
+// recipient
+func ephemAD(sender, recipient *EphemPub) []byte {
+	b := new(bytes.Buffer)
+	recipient.Marshal(b)
 
-	return priv, pub
+	ad := &encapAD{Pubkey: sender.Pubkey, PubkeyPQ: sender.PubkeyPQ}
+	return ad.to(b.Bytes(), DH_HKDF_EPHEM, nil)
 }
 
-func GenerateSharedSecret(local *EphemPriv, remote *EphemPub) (ciphertext []byte, secret [32]byte) {
+func GenerateSharedSecret(local *EphemPriv, remote *EphemPub) (ciphertext []byte, secret [32]byte, err error) {
+	return new(Config).GenerateSharedSecret(local, remote)
+}
+
+// GenerateSharedSecret generates a shared secret with the config's random
+// source
+func (c *Config) GenerateSharedSecret(local *EphemPriv, remote *EphemPub) (ciphertext []byte, secret [32]byte, err error) {
 	// Generate sub shared-secrets
 	var encap DHKey
-	var encapPQ KyberKey
-	io.ReadFull(rand.Reader, encap[:])
-	io.ReadFull(rand.Reader, encapPQ[:])
+	var encapPQ PQKey
+	if err := c.read(encap[:]); err != nil {
+		return nil, secret, err
+	}
+	if err := c.read(encapPQ[:]); err != nil {
+		return nil, secret, err
+	}
 
 	// Find DH shared secret
-	var dhShared x25519.Key
-	x25519.Shared(&dhShared, &local.Privkey, &remote.Pubkey)
-
-	var derived [32]byte
-	keyReader := hkdf.New(sha256.New, append(dhShared[:]), nil, DH_HKDF_EPHEM)
-	_, err := io.ReadFull(keyReader, derived[:])
+	derived, err := dhKey(&local.Privkey, &remote.Pubkey, DH_HKDF_EPHEM)
 	if err != nil {
-		panic(err)
+		return nil, secret, err
 	}
 
-	// Encapsulate them (nonce is prepended to ciphertext)
-	var outDH DHKeyCiphertext
-	var nonce [24]byte
-	io.ReadFull(rand.Reader, nonce[:])
-	copy(outDH[:], nonce[:])
-	dhCtext := secretbox.Seal(nil, encap[:], &nonce, &derived)
-	copy(outDH[24:], dhCtext)
+	// Encapsulate them
+	localPub := local.Public()
+	ad := ephemAD(localPub, remote)
+	outDH, err := sealDH(c, &derived, encap, ad)
+	if err != nil {
+		return nil, secret, err
+	}
 
-	var outKyber KyberKeyCiphertext
-	local.PubkeyPQ.EncryptTo(outKyber[:], encapPQ[:], nil)
+	outPQ, err := sealPQ(c, &remote.PubkeyPQ, encapPQ, ad)
+	if err != nil {
+		return nil, secret, err
+	}
 
 	// Derive shared secret
-	h := hmac.New(sha256.New, append(outDH[:], outKyber[:]...))
-	h.Write(EPHEM_HMAC)
-	var shared MessageKey
-	copy(shared[:], h.Sum(nil))
-
-	return append(outDH[:], outKyber[:]...), shared
+	secret = ephemSecret(encap, encapPQ, outDH, outPQ, localPub, remote)
+	wipe(encap[:])
+	wipe(encapPQ[:])
+	return append(outDH[:], outPQ[:]...), secret, nil
 }
 
-func ReceiveSharedSecret(local *EphemPriv, remote *EphemPub, ciphertext []byte) [32]byte {
-	// Find DH shared secret
-	var dhShared x25519.Key
-	x25519.Shared(&dhShared, &local.Privkey, &remote.Pubkey)
+func ReceiveSharedSecret(local *EphemPriv, remote *EphemPub, ciphertext []byte) ([32]byte, error) {
+	if len(ciphertext) != len(DHKeyCiphertext{})+len(PQKeyCiphertext{}) {
+		return [32]byte{}, ErrTruncated
+	}
 
-	var derived [32]byte
-	keyReader := hkdf.New(sha256.New, append(dhShared[:]), nil, DH_HKDF_EPHEM)
-	_, err := io.ReadFull(keyReader, derived[:])
+	// Find DH shared secret
+	derived, err := dhKey(&local.Privkey, &remote.Pubkey, DH_HKDF_EPHEM)
 	if err != nil {
-		panic(err)
+		return [32]byte{}, err
 	}
 
 	// Decapsulate sub shared-secrets
-	var nonce [24]byte
-	copy(nonce[:], ciphertext)
-	outDH, ok := secretbox.Open(nil, ciphertext[24:32+24+secretbox.Overhead], &nonce, &derived)
-	if !ok {
-		panic("failed to verify mac of encapsulated key")
+	var ctDH DHKeyCiphertext
+	var ctPQ PQKeyCiphertext
+	copy(ctDH[:], ciphertext)
+	copy(ctPQ[:], ciphertext[len(ctDH):])
+
+	localPub := local.Public()
+	ad := ephemAD(remote, localPub)
+	outDH, err := openDH(&derived, ctDH, ad)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	outPQ, err := openPQ(&local.PrivkeyPQ, ctPQ, ad)
+	if err != nil {
+		return [32]byte{}, err
 	}
-
-	var outKyber []byte
-	local.PrivkeyPQ.DecryptTo(outKyber, ciphertext[32+24+secretbox.Overhead:])
 
 	// Derive shared secret
-	h := hmac.New(sha256.New, append(outDH[:], outKyber[:]...))
-	h.Write(EPHEM_HMAC)
-	var shared MessageKey
-	copy(shared[:], h.Sum(nil))
+	shared := ephemSecret(outDH, outPQ, ctDH, ctPQ, remote, localPub)
+	wipe(outDH[:])
+	wipe(outPQ[:])
+	return shared, nil
+}
 
-	return shared
+// ephemSecret combines the keys encapsulated by the initiator to the responder
+// into the shared secret, bound to the ciphertexts and both pubkeys
+func ephemSecret(encap DHKey, encapPQ PQKey, ctDH DHKeyCiphertext, ctPQ PQKeyCiphertext, initiator, responder *EphemPub) [32]byte {
+	i, r := new(bytes.Buffer), new(bytes.Buffer)
+	initiator.Marshal(i)
+	responder.Marshal(r)
+	return Combine(EPHEM_COMBINE_LABEL, encap, encapPQ, ctDH[:], ctPQ[:], i.Bytes(), r.Bytes())
 }
 
 // GenerateFingerprint takes a shared secret and the public values and turns
@@ -177,23 +259,39 @@ func GenerateFingerprint(local *EphemPriv, remote *EphemPub, secret []byte) stri
 		PubkeyPQ: local.PubkeyPQ,
 	}
 
+	// Both sides must hash the public values in the same order
+	localBuf := new(bytes.Buffer)
+	synthpub.Marshal(localBuf)
+	remoteBuf := new(bytes.Buffer)
+	remote.Marshal(remoteBuf)
+
+	first, second := localBuf.Bytes(), remoteBuf.Bytes()
+	if bytes.Compare(first, second) > 0 {
+		first, second = second, first
+	}
+
 	b := new(bytes.Buffer)
-	synthpub.Marshal(b)
-	remote.Marshal(b)
+	b.Write(first)
+	b.Write(second)
 	b.Write(secret)
 
 	hash := argon2.IDKey(b.Bytes(), EPHEM_FINGERPRINT_SALT, 1, 64*1024, 1, 15)
 
+	return digits(hash, 36, 4)
+}
+
+// digits turns a hash into n base-10 digits, in groups separated by spaces
+func digits(hash []byte, n, group int) string {
 	var out string
 	in := new(big.Int).SetBytes(hash)
-	for i := 0; i < 36; i++ {
+	for i := 0; i < n; i++ {
 		digit := new(big.Int).Mod(in, big.NewInt(10)).Int64()
 		in = new(big.Int).Div(in, big.NewInt(10))
 
 		out += fmt.Sprint(digit)
 
-		if i%4 == 3 {
-			// Add spaces every 4 digits
+		if i%group == group-1 {
+			// Add spaces every group of digits
 			out += " "
 		}
 	}
@@ -0,0 +1,114 @@
+package tungsten
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/cloudflare/circl/pke/kyber/kyber768"
+)
+
+// legacyEphem returns an ephem keypair in the layout from before suites
+func legacyEphem(t *testing.T) (priv, pub []byte) {
+	t.Helper()
+	var x x25519.Key
+	if _, err := rand.Read(x[:]); err != nil {
+		t.Fatal(err)
+	}
+	var xPub x25519.Key
+	x25519.KeyGen(&xPub, &x)
+
+	pk, sk, err := kyber768.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	skb := make([]byte, kyber768.PrivateKeySize)
+	sk.Pack(skb)
+	pkb := make([]byte, kyber768.PublicKeySize)
+	pk.Pack(pkb)
+
+	priv = append(append(x[:], skb...), pkb...)
+	pub = append(xPub[:], pkb...)
+	return priv, pub
+}
+
+func TestImportEphemLegacy(t *testing.T) {
+	legacyPriv, legacyPub := legacyEphem(t)
+	if len(legacyPriv) != EPHEM_PRIV_LEGACY_SIZE || len(legacyPub) != EPHEM_PUB_LEGACY_SIZE {
+		t.Fatal("legacy layout has the wrong size")
+	}
+
+	local, err := ImportEphemPriv(bytes.NewReader(legacyPriv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportEphemPub(bytes.NewReader(legacyPub)); err != nil {
+		t.Fatal(err)
+	}
+	if local.PubkeyPQ.Suite != SUITE_X25519_KYBER768_ED25519_DILITHIUM2 {
+		t.Fatal("legacy key isn't of the legacy suite")
+	}
+
+	// A legacy keypair agrees a secret with one of the default suite
+	remote, remotePub, err := GenEphem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, secret, err := GenerateSharedSecret(remote, local.Public())
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := ReceiveSharedSecret(local, remotePub, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if received != secret {
+		t.Fatal("secrets differ")
+	}
+
+	// Keys written with their suites are read back, and must be consumed exactly
+	b := new(bytes.Buffer)
+	remote.Marshal(b)
+	if _, err := ImportEphemPriv(bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportEphemPriv(bytes.NewReader(append(b.Bytes(), 0))); err == nil {
+		t.Fatal("accepted trailing bytes")
+	}
+}
+
+// Each side passes its own keys as local, so the fingerprint must not depend on
+// which side computes it
+func TestFingerprintSymmetric(t *testing.T) {
+	alice, alicePub, err := GenEphem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, bobPub, err := GenEphem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciphertext, secret, err := GenerateSharedSecret(alice, bobPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := ReceiveSharedSecret(bob, alicePub, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fingerprint := GenerateFingerprint(alice, bobPub, secret[:])
+	if GenerateFingerprint(bob, alicePub, received[:]) != fingerprint {
+		t.Fatal("sides compute different fingerprints")
+	}
+
+	// A different key on either side changes it
+	_, otherPub, err := GenEphem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if GenerateFingerprint(alice, otherPub, secret[:]) == fingerprint {
+		t.Fatal("fingerprint doesn't depend on the remote key")
+	}
+}
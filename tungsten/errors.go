@@ -0,0 +1,71 @@
+package tungsten
+
+import (
+	"io"
+)
+
+// Error is the type of every error returned by tungsten. Code is a stable
+// identifier, which is passed through to js.
+type Error struct {
+	Code string
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return "tungsten: " + e.Msg
+}
+
+var (
+	ErrBadSignature     = &Error{"bad_signature", "failed to verify signature"}
+	ErrMACFailure       = &Error{"mac_failure", "failed to verify mac"}
+	ErrTruncated        = &Error{"truncated", "input is truncated or malformed"}
+	ErrUnknownSender    = &Error{"unknown_sender", "couldn't find rx for sender"}
+	ErrUnknownRatchet   = &Error{"unknown_ratchet", "couldn't find ratchet for that ratchet id"}
+	ErrUnknownMsgType   = &Error{"unknown_msg_type", "unknown message type"}
+	ErrDuplicate        = &Error{"duplicate", "message is a duplicate or its key has expired"}
+	ErrTooManySkipped   = &Error{"too_many_skipped", "message skips too many message keys"}
+	ErrFutureEpoch      = &Error{"future_epoch", "message is from a ratchet update that hasn't been received"}
+	ErrRandom           = &Error{"random", "failed to read random bytes"}
+	ErrInvalidArg       = &Error{"invalid_argument", "invalid argument"}
+	ErrCorruptExport    = &Error{"corrupt_export", "export is corrupt"}
+	ErrUnsupported      = &Error{"unsupported", "unsupported version or algorithm suite"}
+	ErrBadPassphrase    = &Error{"bad_passphrase", "wrong passphrase or corrupt export"}
+	ErrDuplicateMember  = &Error{"duplicate_member", "user is already a member"}
+	ErrUnknownMember    = &Error{"unknown_member", "user isn't a member"}
+	ErrDuplicateRatchet = &Error{"duplicate_ratchet", "ratchet already exists"}
+	ErrOtherDevice      = &Error{"other_device", "ratchet belongs to another of our devices"}
+	ErrOwnMessage       = &Error{"own_message", "message was sent by us"}
+	ErrUnknownSession   = &Error{"unknown_session", "no session for key material"}
+	ErrBadPadding       = &Error{"bad_padding", "message padding is malformed"}
+	ErrSafetyMismatch   = &Error{"safety_mismatch", "safety code doesn't match the identities"}
+	ErrDestroyed        = &Error{"destroyed", "session has been destroyed"}
+	ErrHandshakeState   = &Error{"handshake_state", "handshake step is out of order, or the handshake failed"}
+	ErrUpdatePending    = &Error{"update_pending", "session must send a ratchet update before sending messages"}
+)
+
+// errReader wraps a reader and remembers the first error, so that a sequence
+// of reads only needs to be checked once at the end.
+type errReader struct {
+	r   io.Reader
+	err error
+}
+
+func (e *errReader) Read(b []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+
+	n, err := io.ReadFull(e.r, b)
+	if err != nil {
+		e.err = ErrTruncated
+	}
+	return n, e.err
+}
+
+// readRandom fills b from r, returning ErrRandom if it can't
+func readRandom(r io.Reader, b []byte) error {
+	if _, err := io.ReadFull(r, b); err != nil {
+		return ErrRandom
+	}
+	return nil
+}
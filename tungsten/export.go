@@ -0,0 +1,241 @@
+package tungsten
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/cloudflare/circl/sign/ed25519"
+)
+
+// Exports are a self-describing container, see "Export format" in
+// /design/encryption.adoc. New fields should be added as new sections, so that
+// older versions can skip over them.
+//
+// Version 2 writes each post-quantum key with its suite, see suite.go. Version
+// 1 exports are still read, and their keys are all of the legacy suite.
+
+var EXPORT_MAGIC = []byte("TNGS")
+
+const EXPORT_VERSION = 2
+
+const (
+	EXPORT_KIND_TX = 0x01
+	EXPORT_KIND_RX = 0x02
+)
+
+const (
+	EXPORT_SECTION_IDENTITY    = 0x0001
+	EXPORT_SECTION_RATCHETS    = 0x0002
+	EXPORT_SECTION_KEYS        = 0x0003
+	EXPORT_SECTION_SKIPPED     = 0x0004
+	EXPORT_SECTION_CHILD       = 0x0005
+	EXPORT_SECTION_PREV_KEYS   = 0x0006
+	EXPORT_SECTION_RECIPIENTS  = 0x0007
+	EXPORT_SECTION_DEVICES     = 0x0008
+	EXPORT_SECTION_HEADER      = 0x0009
+	EXPORT_SECTION_PADDING     = 0x000A
+	EXPORT_SECTION_UPDATED     = 0x000B
+	EXPORT_SECTION_KEY_HISTORY = 0x000C
+	EXPORT_SECTION_TREE        = 0x000D
+	EXPORT_SECTION_POLICY      = 0x000E
+	EXPORT_SECTION_RETIRED     = 0x000F
+)
+
+// Length of magic, version, suite and kind. The suite is of the session's
+// signing keys.
+const exportHeaderSize = 4 + 2 + 2 + 1
+
+type exportWriter struct {
+	buf bytes.Buffer
+}
+
+func newExport(kind byte, suite Suite) *exportWriter {
+	e := new(exportWriter)
+	e.buf.Write(EXPORT_MAGIC)
+	binary.Write(&e.buf, binary.BigEndian, uint16(EXPORT_VERSION))
+	binary.Write(&e.buf, binary.BigEndian, suite)
+	e.buf.WriteByte(kind)
+	return e
+}
+
+// section writes a length-prefixed section, with the body written by f
+func (e *exportWriter) section(tag uint16, f func(w io.Writer)) {
+	body := new(bytes.Buffer)
+	f(body)
+
+	binary.Write(&e.buf, binary.BigEndian, tag)
+	binary.Write(&e.buf, binary.BigEndian, uint32(body.Len()))
+	e.buf.Write(body.Bytes())
+}
+
+// finish appends the checksum and writes the export to w
+func (e *exportWriter) finish(w io.Writer) error {
+	sum := sha256.Sum256(e.buf.Bytes())
+	e.buf.Write(sum[:])
+
+	_, err := w.Write(e.buf.Bytes())
+	return err
+}
+
+type exportSection struct {
+	Tag  uint16
+	Body []byte
+}
+
+// isExport returns whether b is a versioned export, rather than the
+// unversioned layout. (A legacy export starts with a random UUID, so could
+// only collide with the magic with negligible probability.)
+func isExport(b []byte) bool {
+	return len(b) >= len(EXPORT_MAGIC) && bytes.Equal(b[:len(EXPORT_MAGIC)], EXPORT_MAGIC)
+}
+
+// readExport verifies an export and splits it into its sections, returning
+// its version
+func readExport(b []byte, kind byte) (uint16, []exportSection, error) {
+	if len(b) < exportHeaderSize+sha256.Size || !isExport(b) {
+		return 0, nil, ErrTruncated
+	}
+
+	body := b[:len(b)-sha256.Size]
+	sum := sha256.Sum256(body)
+	if !bytes.Equal(sum[:], b[len(b)-sha256.Size:]) {
+		return 0, nil, ErrCorruptExport
+	}
+
+	version := binary.BigEndian.Uint16(body[4:])
+	suite := Suite(binary.BigEndian.Uint16(body[6:]))
+	switch {
+	case version == 1 && suite.legacy():
+	case version == EXPORT_VERSION && suite.valid():
+	default:
+		return 0, nil, ErrUnsupported
+	}
+	if body[8] != kind {
+		return 0, nil, ErrCorruptExport
+	}
+
+	var sections []exportSection
+	body = body[exportHeaderSize:]
+	for len(body) > 0 {
+		if len(body) < 6 {
+			return 0, nil, ErrTruncated
+		}
+
+		tag := binary.BigEndian.Uint16(body)
+		l := binary.BigEndian.Uint32(body[2:])
+		body = body[6:]
+		if uint64(len(body)) < uint64(l) {
+			return 0, nil, ErrTruncated
+		}
+
+		sections = append(sections, exportSection{Tag: tag, Body: body[:l]})
+		body = body[l:]
+	}
+
+	return version, sections, nil
+}
+
+// importTxLegacy reads the unversioned layout of a tx session, which must
+// consume the input exactly. It has no header key, so one is generated, and
+// members only receive it with our next update.
+func importTxLegacy(b []byte) (*TxSession, error) {
+	i := bytes.NewReader(b)
+	t := &TxSession{Policy: DefaultUpdatePolicy, Skipped: make(SkippedKeys)}
+	r := &errReader{r: i}
+
+	r.Read(t.UUID[:])
+
+	t.SigningKey = make(ed25519.PrivateKey, ed25519.PrivateKeySize)
+	r.Read(t.SigningKey)
+	readPQ(r, true, &t.SigningKeyPQ)
+
+	var ratchetCount int64
+	binary.Read(r, binary.BigEndian, &ratchetCount)
+	for i := int64(0); i < ratchetCount && r.err == nil; i++ {
+		t.Ratchets = append(t.Ratchets, importRatchetLegacy(r))
+	}
+
+	r.Read(t.CurrentPrivkey[:])
+	readPQ(r, true, &t.CurrentPrivkeyPQ)
+	readPQ(r, true, &t.CurrentPubkeyPQ)
+
+	var childrenCount int64
+	binary.Read(r, binary.BigEndian, &childrenCount)
+	for i := int64(0); i < childrenCount && r.err == nil; i++ {
+		rx, err := importRxLegacyFrom(r)
+		if err != nil {
+			return nil, err
+		}
+		rx.Parent = t
+		t.Children = append(t.Children, rx)
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+	if i.Len() != 0 {
+		return nil, ErrCorruptExport
+	}
+
+	if err := t.migrateHeaderKey(); err != nil {
+		return nil, err
+	}
+	t.stampUpdated()
+	return t, nil
+}
+
+// importRxLegacy reads the unversioned layout of an rx session, which must
+// consume the input exactly
+func importRxLegacy(b []byte) (*RxSession, error) {
+	i := bytes.NewReader(b)
+	r, err := importRxLegacyFrom(i)
+	if err != nil {
+		return nil, err
+	}
+	if i.Len() != 0 {
+		return nil, ErrCorruptExport
+	}
+	return r, nil
+}
+
+func importRxLegacyFrom(i io.Reader) (*RxSession, error) {
+	r := &RxSession{Skipped: make(SkippedKeys)}
+	er := &errReader{r: i}
+
+	er.Read(r.UUID[:])
+
+	r.VerifyingPubkey = make(ed25519.PublicKey, ed25519.PublicKeySize)
+	er.Read(r.VerifyingPubkey)
+	readPQ(er, true, &r.VerifyingPubkeyPQ)
+
+	var ratchetCount int64
+	binary.Read(er, binary.BigEndian, &ratchetCount)
+	for j := int64(0); j < ratchetCount && er.err == nil; j++ {
+		r.Ratchets = append(r.Ratchets, importRatchetLegacy(er))
+	}
+
+	er.Read(r.CurrentPubkey[:])
+	readPQ(er, true, &r.CurrentPubkeyPQ)
+
+	if er.err != nil {
+		return nil, er.err
+	}
+	return r, nil
+}
+
+func importRatchetLegacy(r io.Reader) *Ratchet {
+	rat := new(Ratchet)
+	r.Read(rat.UUID[:])
+
+	var symChain ChainKey
+	r.Read(symChain[:])
+	rat.Symmetric = NewSymRatchet(symChain)
+
+	var rootChain ChainKey
+	r.Read(rootChain[:])
+	rat.Root = NewRootRatchet(rootChain)
+
+	return rat
+}
@@ -0,0 +1,145 @@
+package tungsten
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// The fixtures in testdata are a pair of sessions that are members of each
+// other's group, exported by earlier versions: unversioned_* by the layout
+// before the export format, and v1_* by version 1 of the format, whose keys are
+// of the legacy suite.
+
+func testImport(t *testing.T, name string) *TxSession {
+	t.Helper()
+	b, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tx, err := ImportTx(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return tx
+}
+
+// testReexport exports and imports a session
+func testReexport(t *testing.T, tx *TxSession) *TxSession {
+	t.Helper()
+	b := new(bytes.Buffer)
+	if err := tx.Export(b); err != nil {
+		t.Fatal(err)
+	}
+	if v := binary.BigEndian.Uint16(b.Bytes()[len(EXPORT_MAGIC):]); v != EXPORT_VERSION {
+		t.Fatalf("exported version %d, want %d", v, EXPORT_VERSION)
+	}
+	out, err := ImportTx(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestImportUnversioned(t *testing.T) {
+	alice, bob := testImport(t, "unversioned_alice.bin"), testImport(t, "unversioned_bob.bin")
+	if len(alice.Children) != 1 || alice.Children[0].UUID != bob.UUID {
+		t.Fatal("alice doesn't have bob's rx session")
+	}
+
+	// Members don't have a header key for the session yet, so it must send an
+	// update before data, including after another export
+	if !alice.HeaderPending || alice.UpdateDue()&UPDATE_DUE_HEADER == 0 {
+		t.Fatal("header key isn't pending")
+	}
+	alice = testReexport(t, alice)
+	if !alice.HeaderPending {
+		t.Fatal("header key pending was lost by the export")
+	}
+	if err := alice.SendMessage(uuid.Nil, []byte("too early"), new(bytes.Buffer)); err != ErrUpdatePending {
+		t.Fatalf("got %v, want ErrUpdatePending", err)
+	}
+
+	testReceive(t, bob, testUpdate(t, alice), "")
+	if alice.HeaderPending {
+		t.Fatal("header key is still pending after the update")
+	}
+	testReceive(t, bob, testSend(t, alice, "hello bob"), "hello bob")
+
+	testReceive(t, alice, testUpdate(t, bob), "")
+	testReceive(t, alice, testSend(t, bob, "hello alice"), "hello alice")
+}
+
+func TestImportVersion1(t *testing.T) {
+	alice, bob := testImport(t, "v1_alice.bin"), testImport(t, "v1_bob.bin")
+	if alice.SigningKeyPQ.Suite != SUITE_X25519_KYBER768_ED25519_DILITHIUM2 || alice.CurrentPubkeyPQ.Suite != SUITE_X25519_KYBER768_ED25519_DILITHIUM2 {
+		t.Fatal("version 1 keys aren't of the legacy suite")
+	}
+
+	alice, bob = testReexport(t, alice), testReexport(t, bob)
+	testReceive(t, bob, testSend(t, alice, "hello bob"), "hello bob")
+
+	// An update moves the KEM keypair to the default suite
+	testReceive(t, bob, testUpdate(t, alice), "")
+	if alice.CurrentPubkeyPQ.Suite != DEFAULT_SUITE || bob.child(alice.UUID).CurrentPubkeyPQ.Suite != DEFAULT_SUITE {
+		t.Fatal("update didn't move the keypair to the default suite")
+	}
+	testReceive(t, bob, testSend(t, alice, "after update"), "after update")
+	testReceive(t, alice, testSend(t, bob, "hello alice"), "hello alice")
+}
+
+func TestImportCorrupt(t *testing.T) {
+	alice, _ := testPair(t)
+	b := new(bytes.Buffer)
+	if err := alice.Export(b); err != nil {
+		t.Fatal(err)
+	}
+	export := b.Bytes()
+
+	flipped := append([]byte(nil), export...)
+	flipped[exportHeaderSize+10] ^= 1
+	if _, err := ImportTx(bytes.NewReader(flipped)); err != ErrCorruptExport {
+		t.Fatalf("flipped: got %v, want ErrCorruptExport", err)
+	}
+	if _, err := ImportTx(bytes.NewReader(export[:exportHeaderSize])); err != ErrTruncated {
+		t.Fatalf("truncated: got %v, want ErrTruncated", err)
+	}
+	if _, err := ImportRx(bytes.NewReader(export)); err != ErrCorruptExport {
+		t.Fatalf("wrong kind: got %v, want ErrCorruptExport", err)
+	}
+
+	// The unversioned layout must be consumed exactly
+	legacy, err := os.ReadFile(filepath.Join("testdata", "unversioned_alice.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ImportTx(bytes.NewReader(append(legacy, 0))); err == nil {
+		t.Fatal("accepted trailing bytes")
+	}
+	if _, err := ImportTx(bytes.NewReader(legacy[:len(legacy)-1])); err == nil {
+		t.Fatal("accepted a truncated session")
+	}
+}
+
+func TestExportDeterministic(t *testing.T) {
+	alice, bob := testPair(t)
+	for i := 0; i < 10; i++ {
+		testSend(t, alice, "skipped")
+	}
+	testReceive(t, bob, testSend(t, alice, "latest"), "latest")
+
+	a, b := new(bytes.Buffer), new(bytes.Buffer)
+	if err := bob.Export(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.Export(b); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a.Bytes(), b.Bytes()) {
+		t.Fatal("exports of the same session differ")
+	}
+}
@@ -1,13 +1,13 @@
 module carbide/tungsten
 
-go 1.18
+go 1.22.0
 
 require (
 	github.com/google/uuid v1.3.0
-	golang.org/x/crypto v0.3.1-0.20221117191849-2c476679df9a
+	golang.org/x/crypto v0.11.1-0.20230711161743-2e82bdd1719d
 )
 
 require (
-	github.com/cloudflare/circl v1.3.3
-	golang.org/x/sys v0.3.0 // indirect
+	github.com/cloudflare/circl v1.5.0
+	golang.org/x/sys v0.10.0 // indirect
 )
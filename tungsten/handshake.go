@@ -0,0 +1,502 @@
+package tungsten
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"hash"
+	"io"
+
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/cloudflare/circl/sign/ed25519"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/sha3"
+)
+
+// An ephem handshake agrees on a shared secret for session initiation, in
+// three messages:
+//
+//  1. The responder sends a hello with its ephem pubkey
+//  2. The initiator encapsulates a shared secret to it, and sends an init with
+//     its own ephem pubkey, the ciphertext and a proof
+//  3. The responder opens the secret, checks the proof, and sends a finish
+//     with a proof of its own
+//
+// Every message is hashed into a transcript. A proof is a MAC of the
+// transcript, keyed by the shared secret, so each side confirms that the
+// other derived the same secret from the same messages. If both parties
+// already share a guild, the handshake can be bound to their identities: each
+// proof is then also signed with the sender's signing keys, which the other
+// checks with the verifying keys of its rx session, and the comparison of
+// fingerprints isn't needed.
+
+// Types of handshake messages. They aren't sent to a group, so are separate
+// from MSG_TYPE_*.
+const (
+	HANDSHAKE_HELLO  = 0x01
+	HANDSHAKE_INIT   = 0x02
+	HANDSHAKE_FINISH = 0x03
+)
+
+var HANDSHAKE_TRANSCRIPT_LABEL = []byte("tungsten_handshake")
+var HANDSHAKE_INITIATOR_LABEL = []byte("tungsten_handshake_initiator")
+var HANDSHAKE_RESPONDER_LABEL = []byte("tungsten_handshake_responder")
+var HANDSHAKE_SECRET_INFO = []byte("tungsten_handshake_secret")
+
+// States of a handshake
+const (
+	handshakeStart = iota
+	handshakeHelloSent
+	handshakeInitSent
+	handshakeDone
+	handshakeFailed
+)
+
+// Sent by the responder
+type HandshakeHello struct {
+	Identity uuid.UUID // The responder's UUID, or nil if not bound to identities
+	Pub      EphemPub
+}
+
+func (m *HandshakeHello) Marshal(w io.Writer) {
+	w.Write([]byte{HANDSHAKE_HELLO})
+	w.Write(m.Identity[:])
+	m.Pub.Marshal(w)
+}
+
+func (m *HandshakeHello) Unmarshal(i io.Reader) error {
+	r := &errReader{r: i}
+	if err := readHandshakeType(r, HANDSHAKE_HELLO); err != nil {
+		return err
+	}
+	r.Read(m.Identity[:])
+	if r.err != nil {
+		return r.err
+	}
+	return m.Pub.Unmarshal(i)
+}
+
+// Sent by the initiator
+type HandshakeInit struct {
+	Identity     uuid.UUID // The initiator's UUID, or nil if not bound to identities
+	Pub          EphemPub
+	Ciphertext   DHKeyCiphertext
+	CiphertextPQ PQKeyCiphertext
+	Proof        HandshakeProof
+}
+
+// marshalBody writes every field before the proof
+func (m *HandshakeInit) marshalBody(w io.Writer) {
+	w.Write([]byte{HANDSHAKE_INIT})
+	w.Write(m.Identity[:])
+	m.Pub.Marshal(w)
+	w.Write(m.Ciphertext[:])
+	w.Write(m.CiphertextPQ[:])
+}
+
+func (m *HandshakeInit) Marshal(w io.Writer) {
+	m.marshalBody(w)
+	m.Proof.Marshal(w)
+}
+
+func (m *HandshakeInit) Unmarshal(i io.Reader) error {
+	r := &errReader{r: i}
+	if err := readHandshakeType(r, HANDSHAKE_INIT); err != nil {
+		return err
+	}
+	r.Read(m.Identity[:])
+	if r.err != nil {
+		return r.err
+	}
+	if err := m.Pub.Unmarshal(i); err != nil {
+		return err
+	}
+	r.Read(m.Ciphertext[:])
+	r.Read(m.CiphertextPQ[:])
+	if r.err != nil {
+		return r.err
+	}
+	return m.Proof.Unmarshal(i)
+}
+
+// Sent by the responder
+type HandshakeFinish struct {
+	Proof HandshakeProof
+}
+
+func (m *HandshakeFinish) Marshal(w io.Writer) {
+	w.Write([]byte{HANDSHAKE_FINISH})
+	m.Proof.Marshal(w)
+}
+
+func (m *HandshakeFinish) Unmarshal(i io.Reader) error {
+	r := &errReader{r: i}
+	if err := readHandshakeType(r, HANDSHAKE_FINISH); err != nil {
+		return err
+	}
+	return m.Proof.Unmarshal(i)
+}
+
+// Part of HandshakeInit and HandshakeFinish. The signatures are only present
+// if the handshake is bound to identities.
+type HandshakeProof struct {
+	Signed      bool
+	Suite       Suite // Of the signatures
+	Signature   ECSignature
+	SignaturePQ PQSignature
+	Confirm     [32]byte // MAC of the transcript, up to and including the signatures
+}
+
+// marshalSignatures writes every field before Confirm
+func (p *HandshakeProof) marshalSignatures(w io.Writer) {
+	if !p.Signed {
+		w.Write([]byte{0})
+		return
+	}
+
+	w.Write([]byte{1})
+	binary.Write(w, binary.BigEndian, p.Suite)
+	w.Write(p.Signature[:])
+	w.Write(p.SignaturePQ[:])
+}
+
+func (p *HandshakeProof) Marshal(w io.Writer) {
+	p.marshalSignatures(w)
+	w.Write(p.Confirm[:])
+}
+
+func (p *HandshakeProof) Unmarshal(i io.Reader) error {
+	r := &errReader{r: i}
+	var signed [1]byte
+	r.Read(signed[:])
+	if r.err == nil && signed[0] > 1 {
+		return ErrTruncated
+	}
+
+	p.Signed = signed[0] == 1
+	if p.Signed {
+		p.Suite = readSuite(r)
+		r.Read(p.Signature[:])
+		r.Read(p.SignaturePQ[:])
+	}
+	r.Read(p.Confirm[:])
+	return r.err
+}
+
+func readHandshakeType(r *errReader, want byte) error {
+	var t [1]byte
+	r.Read(t[:])
+	if r.err != nil {
+		return r.err
+	}
+	if t[0] != want {
+		return ErrUnknownMsgType
+	}
+	return nil
+}
+
+// A handshake in progress, from either side. See NewHandshake.
+type Handshake struct {
+	config *Config
+	state  int
+
+	// Only set if bound to identities
+	tx   *TxSession
+	peer *RxSession
+
+	local      *EphemPriv
+	remote     *EphemPub
+	transcript hash.Hash
+	shared     [32]byte // From the ephem keys
+	secret     [32]byte // Derived from shared and the whole transcript
+}
+
+// NewHandshake starts a handshake, which is bound to identities if tx is set:
+// our proofs are signed with its signing keys, and the other party must be
+// the member peer of its group. Either side may start it, which is decided by
+// whether Hello or Initiate is called first.
+func NewHandshake(tx *TxSession, peer uuid.UUID) (*Handshake, error) {
+	return new(Config).NewHandshake(tx, peer)
+}
+
+// NewHandshake starts a handshake with the config's random source and suite
+func (c *Config) NewHandshake(tx *TxSession, peer uuid.UUID) (*Handshake, error) {
+	h := &Handshake{config: c, transcript: sha3.New256()}
+	h.transcript.Write(HANDSHAKE_TRANSCRIPT_LABEL)
+
+	if tx != nil {
+		if tx.destroyed {
+			return nil, ErrDestroyed
+		}
+		h.tx = tx
+		h.peer = tx.child(peer)
+		if h.peer == nil {
+			return nil, ErrUnknownMember
+		}
+	}
+
+	var err error
+	h.local, _, err = c.GenEphem()
+	if err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// identity returns the UUID we send, which is nil if not bound to identities
+func (h *Handshake) identity() uuid.UUID {
+	if h.tx == nil {
+		return uuid.Nil
+	}
+	return h.tx.UUID
+}
+
+// checkIdentity checks that the other party sent the identity we expect
+func (h *Handshake) checkIdentity(id uuid.UUID) error {
+	want := uuid.Nil
+	if h.peer != nil {
+		want = h.peer.UUID
+	}
+	if id != want {
+		return ErrUnknownSender
+	}
+	return nil
+}
+
+// Hello writes the hello, as the responder
+func (h *Handshake) Hello(w io.Writer) error {
+	if h.state != handshakeStart {
+		return ErrHandshakeState
+	}
+
+	m := &HandshakeHello{Identity: h.identity(), Pub: *h.local.Public()}
+	b := new(bytes.Buffer)
+	m.Marshal(b)
+	h.transcript.Write(b.Bytes())
+
+	h.state = handshakeHelloSent
+	_, err := b.WriteTo(w)
+	return err
+}
+
+// Initiate reads the responder's hello, and writes the init, as the initiator
+func (h *Handshake) Initiate(hello []byte, w io.Writer) error {
+	if h.state != handshakeStart {
+		return ErrHandshakeState
+	}
+
+	m := new(HandshakeHello)
+	if err := m.Unmarshal(bytes.NewReader(hello)); err != nil {
+		return h.fail(err)
+	}
+	if err := h.checkIdentity(m.Identity); err != nil {
+		return h.fail(err)
+	}
+	h.transcript.Write(hello)
+	h.remote = &m.Pub
+
+	ct, shared, err := h.config.GenerateSharedSecret(h.local, h.remote)
+	if err != nil {
+		return h.fail(err)
+	}
+	h.shared = shared
+
+	init := &HandshakeInit{Identity: h.identity(), Pub: *h.local.Public()}
+	copy(init.Ciphertext[:], ct)
+	copy(init.CiphertextPQ[:], ct[len(init.Ciphertext):])
+	init.marshalBody(h.transcript)
+	if err := h.prove(&init.Proof, HANDSHAKE_INITIATOR_LABEL); err != nil {
+		return h.fail(err)
+	}
+
+	h.state = handshakeInitSent
+	b := new(bytes.Buffer)
+	init.Marshal(b)
+	_, err = b.WriteTo(w)
+	return err
+}
+
+// Respond reads the initiator's init, and writes the finish, as the
+// responder. The handshake is complete once it returns without error.
+func (h *Handshake) Respond(init []byte, w io.Writer) error {
+	if h.state != handshakeHelloSent {
+		return ErrHandshakeState
+	}
+
+	m := new(HandshakeInit)
+	if err := m.Unmarshal(bytes.NewReader(init)); err != nil {
+		return h.fail(err)
+	}
+	if err := h.checkIdentity(m.Identity); err != nil {
+		return h.fail(err)
+	}
+	h.remote = &m.Pub
+
+	ct := append(m.Ciphertext[:], m.CiphertextPQ[:]...)
+	shared, err := ReceiveSharedSecret(h.local, h.remote, ct)
+	if err != nil {
+		return h.fail(err)
+	}
+	h.shared = shared
+
+	m.marshalBody(h.transcript)
+	if err := h.check(&m.Proof, HANDSHAKE_INITIATOR_LABEL); err != nil {
+		return h.fail(err)
+	}
+
+	finish := new(HandshakeFinish)
+	h.transcript.Write([]byte{HANDSHAKE_FINISH})
+	if err := h.prove(&finish.Proof, HANDSHAKE_RESPONDER_LABEL); err != nil {
+		return h.fail(err)
+	}
+	if err := h.complete(); err != nil {
+		return h.fail(err)
+	}
+
+	b := new(bytes.Buffer)
+	finish.Marshal(b)
+	_, err = b.WriteTo(w)
+	return err
+}
+
+// Finish reads the responder's finish, as the initiator. The handshake is
+// complete once it returns without error.
+func (h *Handshake) Finish(finish []byte) error {
+	if h.state != handshakeInitSent {
+		return ErrHandshakeState
+	}
+
+	m := new(HandshakeFinish)
+	if err := m.Unmarshal(bytes.NewReader(finish)); err != nil {
+		return h.fail(err)
+	}
+
+	h.transcript.Write([]byte{HANDSHAKE_FINISH})
+	if err := h.check(&m.Proof, HANDSHAKE_RESPONDER_LABEL); err != nil {
+		return h.fail(err)
+	}
+	if err := h.complete(); err != nil {
+		return h.fail(err)
+	}
+	return nil
+}
+
+// Secret returns the shared secret of a complete handshake, which is used for
+// session initiation (see TxSession.Introduce)
+func (h *Handshake) Secret() ([32]byte, error) {
+	if h.state != handshakeDone {
+		return [32]byte{}, ErrHandshakeState
+	}
+	return h.secret, nil
+}
+
+// Fingerprint returns the fingerprint of a complete handshake, for comparison
+// by the users if it isn't bound to identities. See GenerateFingerprint.
+func (h *Handshake) Fingerprint() (string, error) {
+	if h.state != handshakeDone {
+		return "", ErrHandshakeState
+	}
+	return GenerateFingerprint(h.local, h.remote, h.secret[:]), nil
+}
+
+// Destroy zeroes the keys of the handshake. It can't be used afterwards.
+func (h *Handshake) Destroy() {
+	wipe(h.local.Privkey[:])
+	wipe(h.local.PrivkeyPQ.Key)
+	wipe(h.shared[:])
+	wipe(h.secret[:])
+	h.state = handshakeFailed
+}
+
+// fail destroys the handshake after an error, so that it can't be continued
+func (h *Handshake) fail(err error) error {
+	h.Destroy()
+	return err
+}
+
+// confirmKey derives the key of the MAC in a proof from the shared secret
+func (h *Handshake) confirmKey(label []byte) ([32]byte, error) {
+	return deriveKey((*x25519.Key)(&h.shared), label)
+}
+
+// confirm returns the MAC of the transcript so far
+func (h *Handshake) confirm(label []byte) ([32]byte, error) {
+	key, err := h.confirmKey(label)
+	if err != nil {
+		return [32]byte{}, err
+	}
+
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(h.transcript.Sum(nil))
+	wipe(key[:])
+
+	var out [32]byte
+	copy(out[:], mac.Sum(nil))
+	return out, nil
+}
+
+// signed returns what the signatures of a proof are over: the transcript so
+// far, labelled with the side that signs it
+func (h *Handshake) signed(label []byte) []byte {
+	return append(append([]byte(nil), label...), h.transcript.Sum(nil)...)
+}
+
+// prove writes our proof of the transcript so far, and adds it to the
+// transcript
+func (h *Handshake) prove(p *HandshakeProof, label []byte) error {
+	if h.tx != nil {
+		msg := h.signed(label)
+		p.Signed = true
+		p.Suite = h.tx.SigningKeyPQ.Suite
+		copy(p.Signature[:], ed25519.Sign(h.tx.SigningKey, msg))
+		h.tx.SigningKeyPQ.sign(msg, p.SignaturePQ[:])
+	}
+	p.marshalSignatures(h.transcript)
+
+	var err error
+	p.Confirm, err = h.confirm(label)
+	if err != nil {
+		return err
+	}
+	h.transcript.Write(p.Confirm[:])
+	return nil
+}
+
+// check checks the other party's proof of the transcript so far, and adds it
+// to the transcript
+func (h *Handshake) check(p *HandshakeProof, label []byte) error {
+	if p.Signed != (h.peer != nil) {
+		return ErrBadSignature
+	}
+	if p.Signed {
+		msg := h.signed(label)
+		if !verifySignatures(h.peer.VerifyingPubkey, &h.peer.VerifyingPubkeyPQ, p.Suite, msg, p.Signature[:], p.SignaturePQ[:]) {
+			return ErrBadSignature
+		}
+	}
+	p.marshalSignatures(h.transcript)
+
+	want, err := h.confirm(label)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(want[:], p.Confirm[:]) {
+		return ErrMACFailure
+	}
+	h.transcript.Write(p.Confirm[:])
+	return nil
+}
+
+// complete derives the secret from the shared secret and the whole transcript
+func (h *Handshake) complete() error {
+	r := hkdf.New(sha256.New, h.shared[:], h.transcript.Sum(nil), HANDSHAKE_SECRET_INFO)
+	if _, err := io.ReadFull(r, h.secret[:]); err != nil {
+		return err
+	}
+
+	wipe(h.shared[:])
+	h.state = handshakeDone
+	return nil
+}
@@ -0,0 +1,286 @@
+package tungsten
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// Steps of a handshake, for tampering with the message each one reads
+const (
+	testStepInitiate = iota
+	testStepRespond
+	testStepFinish
+)
+
+// testHandshake runs a handshake, passing each message through tamper before
+// it is read, and returns the first error
+func testHandshake(t *testing.T, initiator, responder *Handshake, tamper func(step int, msg []byte) []byte) error {
+	t.Helper()
+	if tamper == nil {
+		tamper = func(step int, msg []byte) []byte { return msg }
+	}
+
+	hello := new(bytes.Buffer)
+	if err := responder.Hello(hello); err != nil {
+		t.Fatal(err)
+	}
+	init := new(bytes.Buffer)
+	if err := initiator.Initiate(tamper(testStepInitiate, hello.Bytes()), init); err != nil {
+		return err
+	}
+	finish := new(bytes.Buffer)
+	if err := responder.Respond(tamper(testStepRespond, init.Bytes()), finish); err != nil {
+		return err
+	}
+	return initiator.Finish(tamper(testStepFinish, finish.Bytes()))
+}
+
+// testHandshakes returns the two sides of a handshake, bound to the identities
+// of alice and bob if they are set
+func testHandshakes(t *testing.T, alice, bob *TxSession) (*Handshake, *Handshake) {
+	t.Helper()
+	var aliceID, bobID uuid.UUID
+	if alice != nil && bob != nil {
+		aliceID, bobID = alice.UUID, bob.UUID
+	}
+	initiator, err := NewHandshake(alice, bobID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder, err := NewHandshake(bob, aliceID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return initiator, responder
+}
+
+func TestHandshake(t *testing.T) {
+	alice, bob := testPair(t)
+	for _, bound := range []bool{false, true} {
+		initiator, responder := testHandshakes(t, nil, nil)
+		if bound {
+			initiator, responder = testHandshakes(t, alice, bob)
+		}
+		if err := testHandshake(t, initiator, responder, nil); err != nil {
+			t.Fatalf("bound %v: %v", bound, err)
+		}
+
+		secret, err := initiator.Secret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := responder.Secret()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if secret != other || secret == [32]byte{} {
+			t.Fatalf("bound %v: sides agreed on different secrets", bound)
+		}
+
+		fingerprint, err := initiator.Fingerprint()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if other, _ := responder.Fingerprint(); other != fingerprint {
+			t.Fatalf("bound %v: sides show different fingerprints", bound)
+		}
+
+		// The secret can be used for session initiation
+		carol, err := GenTx(uuid.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		intro := new(bytes.Buffer)
+		if err := carol.Introduce(secret, intro); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := alice.CreateUser(other, intro.Bytes(), new(bytes.Buffer)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestHandshakeTampered(t *testing.T) {
+	alice, bob := testPair(t)
+	flip := func(i int) func(msg []byte) []byte {
+		return func(msg []byte) []byte {
+			msg[(i+len(msg))%len(msg)] ^= 1
+			return msg
+		}
+	}
+	tests := []struct {
+		name   string
+		bound  bool
+		step   int
+		tamper func(msg []byte) []byte
+		err    error
+	}{
+		{"hello type", false, testStepInitiate, flip(0), ErrUnknownMsgType},
+		{"hello pubkey", false, testStepInitiate, flip(1 + 16 + 1), ErrMACFailure},
+		{"init type", false, testStepRespond, flip(0), ErrUnknownMsgType},
+		{"init pubkey", false, testStepRespond, flip(1 + 16 + 1), ErrMACFailure},
+		{"init ciphertext", false, testStepRespond, flip(-1 - 32 - 1), ErrMACFailure},
+		{"init confirmation", false, testStepRespond, flip(-1), ErrMACFailure},
+		{"init truncated", false, testStepRespond, func(msg []byte) []byte { return msg[:len(msg)-1] }, ErrTruncated},
+		{"finish confirmation", false, testStepFinish, flip(-1), ErrMACFailure},
+		{"finish type", false, testStepFinish, flip(0), ErrUnknownMsgType},
+		{"bound init signature", true, testStepRespond, flip(-32 - 1), ErrBadSignature},
+		{"bound init confirmation", true, testStepRespond, flip(-1), ErrMACFailure},
+		{"bound finish signature", true, testStepFinish, flip(-32 - 1), ErrBadSignature},
+		{"bound finish confirmation", true, testStepFinish, flip(-1), ErrMACFailure},
+	}
+	for _, tt := range tests {
+		initiator, responder := testHandshakes(t, nil, nil)
+		if tt.bound {
+			initiator, responder = testHandshakes(t, alice, bob)
+		}
+		err := testHandshake(t, initiator, responder, func(step int, msg []byte) []byte {
+			if step == tt.step {
+				return tt.tamper(msg)
+			}
+			return msg
+		})
+		if err != tt.err {
+			t.Fatalf("%s: got %v, want %v", tt.name, err, tt.err)
+		}
+
+		// The initiator never has a secret, and neither does the responder unless
+		// only the finish was changed after it
+		if _, err := initiator.Secret(); err != ErrHandshakeState {
+			t.Fatalf("%s: got %v, want ErrHandshakeState", tt.name, err)
+		}
+		if _, err := initiator.Fingerprint(); err != ErrHandshakeState {
+			t.Fatalf("%s: got %v, want ErrHandshakeState", tt.name, err)
+		}
+		if _, err := responder.Secret(); (err == nil) != (tt.step == testStepFinish) {
+			t.Fatalf("%s: responder's secret: %v", tt.name, err)
+		}
+	}
+}
+
+func TestHandshakeIdentity(t *testing.T) {
+	alice, bob := testPair(t)
+	if _, err := NewHandshake(alice, uuid.New()); err != ErrUnknownMember {
+		t.Fatalf("got %v, want ErrUnknownMember", err)
+	}
+
+	// An impostor with bob's UUID but other keys
+	impostor, err := GenTx(bob.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	RxFromTx(impostor, alice)
+	initiator, responder := testHandshakes(t, alice, impostor)
+	if err := testHandshake(t, initiator, responder, nil); err != ErrBadSignature {
+		t.Fatalf("got %v, want ErrBadSignature", err)
+	}
+	initiator, responder = testHandshakes(t, impostor, alice)
+	if err := testHandshake(t, initiator, responder, nil); err != ErrBadSignature {
+		t.Fatalf("got %v, want ErrBadSignature", err)
+	}
+
+	// Both sides must be bound, to the identity the other expects
+	carol, _ := testAdd(t, alice, bob)
+	tests := []struct {
+		name                 string
+		initiator, responder func() (*Handshake, error)
+	}{
+		{"unbound responder", func() (*Handshake, error) { return NewHandshake(alice, bob.UUID) }, func() (*Handshake, error) { return NewHandshake(nil, uuid.Nil) }},
+		{"unbound initiator", func() (*Handshake, error) { return NewHandshake(nil, uuid.Nil) }, func() (*Handshake, error) { return NewHandshake(bob, alice.UUID) }},
+		{"other responder", func() (*Handshake, error) { return NewHandshake(alice, bob.UUID) }, func() (*Handshake, error) { return NewHandshake(carol, alice.UUID) }},
+		{"other initiator", func() (*Handshake, error) { return NewHandshake(carol, bob.UUID) }, func() (*Handshake, error) { return NewHandshake(bob, alice.UUID) }},
+	}
+	for _, tt := range tests {
+		initiator, err := tt.initiator()
+		if err != nil {
+			t.Fatal(err)
+		}
+		responder, err := tt.responder()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := testHandshake(t, initiator, responder, nil); err != ErrUnknownSender {
+			t.Fatalf("%s: got %v, want ErrUnknownSender", tt.name, err)
+		}
+	}
+}
+
+func TestHandshakeState(t *testing.T) {
+	initiator, responder := testHandshakes(t, nil, nil)
+	b := new(bytes.Buffer)
+
+	// Steps called out of order are refused, without ending the handshake
+	if err := responder.Respond(nil, b); err != ErrHandshakeState {
+		t.Fatalf("respond before hello: got %v, want ErrHandshakeState", err)
+	}
+	if err := initiator.Finish(nil); err != ErrHandshakeState {
+		t.Fatalf("finish before initiate: got %v, want ErrHandshakeState", err)
+	}
+	if _, err := initiator.Secret(); err != ErrHandshakeState {
+		t.Fatalf("secret before finish: got %v, want ErrHandshakeState", err)
+	}
+
+	hello := new(bytes.Buffer)
+	if err := responder.Hello(hello); err != nil {
+		t.Fatal(err)
+	}
+	if err := responder.Hello(b); err != ErrHandshakeState {
+		t.Fatalf("hello twice: got %v, want ErrHandshakeState", err)
+	}
+	if err := responder.Initiate(hello.Bytes(), b); err != ErrHandshakeState {
+		t.Fatalf("initiate after hello: got %v, want ErrHandshakeState", err)
+	}
+
+	init := new(bytes.Buffer)
+	if err := initiator.Initiate(hello.Bytes(), init); err != nil {
+		t.Fatal(err)
+	}
+	if err := initiator.Initiate(hello.Bytes(), b); err != ErrHandshakeState {
+		t.Fatalf("initiate twice: got %v, want ErrHandshakeState", err)
+	}
+	if err := initiator.Hello(b); err != ErrHandshakeState {
+		t.Fatalf("hello after initiate: got %v, want ErrHandshakeState", err)
+	}
+	if err := initiator.Respond(init.Bytes(), b); err != ErrHandshakeState {
+		t.Fatalf("respond as the initiator: got %v, want ErrHandshakeState", err)
+	}
+
+	finish := new(bytes.Buffer)
+	if err := responder.Respond(init.Bytes(), finish); err != nil {
+		t.Fatal(err)
+	}
+	if err := responder.Respond(init.Bytes(), b); err != ErrHandshakeState {
+		t.Fatalf("respond twice: got %v, want ErrHandshakeState", err)
+	}
+	if err := responder.Finish(finish.Bytes()); err != ErrHandshakeState {
+		t.Fatalf("finish as the responder: got %v, want ErrHandshakeState", err)
+	}
+	if b.Len() != 0 {
+		t.Fatal("refused step wrote a message")
+	}
+
+	if err := initiator.Finish(finish.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if err := initiator.Finish(finish.Bytes()); err != ErrHandshakeState {
+		t.Fatalf("finish twice: got %v, want ErrHandshakeState", err)
+	}
+	secret, err := initiator.Secret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other, _ := responder.Secret(); other != secret {
+		t.Fatal("sides agreed on different secrets")
+	}
+
+	// A destroyed handshake has no secret
+	initiator.Destroy()
+	if _, err := initiator.Secret(); err != ErrHandshakeState {
+		t.Fatalf("got %v, want ErrHandshakeState", err)
+	}
+	if secret == initiator.secret {
+		t.Fatal("secret wasn't wiped")
+	}
+}
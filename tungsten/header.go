@@ -0,0 +1,160 @@
+package tungsten
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"io"
+
+	"github.com/google/uuid"
+)
+
+// Sealed sender, see "Sealed sender" in /design/encryption.adoc. Every message
+// is sent in an envelope, which hides the sender and the message inside from
+// anyone without the sender's header key. Each member's header key is shared
+// with the group, and replaced with every ratchet update, so removed members
+// lose it along with the ratchets.
+//
+// Each member has their own header key, rather than the group sharing one, so
+// that no member has to agree a new key with the others when one is removed.
+// The cost is that a receiver can't tell which key opens an envelope, so each
+// envelope carries a one byte hint of its key, and only keys with the same
+// hint are tried. The hint changes with the header key, but until then it lets
+// the server sort a member's envelopes into one of 256 groups, which in a small
+// guild mostly links the messages sent by each member between their updates
+// (though not to the member, which the envelope still hides).
+
+var HEADER_HKDF_INFO = []byte("header_hkdf")
+var HEADER_HINT_LABEL = []byte("header_hint")
+
+// headerHint returns the hint of a header key
+func headerHint(key *[32]byte) byte {
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(HEADER_HINT_LABEL)
+	return mac.Sum(nil)[0]
+}
+
+// hintCache keeps the hint of a header key, so that it is only computed again
+// once the key changes
+type hintCache struct {
+	key  [32]byte
+	hint byte
+	ok   bool
+}
+
+func (c *hintCache) get(key *[32]byte) byte {
+	if !c.ok || subtle.ConstantTimeCompare(c.key[:], key[:]) != 1 {
+		c.key = *key
+		c.hint = headerHint(key)
+		c.ok = true
+	}
+	return c.hint
+}
+
+func (c *hintCache) destroy() {
+	wipe(c.key[:])
+	c.ok = false
+}
+
+// marshaler is implemented by every message type
+type marshaler interface {
+	Marshal(w io.Writer)
+}
+
+// migrateHeaderKey generates a header key for a session imported from a layout
+// without one. Members still have the all-zero key, which stays as the previous
+// key, so envelopes are sealed with it until our next update shares the new
+// key. Data messages are refused until then.
+func (t *TxSession) migrateHeaderKey() error {
+	if err := t.Config.read(t.HeaderKey[:]); err != nil {
+		return err
+	}
+	t.PrevHeaderKey = [32]byte{}
+	t.HeaderPending = true
+	return nil
+}
+
+// sealingKey returns the header key that members have for our envelopes
+func (t *TxSession) sealingKey() *[32]byte {
+	if t.HeaderPending {
+		return &t.PrevHeaderKey
+	}
+	return &t.HeaderKey
+}
+
+// send writes a signed message, sealed in an envelope with our header key
+func (t *TxSession) send(m marshaler, w io.Writer) error {
+	var bodyKey [32]byte
+	if err := t.Config.read(bodyKey[:]); err != nil {
+		return err
+	}
+	return t.sendWith(m, bodyKey, w)
+}
+
+// sendWith is send with a chosen body key, for recipients that don't have our
+// header key yet
+func (t *TxSession) sendWith(m marshaler, bodyKey [32]byte, w io.Writer) error {
+	if t.destroyed {
+		return ErrDestroyed
+	}
+
+	b := new(bytes.Buffer)
+	m.Marshal(b)
+
+	e := &Envelope{Hint: headerHint(t.sealingKey())}
+	if err := t.Config.read(e.Nonce[:]); err != nil {
+		return err
+	}
+	copy(e.Header[:], sealAEAD(t.sealingKey(), e.Nonce[:], bodyKey[:], e.headerAD(t.UUID)))
+	e.Body = sealAEAD(&bodyKey, e.Nonce[:], b.Bytes(), e.bodyAD())
+
+	e.Marshal(w)
+	return nil
+}
+
+// open opens the envelope with the current and previous header keys of sender,
+// returning the message inside. ok is false unless the message is from sender.
+func (e *Envelope) open(sender uuid.UUID, hints *[2]hintCache, key, prev *[32]byte) (msg []byte, ok bool) {
+	for i, k := range []*[32]byte{key, prev} {
+		if hints[i].get(k) != e.Hint {
+			continue
+		}
+
+		b, err := openAEAD(k, e.Nonce[:], e.Header[:], e.headerAD(sender))
+		if err != nil {
+			continue
+		}
+
+		var bodyKey [32]byte
+		copy(bodyKey[:], b)
+		if msg, ok := e.openWith(bodyKey, sender); ok {
+			return msg, true
+		}
+	}
+	return nil, false
+}
+
+// openWith opens the envelope with its body key
+func (e *Envelope) openWith(bodyKey [32]byte, sender uuid.UUID) ([]byte, bool) {
+	msg, err := openAEAD(&bodyKey, e.Nonce[:], e.Body, e.bodyAD())
+	if err != nil || len(msg) < 17 || !bytes.Equal(msg[1:17], sender[:]) {
+		return nil, false
+	}
+	return msg, true
+}
+
+// headerAD returns the associated data of the sealed body key, which binds it
+// to the hint and the sender whose header key sealed it
+func (e *Envelope) headerAD(sender uuid.UUID) []byte {
+	return append([]byte{e.Hint}, sender[:]...)
+}
+
+// bodyAD returns the associated data of the body, which is every field before
+// it, so that it can't be moved to another envelope. The sender isn't included,
+// as a new member opens the body without knowing it, but the message inside
+// names the sender and is signed.
+func (e *Envelope) bodyAD() []byte {
+	b := append([]byte{e.Hint}, e.Nonce[:]...)
+	return append(b, e.Header[:]...)
+}
@@ -0,0 +1,69 @@
+package tungsten
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSealedSender(t *testing.T) {
+	alice, bob := testPair(t)
+	carol, _ := testAdd(t, alice, bob)
+
+	// The envelope doesn't name the sender or the ratchet
+	msg := testSend(t, alice, "hello")
+	if bytes.Contains(msg, alice.UUID[:]) || bytes.Contains(msg, alice.Ratchets[0].UUID[:]) {
+		t.Fatal("envelope shows the sender")
+	}
+	if r := testReceive(t, bob, msg, "hello"); r.SenderID != alice.UUID {
+		t.Fatal("opened as another sender")
+	}
+	if _, err := alice.ReceiveMessage(msg); err != ErrOwnMessage {
+		t.Fatalf("got %v, want ErrOwnMessage", err)
+	}
+
+	// An update replaces the header key. Members that haven't received it can't
+	// open later envelopes, but envelopes sealed with the previous key still open
+	// once they have.
+	late := testSend(t, alice, "late")
+	update := testUpdate(t, alice)
+	testReceive(t, bob, update, "")
+	after := testSend(t, alice, "after update")
+	testReceive(t, bob, after, "after update")
+	testReceive(t, bob, late, "late")
+	if _, err := carol.ReceiveMessage(after); err != ErrUnknownSender {
+		t.Fatalf("got %v, want ErrUnknownSender", err)
+	}
+	testReceive(t, carol, update, "")
+	testReceive(t, carol, after, "after update")
+	testReceive(t, carol, late, "late")
+
+	// Header keys are kept across an export
+	bob = testReexport(t, bob)
+	testReceive(t, bob, testSend(t, alice, "after export"), "after export")
+	testReceive(t, alice, testSend(t, bob, "after export"), "after export")
+}
+
+func TestSealedSenderTampered(t *testing.T) {
+	alice, bob := testPair(t)
+	msg := testSend(t, alice, "hello")
+
+	// Every part of the envelope is authenticated, so a change leaves it
+	// unopenable rather than opened as another message
+	for _, i := range []int{0, 1, 1 + 24, len(msg) - 1} {
+		tampered := append([]byte(nil), msg...)
+		tampered[i] ^= 1
+		if _, err := bob.ReceiveMessage(tampered); err != ErrUnknownSender {
+			t.Fatalf("byte %d: got %v, want ErrUnknownSender", i, err)
+		}
+	}
+	if _, err := bob.ReceiveMessage(msg[:10]); err != ErrTruncated {
+		t.Fatalf("got %v, want ErrTruncated", err)
+	}
+
+	// A member outside the group has no header key to open it with
+	outsider, _ := testPair(t)
+	if _, err := outsider.ReceiveMessage(msg); err != ErrUnknownSender {
+		t.Fatalf("got %v, want ErrUnknownSender", err)
+	}
+	testReceive(t, bob, msg, "hello")
+}
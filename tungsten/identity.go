@@ -0,0 +1,197 @@
+package tungsten
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"github.com/cloudflare/circl/sign/ed25519"
+)
+
+// Signing keys can be rotated, such as when they may have been compromised.
+// Members keep the verifying keys that were replaced, along with the position
+// of each ratchet at the rotation, so that late data messages sent before it
+// can still be verified. Every other message must be signed with the current
+// keys.
+
+// Verifying keys replaced by a rotation
+type PastKey struct {
+	VerifyingPubkey   ed25519.PublicKey
+	VerifyingPubkeyPQ PQVerifyingKey
+
+	// Data messages from earlier positions were signed with these keys
+	Positions []RatchetPosition
+}
+
+// signed returns whether a data message was sent before the keys were replaced
+func (k *PastKey) signed(m *Data) bool {
+	for _, v := range k.Positions {
+		if v.RatchetID == m.RatchetID {
+			return m.Epoch < v.Epoch || (m.Epoch == v.Epoch && m.Counter < v.Counter)
+		}
+	}
+	return false
+}
+
+// RotateKeys replaces our signing keys, and writes a message with the new
+// verifying keys, to be sent to the group. Our other devices can't send until
+// they have applied the mirrored keys. The new keys are of the config's suite.
+func (t *TxSession) RotateKeys(w io.Writer) error {
+	pub, priv, err := ed25519.GenerateKey(t.Config.rand())
+	if err != nil {
+		return ErrRandom
+	}
+	privPQ, err := genSigningPQ(t.Config, t.Config.suite())
+	if err != nil {
+		return err
+	}
+
+	m := &RotateKeys{
+		MsgType:           MSG_TYPE_ROTATE_KEYS,
+		SenderID:          t.UUID,
+		Generation:        t.KeyGeneration + 1,
+		VerifyingPubkey:   pub,
+		VerifyingPubkeyPQ: privPQ.Public(),
+		Positions:         positions(t.Ratchets),
+	}
+	m.SignNew(priv, privPQ)
+	m.Sign(t.SigningKey, t.SigningKeyPQ)
+	if err := t.send(m, w); err != nil {
+		wipe(privPQ.Key)
+		return err
+	}
+
+	t.KeyHistory = append(t.KeyHistory, PastKey{
+		VerifyingPubkey:   t.verifyingPubkey(),
+		VerifyingPubkeyPQ: t.verifyingPubkeyPQ(),
+		Positions:         m.Positions,
+	})
+	wipe(t.SigningKey)
+	wipe(t.SigningKeyPQ.Key)
+	t.SigningKey = priv
+	t.SigningKeyPQ = privPQ
+	t.KeyGeneration = m.Generation
+
+	t.recordIdentity(m.Positions)
+	return nil
+}
+
+// verifyingPubkey returns a copy of our ed25519 verifying key
+func (t *TxSession) verifyingPubkey() ed25519.PublicKey {
+	return append(ed25519.PublicKey(nil), t.SigningKey[ed25519.SeedSize:]...)
+}
+
+// verifyingPubkeyPQ returns our post-quantum verifying key
+func (t *TxSession) verifyingPubkeyPQ() PQVerifyingKey {
+	return t.SigningKeyPQ.Public()
+}
+
+// positions returns the position of the next message in each ratchet
+func positions(rats []*Ratchet) []RatchetPosition {
+	var out []RatchetPosition
+	for _, v := range rats {
+		out = append(out, RatchetPosition{RatchetID: v.UUID, Epoch: v.Epoch, Counter: v.Symmetric.Index()})
+	}
+	return out
+}
+
+// receiveRotate verifies the new keys of a rotate keys message, whose old
+// signatures have been verified, and replaces the member's keys with them
+func (r *RxSession) receiveRotate(m *RotateKeys, msg []byte) error {
+	if m.Generation <= r.KeyGeneration {
+		return ErrDuplicate
+	}
+
+	newEnd := len(msg) - 2*signaturesSize - 2
+	if !verifySignatures(m.VerifyingPubkey, &m.VerifyingPubkeyPQ, m.VerifyingPubkeyPQ.Suite, msg[:newEnd], m.NewSignature[:], m.NewSignaturePQ[:]) {
+		return ErrBadSignature
+	}
+
+	r.KeyHistory = append(r.KeyHistory, PastKey{
+		VerifyingPubkey:   r.VerifyingPubkey,
+		VerifyingPubkeyPQ: r.VerifyingPubkeyPQ,
+		Positions:         m.Positions,
+	})
+	r.VerifyingPubkey = m.VerifyingPubkey
+	r.VerifyingPubkeyPQ = m.VerifyingPubkeyPQ
+	r.KeyGeneration = m.Generation
+	return nil
+}
+
+// verify verifies the signatures that end every message type. Data messages
+// sent before a rotation are verified with the keys that were replaced, and
+// rotations signed with them are rejected as replays.
+func (r *RxSession) verify(msg []byte) error {
+	dataEnd := len(msg) - signaturesSize
+	if dataEnd < 19 {
+		return ErrTruncated
+	}
+	sig, sigPQ := msg[dataEnd:len(msg)-PQ_SIGNATURE_SIZE], msg[len(msg)-PQ_SIGNATURE_SIZE:]
+	suite := Suite(binary.BigEndian.Uint16(msg[dataEnd-2:]))
+
+	if verifySignatures(r.VerifyingPubkey, &r.VerifyingPubkeyPQ, suite, msg[:dataEnd], sig, sigPQ) {
+		return nil
+	}
+
+	switch msg[0] {
+	case MSG_TYPE_DATA:
+		m := new(Data)
+		if err := m.Unmarshal(bytes.NewReader(msg)); err != nil {
+			return ErrBadSignature
+		}
+		for i := len(r.KeyHistory) - 1; i >= 0; i-- {
+			k := &r.KeyHistory[i]
+			if k.signed(m) && verifySignatures(k.VerifyingPubkey, &k.VerifyingPubkeyPQ, suite, msg[:dataEnd], sig, sigPQ) {
+				return nil
+			}
+		}
+
+	case MSG_TYPE_ROTATE_KEYS:
+		// A rotation signed with keys it already replaced is a replay
+		for _, k := range r.KeyHistory {
+			if verifySignatures(k.VerifyingPubkey, &k.VerifyingPubkeyPQ, suite, msg[:dataEnd], sig, sigPQ) {
+				return ErrDuplicate
+			}
+		}
+	}
+	return ErrBadSignature
+}
+
+// verifySignatures verifies both an ed25519 and a post-quantum signature, which
+// must be of the suite of the verifying key
+func verifySignatures(pub ed25519.PublicKey, pubPQ *PQVerifyingKey, suite Suite, msg, sig, sigPQ []byte) bool {
+	return pubPQ.Suite == suite && ed25519.Verify(pub, msg, sig) && pubPQ.verify(msg, sigPQ)
+}
+
+// exportKeyHistory writes the key history section of an export
+func exportKeyHistory(w io.Writer, generation uint32, history []PastKey) {
+	binary.Write(w, binary.BigEndian, generation)
+	binary.Write(w, binary.BigEndian, int64(len(history)))
+	for _, v := range history {
+		w.Write(v.VerifyingPubkey)
+		v.VerifyingPubkeyPQ.Marshal(w)
+		writePositions(w, v.Positions)
+	}
+}
+
+// importKeyHistory reads a key history section, whose keys have no suite if
+// legacy
+func importKeyHistory(r *errReader, legacy bool) (uint32, []PastKey) {
+	var generation uint32
+	binary.Read(r, binary.BigEndian, &generation)
+
+	var history []PastKey
+	var l int64
+	binary.Read(r, binary.BigEndian, &l)
+	for i := int64(0); i < l && r.err == nil; i++ {
+		var k PastKey
+		k.VerifyingPubkey = make(ed25519.PublicKey, ed25519.PublicKeySize)
+		r.Read(k.VerifyingPubkey)
+		readPQ(r, legacy, &k.VerifyingPubkeyPQ)
+
+		k.Positions = readPositions(r)
+		history = append(history, k)
+	}
+
+	return generation, history
+}
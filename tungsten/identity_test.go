@@ -0,0 +1,84 @@
+package tungsten
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/cloudflare/circl/sign/ed25519"
+)
+
+func testRotate(t *testing.T, sender *TxSession) []byte {
+	t.Helper()
+	b := new(bytes.Buffer)
+	if err := sender.RotateKeys(b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestRotateKeys(t *testing.T) {
+	alice, bob := testPair(t)
+	carol, _ := testAdd(t, alice, bob)
+
+	late := testSend(t, alice, "sent before the rotation")
+	rotate := testRotate(t, alice)
+	if r := testReceive(t, bob, rotate, ""); r.MsgType != MSG_TYPE_ROTATE_KEYS {
+		t.Fatal("received as another message type")
+	}
+	if _, err := bob.ReceiveMessage(rotate); err != ErrDuplicate {
+		t.Fatalf("got %v, want ErrDuplicate", err)
+	}
+
+	// Later messages are signed with the new keys, and earlier ones are still
+	// verified with the old keys from the history
+	testReceive(t, bob, testSend(t, alice, "after rotation"), "after rotation")
+	testReceive(t, bob, late, "sent before the rotation")
+
+	// A member that hasn't received the rotation can't verify later messages
+	msg := testSend(t, alice, "new keys")
+	if _, err := carol.ReceiveMessage(msg); err != ErrBadSignature {
+		t.Fatalf("got %v, want ErrBadSignature", err)
+	}
+	testReceive(t, carol, rotate, "")
+	testReceive(t, carol, msg, "new keys")
+
+	// Both sides keep the generation and history across an export
+	alice, bob = testReexport(t, alice), testReexport(t, bob)
+	if alice.KeyGeneration != 1 || len(alice.KeyHistory) != 1 {
+		t.Fatal("export lost our key history")
+	}
+	if rx := bob.child(alice.UUID); rx.KeyGeneration != 1 || len(rx.KeyHistory) != 1 {
+		t.Fatal("export lost the member's key history")
+	}
+	testReceive(t, bob, testSend(t, alice, "after export"), "after export")
+
+	// A second rotation replaces the keys again
+	testReceive(t, bob, testRotate(t, alice), "")
+	testReceive(t, bob, testSend(t, alice, "second rotation"), "second rotation")
+}
+
+// The old keys only verify data messages from before the rotation, so a
+// compromised key can't be used to sign later ones
+func TestRotateKeysOldKeyRejected(t *testing.T) {
+	alice, bob := testPair(t)
+	oldKey := append(ed25519.PrivateKey(nil), alice.SigningKey...)
+	oldKeyPQ := alice.SigningKeyPQ
+	oldKeyPQ.Key = append([]byte(nil), alice.SigningKeyPQ.Key...)
+
+	testReceive(t, bob, testRotate(t, alice), "")
+	newKey, newKeyPQ := alice.SigningKey, alice.SigningKeyPQ
+	alice.SigningKey, alice.SigningKeyPQ = oldKey, oldKeyPQ
+	forged := testSend(t, alice, "forged")
+	rotate := testRotate(t, alice)
+	alice.SigningKey, alice.SigningKeyPQ = newKey, newKeyPQ
+
+	if _, err := bob.ReceiveMessage(forged); err != ErrBadSignature {
+		t.Fatalf("data: got %v, want ErrBadSignature", err)
+	}
+	if _, err := bob.ReceiveMessage(rotate); err != ErrDuplicate {
+		t.Fatalf("rotation: got %v, want ErrDuplicate", err)
+	}
+	if bob.child(alice.UUID).KeyGeneration != 1 {
+		t.Fatal("rotation signed with the old keys was applied")
+	}
+}
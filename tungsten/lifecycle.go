@@ -0,0 +1,319 @@
+package tungsten
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sort"
+
+	"github.com/google/uuid"
+)
+
+// Each member can have any number of ratchets, such as one per channel, so
+// that each has independent forward secrecy. New ratchets are announced to the
+// group with their initial chain keys, and retired ratchets are dropped by
+// every member.
+
+// The epoch recorded for a retired ratchet, which rejects every announcement
+// of it
+const RETIRED_EPOCH = ^uint32(0)
+
+var RATCHET_ANNOUNCE_HKDF_INFO = []byte("ratchet_announce_hkdf")
+
+// newRatchet generates a ratchet with random chain keys
+func newRatchet(c *Config, id uuid.UUID) (*Ratchet, error) {
+	r := &Ratchet{UUID: id, Updated: c.now().UnixNano()}
+
+	var rootRoot ChainKey
+	if err := c.read(rootRoot[:]); err != nil {
+		return nil, err
+	}
+	r.Root = NewRootRatchet(rootRoot)
+
+	var chainRoot ChainKey
+	if err := c.read(chainRoot[:]); err != nil {
+		return nil, err
+	}
+	r.Symmetric = NewSymRatchet(chainRoot)
+
+	return r, nil
+}
+
+// findRatchet returns the ratchet with the id, or nil if there isn't one
+func findRatchet(rats []*Ratchet, id uuid.UUID) *Ratchet {
+	for _, v := range rats {
+		if v.UUID == id {
+			return v
+		}
+	}
+	return nil
+}
+
+// AddRatchet adds a ratchet, and writes a message announcing it, to be sent to
+// the group. If recipients isn't nil, only those members can read it.
+func (t *TxSession) AddRatchet(id uuid.UUID, recipients []uuid.UUID, announce io.Writer) error {
+	if findRatchet(t.Ratchets, id) != nil {
+		return ErrDuplicateRatchet
+	}
+
+	rat, err := t.rekeyed(id, 0, recipients)
+	if err != nil {
+		return err
+	}
+
+	if err := t.announce(rat, 0, announce); err != nil {
+		return err
+	}
+
+	t.Ratchets = append(t.Ratchets, rat)
+	t.recordRatchet(rat, 0)
+	return nil
+}
+
+// SetRecipients changes the members that can read a ratchet, or lets every
+// member read it if recipients is nil. The ratchet is replaced with new chain
+// keys, announced to the group in the message written to announce, so that
+// added members can't read earlier messages and removed members can't read
+// later ones.
+func (t *TxSession) SetRecipients(id uuid.UUID, recipients []uuid.UUID, announce io.Writer) error {
+	old := findRatchet(t.Ratchets, id)
+	if old == nil {
+		return ErrUnknownRatchet
+	}
+	if old.Device != t.Device {
+		return ErrOtherDevice
+	}
+
+	rat, err := t.rekeyed(id, old.Epoch+1, recipients)
+	if err != nil {
+		return err
+	}
+
+	prevCounter := old.Symmetric.Index()
+	if err := t.announce(rat, prevCounter, announce); err != nil {
+		return err
+	}
+
+	old.Destroy()
+	*old = *rat
+	t.recordRatchet(rat, prevCounter)
+	return nil
+}
+
+// rekeyed generates a ratchet to be announced, checking the recipients are
+// members
+func (t *TxSession) rekeyed(id uuid.UUID, epoch uint32, recipients []uuid.UUID) (*Ratchet, error) {
+	for _, v := range recipients {
+		if t.child(v) == nil {
+			return nil, ErrUnknownMember
+		}
+	}
+
+	rat, err := newRatchet(t.Config, id)
+	if err != nil {
+		return nil, err
+	}
+	rat.Epoch = epoch
+	rat.Device = t.Device
+	rat.Restricted = recipients != nil
+	rat.Recipients = append([]uuid.UUID(nil), recipients...)
+
+	return rat, nil
+}
+
+// announce writes a message with the initial chain keys of rat, encrypted to
+// the members that can read it
+func (t *TxSession) announce(rat *Ratchet, prevCounter uint32, w io.Writer) error {
+	m := &AnnounceRatchet{
+		MsgType:     MSG_TYPE_ANNOUNCE_RATCHET,
+		SenderID:    t.UUID,
+		RatchetID:   rat.UUID,
+		Epoch:       rat.Epoch,
+		PrevCounter: prevCounter,
+		Restricted:  rat.Restricted,
+		Recipients:  rat.Recipients,
+	}
+
+	key, keys, err := sealTo(t.Config, &t.CurrentPrivkey, t.recipients(rat), RATCHET_ANNOUNCE_HKDF_INFO, ANNOUNCE_COMBINE_LABEL,
+		t.senderAD(), ratchetPurpose(rat.UUID, rat.Epoch))
+	if err != nil {
+		return err
+	}
+	m.Keys = keys
+
+	if err := t.Config.read(m.Nonce[:]); err != nil {
+		return err
+	}
+
+	plain := make([]byte, 0, 2*len(ChainKey{}))
+	plain = append(plain, rat.Symmetric.current[:]...)
+	plain = append(plain, rat.Root.current[:]...)
+	m.Payload = sealAEAD(&key, m.Nonce[:], plain, m.ad())
+	wipe(plain)
+
+	m.Sign(t.SigningKey, t.SigningKeyPQ)
+	return t.send(m, w)
+}
+
+// recipients returns the children that can read a ratchet
+func (t *TxSession) recipients(rat *Ratchet) []*RxSession {
+	var out []*RxSession
+	for _, v := range t.Children {
+		if rat.CanRead(v.UUID) {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+// RetireRatchet removes a ratchet, and writes a message retiring it, to be sent
+// to the group. Messages sent with it that haven't been received by a member
+// can no longer be received.
+func (t *TxSession) RetireRatchet(id uuid.UUID, retire io.Writer) error {
+	rat := findRatchet(t.Ratchets, id)
+	if rat == nil {
+		return ErrUnknownRatchet
+	}
+	if rat.Device != t.Device {
+		return ErrOtherDevice
+	}
+
+	m := &RetireRatchet{
+		MsgType:   MSG_TYPE_RETIRE_RATCHET,
+		SenderID:  t.UUID,
+		RatchetID: id,
+	}
+	m.Sign(t.SigningKey, t.SigningKeyPQ)
+	if err := t.send(m, retire); err != nil {
+		return err
+	}
+
+	rat.Destroy()
+	t.Ratchets = dropRatchet(t.Ratchets, id)
+	t.recordRetire(id)
+	return nil
+}
+
+func dropRatchet(rats []*Ratchet, id uuid.UUID) []*Ratchet {
+	var out []*Ratchet
+	for _, v := range rats {
+		if v.UUID != id {
+			out = append(out, v)
+		}
+	}
+	return out
+}
+
+func (r *RxSession) receiveAnnounce(m *AnnounceRatchet) error {
+	rat := findRatchet(r.Ratchets, m.RatchetID)
+	if rat != nil && m.Epoch <= rat.Epoch {
+		return ErrDuplicateRatchet
+	}
+	if epoch, ok := r.Retired[m.RatchetID]; ok && m.Epoch <= epoch {
+		return ErrDuplicateRatchet
+	}
+
+	// We aren't allowed to read it (anymore)
+	if findKey(m.Keys, r.Parent.UUID) == nil {
+		r.dropRatchet(m.RatchetID, m.Epoch)
+		return nil
+	}
+
+	key, err := r.openFromSender(m.Keys, RATCHET_ANNOUNCE_HKDF_INFO, ANNOUNCE_COMBINE_LABEL,
+		r.senderAD(), ratchetPurpose(m.RatchetID, m.Epoch))
+	if err != nil {
+		return err
+	}
+
+	plain, err := openAEAD(&key, m.Nonce[:], m.Payload, m.ad())
+	if err != nil {
+		return err
+	}
+	if len(plain) != 2*len(ChainKey{}) {
+		return ErrTruncated
+	}
+
+	var symChain, rootChain ChainKey
+	copy(symChain[:], plain)
+	copy(rootChain[:], plain[len(symChain):])
+
+	if rat == nil {
+		rat = &Ratchet{UUID: m.RatchetID}
+		r.Ratchets = append(r.Ratchets, rat)
+	} else {
+		// Keep the keys of messages that haven't arrived from the replaced chain
+		sym, skipped, ok := skipTo(*rat.Symmetric, m.PrevCounter)
+		if ok {
+			rat.setSymmetric(sym)
+			r.storeSkipped(rat, skipped)
+		}
+	}
+
+	rat.Destroy()
+	rat.Epoch = m.Epoch
+	rat.Symmetric = NewSymRatchet(symChain)
+	rat.Root = NewRootRatchet(rootChain)
+	wipe(symChain[:])
+	wipe(rootChain[:])
+	rat.Restricted = m.Restricted
+	rat.Recipients = m.Recipients
+	return nil
+}
+
+// receiveRetire drops a retired ratchet. Members that couldn't read it won't
+// have it, so an unknown ratchet isn't an error.
+func (r *RxSession) receiveRetire(m *RetireRatchet) error {
+	r.dropRatchet(m.RatchetID, RETIRED_EPOCH)
+	return nil
+}
+
+// dropRatchet removes a ratchet, along with the keys of its skipped messages,
+// and rejects its announcements up to epoch from then on
+func (r *RxSession) dropRatchet(id uuid.UUID, epoch uint32) {
+	if rat := findRatchet(r.Ratchets, id); rat != nil {
+		rat.Destroy()
+	}
+	r.Ratchets = dropRatchet(r.Ratchets, id)
+
+	if r.Retired == nil {
+		r.Retired = make(map[uuid.UUID]uint32)
+	}
+	if epoch > r.Retired[id] {
+		r.Retired[id] = epoch
+	}
+
+	for k := range r.Skipped {
+		if k.RatchetID == id {
+			delete(r.Skipped, k)
+		}
+	}
+}
+
+// exportRetired writes the retired ratchets, in order of their ids
+func exportRetired(w io.Writer, retired map[uuid.UUID]uint32) {
+	ids := make([]uuid.UUID, 0, len(retired))
+	for id := range retired {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+
+	binary.Write(w, binary.BigEndian, int64(len(ids)))
+	for _, id := range ids {
+		w.Write(id[:])
+		binary.Write(w, binary.BigEndian, retired[id])
+	}
+}
+
+func importRetired(r *errReader, retired map[uuid.UUID]uint32) {
+	var count int64
+	binary.Read(r, binary.BigEndian, &count)
+	for i := int64(0); i < count && r.err == nil; i++ {
+		var id uuid.UUID
+		var epoch uint32
+		r.Read(id[:])
+		binary.Read(r, binary.BigEndian, &epoch)
+		retired[id] = epoch
+	}
+}
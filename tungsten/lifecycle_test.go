@@ -0,0 +1,105 @@
+package tungsten
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// testSendOn sends a data message with one of the sender's ratchets
+func testSendOn(t *testing.T, sender *TxSession, id uuid.UUID, plain string) []byte {
+	t.Helper()
+	b := new(bytes.Buffer)
+	if err := sender.SendMessage(id, []byte(plain), b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestRatchetLifecycle(t *testing.T) {
+	alice, bob := testPair(t)
+	id := uuid.New()
+
+	announce := new(bytes.Buffer)
+	if err := alice.AddRatchet(id, nil, announce); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.AddRatchet(id, nil, new(bytes.Buffer)); err != ErrDuplicateRatchet {
+		t.Fatalf("got %v, want ErrDuplicateRatchet", err)
+	}
+	r := testReceive(t, bob, announce.Bytes(), "")
+	if r.MsgType != MSG_TYPE_ANNOUNCE_RATCHET || r.RatchetID != id {
+		t.Fatal("announcement didn't name the ratchet")
+	}
+
+	r = testReceive(t, bob, testSendOn(t, alice, id, "on the channel"), "on the channel")
+	if r.RatchetID != id {
+		t.Fatal("message wasn't on the channel's ratchet")
+	}
+
+	// The ratchet is kept across updates and exports
+	late := testSendOn(t, alice, id, "late")
+	testReceive(t, bob, testUpdate(t, alice), "")
+	testReceive(t, bob, testSendOn(t, alice, id, "after update"), "after update")
+	bob = testReexport(t, bob)
+	testReceive(t, bob, late, "late")
+
+	// Once retired, it can't be used by either side, and the keys of its
+	// skipped messages are dropped
+	skipped := testSendOn(t, alice, id, "skipped")
+	testReceive(t, bob, testSendOn(t, alice, id, "latest"), "latest")
+	retire := new(bytes.Buffer)
+	if err := alice.RetireRatchet(id, retire); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SendMessage(id, []byte("retired"), new(bytes.Buffer)); err != ErrUnknownRatchet {
+		t.Fatalf("got %v, want ErrUnknownRatchet", err)
+	}
+	if r := testReceive(t, bob, retire.Bytes(), ""); r.RatchetID != id {
+		t.Fatal("retirement didn't name the ratchet")
+	}
+	if _, err := bob.ReceiveMessage(skipped); err != ErrUnknownRatchet {
+		t.Fatalf("got %v, want ErrUnknownRatchet", err)
+	}
+	if len(bob.child(alice.UUID).Skipped) != 0 {
+		t.Fatal("skipped keys of the retired ratchet were kept")
+	}
+
+	testReceive(t, bob, testSend(t, alice, "default ratchet"), "default ratchet")
+}
+
+func TestAnnounceReplayed(t *testing.T) {
+	alice, bob := testPair(t)
+	id := uuid.New()
+
+	announce := new(bytes.Buffer)
+	if err := alice.AddRatchet(id, nil, announce); err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, bob, announce.Bytes(), "")
+	msg := testSendOn(t, alice, id, "first")
+	testReceive(t, bob, msg, "first")
+
+	// A replayed announcement doesn't reset the chain keys
+	if _, err := bob.ReceiveMessage(announce.Bytes()); err != ErrDuplicateRatchet {
+		t.Fatalf("got %v, want ErrDuplicateRatchet", err)
+	}
+	if _, err := bob.ReceiveMessage(msg); err != ErrDuplicate {
+		t.Fatalf("got %v, want ErrDuplicate", err)
+	}
+
+	// Nor does it bring back a retired ratchet, including after an export
+	retire := new(bytes.Buffer)
+	if err := alice.RetireRatchet(id, retire); err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, bob, retire.Bytes(), "")
+	bob = testReexport(t, bob)
+	if _, err := bob.ReceiveMessage(announce.Bytes()); err != ErrDuplicateRatchet {
+		t.Fatalf("got %v, want ErrDuplicateRatchet", err)
+	}
+	if findRatchet(bob.child(alice.UUID).Ratchets, id) != nil {
+		t.Fatal("retired ratchet was brought back")
+	}
+}
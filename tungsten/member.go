@@ -0,0 +1,386 @@
+package tungsten
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+)
+
+// The end of session initiation, see "Session initiation" in
+// /design/encryption.adoc. Once the new member and an existing member share an
+// ephem secret:
+//
+//  1. The new member generates a tx session, and sends Introduce to the
+//     existing member
+//  2. The existing member calls CreateUser, and sends the message to the group
+//  3. Every other member receives the message, and calls AcceptMember
+//  4. The new member calls JoinGroup with the same message
+
+var CREATE_USER_HKDF_INFO = []byte("create_user_hkdf")
+var CREATE_USER_INTRO_INFO = []byte("create_user_intro")
+var CREATE_USER_BUNDLE_INFO = []byte("create_user_bundle")
+var CREATE_USER_ENVELOPE_INFO = []byte("create_user_envelope")
+
+// secretKey derives a key for a single purpose from an ephem shared secret
+func secretKey(secret [32]byte, info []byte) ([32]byte, error) {
+	var key [32]byte
+	keyReader := hkdf.New(sha256.New, secret[:], nil, info)
+	_, err := io.ReadFull(keyReader, key[:])
+	return key, err
+}
+
+// Introduce writes the new member's rx session, encrypted with the ephem shared
+// secret, to be sent to the member that will add them. It is written as
+// UUID || Nonce || Sealed, where the UUID is the new member's and is the
+// associated data.
+func (t *TxSession) Introduce(secret [32]byte, w io.Writer) error {
+	key, err := secretKey(secret, CREATE_USER_INTRO_INFO)
+	if err != nil {
+		return err
+	}
+
+	plain := new(bytes.Buffer)
+	if err := t.AsRx().Export(plain); err != nil {
+		return err
+	}
+
+	var nonce [24]byte
+	if err := t.Config.read(nonce[:]); err != nil {
+		return err
+	}
+
+	w.Write(t.UUID[:])
+	w.Write(nonce[:])
+	_, err = w.Write(sealAEAD(&key, nonce[:], plain.Bytes(), t.UUID[:]))
+	wipe(plain.Bytes())
+	return err
+}
+
+// CreateUser adds the member who sent intro, and writes a create user message,
+// to be sent to the group. The message introduces the member to every other
+// member, and gives the new member our rx sessions.
+func (t *TxSession) CreateUser(secret [32]byte, intro []byte, w io.Writer) (*RxSession, error) {
+	// Open their introduction
+	key, err := secretKey(secret, CREATE_USER_INTRO_INFO)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(intro) < 16+24 {
+		return nil, ErrTruncated
+	}
+	id, nonce := intro[:16], intro[16:16+24]
+	plain, err := openAEAD(&key, nonce, intro[16+24:], id)
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := ImportRx(bytes.NewReader(plain))
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(member.UUID[:], id) {
+		return nil, ErrCorruptExport
+	}
+	// Checked before anything is sent, so a duplicate leaves no message behind
+	if err := t.checkNewMember(member.UUID); err != nil {
+		return nil, err
+	}
+
+	m := &CreateUser{
+		MsgType:  MSG_TYPE_CREATE_USER,
+		SenderID: t.UUID,
+		MemberID: member.UUID,
+	}
+
+	// Encrypt their rx session to every other member
+	stateKey, keys, err := sealTo(t.Config, &t.CurrentPrivkey, t.Children, CREATE_USER_HKDF_INFO, CREATE_USER_COMBINE_LABEL,
+		t.senderAD(), m.MemberID[:])
+	if err != nil {
+		return nil, err
+	}
+	m.Keys = keys
+
+	if err := t.Config.read(m.StateNonce[:]); err != nil {
+		return nil, err
+	}
+	m.State = sealAEAD(&stateKey, m.StateNonce[:], plain, m.ad())
+
+	// Bundle up our rx sessions for them
+	bundle := new(bytes.Buffer)
+	binary.Write(bundle, binary.BigEndian, int64(len(t.Children)+1))
+	for _, v := range append([]*RxSession{t.AsRx()}, t.Children...) {
+		// They can't read restricted ratchets until they are made a recipient
+		v = v.shareable()
+
+		b := new(bytes.Buffer)
+		if err := v.Export(b); err != nil {
+			return nil, err
+		}
+		writeBytes(bundle, b.Bytes())
+	}
+
+	bundleKey, err := secretKey(secret, CREATE_USER_BUNDLE_INFO)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.Config.read(m.BundleNonce[:]); err != nil {
+		return nil, err
+	}
+	m.Bundle = sealAEAD(&bundleKey, m.BundleNonce[:], bundle.Bytes(), m.ad())
+
+	// The new member doesn't have our header key, so the body key of the
+	// envelope is derived from the ephem secret instead
+	bodyKey, err := secretKey(secret, CREATE_USER_ENVELOPE_INFO)
+	if err != nil {
+		return nil, err
+	}
+
+	m.Sign(t.SigningKey, t.SigningKeyPQ)
+	if err := t.sendWith(m, bodyKey, w); err != nil {
+		return nil, err
+	}
+
+	if err := t.AcceptMember(member); err != nil {
+		return nil, err
+	}
+	if err := t.recordMember(member); err != nil {
+		return nil, err
+	}
+	return member, nil
+}
+
+// receiveCreateUser decrypts the rx session of the member introduced by a
+// create user message. It is not added as a child, see TxSession.AcceptMember.
+func (r *RxSession) receiveCreateUser(m *CreateUser) (*RxSession, error) {
+	stateKey, err := r.openFromSender(m.Keys, CREATE_USER_HKDF_INFO, CREATE_USER_COMBINE_LABEL, r.senderAD(), m.MemberID[:])
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := openAEAD(&stateKey, m.StateNonce[:], m.State, m.ad())
+	if err != nil {
+		return nil, err
+	}
+
+	member, err := ImportRx(bytes.NewReader(plain))
+	if err != nil {
+		return nil, err
+	}
+	if member.UUID != m.MemberID {
+		return nil, ErrCorruptExport
+	}
+
+	return member, nil
+}
+
+// AcceptMember adds a member, so that they receive our ratchet updates
+func (t *TxSession) AcceptMember(member *RxSession) error {
+	if err := t.checkNewMember(member.UUID); err != nil {
+		return err
+	}
+
+	member.Parent = t
+	t.Children = append(t.Children, member)
+	t.MembersChanged = t.Config.now().UnixNano()
+	return nil
+}
+
+// checkNewMember returns ErrDuplicateMember if id is us or already a member
+func (t *TxSession) checkNewMember(id uuid.UUID) error {
+	if id == t.UUID || t.child(id) != nil {
+		return ErrDuplicateMember
+	}
+	return nil
+}
+
+// JoinGroup completes session initiation for the new member, adding the rx
+// sessions in the create user message that introduced us
+func (t *TxSession) JoinGroup(secret [32]byte, msg []byte) error {
+	e := new(Envelope)
+	if err := e.Unmarshal(bytes.NewReader(msg)); err != nil {
+		return err
+	}
+
+	bodyKey, err := secretKey(secret, CREATE_USER_ENVELOPE_INFO)
+	if err != nil {
+		return err
+	}
+	msg, err = openAEAD(&bodyKey, e.Nonce[:], e.Body, e.bodyAD())
+	if err != nil {
+		return err
+	}
+
+	m := new(CreateUser)
+	if err := m.Unmarshal(bytes.NewReader(msg)); err != nil {
+		return err
+	}
+	if m.MsgType != MSG_TYPE_CREATE_USER {
+		return ErrUnknownMsgType
+	}
+	if m.MemberID != t.UUID {
+		return ErrUnknownSender
+	}
+
+	key, err := secretKey(secret, CREATE_USER_BUNDLE_INFO)
+	if err != nil {
+		return err
+	}
+	plain, err := openAEAD(&key, m.BundleNonce[:], m.Bundle, m.ad())
+	if err != nil {
+		return err
+	}
+
+	r := &errReader{r: bytes.NewReader(plain)}
+	var members []*RxSession
+	var count int64
+	binary.Read(r, binary.BigEndian, &count)
+	for i := int64(0); i < count && r.err == nil; i++ {
+		b := readBytes(r)
+		if r.err != nil {
+			break
+		}
+
+		rx, err := ImportRx(bytes.NewReader(b))
+		if err != nil {
+			return err
+		}
+		members = append(members, rx)
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	// The message must be signed by the member that sent us the bundle
+	var sender *RxSession
+	for _, v := range members {
+		if v.UUID == m.SenderID {
+			sender = v
+		}
+	}
+	if sender == nil {
+		return ErrUnknownSender
+	}
+
+	dataEnd := len(msg) - signaturesSize
+	if !verifySignatures(sender.VerifyingPubkey, &sender.VerifyingPubkeyPQ, m.Suite, msg[:dataEnd], m.Signature[:], m.SignaturePQ[:]) {
+		return ErrBadSignature
+	}
+
+	for _, v := range members {
+		if v.UUID != t.UUID && t.child(v.UUID) == nil {
+			t.AcceptMember(v)
+		}
+	}
+
+	return nil
+}
+
+// RemoveMember removes a member, writing a remove member message for the group
+// to removal, and a ratchet update that excludes them to update. Until every
+// other member has applied the removal, the removed member can still decrypt
+// their messages.
+func (t *TxSession) RemoveMember(id uuid.UUID, removal, update io.Writer) error {
+	m := &RemoveMember{
+		MsgType:  MSG_TYPE_REMOVE_MEMBER,
+		SenderID: t.UUID,
+		MemberID: id,
+	}
+	m.Sign(t.SigningKey, t.SigningKeyPQ)
+
+	// Sealed before the update replaces our header key, so members can open it
+	// whichever they receive first
+	msg := new(bytes.Buffer)
+	if err := t.send(m, msg); err != nil {
+		return err
+	}
+
+	if err := t.dropMember(id, update); err != nil {
+		return err
+	}
+
+	_, err := msg.WriteTo(removal)
+	return err
+}
+
+// ApplyRemoval removes the member named by a remove member message, writing a
+// ratchet update that excludes them to update. The message is verified again,
+// so it must be from a current member, but the application must check the
+// sender was allowed to remove them first.
+func (t *TxSession) ApplyRemoval(msg []byte, update io.Writer) error {
+	r, err := t.ReceiveMessage(msg)
+	if err != nil {
+		return err
+	}
+	if r.MsgType != MSG_TYPE_REMOVE_MEMBER {
+		return ErrUnknownMsgType
+	}
+
+	return t.dropMember(r.Removed, update)
+}
+
+// dropMember removes a child and rekeys every ratchet without them, leaving
+// the session untouched if the update fails
+func (t *TxSession) dropMember(id uuid.UUID, update io.Writer) error {
+	if t.child(id) == nil {
+		return ErrUnknownMember
+	}
+
+	children := t.Children
+	t.Children = nil
+	for _, v := range children {
+		if v.UUID != id {
+			t.Children = append(t.Children, v)
+		}
+	}
+
+	if err := t.GenerateUpdate(update); err != nil {
+		t.Children = children
+		return err
+	}
+	for _, v := range children {
+		if v.UUID == id {
+			v.Destroy()
+		}
+	}
+
+	for _, v := range t.Ratchets {
+		var recipients []uuid.UUID
+		for _, w := range v.Recipients {
+			if w != id {
+				recipients = append(recipients, w)
+			}
+		}
+		v.Recipients = recipients
+	}
+	return nil
+}
+
+// shareable returns a copy of the rx session that can be given to a new
+// member, without restricted ratchets or the keys of our skipped messages
+func (r *RxSession) shareable() *RxSession {
+	out := *r
+	out.Ratchets = nil
+	out.Skipped = nil
+
+	for _, v := range r.Ratchets {
+		if !v.Restricted {
+			out.Ratchets = append(out.Ratchets, v)
+		}
+	}
+	return &out
+}
+
+// child returns the rx session of a member, or nil if they aren't a member
+func (t *TxSession) child(id uuid.UUID) *RxSession {
+	for _, v := range t.Children {
+		if v.UUID == id {
+			return v
+		}
+	}
+	return nil
+}
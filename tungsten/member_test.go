@@ -0,0 +1,243 @@
+package tungsten
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+// testSecret returns an ephem shared secret, as agreed by two members before
+// session initiation
+func testSecret(t *testing.T) [32]byte {
+	t.Helper()
+	priv, _, err := GenEphem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, remotePub, err := GenEphem()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, secret, err := GenerateSharedSecret(priv, remotePub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+// testAdd adds a new member to the group of alice and bob through alice,
+// returning the new member and the create user message
+func testAdd(t *testing.T, alice, bob *TxSession) (*TxSession, []byte) {
+	t.Helper()
+	carol, err := GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := testSecret(t)
+
+	intro := new(bytes.Buffer)
+	if err := carol.Introduce(secret, intro); err != nil {
+		t.Fatal(err)
+	}
+	b := new(bytes.Buffer)
+	if _, err := alice.CreateUser(secret, intro.Bytes(), b); err != nil {
+		t.Fatal(err)
+	}
+	msg := b.Bytes()
+
+	r := testReceive(t, bob, msg, "")
+	if r.Member == nil || r.Member.UUID != carol.UUID {
+		t.Fatal("create user didn't introduce the member")
+	}
+	if err := bob.AcceptMember(r.Member); err != nil {
+		t.Fatal(err)
+	}
+	if err := carol.JoinGroup(secret, msg); err != nil {
+		t.Fatal(err)
+	}
+	return carol, msg
+}
+
+func TestCreateUser(t *testing.T) {
+	alice, bob := testPair(t)
+	carol, _ := testAdd(t, alice, bob)
+	if len(carol.Children) != 2 || alice.child(carol.UUID) == nil {
+		t.Fatal("members weren't added")
+	}
+
+	// Every member can talk to every other, including after updates
+	testReceive(t, carol, testSend(t, alice, "hello carol"), "hello carol")
+	testReceive(t, carol, testSend(t, bob, "hello carol"), "hello carol")
+	msg := testSend(t, carol, "hello both")
+	testReceive(t, alice, msg, "hello both")
+	testReceive(t, bob, msg, "hello both")
+
+	update := testUpdate(t, carol)
+	testReceive(t, alice, update, "")
+	testReceive(t, bob, update, "")
+	msg = testSend(t, carol, "after update")
+	testReceive(t, alice, msg, "after update")
+	testReceive(t, bob, msg, "after update")
+}
+
+func TestCreateUserDuplicate(t *testing.T) {
+	alice, bob := testPair(t)
+	secret := testSecret(t)
+	intro := new(bytes.Buffer)
+	if err := bob.Introduce(secret, intro); err != nil {
+		t.Fatal(err)
+	}
+
+	// An existing member is refused before anything is written
+	b := new(bytes.Buffer)
+	if _, err := alice.CreateUser(secret, intro.Bytes(), b); err != ErrDuplicateMember {
+		t.Fatalf("got %v, want ErrDuplicateMember", err)
+	}
+	if b.Len() != 0 {
+		t.Fatal("wrote a message for a duplicate member")
+	}
+	if len(alice.Children) != 1 {
+		t.Fatal("duplicate member was added")
+	}
+}
+
+func TestCreateUserWrongSecret(t *testing.T) {
+	alice, _ := testPair(t)
+	carol, err := GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := testSecret(t)
+
+	intro := new(bytes.Buffer)
+	if err := carol.Introduce(secret, intro); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := alice.CreateUser(testSecret(t), intro.Bytes(), new(bytes.Buffer)); err != ErrMACFailure {
+		t.Fatalf("create user: got %v, want ErrMACFailure", err)
+	}
+
+	b := new(bytes.Buffer)
+	if _, err := alice.CreateUser(secret, intro.Bytes(), b); err != nil {
+		t.Fatal(err)
+	}
+	if err := carol.JoinGroup(testSecret(t), b.Bytes()); err != ErrMACFailure {
+		t.Fatalf("join group: got %v, want ErrMACFailure", err)
+	}
+	if len(carol.Children) != 0 {
+		t.Fatal("members were added with the wrong secret")
+	}
+}
+
+func TestJoinGroupBadSignature(t *testing.T) {
+	alice, _ := testPair(t)
+	carol, err := GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := testSecret(t)
+
+	intro := new(bytes.Buffer)
+	if err := carol.Introduce(secret, intro); err != nil {
+		t.Fatal(err)
+	}
+	b := new(bytes.Buffer)
+	if _, err := alice.CreateUser(secret, intro.Bytes(), b); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reseal the message with a flipped signature byte, as anyone holding the
+	// ephem secret could
+	e := new(Envelope)
+	if err := e.Unmarshal(bytes.NewReader(b.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	bodyKey, err := secretKey(secret, CREATE_USER_ENVELOPE_INFO)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := openAEAD(&bodyKey, e.Nonce[:], e.Body, e.bodyAD())
+	if err != nil {
+		t.Fatal(err)
+	}
+	body[len(body)-1] ^= 1
+	e.Body = sealAEAD(&bodyKey, e.Nonce[:], body, e.bodyAD())
+	forged := new(bytes.Buffer)
+	e.Marshal(forged)
+
+	if err := carol.JoinGroup(secret, forged.Bytes()); err != ErrBadSignature {
+		t.Fatalf("got %v, want ErrBadSignature", err)
+	}
+	if len(carol.Children) != 0 {
+		t.Fatal("members were added from a forged message")
+	}
+}
+
+func TestRemoveMember(t *testing.T) {
+	alice, bob := testPair(t)
+	carol, _ := testAdd(t, alice, bob)
+	data := testSend(t, alice, "not a removal")
+
+	removal, update := new(bytes.Buffer), new(bytes.Buffer)
+	if err := alice.RemoveMember(carol.UUID, removal, update); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.RemoveMember(carol.UUID, new(bytes.Buffer), new(bytes.Buffer)); err != ErrUnknownMember {
+		t.Fatalf("got %v, want ErrUnknownMember", err)
+	}
+
+	r := testReceive(t, bob, removal.Bytes(), "")
+	if r.MsgType != MSG_TYPE_REMOVE_MEMBER || r.Removed != carol.UUID {
+		t.Fatal("remove member didn't name the member")
+	}
+	if r := testReceive(t, carol, removal.Bytes(), ""); r.Removed != carol.UUID {
+		t.Fatal("removed member wasn't told")
+	}
+
+	// Only a remove member message is applied, and only when it is intact
+	if err := bob.ApplyRemoval(data, new(bytes.Buffer)); err != ErrUnknownMsgType {
+		t.Fatalf("data: got %v, want ErrUnknownMsgType", err)
+	}
+	tampered := append([]byte(nil), removal.Bytes()...)
+	tampered[len(tampered)-1] ^= 1
+	if err := bob.ApplyRemoval(tampered, new(bytes.Buffer)); err == nil {
+		t.Fatal("applied a tampered removal")
+	}
+	if bob.child(carol.UUID) == nil {
+		t.Fatal("member was removed by a rejected message")
+	}
+
+	bobUpdate := new(bytes.Buffer)
+	if err := bob.ApplyRemoval(removal.Bytes(), bobUpdate); err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, bob, update.Bytes(), "")
+	testReceive(t, alice, bobUpdate.Bytes(), "")
+	if len(alice.Children) != 1 || len(bob.Children) != 1 {
+		t.Fatal("member wasn't removed")
+	}
+
+	// After the rekey, the removed member can't open the updates or messages of
+	// either remaining member
+	for _, msg := range [][]byte{
+		update.Bytes(),
+		bobUpdate.Bytes(),
+		testSend(t, alice, "after removal"),
+		testSend(t, bob, "after removal"),
+	} {
+		if _, err := carol.ReceiveMessage(msg); err == nil {
+			t.Fatal("removed member opened a message")
+		}
+	}
+	testReceive(t, bob, testSend(t, alice, "still here"), "still here")
+
+	// Nor can they remove anyone
+	theirRemoval := new(bytes.Buffer)
+	if err := carol.RemoveMember(bob.UUID, theirRemoval, new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ApplyRemoval(theirRemoval.Bytes(), new(bytes.Buffer)); err != ErrUnknownSender {
+		t.Fatalf("got %v, want ErrUnknownSender", err)
+	}
+}
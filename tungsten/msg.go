@@ -1,4 +1,4 @@
-package main
+package tungsten
 
 import (
 	"bytes"
@@ -6,68 +6,134 @@ import (
 	"io"
 
 	"github.com/cloudflare/circl/dh/x25519"
-	"github.com/cloudflare/circl/pke/kyber/kyber768"
-	"github.com/cloudflare/circl/sign/dilithium/mode2"
 	"github.com/cloudflare/circl/sign/ed25519"
 	"github.com/google/uuid"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 const (
 	MSG_TYPE_DATA = iota
 	MSG_TYPE_RATCHET_UPDATE
+	MSG_TYPE_CREATE_USER
+	MSG_TYPE_REMOVE_MEMBER
+	MSG_TYPE_ANNOUNCE_RATCHET
+	MSG_TYPE_RETIRE_RATCHET
+	MSG_TYPE_ROTATE_KEYS
 )
 
+// Every message ends with its signatures, after the suite of the sender's
+// signing keys
+const signaturesSize = ed25519.SignatureSize + PQ_SIGNATURE_SIZE
+
+// signBody signs the marshalled body of a message, which excludes the
+// signatures themselves
+func signBody(ed ed25519.PrivateKey, pq PQSigningKey, body []byte, sig *ECSignature, sigPQ *PQSignature) {
+	copy(sig[:], ed25519.Sign(ed, body))
+	pq.sign(body, sigPQ[:])
+}
+
+// The envelope that every message is sent in. Only members with the sender's
+// header key can open it, see header.go.
+type Envelope struct {
+	Hint   byte // Of the header key, see headerHint
+	Nonce  [24]byte
+	Header [32 + chacha20poly1305.Overhead]byte // A random body key, sealed with the header key
+	Body   []byte                               // The message, sealed with the body key
+}
+
+func (e *Envelope) Marshal(w io.Writer) {
+	w.Write([]byte{e.Hint})
+	w.Write(e.Nonce[:])
+	w.Write(e.Header[:])
+	w.Write(e.Body)
+}
+
+func (e *Envelope) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+
+	b := make([]byte, 1)
+	er.Read(b)
+	e.Hint = b[0]
+
+	er.Read(e.Nonce[:])
+	er.Read(e.Header[:])
+	if er.err != nil {
+		return er.err
+	}
+
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return ErrTruncated
+	}
+	e.Body = b
+	return nil
+}
+
 // A normal message containing encrypted data
 type Data struct {
 	MsgType   byte
 	SenderID  uuid.UUID
 	RatchetID uuid.UUID
+	Epoch     uint32 // Number of ratchet updates applied to the ratchet
+	Counter   uint32 // Index of the message key in the symmetric ratchet
 	Nonce     [24]byte
 	Payload   []byte
 
+	Suite       Suite // Of the signatures
 	Signature   ECSignature
-	SignaturePQ DiLiSignature
+	SignaturePQ PQSignature
 }
 
 func (m *Data) Marshal(w io.Writer) {
 	w.Write([]byte{m.MsgType})
 	w.Write(m.SenderID[:])
 	w.Write(m.RatchetID[:])
+	binary.Write(w, binary.BigEndian, m.Epoch)
+	binary.Write(w, binary.BigEndian, m.Counter)
 	w.Write(m.Nonce[:])
 	w.Write(m.Payload)
+	binary.Write(w, binary.BigEndian, m.Suite)
 	w.Write(m.Signature[:])
 	w.Write(m.SignaturePQ[:])
 }
 
-func (m *Data) Sign(ed ed25519.PrivateKey, dili mode2.PrivateKey) {
+func (m *Data) Sign(ed ed25519.PrivateKey, pq PQSigningKey) {
+	m.Suite = pq.Suite
 	b := new(bytes.Buffer)
 	m.Marshal(b)
 
-	dataEnd := b.Len() - ed25519.SignatureSize - mode2.SignatureSize
-	msg := b.Bytes()[:dataEnd]
-
-	sig := ed25519.Sign(ed, msg)
-	copy(m.Signature[:], sig)
-
-	mode2.SignTo(&dili, msg, m.SignaturePQ[:])
+	signBody(ed, pq, b.Bytes()[:b.Len()-signaturesSize], &m.Signature, &m.SignaturePQ)
 }
 
-func (m *Data) Unmarshal(r io.Reader) {
+func (m *Data) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+
 	b := make([]byte, 1)
-	io.ReadFull(r, b)
+	er.Read(b)
 	m.MsgType = b[0]
 
-	io.ReadFull(r, m.SenderID[:])
-	io.ReadFull(r, m.RatchetID[:])
+	er.Read(m.SenderID[:])
+	er.Read(m.RatchetID[:])
+	binary.Read(er, binary.BigEndian, &m.Epoch)
+	binary.Read(er, binary.BigEndian, &m.Counter)
+
+	er.Read(m.Nonce[:])
+	if er.err != nil {
+		return er.err
+	}
 
-	io.ReadFull(r, m.Nonce[:])
+	b, err := io.ReadAll(r)
+	if err != nil || len(b) < 2+signaturesSize {
+		return ErrTruncated
+	}
+	m.Payload = b[:len(b)-2-signaturesSize]
+	sigs := &errReader{r: bytes.NewBuffer(b[len(m.Payload):])}
 
-	b, _ = io.ReadAll(r)
-	m.Payload = b[:len(b)-ed25519.SignatureSize-mode2.SignatureSize]
-	newBuf := bytes.NewBuffer(b[len(b)-ed25519.SignatureSize-mode2.SignatureSize:])
+	m.Suite = readSuite(sigs)
+	sigs.Read(m.Signature[:])
+	sigs.Read(m.SignaturePQ[:])
 
-	io.ReadFull(newBuf, m.Signature[:])
-	io.ReadFull(newBuf, m.SignaturePQ[:])
+	return sigs.err
 }
 
 // A message sent for updating the ratchets of other users
@@ -75,80 +141,619 @@ type RatchetUpdate struct {
 	MsgType     byte
 	SenderID    uuid.UUID
 	NewPubkey   x25519.Key
-	NewPubkeyPQ kyber768.PublicKey
+	NewPubkeyPQ PQPubkey
+	Timestamp   int64 // When the keypair was generated (unix nanoseconds), only ever increasing
 
 	Updates []UserRatchetUpdate
 
+	// Our new header key, encapsulated to each member
+	HeaderKeys []UserKey
+
+	// In tree mode, the nodes above our leaf in the ratchet tree, which replace
+	// the updates and header keys for ratchets every member can read
+	Path *UpdatePath
+
+	Suite       Suite // Of the signatures
 	Signature   ECSignature
-	SignaturePQ DiLiSignature
+	SignaturePQ PQSignature
+}
+
+// Part of RatchetUpdate. See tree.go.
+type UpdatePath struct {
+	Leaves   uint32 // Number of members in the sender's tree
+	Leaf     uint32 // The sender's leaf
+	Nodes    []PathNode
+	Ratchets []TreeRatchetUpdate
+}
+
+// Part of UpdatePath. A node above the sender's leaf, from its parent to the
+// root.
+type PathNode struct {
+	Pubkey   x25519.Key
+	PubkeyPQ PQPubkey
+
+	// The node's secret, encapsulated to each node covering the other child
+	Secrets []NodeSecret
+}
+
+// Part of PathNode. Addressed by the pubkey of the node it's encapsulated to.
+type NodeSecret struct {
+	Target x25519.Key
+	DH     DHKeyCiphertext
+	PQ     PQKeyCiphertext
+}
+
+// Part of UpdatePath. A ratchet advanced with keys derived from the commit
+// secret.
+type TreeRatchetUpdate struct {
+	RatchetID   uuid.UUID
+	Epoch       uint32
+	PrevCounter uint32
 }
 
 // Part of RatchetUpdate. Addressed per user & ratchet.
 type UserRatchetUpdate struct {
-	UserID    uuid.UUID
-	RatchetID uuid.UUID
-	DH        DHKeyCiphertext
-	Kyber     KyberKeyCiphertext
+	UserID      uuid.UUID
+	RatchetID   uuid.UUID
+	Epoch       uint32 // Epoch of the ratchet after the update
+	PrevCounter uint32 // Number of messages sent in the previous symmetric ratchet
+	DH          DHKeyCiphertext
+	PQ          PQKeyCiphertext
 }
 
 func (m *RatchetUpdate) Marshal(w io.Writer) {
 	w.Write([]byte{m.MsgType})
 	w.Write(m.SenderID[:])
 	w.Write(m.NewPubkey[:])
-
-	b := make([]byte, kyber768.PublicKeySize)
-	m.NewPubkeyPQ.Pack(b)
-	w.Write(b)
+	m.NewPubkeyPQ.Marshal(w)
+	binary.Write(w, binary.BigEndian, m.Timestamp)
 
 	binary.Write(w, binary.BigEndian, int64(len(m.Updates)))
 	for _, v := range m.Updates {
 		w.Write(v.UserID[:])
 		w.Write(v.RatchetID[:])
+		binary.Write(w, binary.BigEndian, v.Epoch)
+		binary.Write(w, binary.BigEndian, v.PrevCounter)
 		w.Write(v.DH[:])
-		w.Write(v.Kyber[:])
+		w.Write(v.PQ[:])
 	}
 
+	writeUserKeys(w, m.HeaderKeys)
+
+	if m.Path == nil {
+		w.Write([]byte{0})
+	} else {
+		w.Write([]byte{1})
+		writePath(w, m.Path)
+	}
+
+	binary.Write(w, binary.BigEndian, m.Suite)
 	w.Write(m.Signature[:])
 	w.Write(m.SignaturePQ[:])
 }
 
-func (m *RatchetUpdate) Sign(ed ed25519.PrivateKey, dili mode2.PrivateKey) {
+func (m *RatchetUpdate) Sign(ed ed25519.PrivateKey, pq PQSigningKey) {
+	m.Suite = pq.Suite
 	b := new(bytes.Buffer)
 	m.Marshal(b)
 
-	dataEnd := b.Len() - ed25519.SignatureSize - mode2.SignatureSize
-	msg := b.Bytes()[:dataEnd]
+	signBody(ed, pq, b.Bytes()[:b.Len()-signaturesSize], &m.Signature, &m.SignaturePQ)
+}
+
+func (m *RatchetUpdate) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+
+	b := make([]byte, 1)
+	er.Read(b)
+	m.MsgType = b[0]
+	er.Read(m.SenderID[:])
+
+	er.Read(m.NewPubkey[:])
+	readPQ(er, false, &m.NewPubkeyPQ)
+	binary.Read(er, binary.BigEndian, &m.Timestamp)
 
-	sig := ed25519.Sign(ed, msg)
-	copy(m.Signature[:], sig)
+	var l int64
+	binary.Read(er, binary.BigEndian, &l)
+	for i := int64(0); i < l && er.err == nil; i++ {
+		v := UserRatchetUpdate{}
+		er.Read(v.UserID[:])
+		er.Read(v.RatchetID[:])
+		binary.Read(er, binary.BigEndian, &v.Epoch)
+		binary.Read(er, binary.BigEndian, &v.PrevCounter)
+		er.Read(v.DH[:])
+		er.Read(v.PQ[:])
 
-	mode2.SignTo(&dili, msg, m.SignaturePQ[:])
+		m.Updates = append(m.Updates, v)
+	}
+
+	m.HeaderKeys = readUserKeys(er)
+
+	b = make([]byte, 1)
+	er.Read(b)
+	if b[0] == 1 {
+		m.Path = readPath(er)
+	}
+
+	m.Suite = readSuite(er)
+	er.Read(m.Signature[:])
+	er.Read(m.SignaturePQ[:])
+
+	return er.err
 }
 
-func (m *RatchetUpdate) Unmarshal(r io.Reader) {
+func writePath(w io.Writer, p *UpdatePath) {
+	binary.Write(w, binary.BigEndian, p.Leaves)
+	binary.Write(w, binary.BigEndian, p.Leaf)
+
+	binary.Write(w, binary.BigEndian, int64(len(p.Nodes)))
+	for _, v := range p.Nodes {
+		w.Write(v.Pubkey[:])
+		v.PubkeyPQ.Marshal(w)
+
+		binary.Write(w, binary.BigEndian, int64(len(v.Secrets)))
+		for _, s := range v.Secrets {
+			w.Write(s.Target[:])
+			w.Write(s.DH[:])
+			w.Write(s.PQ[:])
+		}
+	}
+
+	binary.Write(w, binary.BigEndian, int64(len(p.Ratchets)))
+	for _, v := range p.Ratchets {
+		w.Write(v.RatchetID[:])
+		binary.Write(w, binary.BigEndian, v.Epoch)
+		binary.Write(w, binary.BigEndian, v.PrevCounter)
+	}
+}
+
+func readPath(er *errReader) *UpdatePath {
+	p := new(UpdatePath)
+	binary.Read(er, binary.BigEndian, &p.Leaves)
+	binary.Read(er, binary.BigEndian, &p.Leaf)
+
+	var l int64
+	binary.Read(er, binary.BigEndian, &l)
+	for i := int64(0); i < l && er.err == nil; i++ {
+		var v PathNode
+		er.Read(v.Pubkey[:])
+		readPQ(er, false, &v.PubkeyPQ)
+
+		var sl int64
+		binary.Read(er, binary.BigEndian, &sl)
+		for j := int64(0); j < sl && er.err == nil; j++ {
+			var s NodeSecret
+			er.Read(s.Target[:])
+			er.Read(s.DH[:])
+			er.Read(s.PQ[:])
+			v.Secrets = append(v.Secrets, s)
+		}
+
+		p.Nodes = append(p.Nodes, v)
+	}
+
+	binary.Read(er, binary.BigEndian, &l)
+	for i := int64(0); i < l && er.err == nil; i++ {
+		var v TreeRatchetUpdate
+		er.Read(v.RatchetID[:])
+		binary.Read(er, binary.BigEndian, &v.Epoch)
+		binary.Read(er, binary.BigEndian, &v.PrevCounter)
+		p.Ratchets = append(p.Ratchets, v)
+	}
+
+	return p
+}
+
+// A message introducing a new member to the group, sent by the member that
+// initiated a session with them
+type CreateUser struct {
+	MsgType  byte
+	SenderID uuid.UUID
+	MemberID uuid.UUID
+
+	// The new member's rx session, encrypted with a key which is encapsulated
+	// to each existing member
+	StateNonce [24]byte
+	State      []byte
+	Keys       []UserKey
+
+	// The sender's rx sessions (including their own), for the new member,
+	// encrypted with a key derived from the ephem shared secret
+	BundleNonce [24]byte
+	Bundle      []byte
+
+	Suite       Suite // Of the signatures
+	Signature   ECSignature
+	SignaturePQ PQSignature
+}
+
+// Part of CreateUser. A key encapsulated to a user.
+type UserKey struct {
+	UserID uuid.UUID
+	DH     DHKeyCiphertext
+	PQ     PQKeyCiphertext
+}
+
+func (m *CreateUser) Marshal(w io.Writer) {
+	w.Write([]byte{m.MsgType})
+	w.Write(m.SenderID[:])
+	w.Write(m.MemberID[:])
+
+	w.Write(m.StateNonce[:])
+	writeBytes(w, m.State)
+
+	writeUserKeys(w, m.Keys)
+
+	w.Write(m.BundleNonce[:])
+	writeBytes(w, m.Bundle)
+
+	binary.Write(w, binary.BigEndian, m.Suite)
+	w.Write(m.Signature[:])
+	w.Write(m.SignaturePQ[:])
+}
+
+func (m *CreateUser) Sign(ed ed25519.PrivateKey, pq PQSigningKey) {
+	m.Suite = pq.Suite
+	b := new(bytes.Buffer)
+	m.Marshal(b)
+
+	signBody(ed, pq, b.Bytes()[:b.Len()-signaturesSize], &m.Signature, &m.SignaturePQ)
+}
+
+func (m *CreateUser) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+
 	b := make([]byte, 1)
-	io.ReadFull(r, b)
+	er.Read(b)
 	m.MsgType = b[0]
-	io.ReadFull(r, m.SenderID[:])
+	er.Read(m.SenderID[:])
+	er.Read(m.MemberID[:])
+
+	er.Read(m.StateNonce[:])
+	m.State = readBytes(er)
+
+	m.Keys = readUserKeys(er)
 
-	io.ReadFull(r, m.NewPubkey[:])
+	er.Read(m.BundleNonce[:])
+	m.Bundle = readBytes(er)
+
+	m.Suite = readSuite(er)
+	er.Read(m.Signature[:])
+	er.Read(m.SignaturePQ[:])
+
+	return er.err
+}
 
-	b = make([]byte, kyber768.PublicKeySize)
-	io.ReadFull(r, b)
-	m.NewPubkeyPQ.Unpack(b)
+// A signed notice that a member has been removed from the group
+type RemoveMember struct {
+	MsgType  byte
+	SenderID uuid.UUID
+	MemberID uuid.UUID
+
+	Suite       Suite // Of the signatures
+	Signature   ECSignature
+	SignaturePQ PQSignature
+}
+
+func (m *RemoveMember) Marshal(w io.Writer) {
+	w.Write([]byte{m.MsgType})
+	w.Write(m.SenderID[:])
+	w.Write(m.MemberID[:])
+	binary.Write(w, binary.BigEndian, m.Suite)
+	w.Write(m.Signature[:])
+	w.Write(m.SignaturePQ[:])
+}
+
+func (m *RemoveMember) Sign(ed ed25519.PrivateKey, pq PQSigningKey) {
+	m.Suite = pq.Suite
+	b := new(bytes.Buffer)
+	m.Marshal(b)
+
+	signBody(ed, pq, b.Bytes()[:b.Len()-signaturesSize], &m.Signature, &m.SignaturePQ)
+}
+
+func (m *RemoveMember) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+
+	b := make([]byte, 1)
+	er.Read(b)
+	m.MsgType = b[0]
+	er.Read(m.SenderID[:])
+	er.Read(m.MemberID[:])
+
+	m.Suite = readSuite(er)
+	er.Read(m.Signature[:])
+	er.Read(m.SignaturePQ[:])
+
+	return er.err
+}
+
+// Announces a new ratchet of the sender. The initial chain keys are encrypted
+// with a key which is encapsulated to each member.
+type AnnounceRatchet struct {
+	MsgType     byte
+	SenderID    uuid.UUID
+	RatchetID   uuid.UUID
+	Epoch       uint32
+	PrevCounter uint32 // Number of messages sent with the ratchet it replaces
+
+	// Members allowed to read the ratchet, if it is restricted
+	Restricted bool
+	Recipients []uuid.UUID
+
+	Keys    []UserKey
+	Nonce   [24]byte
+	Payload []byte
+
+	Suite       Suite // Of the signatures
+	Signature   ECSignature
+	SignaturePQ PQSignature
+}
+
+func (m *AnnounceRatchet) Marshal(w io.Writer) {
+	w.Write([]byte{m.MsgType})
+	w.Write(m.SenderID[:])
+	w.Write(m.RatchetID[:])
+	binary.Write(w, binary.BigEndian, m.Epoch)
+	binary.Write(w, binary.BigEndian, m.PrevCounter)
+
+	binary.Write(w, binary.BigEndian, m.Restricted)
+	binary.Write(w, binary.BigEndian, int64(len(m.Recipients)))
+	for _, v := range m.Recipients {
+		w.Write(v[:])
+	}
+
+	writeUserKeys(w, m.Keys)
+
+	w.Write(m.Nonce[:])
+	writeBytes(w, m.Payload)
+
+	binary.Write(w, binary.BigEndian, m.Suite)
+	w.Write(m.Signature[:])
+	w.Write(m.SignaturePQ[:])
+}
+
+func (m *AnnounceRatchet) Sign(ed ed25519.PrivateKey, pq PQSigningKey) {
+	m.Suite = pq.Suite
+	b := new(bytes.Buffer)
+	m.Marshal(b)
+
+	signBody(ed, pq, b.Bytes()[:b.Len()-signaturesSize], &m.Signature, &m.SignaturePQ)
+}
+
+func (m *AnnounceRatchet) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+
+	b := make([]byte, 1)
+	er.Read(b)
+	m.MsgType = b[0]
+	er.Read(m.SenderID[:])
+	er.Read(m.RatchetID[:])
+	binary.Read(er, binary.BigEndian, &m.Epoch)
+	binary.Read(er, binary.BigEndian, &m.PrevCounter)
+
+	binary.Read(er, binary.BigEndian, &m.Restricted)
+	var l int64
+	binary.Read(er, binary.BigEndian, &l)
+	for i := int64(0); i < l && er.err == nil; i++ {
+		var v uuid.UUID
+		er.Read(v[:])
+		m.Recipients = append(m.Recipients, v)
+	}
+
+	m.Keys = readUserKeys(er)
+
+	er.Read(m.Nonce[:])
+	m.Payload = readBytes(er)
+
+	m.Suite = readSuite(er)
+	er.Read(m.Signature[:])
+	er.Read(m.SignaturePQ[:])
+
+	return er.err
+}
+
+// Retires a ratchet of the sender
+type RetireRatchet struct {
+	MsgType   byte
+	SenderID  uuid.UUID
+	RatchetID uuid.UUID
+
+	Suite       Suite // Of the signatures
+	Signature   ECSignature
+	SignaturePQ PQSignature
+}
+
+func (m *RetireRatchet) Marshal(w io.Writer) {
+	w.Write([]byte{m.MsgType})
+	w.Write(m.SenderID[:])
+	w.Write(m.RatchetID[:])
+	binary.Write(w, binary.BigEndian, m.Suite)
+	w.Write(m.Signature[:])
+	w.Write(m.SignaturePQ[:])
+}
+
+func (m *RetireRatchet) Sign(ed ed25519.PrivateKey, pq PQSigningKey) {
+	m.Suite = pq.Suite
+	b := new(bytes.Buffer)
+	m.Marshal(b)
+
+	signBody(ed, pq, b.Bytes()[:b.Len()-signaturesSize], &m.Signature, &m.SignaturePQ)
+}
+
+func (m *RetireRatchet) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+
+	b := make([]byte, 1)
+	er.Read(b)
+	m.MsgType = b[0]
+	er.Read(m.SenderID[:])
+	er.Read(m.RatchetID[:])
+
+	m.Suite = readSuite(er)
+	er.Read(m.Signature[:])
+	er.Read(m.SignaturePQ[:])
+
+	return er.err
+}
+
+// Replaces the sender's signing keys. It is signed with the new keys, and then
+// with the old keys, so that members know the sender holds both.
+type RotateKeys struct {
+	MsgType           byte
+	SenderID          uuid.UUID
+	Generation        uint32 // Number of rotations, including this one
+	VerifyingPubkey   ed25519.PublicKey
+	VerifyingPubkeyPQ PQVerifyingKey
+
+	// Position of each of the sender's ratchets at the rotation. Data messages
+	// from earlier positions were signed with the old keys.
+	Positions []RatchetPosition
+
+	NewSignature   ECSignature
+	NewSignaturePQ PQSignature
+
+	Suite       Suite // Of the signatures
+	Signature   ECSignature
+	SignaturePQ PQSignature
+}
+
+// Part of RotateKeys. The position of the next message in a ratchet.
+type RatchetPosition struct {
+	RatchetID uuid.UUID
+	Epoch     uint32
+	Counter   uint32
+}
+
+func (m *RotateKeys) Marshal(w io.Writer) {
+	w.Write([]byte{m.MsgType})
+	w.Write(m.SenderID[:])
+	binary.Write(w, binary.BigEndian, m.Generation)
+	w.Write(m.VerifyingPubkey)
+	m.VerifyingPubkeyPQ.Marshal(w)
+	writePositions(w, m.Positions)
+
+	w.Write(m.NewSignature[:])
+	w.Write(m.NewSignaturePQ[:])
+	binary.Write(w, binary.BigEndian, m.Suite)
+	w.Write(m.Signature[:])
+	w.Write(m.SignaturePQ[:])
+}
+
+// SignNew signs the message with the new keys. It must be called before Sign.
+func (m *RotateKeys) SignNew(ed ed25519.PrivateKey, pq PQSigningKey) {
+	b := new(bytes.Buffer)
+	m.Marshal(b)
+
+	newEnd := b.Len() - 2*signaturesSize - 2
+	signBody(ed, pq, b.Bytes()[:newEnd], &m.NewSignature, &m.NewSignaturePQ)
+}
+
+func (m *RotateKeys) Sign(ed ed25519.PrivateKey, pq PQSigningKey) {
+	m.Suite = pq.Suite
+	b := new(bytes.Buffer)
+	m.Marshal(b)
+
+	signBody(ed, pq, b.Bytes()[:b.Len()-signaturesSize], &m.Signature, &m.SignaturePQ)
+}
+
+func (m *RotateKeys) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+
+	b := make([]byte, 1)
+	er.Read(b)
+	m.MsgType = b[0]
+	er.Read(m.SenderID[:])
+	binary.Read(er, binary.BigEndian, &m.Generation)
+
+	m.VerifyingPubkey = make(ed25519.PublicKey, ed25519.PublicKeySize)
+	er.Read(m.VerifyingPubkey)
+
+	readPQ(er, false, &m.VerifyingPubkeyPQ)
+
+	m.Positions = readPositions(er)
+
+	er.Read(m.NewSignature[:])
+	er.Read(m.NewSignaturePQ[:])
+	m.Suite = readSuite(er)
+	er.Read(m.Signature[:])
+	er.Read(m.SignaturePQ[:])
+
+	return er.err
+}
+
+func writePositions(w io.Writer, positions []RatchetPosition) {
+	binary.Write(w, binary.BigEndian, int64(len(positions)))
+	for _, v := range positions {
+		w.Write(v.RatchetID[:])
+		binary.Write(w, binary.BigEndian, v.Epoch)
+		binary.Write(w, binary.BigEndian, v.Counter)
+	}
+}
+
+func readPositions(r *errReader) []RatchetPosition {
+	var positions []RatchetPosition
 
 	var l int64
 	binary.Read(r, binary.BigEndian, &l)
-	for i := int64(0); i < l; i++ {
-		v := UserRatchetUpdate{}
-		io.ReadFull(r, v.UserID[:])
-		io.ReadFull(r, v.RatchetID[:])
-		io.ReadFull(r, v.DH[:])
-		io.ReadFull(r, v.Kyber[:])
+	for i := int64(0); i < l && r.err == nil; i++ {
+		v := RatchetPosition{}
+		r.Read(v.RatchetID[:])
+		binary.Read(r, binary.BigEndian, &v.Epoch)
+		binary.Read(r, binary.BigEndian, &v.Counter)
 
-		m.Updates = append(m.Updates, v)
+		positions = append(positions, v)
+	}
+
+	return positions
+}
+
+func writeUserKeys(w io.Writer, keys []UserKey) {
+	binary.Write(w, binary.BigEndian, int64(len(keys)))
+	for _, v := range keys {
+		w.Write(v.UserID[:])
+		w.Write(v.DH[:])
+		w.Write(v.PQ[:])
+	}
+}
+
+func readUserKeys(r *errReader) []UserKey {
+	var keys []UserKey
+
+	var l int64
+	binary.Read(r, binary.BigEndian, &l)
+	for i := int64(0); i < l && r.err == nil; i++ {
+		v := UserKey{}
+		r.Read(v.UserID[:])
+		r.Read(v.DH[:])
+		r.Read(v.PQ[:])
+
+		keys = append(keys, v)
+	}
+
+	return keys
+}
+
+// writeBytes writes a length-prefixed byte slice
+func writeBytes(w io.Writer, b []byte) {
+	binary.Write(w, binary.BigEndian, int64(len(b)))
+	w.Write(b)
+}
+
+// readBytes reads a length-prefixed byte slice. The slice grows as it is read,
+// so a bogus length can't allocate more than the input.
+func readBytes(r *errReader) []byte {
+	var l int64
+	binary.Read(r, binary.BigEndian, &l)
+	if r.err != nil {
+		return nil
+	}
+
+	b := new(bytes.Buffer)
+	n, err := io.CopyN(b, r.r, l)
+	if err != nil || n != l {
+		r.err = ErrTruncated
+		return nil
 	}
 
-	io.ReadFull(r, m.Signature[:])
-	io.ReadFull(r, m.SignaturePQ[:])
+	return b.Bytes()
 }
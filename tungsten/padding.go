@@ -0,0 +1,80 @@
+package tungsten
+
+import "math/bits"
+
+// Padding policies, for hiding the length of data messages from the server.
+// The payload is padded with a 0x80 byte followed by zeroes (ISO/IEC 7816-4)
+// before it is encrypted, so it can be unpadded whatever the sender's policy.
+const (
+	PADDING_PADME   = iota // Padmé, which leaks at most O(log log n) bits of the length
+	PADDING_BUCKETS        // The smallest of paddingBuckets, then multiples of the largest
+	PADDING_NONE           // Only the 0x80 byte
+)
+
+// Bucket sizes, up to the 500 KiB that chat message batches are padded to
+var paddingBuckets = []int{256, 1024, 4096, 16 * 1024, 64 * 1024, 256 * 1024, 500 * 1024}
+
+// SetPadding sets the padding policy for our data messages
+func (t *TxSession) SetPadding(policy byte) error {
+	if policy > PADDING_NONE {
+		return ErrInvalidArg
+	}
+
+	t.Padding = policy
+	return nil
+}
+
+// pad pads msg to the length given by policy
+func pad(msg []byte, policy byte) []byte {
+	l := len(msg) + 1
+
+	switch policy {
+	case PADDING_PADME:
+		l = padme(l)
+
+	case PADDING_BUCKETS:
+		last := paddingBuckets[len(paddingBuckets)-1]
+		if l > last {
+			l = (l + last - 1) / last * last
+			break
+		}
+
+		for _, v := range paddingBuckets {
+			if l <= v {
+				l = v
+				break
+			}
+		}
+	}
+
+	out := make([]byte, l)
+	copy(out, msg)
+	out[len(msg)] = 0x80
+	return out
+}
+
+// unpad removes the padding added by pad
+func unpad(padded []byte) ([]byte, error) {
+	i := len(padded) - 1
+	for i >= 0 && padded[i] == 0 {
+		i--
+	}
+
+	if i < 0 || padded[i] != 0x80 {
+		return nil, ErrBadPadding
+	}
+	return padded[:i], nil
+}
+
+// padme rounds l up so that only the top O(log log l) bits are significant, see
+// "Reducing Metadata Leakage from Encrypted Files and Communication with PURBs"
+func padme(l int) int {
+	if l < 2 {
+		return l
+	}
+
+	e := bits.Len(uint(l)) - 1
+	s := bits.Len(uint(e))
+	mask := 1<<(e-s) - 1
+	return (l + mask) &^ mask
+}
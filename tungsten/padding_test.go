@@ -0,0 +1,112 @@
+package tungsten
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPadme(t *testing.T) {
+	tests := []struct{ in, want int }{
+		{0, 0},
+		{1, 1},
+		{2, 2},
+		{9, 10},
+		{256, 256},
+		{257, 272},
+		{1025, 1088},
+		{100000, 100352},
+		{500*1024 + 1, 516096},
+	}
+	for _, tt := range tests {
+		if got := padme(tt.in); got != tt.want {
+			t.Errorf("padme(%d) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPad(t *testing.T) {
+	const last = 500 * 1024
+	tests := []struct {
+		policy byte
+		len    int
+		want   int
+	}{
+		{PADDING_NONE, 0, 1},
+		{PADDING_NONE, last, last + 1},
+		{PADDING_PADME, 0, 1},
+		{PADDING_PADME, 255, 256},
+		{PADDING_PADME, 256, 272},
+		{PADDING_PADME, last, 516096},
+		{PADDING_BUCKETS, 0, 256},
+		{PADDING_BUCKETS, 255, 256},
+		{PADDING_BUCKETS, 256, 1024},
+		{PADDING_BUCKETS, 1023, 1024},
+		{PADDING_BUCKETS, 64*1024 - 1, 64 * 1024},
+		{PADDING_BUCKETS, last - 1, last},
+		{PADDING_BUCKETS, last, 2 * last},
+		{PADDING_BUCKETS, 2*last - 1, 2 * last},
+		{PADDING_BUCKETS, 2 * last, 3 * last},
+	}
+	for _, tt := range tests {
+		// Payloads that end in the padding bytes themselves must survive
+		msg := bytes.Repeat([]byte{0x80, 0}, tt.len/2+1)[:tt.len]
+		padded := pad(msg, tt.policy)
+		if len(padded) != tt.want {
+			t.Errorf("policy %d, length %d: padded to %d, want %d", tt.policy, tt.len, len(padded), tt.want)
+			continue
+		}
+
+		out, err := unpad(padded)
+		if err != nil {
+			t.Fatalf("policy %d, length %d: %v", tt.policy, tt.len, err)
+		}
+		if !bytes.Equal(out, msg) {
+			t.Fatalf("policy %d, length %d: unpadded to another payload", tt.policy, tt.len)
+		}
+	}
+}
+
+func TestUnpadInvalid(t *testing.T) {
+	for _, padded := range [][]byte{
+		nil,
+		{0},
+		make([]byte, 256),
+		{1, 0, 0},
+		{0x80, 1},
+	} {
+		if _, err := unpad(padded); err != ErrBadPadding {
+			t.Fatalf("%x: got %v, want ErrBadPadding", padded, err)
+		}
+	}
+}
+
+func TestPaddingPolicy(t *testing.T) {
+	alice, bob := testPair(t)
+	if err := alice.SetPadding(PADDING_NONE + 1); err != ErrInvalidArg {
+		t.Fatalf("got %v, want ErrInvalidArg", err)
+	}
+
+	// Messages in the same bucket can't be told apart by their length
+	if err := alice.SetPadding(PADDING_BUCKETS); err != nil {
+		t.Fatal(err)
+	}
+	short := testSend(t, alice, "a")
+	long := testSend(t, alice, "abcdefghijklmnopqrstuvwxyz")
+	if len(short) != len(long) {
+		t.Fatalf("lengths %d and %d differ", len(short), len(long))
+	}
+	testReceive(t, bob, short, "a")
+	testReceive(t, bob, long, "abcdefghijklmnopqrstuvwxyz")
+
+	// The policy is kept across an export
+	for _, policy := range []byte{PADDING_PADME, PADDING_BUCKETS, PADDING_NONE} {
+		if err := alice.SetPadding(policy); err != nil {
+			t.Fatal(err)
+		}
+		alice = testReexport(t, alice)
+		if alice.Padding != policy {
+			t.Fatalf("exported policy %d, imported %d", policy, alice.Padding)
+		}
+	}
+	testReceive(t, bob, testSend(t, alice, "after export"), "after export")
+}
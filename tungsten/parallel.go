@@ -0,0 +1,59 @@
+//go:build !js
+
+package tungsten
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Workers is the number of goroutines that encapsulate keys to members, such
+// as in GenerateUpdate. If it isn't positive, GOMAXPROCS is used.
+var Workers = 0
+
+// parallel calls f for each i in [0, n) over a pool of workers, returning the
+// first error
+func parallel(n int, f func(i int) error) error {
+	workers := Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		return serial(n, f)
+	}
+
+	jobs := make(chan int)
+	errs := make(chan error, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			var err error
+			for i := range jobs {
+				if err == nil {
+					err = f(i)
+				}
+			}
+			errs <- err
+		}()
+	}
+
+	for i := 0; i < n; i++ {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
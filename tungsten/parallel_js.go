@@ -0,0 +1,12 @@
+//go:build js
+
+package tungsten
+
+// Workers has no effect in wasm, which is single threaded
+var Workers = 0
+
+// parallel calls f for each i in [0, n), returning the first error. Goroutines
+// would only add overhead in wasm.
+func parallel(n int, f func(i int) error) error {
+	return serial(n, f)
+}
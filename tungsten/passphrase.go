@@ -0,0 +1,128 @@
+package tungsten
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/chacha20poly1305"
+)
+
+var EXPORT_ENCRYPTED_MAGIC = []byte("TNGE")
+
+const EXPORT_ENCRYPTED_VERSION = 1
+
+// Upper bounds on the cost of an encrypted export, so that importing a
+// malicious export can't exhaust memory
+const (
+	MAX_KDF_TIME    = 64
+	MAX_KDF_MEMORY  = 256 * 1024 // KiB
+	MAX_KDF_THREADS = 16
+)
+
+// Length of magic, version, kdf params, salt and nonce
+const encryptedHeaderSize = 4 + 2 + 4 + 4 + 1 + 16 + chacha20poly1305.NonceSizeX
+
+// KDFParams are the Argon2id cost parameters used to derive the key of an
+// encrypted export. Memory is in KiB.
+type KDFParams struct {
+	Time    uint32
+	Memory  uint32
+	Threads uint8
+}
+
+// DefaultKDFParams uses a single thread, as wasm has no parallelism
+var DefaultKDFParams = KDFParams{Time: 3, Memory: 64 * 1024, Threads: 1}
+
+func (p KDFParams) valid() bool {
+	return p.Time >= 1 && p.Time <= MAX_KDF_TIME &&
+		p.Memory >= 8*uint32(p.Threads) && p.Memory <= MAX_KDF_MEMORY &&
+		p.Threads >= 1 && p.Threads <= MAX_KDF_THREADS
+}
+
+// ExportEncrypted exports the session, encrypted with a key derived from the
+// passphrase. The header (including the kdf params and salt) is authenticated.
+func (t *TxSession) ExportEncrypted(w io.Writer, passphrase []byte, params KDFParams) error {
+	if !params.valid() {
+		return ErrInvalidArg
+	}
+
+	plain := new(bytes.Buffer)
+	defer func() { wipe(plain.Bytes()) }()
+	if err := t.Export(plain); err != nil {
+		return err
+	}
+
+	header := new(bytes.Buffer)
+	header.Write(EXPORT_ENCRYPTED_MAGIC)
+	binary.Write(header, binary.BigEndian, uint16(EXPORT_ENCRYPTED_VERSION))
+	binary.Write(header, binary.BigEndian, params.Time)
+	binary.Write(header, binary.BigEndian, params.Memory)
+	header.WriteByte(params.Threads)
+
+	salt := make([]byte, 16)
+	nonce := make([]byte, chacha20poly1305.NonceSizeX)
+	if err := t.Config.read(salt); err != nil {
+		return err
+	}
+	if err := t.Config.read(nonce); err != nil {
+		return err
+	}
+	header.Write(salt)
+	header.Write(nonce)
+
+	key := argon2.IDKey(passphrase, salt, params.Time, params.Memory, params.Threads, chacha20poly1305.KeySize)
+	defer wipe(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return err
+	}
+
+	out := aead.Seal(header.Bytes(), nonce, plain.Bytes(), header.Bytes())
+	_, err = w.Write(out)
+	return err
+}
+
+// ImportEncrypted imports a tx session exported with ExportEncrypted
+func ImportEncrypted(r io.Reader, passphrase []byte) (*TxSession, error) {
+	b, err := io.ReadAll(r)
+	if err != nil || len(b) < encryptedHeaderSize+chacha20poly1305.Overhead {
+		return nil, ErrTruncated
+	}
+
+	if !bytes.Equal(b[:4], EXPORT_ENCRYPTED_MAGIC) {
+		return nil, ErrCorruptExport
+	}
+	if binary.BigEndian.Uint16(b[4:]) != EXPORT_ENCRYPTED_VERSION {
+		return nil, ErrUnsupported
+	}
+
+	params := KDFParams{
+		Time:    binary.BigEndian.Uint32(b[6:]),
+		Memory:  binary.BigEndian.Uint32(b[10:]),
+		Threads: b[14],
+	}
+	if !params.valid() {
+		return nil, ErrUnsupported
+	}
+
+	header := b[:encryptedHeaderSize]
+	salt := header[15 : 15+16]
+	nonce := header[15+16:]
+
+	key := argon2.IDKey(passphrase, salt, params.Time, params.Memory, params.Threads, chacha20poly1305.KeySize)
+	defer wipe(key)
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plain, err := aead.Open(nil, nonce, b[encryptedHeaderSize:], header)
+	if err != nil {
+		return nil, ErrBadPassphrase
+	}
+	defer wipe(plain)
+
+	return ImportTx(bytes.NewReader(plain))
+}
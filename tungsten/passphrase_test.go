@@ -0,0 +1,92 @@
+package tungsten
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Cheap parameters, so that the tests don't spend their time in the kdf
+var testKDFParams = KDFParams{Time: 1, Memory: 64, Threads: 1}
+
+func TestExportEncrypted(t *testing.T) {
+	alice, bob := testPair(t)
+	b := new(bytes.Buffer)
+	if err := bob.ExportEncrypted(b, []byte("correct horse"), testKDFParams); err != nil {
+		t.Fatal(err)
+	}
+	export := b.Bytes()
+
+	imported, err := ImportEncrypted(bytes.NewReader(export), []byte("correct horse"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, imported, testSend(t, alice, "after import"), "after import")
+
+	// Changes to the header or the ciphertext are caught
+	tests := []struct {
+		name   string
+		change func(b []byte) []byte
+		pass   string
+		err    error
+	}{
+		{"wrong passphrase", nil, "wrong horse", ErrBadPassphrase},
+		{"empty passphrase", nil, "", ErrBadPassphrase},
+		{"magic", func(b []byte) []byte { b[0] ^= 1; return b }, "correct horse", ErrCorruptExport},
+		{"version", func(b []byte) []byte { b[5] = 2; return b }, "correct horse", ErrUnsupported},
+		{"kdf time", func(b []byte) []byte { b[9] = 2; return b }, "correct horse", ErrBadPassphrase},
+		{"kdf memory", func(b []byte) []byte { b[13] = 128; return b }, "correct horse", ErrBadPassphrase},
+		{"salt", func(b []byte) []byte { b[15] ^= 1; return b }, "correct horse", ErrBadPassphrase},
+		{"nonce", func(b []byte) []byte { b[15+16] ^= 1; return b }, "correct horse", ErrBadPassphrase},
+		{"ciphertext", func(b []byte) []byte { b[len(b)-1] ^= 1; return b }, "correct horse", ErrBadPassphrase},
+		{"truncated", func(b []byte) []byte { return b[:encryptedHeaderSize] }, "correct horse", ErrTruncated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := append([]byte(nil), export...)
+			if tt.change != nil {
+				b = tt.change(b)
+			}
+			if _, err := ImportEncrypted(bytes.NewReader(b), []byte(tt.pass)); err != tt.err {
+				t.Fatalf("got %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestKDFParamsBounds(t *testing.T) {
+	alice, _ := testPair(t)
+	b := new(bytes.Buffer)
+	if err := alice.ExportEncrypted(b, []byte("pass"), testKDFParams); err != nil {
+		t.Fatal(err)
+	}
+	export := b.Bytes()
+
+	tests := []struct {
+		name   string
+		params KDFParams
+	}{
+		{"zero time", KDFParams{Time: 0, Memory: 64, Threads: 1}},
+		{"time", KDFParams{Time: MAX_KDF_TIME + 1, Memory: 64, Threads: 1}},
+		{"memory", KDFParams{Time: 1, Memory: MAX_KDF_MEMORY + 1, Threads: 1}},
+		{"memory below threads", KDFParams{Time: 1, Memory: 8, Threads: 2}},
+		{"zero threads", KDFParams{Time: 1, Memory: 64, Threads: 0}},
+		{"threads", KDFParams{Time: 1, Memory: 1024, Threads: MAX_KDF_THREADS + 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := alice.ExportEncrypted(new(bytes.Buffer), []byte("pass"), tt.params); err != ErrInvalidArg {
+				t.Fatalf("export: got %v, want ErrInvalidArg", err)
+			}
+
+			// An export claiming the params is refused before the kdf runs
+			b := append([]byte(nil), export...)
+			binary.BigEndian.PutUint32(b[6:], tt.params.Time)
+			binary.BigEndian.PutUint32(b[10:], tt.params.Memory)
+			b[14] = tt.params.Threads
+			if _, err := ImportEncrypted(bytes.NewReader(b), []byte("pass")); err != ErrUnsupported {
+				t.Fatalf("import: got %v, want ErrUnsupported", err)
+			}
+		})
+	}
+}
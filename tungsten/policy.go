@@ -0,0 +1,188 @@
+package tungsten
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Break-in recovery only happens when we send a ratchet update, so the update
+// policy reports when one is due: after a number of messages have been sent
+// with a ratchet, after a ratchet hasn't been updated for some time, or after
+// the members have changed. Sending the update is left to the application.
+
+// Reasons an update is due, as a bitmask
+const (
+	UPDATE_DUE_MESSAGES = 1 << iota // A ratchet has sent MaxMessages messages
+	UPDATE_DUE_AGE                  // A ratchet hasn't been updated for MaxAge
+	UPDATE_DUE_MEMBERS              // A member has joined since a ratchet was updated
+	UPDATE_DUE_HEADER               // Members don't have our header key, see TxSession.HeaderPending
+)
+
+// When our ratchets should be updated. Zero values disable each condition.
+type UpdatePolicy struct {
+	MaxMessages        uint32
+	MaxAge             time.Duration
+	OnMembershipChange bool
+}
+
+// The policy of new sessions, and of sessions exported without one
+var DefaultUpdatePolicy = UpdatePolicy{
+	MaxMessages:        1000,
+	MaxAge:             7 * 24 * time.Hour,
+	OnMembershipChange: true,
+}
+
+// How stale one of our ratchets is
+type RatchetStatus struct {
+	RatchetID uuid.UUID
+	Epoch     uint32
+	Sent      uint32    // Messages sent since the last update
+	Updated   time.Time // When the session was imported, for sessions exported before it was tracked
+	Due       byte      // Bitmask of UPDATE_DUE_*
+}
+
+// SetUpdatePolicy sets when our ratchets should be updated
+func (t *TxSession) SetUpdatePolicy(p UpdatePolicy) {
+	t.Policy = p
+}
+
+// UpdateStatus returns how stale each of the ratchets this device sends with
+// is
+func (t *TxSession) UpdateStatus() []RatchetStatus {
+	now := t.Config.now()
+
+	var out []RatchetStatus
+	for _, v := range t.deviceRatchets() {
+		s := RatchetStatus{
+			RatchetID: v.UUID,
+			Epoch:     v.Epoch,
+			Sent:      v.Symmetric.Index(),
+			Due:       t.due(v, now),
+		}
+		if v.Updated != 0 {
+			s.Updated = time.Unix(0, v.Updated)
+		}
+		out = append(out, s)
+	}
+	return out
+}
+
+// UpdateDue returns why an update is due for any of our ratchets, or 0 if one
+// isn't
+func (t *TxSession) UpdateDue() byte {
+	now := t.Config.now()
+
+	var due byte
+	if t.HeaderPending {
+		due |= UPDATE_DUE_HEADER
+	}
+	for _, v := range t.deviceRatchets() {
+		due |= t.due(v, now)
+	}
+	return due
+}
+
+// NextUpdate returns when an update will be due because of MaxAge, assuming
+// nothing else makes one due sooner. It is zero if MaxAge is disabled.
+func (t *TxSession) NextUpdate() time.Time {
+	if t.Policy.MaxAge <= 0 {
+		return time.Time{}
+	}
+
+	var next time.Time
+	for _, v := range t.deviceRatchets() {
+		at := time.Unix(0, v.Updated).Add(t.Policy.MaxAge)
+		if next.IsZero() || at.Before(next) {
+			next = at
+		}
+	}
+	return next
+}
+
+func (t *TxSession) due(rat *Ratchet, now time.Time) byte {
+	var due byte
+	p := t.Policy
+
+	if p.MaxMessages > 0 && rat.Symmetric.Index() >= p.MaxMessages {
+		due |= UPDATE_DUE_MESSAGES
+	}
+
+	if p.MaxAge > 0 && now.Sub(time.Unix(0, rat.Updated)) >= p.MaxAge {
+		due |= UPDATE_DUE_AGE
+	}
+
+	if p.OnMembershipChange && rat.Updated < t.MembersChanged {
+		due |= UPDATE_DUE_MEMBERS
+	}
+
+	return due
+}
+
+// stampUpdated treats ratchets whose last update isn't known, as they were
+// exported before it was tracked, as updated now. Otherwise they would be
+// overdue for MaxAge as soon as they were imported.
+func (t *TxSession) stampUpdated() {
+	now := t.Config.now().UnixNano()
+	for _, v := range t.Ratchets {
+		if v.Updated == 0 {
+			v.Updated = now
+		}
+	}
+}
+
+// exportPolicy writes the policy section of a tx export
+func exportPolicy(w io.Writer, t *TxSession) {
+	binary.Write(w, binary.BigEndian, t.Policy.MaxMessages)
+	binary.Write(w, binary.BigEndian, int64(t.Policy.MaxAge))
+	if t.Policy.OnMembershipChange {
+		w.Write([]byte{1})
+	} else {
+		w.Write([]byte{0})
+	}
+	binary.Write(w, binary.BigEndian, t.MembersChanged)
+
+	binary.Write(w, binary.BigEndian, int64(len(t.Ratchets)))
+	for _, v := range t.Ratchets {
+		w.Write(v.UUID[:])
+		binary.Write(w, binary.BigEndian, v.Updated)
+	}
+}
+
+// importPolicy reads the policy section, once the ratchets have been imported
+func importPolicy(b []byte, t *TxSession) error {
+	t.Policy = DefaultUpdatePolicy
+	if len(b) == 0 {
+		return nil
+	}
+
+	r := &errReader{r: bytes.NewReader(b)}
+	binary.Read(r, binary.BigEndian, &t.Policy.MaxMessages)
+
+	var maxAge int64
+	binary.Read(r, binary.BigEndian, &maxAge)
+	t.Policy.MaxAge = time.Duration(maxAge)
+
+	flag := make([]byte, 1)
+	r.Read(flag)
+	t.Policy.OnMembershipChange = flag[0] == 1
+	binary.Read(r, binary.BigEndian, &t.MembersChanged)
+
+	var l int64
+	binary.Read(r, binary.BigEndian, &l)
+	for i := int64(0); i < l && r.err == nil; i++ {
+		var id uuid.UUID
+		var updated int64
+		r.Read(id[:])
+		binary.Read(r, binary.BigEndian, &updated)
+
+		if rat := findRatchet(t.Ratchets, id); rat != nil {
+			rat.Updated = updated
+		}
+	}
+
+	return r.err
+}
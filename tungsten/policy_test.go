@@ -0,0 +1,175 @@
+package tungsten
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testClockPair returns two sessions like testPair, whose sender reads the time
+// from now
+func testClockPair(t *testing.T, now *time.Time) (*TxSession, *TxSession) {
+	t.Helper()
+	alice, err := (&Config{Now: func() time.Time { return *now }}).GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	RxFromTx(alice, bob)
+	RxFromTx(bob, alice)
+	return alice, bob
+}
+
+func TestUpdateDue(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	alice, bob := testClockPair(t, &now)
+	if due := alice.UpdateDue(); due != 0 {
+		t.Fatalf("new session is due: %b", due)
+	}
+	if next := alice.NextUpdate(); !next.Equal(now.Add(DefaultUpdatePolicy.MaxAge)) {
+		t.Fatalf("next update at %v", next)
+	}
+
+	policy := UpdatePolicy{MaxMessages: 3, MaxAge: time.Hour, OnMembershipChange: true}
+	alice.SetUpdatePolicy(policy)
+
+	// Messages
+	for i := 0; i < 3; i++ {
+		if due := alice.UpdateDue(); due != 0 {
+			t.Fatalf("due after %d messages: %b", i, due)
+		}
+		testReceive(t, bob, testSend(t, alice, "message"), "message")
+	}
+	if due := alice.UpdateDue(); due != UPDATE_DUE_MESSAGES {
+		t.Fatalf("got %b, want UPDATE_DUE_MESSAGES", due)
+	}
+	status := alice.UpdateStatus()
+	if len(status) != 1 || status[0].Sent != 3 || status[0].Due != UPDATE_DUE_MESSAGES || !status[0].Updated.Equal(now) {
+		t.Fatalf("status %+v", status)
+	}
+	testReceive(t, bob, testUpdate(t, alice), "")
+	if due := alice.UpdateDue(); due != 0 {
+		t.Fatalf("due after an update: %b", due)
+	}
+
+	// Age
+	now = now.Add(time.Hour - 1)
+	if due := alice.UpdateDue(); due != 0 {
+		t.Fatalf("due before MaxAge: %b", due)
+	}
+	if next := alice.NextUpdate(); !next.Equal(now.Add(1)) {
+		t.Fatalf("next update at %v", next)
+	}
+	now = now.Add(1)
+	if due := alice.UpdateDue(); due != UPDATE_DUE_AGE {
+		t.Fatalf("got %b, want UPDATE_DUE_AGE", due)
+	}
+	testReceive(t, bob, testUpdate(t, alice), "")
+	if next := alice.NextUpdate(); !next.Equal(now.Add(time.Hour)) {
+		t.Fatalf("next update at %v", next)
+	}
+
+	// Members
+	now = now.Add(time.Second)
+	testAdd(t, alice, bob)
+	if due := alice.UpdateDue(); due != UPDATE_DUE_MEMBERS {
+		t.Fatalf("got %b, want UPDATE_DUE_MEMBERS", due)
+	}
+	testReceive(t, bob, testUpdate(t, alice), "")
+	if due := alice.UpdateDue(); due != 0 {
+		t.Fatalf("due after an update: %b", due)
+	}
+
+	// Header, as after a migration from a layout without one
+	alice.HeaderPending = true
+	if due := alice.UpdateDue(); due != UPDATE_DUE_HEADER {
+		t.Fatalf("got %b, want UPDATE_DUE_HEADER", due)
+	}
+	testReceive(t, bob, testUpdate(t, alice), "")
+	if due := alice.UpdateDue(); due != 0 {
+		t.Fatalf("due after an update: %b", due)
+	}
+
+	// Every reason is reported together
+	for i := 0; i < 3; i++ {
+		testReceive(t, bob, testSend(t, alice, "message"), "message")
+	}
+	now = now.Add(2 * time.Hour)
+	testAdd(t, alice, bob)
+	alice.HeaderPending = true
+	want := byte(UPDATE_DUE_MESSAGES | UPDATE_DUE_AGE | UPDATE_DUE_MEMBERS | UPDATE_DUE_HEADER)
+	if due := alice.UpdateDue(); due != want {
+		t.Fatalf("got %b, want %b", due, want)
+	}
+
+	// Zero values disable each condition, but not the header
+	alice.SetUpdatePolicy(UpdatePolicy{})
+	if due := alice.UpdateDue(); due != UPDATE_DUE_HEADER {
+		t.Fatalf("got %b, want UPDATE_DUE_HEADER", due)
+	}
+	if next := alice.NextUpdate(); !next.IsZero() {
+		t.Fatalf("next update at %v with MaxAge disabled", next)
+	}
+}
+
+func TestUpdatePolicyExport(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	alice, bob := testClockPair(t, &now)
+	policy := UpdatePolicy{MaxMessages: 10, MaxAge: time.Minute}
+	alice.SetUpdatePolicy(policy)
+	now = now.Add(time.Second)
+	testAdd(t, alice, bob)
+	testReceive(t, bob, testSend(t, alice, "message"), "message")
+
+	// The policy and when the ratchets were updated are kept
+	imported := testReexport(t, alice)
+	if imported.Policy != policy || imported.MembersChanged != now.UnixNano() {
+		t.Fatalf("imported policy %+v, members changed %d", imported.Policy, imported.MembersChanged)
+	}
+	if imported.Ratchets[0].Updated != alice.Ratchets[0].Updated {
+		t.Fatal("export lost when the ratchet was updated")
+	}
+	imported.Config = alice.Config
+	imported.SetUpdatePolicy(UpdatePolicy{MaxMessages: 1, OnMembershipChange: true})
+	if due := imported.UpdateDue(); due != UPDATE_DUE_MESSAGES|UPDATE_DUE_MEMBERS {
+		t.Fatalf("got %b, want UPDATE_DUE_MESSAGES|UPDATE_DUE_MEMBERS", due)
+	}
+
+	// Sessions exported without a policy have the default
+	if err := importPolicy(nil, imported); err != nil {
+		t.Fatal(err)
+	}
+	if imported.Policy != DefaultUpdatePolicy {
+		t.Fatalf("got %+v, want the default policy", imported.Policy)
+	}
+	if err := importPolicy([]byte{0, 0}, imported); err != ErrTruncated {
+		t.Fatalf("got %v, want ErrTruncated", err)
+	}
+
+	// Ratchets whose update isn't known are treated as updated on import
+	now = now.Add(time.Hour)
+	updated := alice.Ratchets[0].Updated
+	announce := uuid.New()
+	if err := alice.AddRatchet(announce, nil, new(bytes.Buffer)); err != nil {
+		t.Fatal(err)
+	}
+	findRatchet(alice.Ratchets, announce).Updated = 0
+	alice.stampUpdated()
+	if findRatchet(alice.Ratchets, announce).Updated != now.UnixNano() {
+		t.Fatal("ratchet without an update wasn't stamped")
+	}
+	if alice.Ratchets[0].Updated != updated {
+		t.Fatal("stamped a ratchet whose update is known")
+	}
+	for _, name := range []string{"unversioned_alice.bin", "v1_alice.bin"} {
+		legacy := testImport(t, name)
+		if legacy.Policy != DefaultUpdatePolicy || legacy.UpdateDue()&UPDATE_DUE_AGE != 0 {
+			t.Fatalf("%s: policy %+v, due %b", name, legacy.Policy, legacy.UpdateDue())
+		}
+	}
+}
@@ -1,15 +1,29 @@
-package main
+package tungsten
 
 import (
 	"crypto/hmac"
 	"crypto/sha256"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
 )
 
 var RATCHET_HMAC_MSG = []byte{0x01}
 var RATCHET_HMAC_CHAIN = []byte{0x02}
 
+// The maximum number of message keys that can be skipped by a single message
+const MAX_SKIP = 1000
+
+// The maximum number of skipped message keys stored per rx session
+const MAX_SKIPPED_KEYS = 2000
+
+// How long a skipped message key is kept before it is discarded
+const SKIPPED_KEY_LIFETIME = 7 * 24 * time.Hour
+
 type SymRatchet struct {
 	current ChainKey
+	index   uint32
 }
 
 func NewSymRatchet(root ChainKey) *SymRatchet {
@@ -18,6 +32,11 @@ func NewSymRatchet(root ChainKey) *SymRatchet {
 	}
 }
 
+// Index returns the counter of the next message key in the chain
+func (r *SymRatchet) Index() uint32 {
+	return r.index
+}
+
 func (r *SymRatchet) Advance() MessageKey {
 	h := hmac.New(sha256.New, r.current[:])
 	h.Write(RATCHET_HMAC_CHAIN)
@@ -28,9 +47,12 @@ func (r *SymRatchet) Advance() MessageKey {
 	msgKey := h.Sum(nil)
 
 	copy(r.current[:], next)
+	r.index++
 
 	var out MessageKey
 	copy(out[:], msgKey)
+	wipe(next)
+	wipe(msgKey)
 	return out
 }
 
@@ -44,8 +66,12 @@ func NewRootRatchet(root ChainKey) *RootRatchet {
 	}
 }
 
-func (r *RootRatchet) Advance(dh DHKey, kyber KyberKey) ChainKey {
-	h := hmac.New(sha256.New, append(append(r.current[:], dh[:]...), kyber[:]...))
+// Advance advances the ratchet with the parts of the keys of a ratchet update,
+// which are combined with its context (see Combine)
+func (r *RootRatchet) Advance(dh DHKey, pq PQKey, context []byte) ChainKey {
+	combined := Combine(RATCHET_COMBINE_LABEL, dh, pq, context)
+	key := append(r.current[:], combined[:]...)
+	h := hmac.New(sha256.New, key)
 	h.Write(RATCHET_HMAC_CHAIN)
 	next := h.Sum(nil)
 	h.Reset()
@@ -57,5 +83,75 @@ func (r *RootRatchet) Advance(dh DHKey, kyber KyberKey) ChainKey {
 
 	var out ChainKey
 	copy(out[:], msgKey)
+	wipe(key)
+	wipe(combined[:])
+	wipe(next)
+	wipe(msgKey)
 	return out
 }
+
+// Identifies a single message key within a session
+type SkippedKeyID struct {
+	RatchetID uuid.UUID
+	Epoch     uint32
+	Counter   uint32
+}
+
+type SkippedKey struct {
+	Key     MessageKey
+	Created int64 // unix seconds
+}
+
+// SkippedKeys stores the message keys of messages that have not been received
+// yet, so that they can still be decrypted if they arrive late or out of order.
+type SkippedKeys map[SkippedKeyID]SkippedKey
+
+// Prune removes the keys that have expired by now, and then the oldest keys
+// until the store is within MAX_SKIPPED_KEYS
+func (s SkippedKeys) Prune(now time.Time) {
+	for id, k := range s {
+		if now.Sub(time.Unix(k.Created, 0)) > SKIPPED_KEY_LIFETIME {
+			delete(s, id)
+		}
+	}
+
+	if len(s) <= MAX_SKIPPED_KEYS {
+		return
+	}
+
+	ids := make([]SkippedKeyID, 0, len(s))
+	for id := range s {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		if s[a].Created != s[b].Created {
+			return s[a].Created < s[b].Created
+		}
+		if a.Epoch != b.Epoch {
+			return a.Epoch < b.Epoch
+		}
+		return a.Counter < b.Counter
+	})
+
+	for _, id := range ids[:len(ids)-MAX_SKIPPED_KEYS] {
+		delete(s, id)
+	}
+}
+
+// skipTo advances a copy of the symmetric ratchet up to (but not including)
+// counter, recording every key along the way. The ratchet passed in is not
+// modified.
+func skipTo(sym SymRatchet, counter uint32) (*SymRatchet, map[uint32]MessageKey, bool) {
+	if counter < sym.index || counter-sym.index > MAX_SKIP {
+		return nil, nil, false
+	}
+
+	keys := make(map[uint32]MessageKey)
+	for sym.index < counter {
+		i := sym.index
+		keys[i] = sym.Advance()
+	}
+
+	return &sym, keys, true
+}
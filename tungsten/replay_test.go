@@ -0,0 +1,56 @@
+package tungsten
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReplayedData(t *testing.T) {
+	alice, bob := testPair(t)
+
+	first := testSend(t, alice, "first")
+	testReceive(t, bob, first, "first")
+	if _, err := bob.ReceiveMessage(first); err != ErrDuplicate {
+		t.Fatalf("got %v, want ErrDuplicate", err)
+	}
+
+	// A skipped message is only accepted once
+	skipped := testSend(t, alice, "skipped")
+	testReceive(t, bob, testSend(t, alice, "latest"), "latest")
+	testReceive(t, bob, skipped, "skipped")
+	if _, err := bob.ReceiveMessage(skipped); err != ErrDuplicate {
+		t.Fatalf("got %v, want ErrDuplicate", err)
+	}
+
+	// The high-water marks are kept across an export
+	b := new(bytes.Buffer)
+	if err := bob.Export(b); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := ImportTx(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, msg := range [][]byte{first, skipped} {
+		if _, err := bob.ReceiveMessage(msg); err != ErrDuplicate {
+			t.Fatalf("got %v, want ErrDuplicate", err)
+		}
+	}
+}
+
+func TestReplayedUpdate(t *testing.T) {
+	alice, bob := testPair(t)
+
+	update := testUpdate(t, alice)
+	testReceive(t, bob, update, "")
+	pubkey := bob.child(alice.UUID).CurrentPubkey
+	if _, err := bob.ReceiveMessage(update); err != ErrDuplicate {
+		t.Fatalf("got %v, want ErrDuplicate", err)
+	}
+
+	// A replayed update doesn't roll back the sender's pubkey or ratchets
+	if bob.child(alice.UUID).CurrentPubkey != pubkey {
+		t.Fatal("replayed update replaced the pubkey")
+	}
+	testReceive(t, bob, testSend(t, alice, "still in sync"), "still in sync")
+}
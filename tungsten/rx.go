@@ -1,18 +1,14 @@
-package main
+package tungsten
 
 import (
 	"bytes"
-	"crypto/sha256"
 	"encoding/binary"
 	"io"
+	"sort"
 
 	"github.com/cloudflare/circl/dh/x25519"
-	"github.com/cloudflare/circl/pke/kyber/kyber768"
-	"github.com/cloudflare/circl/sign/dilithium/mode2"
 	"github.com/cloudflare/circl/sign/ed25519"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/hkdf"
-	"golang.org/x/crypto/nacl/secretbox"
 )
 
 type RxSession struct {
@@ -20,154 +16,528 @@ type RxSession struct {
 
 	UUID              uuid.UUID
 	VerifyingPubkey   ed25519.PublicKey
-	VerifyingPubkeyPQ mode2.PublicKey
+	VerifyingPubkeyPQ PQVerifyingKey
+
+	// Number of times the member has rotated their signing keys, and the
+	// verifying keys that were replaced
+	KeyGeneration uint32
+	KeyHistory    []PastKey
 
 	Ratchets []*Ratchet
 
 	CurrentPubkey   x25519.Key
-	CurrentPubkeyPQ kyber768.PublicKey
+	CurrentPubkeyPQ PQPubkey
+
+	// The member's header key, and the key it replaced
+	HeaderKey     [32]byte
+	PrevHeaderKey [32]byte
+	hints         [2]hintCache // Of HeaderKey and PrevHeaderKey, see header.go
+
+	// Timestamp of the member's last ratchet update, so that earlier updates
+	// can't be replayed
+	KeysUpdated int64
+
+	// Keys for messages that were skipped over but not yet received
+	Skipped SkippedKeys
+
+	// The latest epoch of each ratchet that was retired, or that we can no
+	// longer read, so that replaying its earlier announcements can't reinstall
+	// it. Retired ratchets have RETIRED_EPOCH. See lifecycle.go.
+	Retired map[uuid.UUID]uint32
 }
 
-func (r *RxSession) ReceiveMessage(msg []byte) []byte {
-	// Verify both signatures
-	m := new(Data)
-	m.Unmarshal(bytes.NewBuffer(msg))
-	dataEnd := len(msg) - ed25519.SignatureSize - mode2.SignatureSize
+// Received is the result of receiving a message
+type Received struct {
+	MsgType   byte
+	SenderID  uuid.UUID
+	RatchetID uuid.UUID // Ratchet of a data message, or the ratchet announced or retired
 
-	ok := ed25519.Verify(r.VerifyingPubkey, msg[:dataEnd], m.Signature[:])
-	if !ok {
-		panic("failed to verify ed25519 signature")
-	}
+	Plain   []byte // Decrypted payload of a data message
+	Skipped int    // Number of earlier messages skipped over, which may still arrive
 
-	ok = mode2.Verify(&r.VerifyingPubkeyPQ, msg[:dataEnd], m.SignaturePQ[:])
-	if !ok {
-		panic("failed to verify dilithium mode2 signature")
+	// The member introduced by a create user message. They only become a
+	// recipient of our ratchet updates once passed to TxSession.AcceptMember.
+	Member *RxSession
+
+	// The member removed by a remove member message. They are only removed
+	// once the message is passed to TxSession.ApplyRemoval, after the
+	// application has checked the sender is allowed to remove them. If it is
+	// us, we have been removed.
+	Removed uuid.UUID
+}
+
+// ReceiveMessage verifies and decrypts a message
+func (r *RxSession) ReceiveMessage(msg []byte) (*Received, error) {
+	// Verify both signatures, which end every message type
+	if err := r.verify(msg); err != nil {
+		return nil, err
 	}
 
+	out := &Received{MsgType: msg[0], SenderID: r.UUID}
+
 	// Switch on message type
-	switch m.MsgType {
+	switch msg[0] {
 	case MSG_TYPE_DATA:
-		for _, v := range r.Ratchets {
-			if v.UUID == m.RatchetID {
-				key := v.Symmetric.Advance()
+		m := new(Data)
+		err := m.Unmarshal(bytes.NewBuffer(msg))
+		if err != nil {
+			return nil, err
+		}
 
-				plain, ok := secretbox.Open(nil, m.Payload, &m.Nonce, (*[32]byte)(&key))
-				if !ok {
-					panic("failed to verify mac of payload")
-				}
+		rat := findRatchet(r.Ratchets, m.RatchetID)
+		if rat == nil {
+			return nil, ErrUnknownRatchet
+		}
 
-				return plain
-			}
+		out.RatchetID = m.RatchetID
+		out.Plain, out.Skipped, err = r.decryptData(rat, m)
+		if err != nil {
+			return nil, err
 		}
+		return out, nil
 
 	case MSG_TYPE_RATCHET_UPDATE:
 		u := new(RatchetUpdate)
-		u.Unmarshal(bytes.NewBuffer(msg))
+		err := u.Unmarshal(bytes.NewBuffer(msg))
+		if err != nil {
+			return nil, err
+		}
+
+		return out, r.UpdateSymmetric(u)
 
-		var updates []UserRatchetUpdate
-		for _, v := range u.Updates {
-			if v.UserID == r.Parent.UUID {
-				updates = append(updates, v)
-			}
+	case MSG_TYPE_CREATE_USER:
+		c := new(CreateUser)
+		err := c.Unmarshal(bytes.NewBuffer(msg))
+		if err != nil {
+			return nil, err
 		}
 
-		r.UpdateSymmetric(u.NewPubkey, u.NewPubkeyPQ, updates)
+		out.Member, err = r.receiveCreateUser(c)
+		if err != nil {
+			return nil, err
+		}
+		return out, nil
+
+	case MSG_TYPE_REMOVE_MEMBER:
+		m := new(RemoveMember)
+		err := m.Unmarshal(bytes.NewBuffer(msg))
+		if err != nil {
+			return nil, err
+		}
+
+		out.Removed = m.MemberID
+		return out, nil
+
+	case MSG_TYPE_ANNOUNCE_RATCHET:
+		m := new(AnnounceRatchet)
+		err := m.Unmarshal(bytes.NewBuffer(msg))
+		if err != nil {
+			return nil, err
+		}
+
+		err = r.receiveAnnounce(m)
+		if err != nil {
+			return nil, err
+		}
+		out.RatchetID = m.RatchetID
+		return out, nil
+
+	case MSG_TYPE_ROTATE_KEYS:
+		m := new(RotateKeys)
+		err := m.Unmarshal(bytes.NewBuffer(msg))
+		if err != nil {
+			return nil, err
+		}
+
+		return out, r.receiveRotate(m, msg)
+
+	case MSG_TYPE_RETIRE_RATCHET:
+		m := new(RetireRatchet)
+		err := m.Unmarshal(bytes.NewBuffer(msg))
+		if err != nil {
+			return nil, err
+		}
+
+		err = r.receiveRetire(m)
+		if err != nil {
+			return nil, err
+		}
+		out.RatchetID = m.RatchetID
+		return out, nil
 	}
 
-	return []byte{}
+	return nil, ErrUnknownMsgType
 }
 
-func (r *RxSession) UpdateSymmetric(newPub x25519.Key, newPubPQ kyber768.PublicKey, updates []UserRatchetUpdate) {
-	// Update current pubkeys
-	r.CurrentPubkey = newPub
-	r.CurrentPubkeyPQ = newPubPQ
+func (r *RxSession) decryptData(rat *Ratchet, m *Data) ([]byte, int, error) {
+	// Discard expired keys before looking any up
+	r.Skipped.Prune(r.config().now())
+
+	// Late message from an earlier position or earlier ratchet update
+	if m.Epoch < rat.Epoch || (m.Epoch == rat.Epoch && m.Counter < rat.Symmetric.Index()) {
+		id := SkippedKeyID{RatchetID: rat.UUID, Epoch: m.Epoch, Counter: m.Counter}
+		key, ok := r.Skipped[id]
+		if !ok {
+			return nil, 0, ErrDuplicate
+		}
+
+		padded, err := openAEAD((*[32]byte)(&key.Key), m.Nonce[:], m.Payload, m.ad())
+		wipe(key.Key[:])
+		if err != nil {
+			return nil, 0, err
+		}
+		plain, err := unpad(padded)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		delete(r.Skipped, id)
+		return plain, 0, nil
+	}
+
+	if m.Epoch > rat.Epoch {
+		return nil, 0, ErrFutureEpoch
+	}
+
+	// Skip forward to the message's key, only committing once the mac verifies
+	sym, skipped, ok := skipTo(*rat.Symmetric, m.Counter)
+	if !ok {
+		return nil, 0, ErrTooManySkipped
+	}
+	key := sym.Advance()
+
+	padded, err := openAEAD((*[32]byte)(&key), m.Nonce[:], m.Payload, m.ad())
+	wipe(key[:])
+	if err != nil {
+		sym.Destroy()
+		wipeKeys(skipped)
+		return nil, 0, err
+	}
+	plain, err := unpad(padded)
+	if err != nil {
+		sym.Destroy()
+		wipeKeys(skipped)
+		return nil, 0, err
+	}
+
+	// Storing the skipped keys wipes them from skipped
+	n := len(skipped)
+	rat.setSymmetric(sym)
+	r.storeSkipped(rat, skipped)
+
+	return plain, n, nil
+}
+
+func (r *RxSession) storeSkipped(rat *Ratchet, keys map[uint32]MessageKey) {
+	if r.Skipped == nil {
+		r.Skipped = make(SkippedKeys)
+	}
+
+	now := r.config().now().Unix()
+	for i, k := range keys {
+		r.Skipped[SkippedKeyID{RatchetID: rat.UUID, Epoch: rat.Epoch, Counter: i}] = SkippedKey{Key: k, Created: now}
+	}
+	wipeKeys(keys)
+	r.Skipped.Prune(r.config().now())
+}
+
+// config returns the config of our tx session
+func (r *RxSession) config() *Config {
+	if r.Parent == nil {
+		return nil
+	}
+	return r.Parent.Config
+}
+
+// UpdateSymmetric applies a ratchet update. Every update is decrypted before
+// any state is modified, so a bad update leaves the session untouched.
+//
+// A replayed update is rejected with ErrDuplicate, as it would roll back the
+// sender's keys. Each ratchet's epoch must increase, and the keypair is only
+// replaced by one with a later timestamp. An update with an earlier timestamp
+// is from another of the sender's devices, which updated at around the same
+// time, and still advances that device's ratchets.
+func (r *RxSession) UpdateSymmetric(u *RatchetUpdate) error {
+	var updates []UserRatchetUpdate
+	for _, v := range u.Updates {
+		if v.UserID == r.Parent.UUID {
+			updates = append(updates, v)
+		}
+	}
+
+	var treeUpdates []TreeRatchetUpdate
+	if u.Path != nil {
+		treeUpdates = u.Path.Ratchets
+	}
 
-	// Find DH shared secret and derive symmetric key
-	var shared x25519.Key
-	x25519.Shared(&shared, &r.Parent.CurrentPrivkey, &newPub)
+	later := u.Timestamp > r.KeysUpdated
+	if !later && len(updates) == 0 && len(treeUpdates) == 0 {
+		return ErrDuplicate
+	}
 
-	var derived [32]byte
-	keyReader := hkdf.New(sha256.New, shared[:], nil, DH_HKDF_INFO)
-	_, err := io.ReadFull(keyReader, derived[:])
+	// Their new header key is encapsulated with their new keypair, like the
+	// updates. In tree mode, it is derived from the commit secret.
+	var headerKey [32]byte
+	var opened *openedPath
+	var err error
+	if u.Path != nil {
+		opened, err = r.Parent.openPath(u)
+		if err == nil {
+			defer opened.commit.destroy()
+			headerKey = opened.commit.headerKey(u.senderAD(), u.Timestamp, u.Path)
+		}
+	} else {
+		headerKey, err = r.openFromSender(u.HeaderKeys, HEADER_HKDF_INFO, HEADER_COMBINE_LABEL,
+			u.senderAD(), timestampPurpose(u.Timestamp))
+	}
 	if err != nil {
-		panic(err)
+		return err
+	}
+
+	type decrypted struct {
+		ratchet     *Ratchet
+		epoch       uint32
+		prevCounter uint32
+		encap       DHKey
+		encapPQ     PQKey
 	}
+	var decrypts []decrypted
 
+	keys := r.Parent.senderKeys(u.senderAD(), DH_HKDF_INFO)
+	defer keys.destroy()
 	for _, v := range updates {
+		d := decrypted{ratchet: findRatchet(r.Ratchets, v.RatchetID), epoch: v.Epoch, prevCounter: v.PrevCounter}
+		if d.ratchet == nil {
+			return ErrUnknownRatchet
+		}
+		if d.epoch <= d.ratchet.Epoch {
+			return ErrDuplicate
+		}
+
 		// Unencapsulate them
-		var encap DHKey
-		var nonce [24]byte
-		copy(nonce[:], v.DH[:])
-		plain, ok := secretbox.Open(nil, v.DH[24:], &nonce, &derived)
-		if !ok {
-			panic("failed to verify mac of encapsulated key")
+		var err error
+		d.encap, d.encapPQ, err = keys.open(ratchetPurpose(v.RatchetID, v.Epoch), v.DH, v.PQ)
+		if err != nil {
+			return err
 		}
-		copy(encap[:], plain)
 
-		var encapPQ KyberKey
-		r.Parent.CurrentPrivkeyPQ.DecryptTo(encapPQ[:], v.Kyber[:])
+		decrypts = append(decrypts, d)
+	}
 
-		for _, w := range r.Ratchets {
-			if w.UUID == v.RatchetID {
-				// Advance our root ratchet
-				chain := w.Root.Advance(encap, encapPQ)
+	for _, v := range treeUpdates {
+		d := decrypted{ratchet: findRatchet(r.Ratchets, v.RatchetID), epoch: v.Epoch, prevCounter: v.PrevCounter}
+		if d.ratchet == nil {
+			return ErrUnknownRatchet
+		}
+		if d.epoch <= d.ratchet.Epoch {
+			return ErrDuplicate
+		}
 
-				// Generate new symmetric ratchet
-				w.Symmetric = NewSymRatchet(chain)
-			}
+		d.encap, d.encapPQ = opened.commit.encaps(v.RatchetID)
+		decrypts = append(decrypts, d)
+	}
+
+	if opened != nil {
+		r.Parent.mergePath(u, opened)
+	}
+
+	// Update current pubkeys
+	if later {
+		r.CurrentPubkey = u.NewPubkey
+		r.CurrentPubkeyPQ = u.NewPubkeyPQ
+		r.PrevHeaderKey = r.HeaderKey
+		r.HeaderKey = headerKey
+		r.KeysUpdated = u.Timestamp
+	} else {
+		r.PrevHeaderKey = headerKey
+	}
+
+	for _, d := range decrypts {
+		w := d.ratchet
+
+		// Keep the keys of messages that haven't arrived from the old chain
+		sym, skipped, ok := skipTo(*w.Symmetric, d.prevCounter)
+		if ok {
+			w.setSymmetric(sym)
+			r.storeSkipped(w, skipped)
 		}
+
+		// Advance our root ratchet
+		chain := w.Root.Advance(d.encap, d.encapPQ, ratchetContext(u.senderAD(), w.UUID, d.epoch))
+		wipe(d.encap[:])
+		wipe(d.encapPQ[:])
+
+		// Generate new symmetric ratchet
+		w.setChain(&chain)
+		w.Epoch = d.epoch
 	}
+
+	return nil
 }
 
-func (r *RxSession) Export(w io.Writer) {
-	w.Write(r.UUID[:])
-	w.Write(r.VerifyingPubkey)
-	w.Write(r.VerifyingPubkeyPQ.Bytes())
-	binary.Write(w, binary.BigEndian, int64(len(r.Ratchets)))
-	for _, v := range r.Ratchets {
-		w.Write(v.UUID[:])
-		w.Write(v.Symmetric.current[:])
-		w.Write(v.Root.current[:])
-	}
-	w.Write(r.CurrentPubkey[:])
-
-	curPubPQ := make([]byte, kyber768.PublicKeySize)
-	r.CurrentPubkeyPQ.Pack(curPubPQ)
-	w.Write(curPubPQ)
+func (r *RxSession) Export(w io.Writer) error {
+	e := newExport(EXPORT_KIND_RX, r.VerifyingPubkeyPQ.Suite)
+
+	e.section(EXPORT_SECTION_IDENTITY, func(w io.Writer) {
+		w.Write(r.UUID[:])
+		w.Write(r.VerifyingPubkey)
+		r.VerifyingPubkeyPQ.Marshal(w)
+	})
+
+	e.section(EXPORT_SECTION_KEY_HISTORY, func(w io.Writer) {
+		exportKeyHistory(w, r.KeyGeneration, r.KeyHistory)
+	})
+
+	e.section(EXPORT_SECTION_RATCHETS, func(w io.Writer) {
+		exportRatchets(w, r.Ratchets)
+	})
+
+	e.section(EXPORT_SECTION_RECIPIENTS, func(w io.Writer) {
+		exportRecipients(w, r.Ratchets)
+	})
+
+	e.section(EXPORT_SECTION_KEYS, func(w io.Writer) {
+		w.Write(r.CurrentPubkey[:])
+		r.CurrentPubkeyPQ.Marshal(w)
+	})
+
+	e.section(EXPORT_SECTION_HEADER, func(w io.Writer) {
+		w.Write(r.HeaderKey[:])
+		w.Write(r.PrevHeaderKey[:])
+	})
+
+	e.section(EXPORT_SECTION_UPDATED, func(w io.Writer) {
+		binary.Write(w, binary.BigEndian, r.KeysUpdated)
+	})
+
+	e.section(EXPORT_SECTION_SKIPPED, func(w io.Writer) {
+		exportSkipped(w, r.Skipped)
+	})
+
+	e.section(EXPORT_SECTION_RETIRED, func(w io.Writer) {
+		exportRetired(w, r.Retired)
+	})
+
+	return e.finish(w)
 }
 
-func ImportRx(i io.Reader) *RxSession {
-	r := new(RxSession)
+// ImportRx reads an export of an rx session, either versioned or in the
+// unversioned layout.
+func ImportRx(i io.Reader) (*RxSession, error) {
+	b, err := io.ReadAll(i)
+	if err != nil {
+		return nil, ErrTruncated
+	}
+	defer wipe(b)
+
+	if !isExport(b) {
+		return importRxLegacy(b)
+	}
+
+	version, sections, err := readExport(b, EXPORT_KIND_RX)
+	if err != nil {
+		return nil, err
+	}
+	legacy := version == 1
+
+	r := &RxSession{Skipped: make(SkippedKeys), Retired: make(map[uuid.UUID]uint32)}
+	var hasIdentity, hasRatchets, hasKeys bool
+	var recipients []byte
+	for _, s := range sections {
+		er := &errReader{r: bytes.NewReader(s.Body)}
+
+		switch s.Tag {
+		case EXPORT_SECTION_IDENTITY:
+			hasIdentity = true
+			er.Read(r.UUID[:])
 
-	i.Read(r.UUID[:])
+			r.VerifyingPubkey = make(ed25519.PublicKey, ed25519.PublicKeySize)
+			er.Read(r.VerifyingPubkey)
+			readPQ(er, legacy, &r.VerifyingPubkeyPQ)
 
-	r.VerifyingPubkey = make(ed25519.PublicKey, ed25519.PublicKeySize)
-	i.Read(r.VerifyingPubkey)
+		case EXPORT_SECTION_RATCHETS:
+			hasRatchets = true
+			r.Ratchets = importRatchets(er)
 
-	var verPubPQ [mode2.PublicKeySize]byte
-	i.Read(verPubPQ[:])
-	r.VerifyingPubkeyPQ.Unpack(&verPubPQ)
+		case EXPORT_SECTION_KEYS:
+			hasKeys = true
+			er.Read(r.CurrentPubkey[:])
+			readPQ(er, legacy, &r.CurrentPubkeyPQ)
 
-	var ratchetCount int64
-	binary.Read(i, binary.BigEndian, &ratchetCount)
-	for j := 0; j < int(ratchetCount); j++ {
-		var rat Ratchet
-		i.Read(rat.UUID[:])
+		case EXPORT_SECTION_RECIPIENTS:
+			recipients = s.Body
 
-		var symChain ChainKey
-		i.Read(symChain[:])
-		rat.Symmetric = NewSymRatchet(symChain)
+		case EXPORT_SECTION_HEADER:
+			er.Read(r.HeaderKey[:])
+			er.Read(r.PrevHeaderKey[:])
 
-		var rootChain ChainKey
-		i.Read(rootChain[:])
-		rat.Root = NewRootRatchet(rootChain)
+		case EXPORT_SECTION_KEY_HISTORY:
+			r.KeyGeneration, r.KeyHistory = importKeyHistory(er, legacy)
+
+		case EXPORT_SECTION_UPDATED:
+			binary.Read(er, binary.BigEndian, &r.KeysUpdated)
+
+		case EXPORT_SECTION_SKIPPED:
+			importSkipped(er, r.Skipped)
+
+		case EXPORT_SECTION_RETIRED:
+			importRetired(er, r.Retired)
+		}
+
+		if er.err != nil {
+			return nil, er.err
+		}
 	}
 
-	i.Read(r.CurrentPubkey[:])
+	if !hasIdentity || !hasRatchets || !hasKeys {
+		return nil, ErrCorruptExport
+	}
+	if err := importRecipients(recipients, r.Ratchets); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
 
-	curPubPQ := make([]byte, kyber768.PublicKeySize)
-	i.Read(curPubPQ)
-	r.CurrentPubkeyPQ.Unpack(curPubPQ)
+// exportSkipped writes the skipped keys in order of ratchet, epoch and counter,
+// so that the same session always gives the same export
+func exportSkipped(w io.Writer, skipped SkippedKeys) {
+	ids := make([]SkippedKeyID, 0, len(skipped))
+	for id := range skipped {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		a, b := ids[i], ids[j]
+		if c := bytes.Compare(a.RatchetID[:], b.RatchetID[:]); c != 0 {
+			return c < 0
+		}
+		if a.Epoch != b.Epoch {
+			return a.Epoch < b.Epoch
+		}
+		return a.Counter < b.Counter
+	})
+
+	binary.Write(w, binary.BigEndian, int64(len(ids)))
+	for _, id := range ids {
+		k := skipped[id]
+		w.Write(id.RatchetID[:])
+		binary.Write(w, binary.BigEndian, id.Epoch)
+		binary.Write(w, binary.BigEndian, id.Counter)
+		w.Write(k.Key[:])
+		binary.Write(w, binary.BigEndian, k.Created)
+	}
+}
 
-	return r
+func importSkipped(r *errReader, skipped SkippedKeys) {
+	var skippedCount int64
+	binary.Read(r, binary.BigEndian, &skippedCount)
+	for j := int64(0); j < skippedCount && r.err == nil; j++ {
+		var id SkippedKeyID
+		var k SkippedKey
+		r.Read(id.RatchetID[:])
+		binary.Read(r, binary.BigEndian, &id.Epoch)
+		binary.Read(r, binary.BigEndian, &id.Counter)
+		r.Read(k.Key[:])
+		binary.Read(r, binary.BigEndian, &k.Created)
+		skipped[id] = k
+	}
 }
@@ -0,0 +1,147 @@
+package tungsten
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testPair returns two sessions that are members of each other's group
+func testPair(t *testing.T) (*TxSession, *TxSession) {
+	t.Helper()
+	alice, err := GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := GenTx(uuid.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	RxFromTx(alice, bob)
+	RxFromTx(bob, alice)
+	return alice, bob
+}
+
+// testSend sends a data message with the sender's default ratchet
+func testSend(t *testing.T, sender *TxSession, plain string) []byte {
+	t.Helper()
+	b := new(bytes.Buffer)
+	if err := sender.SendMessage(uuid.Nil, []byte(plain), b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func testUpdate(t *testing.T, sender *TxSession) []byte {
+	t.Helper()
+	b := new(bytes.Buffer)
+	if err := sender.GenerateUpdate(b); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+// testReceive receives a message, checking the plaintext if it is data
+func testReceive(t *testing.T, receiver *TxSession, msg []byte, plain string) *Received {
+	t.Helper()
+	r, err := receiver.ReceiveMessage(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.MsgType == MSG_TYPE_DATA && string(r.Plain) != plain {
+		t.Fatalf("got %q, want %q", r.Plain, plain)
+	}
+	return r
+}
+
+func TestRoundTrip(t *testing.T) {
+	alice, bob := testPair(t)
+
+	r := testReceive(t, bob, testSend(t, alice, "hello bob"), "hello bob")
+	if r.SenderID != alice.UUID || r.Skipped != 0 {
+		t.Fatalf("sender %v, skipped %d", r.SenderID, r.Skipped)
+	}
+	testReceive(t, alice, testSend(t, bob, "hello alice"), "hello alice")
+
+	// Both directions keep working across updates from either side
+	testReceive(t, bob, testUpdate(t, alice), "")
+	testReceive(t, bob, testSend(t, alice, "after alice's update"), "after alice's update")
+	testReceive(t, alice, testUpdate(t, bob), "")
+	testReceive(t, alice, testSend(t, bob, "after bob's update"), "after bob's update")
+
+	// And across an export of the receiver
+	msg := testSend(t, alice, "after export")
+	b := new(bytes.Buffer)
+	if err := bob.Export(b); err != nil {
+		t.Fatal(err)
+	}
+	bob, err := ImportTx(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, bob, msg, "after export")
+}
+
+func TestReorderedMessages(t *testing.T) {
+	alice, bob := testPair(t)
+
+	msgs := make([][]byte, 5)
+	for i := range msgs {
+		msgs[i] = testSend(t, alice, string(rune('a'+i)))
+	}
+
+	// The latest first skips the others, whose keys are kept until they arrive
+	if r := testReceive(t, bob, msgs[4], "e"); r.Skipped != 4 {
+		t.Fatalf("skipped %d, want 4", r.Skipped)
+	}
+	for _, i := range []int{2, 0, 3, 1} {
+		if r := testReceive(t, bob, msgs[i], string(rune('a'+i))); r.Skipped != 0 {
+			t.Fatalf("skipped %d, want 0", r.Skipped)
+		}
+	}
+}
+
+func TestDroppedMessages(t *testing.T) {
+	alice, bob := testPair(t)
+
+	testSend(t, alice, "lost")
+	testSend(t, alice, "lost")
+	if r := testReceive(t, bob, testSend(t, alice, "kept"), "kept"); r.Skipped != 2 {
+		t.Fatalf("skipped %d, want 2", r.Skipped)
+	}
+
+	// A message sent before an update that is lost still arrives after it
+	late := testSend(t, alice, "late")
+	testReceive(t, bob, testUpdate(t, alice), "")
+	testReceive(t, bob, testSend(t, alice, "after update"), "after update")
+	testReceive(t, bob, late, "late")
+
+	// Skipping too many keys at once is refused
+	for i := 0; i < MAX_SKIP+1; i++ {
+		testSend(t, alice, "lost")
+	}
+	if _, err := bob.ReceiveMessage(testSend(t, alice, "too far")); err != ErrTooManySkipped {
+		t.Fatalf("got %v, want ErrTooManySkipped", err)
+	}
+}
+
+func TestSkippedKeysExpire(t *testing.T) {
+	alice, bob := testPair(t)
+	now := time.Unix(1700000000, 0)
+	bob.Config = &Config{Now: func() time.Time { return now }}
+
+	expired := testSend(t, alice, "expired")
+	kept := testSend(t, alice, "kept")
+	testReceive(t, bob, testSend(t, alice, "first"), "first")
+
+	// A key is kept for its lifetime, and pruned once it has passed
+	now = now.Add(SKIPPED_KEY_LIFETIME)
+	testReceive(t, bob, kept, "kept")
+	now = now.Add(time.Second)
+	testReceive(t, bob, testSend(t, alice, "prunes"), "prunes")
+	if _, err := bob.ReceiveMessage(expired); err != ErrDuplicate {
+		t.Fatalf("got %v, want ErrDuplicate", err)
+	}
+}
@@ -0,0 +1,166 @@
+package tungsten
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"io"
+
+	"github.com/cloudflare/circl/sign/ed25519"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/argon2"
+)
+
+// Safety numbers let two users verify each other's long-term verifying keys,
+// at any time after their sessions exist. Unlike the ephem fingerprint, they
+// don't change with ratchet updates, only when either user rotates their keys.
+// Each identity's keys are hashed to a fingerprint, which is shown as digits
+// or scanned as a safety code.
+
+var IDENTITY_FINGERPRINT_SALT = []byte("identity_fingerprint_salt")
+
+const SAFETY_CODE_VERSION = 0x00
+
+// The long-term identity of a user
+type Identity struct {
+	UUID              uuid.UUID
+	VerifyingPubkey   ed25519.PublicKey
+	VerifyingPubkeyPQ PQVerifyingKey
+}
+
+// Identity returns our identity
+func (t *TxSession) Identity() *Identity {
+	return &Identity{
+		UUID:              t.UUID,
+		VerifyingPubkey:   t.verifyingPubkey(),
+		VerifyingPubkeyPQ: t.verifyingPubkeyPQ(),
+	}
+}
+
+// Identity returns the member's identity
+func (r *RxSession) Identity() *Identity {
+	return &Identity{
+		UUID:              r.UUID,
+		VerifyingPubkey:   r.VerifyingPubkey,
+		VerifyingPubkeyPQ: r.VerifyingPubkeyPQ,
+	}
+}
+
+// Fingerprint hashes the identity, slowly so that finding another identity
+// with the same safety number is expensive
+func (i *Identity) Fingerprint() [32]byte {
+	b := new(bytes.Buffer)
+	b.Write(i.UUID[:])
+	b.Write(i.VerifyingPubkey)
+	i.VerifyingPubkeyPQ.Marshal(b)
+
+	var out [32]byte
+	copy(out[:], argon2.IDKey(b.Bytes(), IDENTITY_FINGERPRINT_SALT, 1, 64*1024, 1, 32))
+	return out
+}
+
+// SafetyNumber returns 12 groups of 5 base-10 digits, 6 for each identity. Both
+// users see the same number.
+func SafetyNumber(local, remote *Identity) string {
+	localFp, remoteFp := local.Fingerprint(), remote.Fingerprint()
+	first, second := digits(localFp[:], 30, 5), digits(remoteFp[:], 30, 5)
+	if first > second {
+		first, second = second, first
+	}
+
+	return first + " " + second
+}
+
+// A QR code payload with the fingerprints of the user showing it, and the
+// member they are verifying. A scanner verifies it against both identities.
+type SafetyCode struct {
+	Version           byte
+	UUID              uuid.UUID
+	Fingerprint       [32]byte
+	RemoteUUID        uuid.UUID
+	RemoteFingerprint [32]byte
+}
+
+// NewSafetyCode returns the safety code to show to remote
+func NewSafetyCode(local, remote *Identity) *SafetyCode {
+	return &SafetyCode{
+		Version:           SAFETY_CODE_VERSION,
+		UUID:              local.UUID,
+		Fingerprint:       local.Fingerprint(),
+		RemoteUUID:        remote.UUID,
+		RemoteFingerprint: remote.Fingerprint(),
+	}
+}
+
+func (c *SafetyCode) Marshal(w io.Writer) {
+	w.Write([]byte{c.Version})
+	w.Write(c.UUID[:])
+	w.Write(c.Fingerprint[:])
+	w.Write(c.RemoteUUID[:])
+	w.Write(c.RemoteFingerprint[:])
+}
+
+func (c *SafetyCode) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+
+	b := make([]byte, 1)
+	er.Read(b)
+	c.Version = b[0]
+	if er.err == nil && c.Version != SAFETY_CODE_VERSION {
+		return ErrUnsupported
+	}
+
+	er.Read(c.UUID[:])
+	er.Read(c.Fingerprint[:])
+	er.Read(c.RemoteUUID[:])
+	er.Read(c.RemoteFingerprint[:])
+	return er.err
+}
+
+// Verify checks that a code scanned from remote was made with both of our
+// current identities
+func (c *SafetyCode) Verify(local, remote *Identity) error {
+	localFp, remoteFp := local.Fingerprint(), remote.Fingerprint()
+	if c.UUID != remote.UUID || c.RemoteUUID != local.UUID ||
+		subtle.ConstantTimeCompare(c.Fingerprint[:], remoteFp[:]) != 1 ||
+		subtle.ConstantTimeCompare(c.RemoteFingerprint[:], localFp[:]) != 1 {
+		return ErrSafetyMismatch
+	}
+
+	return nil
+}
+
+// SafetyNumber returns the safety number between us and a member
+func (t *TxSession) SafetyNumber(member uuid.UUID) (string, error) {
+	r := t.child(member)
+	if r == nil {
+		return "", ErrUnknownMember
+	}
+
+	return SafetyNumber(t.Identity(), r.Identity()), nil
+}
+
+// SafetyCode writes the safety code to show to a member
+func (t *TxSession) SafetyCode(member uuid.UUID, w io.Writer) error {
+	r := t.child(member)
+	if r == nil {
+		return ErrUnknownMember
+	}
+
+	NewSafetyCode(t.Identity(), r.Identity()).Marshal(w)
+	return nil
+}
+
+// VerifySafetyCode verifies a safety code scanned from a member
+func (t *TxSession) VerifySafetyCode(member uuid.UUID, code []byte) error {
+	r := t.child(member)
+	if r == nil {
+		return ErrUnknownMember
+	}
+
+	c := new(SafetyCode)
+	if err := c.Unmarshal(bytes.NewReader(code)); err != nil {
+		return err
+	}
+
+	return c.Verify(t.Identity(), r.Identity())
+}
@@ -0,0 +1,89 @@
+package tungsten
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestSafetyNumber(t *testing.T) {
+	alice, bob := testPair(t)
+	number, err := alice.SafetyNumber(bob.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := bob.SafetyNumber(alice.UUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if number != other {
+		t.Fatalf("members see %q and %q", number, other)
+	}
+	if groups := strings.Fields(number); len(groups) != 12 {
+		t.Fatalf("got %d groups, want 12", len(groups))
+	}
+	if _, err := alice.SafetyNumber(uuid.New()); err != ErrUnknownMember {
+		t.Fatalf("got %v, want ErrUnknownMember", err)
+	}
+
+	// Updates don't change it, but rotating keys does
+	testReceive(t, bob, testUpdate(t, alice), "")
+	if n, _ := bob.SafetyNumber(alice.UUID); n != number {
+		t.Fatal("safety number changed after an update")
+	}
+	testReceive(t, bob, testRotate(t, alice), "")
+	if n, _ := bob.SafetyNumber(alice.UUID); n == number {
+		t.Fatal("safety number didn't change after a rotation")
+	}
+}
+
+func TestSafetyCode(t *testing.T) {
+	alice, bob := testPair(t)
+	carol, _ := testAdd(t, alice, bob)
+
+	code := new(bytes.Buffer)
+	if err := alice.SafetyCode(bob.UUID, code); err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.VerifySafetyCode(alice.UUID, code.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	// A code is only valid for the pair it was made for
+	if err := alice.VerifySafetyCode(bob.UUID, code.Bytes()); err != ErrSafetyMismatch {
+		t.Fatalf("own code: got %v, want ErrSafetyMismatch", err)
+	}
+	if err := carol.VerifySafetyCode(alice.UUID, code.Bytes()); err != ErrSafetyMismatch {
+		t.Fatalf("other member: got %v, want ErrSafetyMismatch", err)
+	}
+	if err := bob.VerifySafetyCode(carol.UUID, code.Bytes()); err != ErrSafetyMismatch {
+		t.Fatalf("other identity: got %v, want ErrSafetyMismatch", err)
+	}
+	if err := bob.VerifySafetyCode(uuid.New(), code.Bytes()); err != ErrUnknownMember {
+		t.Fatalf("got %v, want ErrUnknownMember", err)
+	}
+
+	for _, i := range []int{1, 1 + 16, 1 + 16 + 32, code.Len() - 1} {
+		tampered := append([]byte(nil), code.Bytes()...)
+		tampered[i] ^= 1
+		if err := bob.VerifySafetyCode(alice.UUID, tampered); err != ErrSafetyMismatch {
+			t.Fatalf("byte %d: got %v, want ErrSafetyMismatch", i, err)
+		}
+	}
+	tampered := append([]byte(nil), code.Bytes()...)
+	tampered[0] = SAFETY_CODE_VERSION + 1
+	if err := bob.VerifySafetyCode(alice.UUID, tampered); err != ErrUnsupported {
+		t.Fatalf("got %v, want ErrUnsupported", err)
+	}
+	if err := bob.VerifySafetyCode(alice.UUID, code.Bytes()[:code.Len()-1]); err != ErrTruncated {
+		t.Fatalf("got %v, want ErrTruncated", err)
+	}
+
+	// A code made before a rotation no longer verifies
+	testReceive(t, bob, testRotate(t, alice), "")
+	if err := bob.VerifySafetyCode(alice.UUID, code.Bytes()); err != ErrSafetyMismatch {
+		t.Fatalf("got %v, want ErrSafetyMismatch", err)
+	}
+}
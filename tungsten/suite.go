@@ -0,0 +1,387 @@
+package tungsten
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/cloudflare/circl/kem/mlkem/mlkem768"
+	"github.com/cloudflare/circl/pke/kyber/kyber768"
+	"github.com/cloudflare/circl/sign/dilithium/mode2"
+	"github.com/cloudflare/circl/sign/mldsa/mldsa44"
+)
+
+// Algorithm suites, see "Algorithm suites" in /design/encryption.adoc. Every
+// post-quantum key names the suite it belongs to, so members on different
+// suites can share a group: keys are encapsulated to a member with the suite
+// of their keypair, and signatures are verified with the suite of the signer's
+// verifying key. New keys use the config's suite, so a session created under
+// the legacy suite moves to the default as its keys are replaced, by
+// GenerateUpdate and RotateKeys. The classical halves (x25519 and ed25519) are
+// the same in every suite.
+
+type Suite uint16
+
+const (
+	// Round 3 Kyber768 and Dilithium2, which predate the standards
+	SUITE_X25519_KYBER768_ED25519_DILITHIUM2 Suite = 0x0001
+
+	// ML-KEM-768 (FIPS 203) and ML-DSA-44 (FIPS 204)
+	SUITE_X25519_MLKEM768_ED25519_MLDSA44 Suite = 0x0002
+)
+
+// The suite of new keys, unless the config chooses another
+const DEFAULT_SUITE = SUITE_X25519_MLKEM768_ED25519_MLDSA44
+
+// Sizes that are the same in both suites
+const (
+	PQ_PUBKEY_SIZE        = mlkem768.PublicKeySize
+	PQ_CIPHERTEXT_SIZE    = mlkem768.CiphertextSize
+	PQ_VERIFYING_KEY_SIZE = mldsa44.PublicKeySize
+	PQ_SIGNATURE_SIZE     = mldsa44.SignatureSize
+)
+
+// Signatures are deterministic, and ML-DSA's context is empty
+var mldsaContext []byte
+
+func (s Suite) valid() bool {
+	return s == SUITE_X25519_KYBER768_ED25519_DILITHIUM2 || s == SUITE_X25519_MLKEM768_ED25519_MLDSA44
+}
+
+func (s Suite) legacy() bool {
+	return s == SUITE_X25519_KYBER768_ED25519_DILITHIUM2
+}
+
+func (s Suite) privkeySize() int {
+	if s.legacy() {
+		return kyber768.PrivateKeySize
+	}
+	return mlkem768.PrivateKeySize
+}
+
+func (s Suite) signingKeySize() int {
+	if s.legacy() {
+		return mode2.PrivateKeySize
+	}
+	return mldsa44.PrivateKeySize
+}
+
+// seedSize is the length of the seed a KEM keypair is derived from
+func (s Suite) seedSize() int {
+	if s.legacy() {
+		return kyber768.KeySeedSize
+	}
+	return mlkem768.KeySeedSize
+}
+
+// A post-quantum KEM public key
+type PQPubkey struct {
+	Suite Suite
+	Key   [PQ_PUBKEY_SIZE]byte
+}
+
+// A post-quantum KEM private key
+type PQPrivkey struct {
+	Suite Suite
+	Key   []byte
+}
+
+// A post-quantum verifying key
+type PQVerifyingKey struct {
+	Suite Suite
+	Key   [PQ_VERIFYING_KEY_SIZE]byte
+}
+
+// A post-quantum signing key
+type PQSigningKey struct {
+	Suite Suite
+	Key   []byte
+}
+
+// genPQ generates a KEM keypair of the suite
+func genPQ(c *Config, suite Suite) (PQPubkey, PQPrivkey, error) {
+	pub := PQPubkey{Suite: suite}
+	priv := PQPrivkey{Suite: suite, Key: make([]byte, suite.privkeySize())}
+
+	if suite.legacy() {
+		pk, sk, err := kyber768.GenerateKey(c.rand())
+		if err != nil {
+			return pub, priv, ErrRandom
+		}
+		pk.Pack(pub.Key[:])
+		sk.Pack(priv.Key)
+	} else {
+		pk, sk, err := mlkem768.GenerateKeyPair(c.rand())
+		if err != nil {
+			return pub, priv, ErrRandom
+		}
+		pk.Pack(pub.Key[:])
+		sk.Pack(priv.Key)
+	}
+
+	return pub, priv, nil
+}
+
+// pqFromSeed derives a KEM keypair of the suite from a seed of its seedSize
+func pqFromSeed(suite Suite, seed []byte) (PQPubkey, PQPrivkey) {
+	pub := PQPubkey{Suite: suite}
+	priv := PQPrivkey{Suite: suite, Key: make([]byte, suite.privkeySize())}
+
+	if suite.legacy() {
+		pk, sk := kyber768.NewKeyFromSeed(seed)
+		pk.Pack(pub.Key[:])
+		sk.Pack(priv.Key)
+	} else {
+		pk, sk := mlkem768.NewKeyFromSeed(seed)
+		pk.Pack(pub.Key[:])
+		sk.Pack(priv.Key)
+	}
+
+	return pub, priv
+}
+
+// encapsulate generates a shared secret and its ciphertext for pub. The legacy
+// suite only has kyber pke, so the secret is random and encrypted to pub.
+func (pub *PQPubkey) encapsulate(c *Config) (ct [PQ_CIPHERTEXT_SIZE]byte, ss [32]byte, err error) {
+	seed := make([]byte, 32)
+	if err := c.read(seed); err != nil {
+		return ct, ss, err
+	}
+
+	if pub.Suite.legacy() {
+		if err := c.read(ss[:]); err != nil {
+			return ct, ss, err
+		}
+
+		var pk kyber768.PublicKey
+		pk.Unpack(pub.Key[:])
+		pk.EncryptTo(ct[:], ss[:], seed)
+		return ct, ss, nil
+	}
+
+	var pk mlkem768.PublicKey
+	if err := pk.Unpack(pub.Key[:]); err != nil {
+		return ct, ss, ErrTruncated
+	}
+	pk.EncapsulateTo(ct[:], ss[:], seed)
+	return ct, ss, nil
+}
+
+// decapsulate returns the shared secret of a ciphertext from encapsulate
+func (priv *PQPrivkey) decapsulate(ct []byte) ([32]byte, error) {
+	var ss [32]byte
+
+	if priv.Suite.legacy() {
+		var sk kyber768.PrivateKey
+		sk.Unpack(priv.Key)
+		sk.DecryptTo(ss[:], ct)
+		return ss, nil
+	}
+
+	var sk mlkem768.PrivateKey
+	if err := sk.Unpack(priv.Key); err != nil {
+		return ss, ErrTruncated
+	}
+	sk.DecapsulateTo(ss[:], ct)
+	return ss, nil
+}
+
+// genSigningPQ generates a signing key of the suite
+func genSigningPQ(c *Config, suite Suite) (PQSigningKey, error) {
+	k := PQSigningKey{Suite: suite, Key: make([]byte, suite.signingKeySize())}
+
+	if suite.legacy() {
+		_, sk, err := mode2.GenerateKey(c.rand())
+		if err != nil {
+			return k, ErrRandom
+		}
+		copy(k.Key, sk.Bytes())
+	} else {
+		_, sk, err := mldsa44.GenerateKey(c.rand())
+		if err != nil {
+			return k, ErrRandom
+		}
+		copy(k.Key, sk.Bytes())
+	}
+
+	return k, nil
+}
+
+// Public returns the verifying key
+func (k *PQSigningKey) Public() PQVerifyingKey {
+	pub := PQVerifyingKey{Suite: k.Suite}
+
+	if k.Suite.legacy() {
+		var b [mode2.PrivateKeySize]byte
+		copy(b[:], k.Key)
+		var sk mode2.PrivateKey
+		sk.Unpack(&b)
+		sk.Public().(*mode2.PublicKey).Pack(&pub.Key)
+		wipe(b[:])
+	} else {
+		var b [mldsa44.PrivateKeySize]byte
+		copy(b[:], k.Key)
+		var sk mldsa44.PrivateKey
+		sk.Unpack(&b)
+		sk.Public().(*mldsa44.PublicKey).Pack(&pub.Key)
+		wipe(b[:])
+	}
+
+	return pub
+}
+
+// sign writes the signature of msg to sig
+func (k *PQSigningKey) sign(msg, sig []byte) {
+	if k.Suite.legacy() {
+		var b [mode2.PrivateKeySize]byte
+		copy(b[:], k.Key)
+		var sk mode2.PrivateKey
+		sk.Unpack(&b)
+		mode2.SignTo(&sk, msg, sig)
+		wipe(b[:])
+	} else {
+		var b [mldsa44.PrivateKeySize]byte
+		copy(b[:], k.Key)
+		var sk mldsa44.PrivateKey
+		sk.Unpack(&b)
+		mldsa44.SignTo(&sk, msg, mldsaContext, false, sig)
+		wipe(b[:])
+	}
+}
+
+// verify returns whether sig is a signature of msg
+func (k *PQVerifyingKey) verify(msg, sig []byte) bool {
+	if k.Suite.legacy() {
+		var pk mode2.PublicKey
+		pk.Unpack(&k.Key)
+		return mode2.Verify(&pk, msg, sig)
+	}
+
+	var pk mldsa44.PublicKey
+	pk.Unpack(&k.Key)
+	return mldsa44.Verify(&pk, msg, mldsaContext, sig)
+}
+
+// Keys are written with their suite before them, except in version 1 exports,
+// where every key is of the legacy suite
+
+func (k *PQPubkey) Marshal(w io.Writer) {
+	binary.Write(w, binary.BigEndian, k.Suite)
+	w.Write(k.Key[:])
+}
+
+func (k *PQPubkey) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+	k.Suite = readSuite(er)
+	er.Read(k.Key[:])
+	return er.err
+}
+
+func (k *PQPubkey) unmarshalLegacy(r io.Reader) error {
+	k.Suite = SUITE_X25519_KYBER768_ED25519_DILITHIUM2
+	_, err := io.ReadFull(r, k.Key[:])
+	return err
+}
+
+func (k *PQPrivkey) Marshal(w io.Writer) {
+	binary.Write(w, binary.BigEndian, k.Suite)
+	w.Write(k.Key)
+}
+
+// Unmarshal reads a private key. A key that was never set, such as the
+// previous key of a new session, has no suite and is empty.
+func (k *PQPrivkey) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+	binary.Read(er, binary.BigEndian, &k.Suite)
+	if er.err != nil || k.Suite == 0 {
+		k.Key = nil
+		return er.err
+	}
+	if !k.Suite.valid() {
+		return ErrUnsupported
+	}
+
+	k.Key = make([]byte, k.Suite.privkeySize())
+	er.Read(k.Key)
+	return er.err
+}
+
+func (k *PQPrivkey) unmarshalLegacy(r io.Reader) error {
+	k.Suite = SUITE_X25519_KYBER768_ED25519_DILITHIUM2
+	k.Key = make([]byte, kyber768.PrivateKeySize)
+	_, err := io.ReadFull(r, k.Key)
+	return err
+}
+
+func (k *PQVerifyingKey) Marshal(w io.Writer) {
+	binary.Write(w, binary.BigEndian, k.Suite)
+	w.Write(k.Key[:])
+}
+
+func (k *PQVerifyingKey) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+	k.Suite = readSuite(er)
+	er.Read(k.Key[:])
+	return er.err
+}
+
+func (k *PQVerifyingKey) unmarshalLegacy(r io.Reader) error {
+	k.Suite = SUITE_X25519_KYBER768_ED25519_DILITHIUM2
+	_, err := io.ReadFull(r, k.Key[:])
+	return err
+}
+
+func (k *PQSigningKey) Marshal(w io.Writer) {
+	binary.Write(w, binary.BigEndian, k.Suite)
+	w.Write(k.Key)
+}
+
+func (k *PQSigningKey) Unmarshal(r io.Reader) error {
+	er := &errReader{r: r}
+	k.Suite = readSuite(er)
+	if er.err != nil {
+		return er.err
+	}
+
+	k.Key = make([]byte, k.Suite.signingKeySize())
+	er.Read(k.Key)
+	return er.err
+}
+
+func (k *PQSigningKey) unmarshalLegacy(r io.Reader) error {
+	k.Suite = SUITE_X25519_KYBER768_ED25519_DILITHIUM2
+	k.Key = make([]byte, mode2.PrivateKeySize)
+	_, err := io.ReadFull(r, k.Key)
+	return err
+}
+
+// readSuite reads a suite, failing with ErrUnsupported if it is unknown
+func readSuite(r *errReader) Suite {
+	var s Suite
+	binary.Read(r, binary.BigEndian, &s)
+	if r.err == nil && !s.valid() {
+		r.err = ErrUnsupported
+	}
+	return s
+}
+
+type pqKey interface {
+	Unmarshal(r io.Reader) error
+	unmarshalLegacy(r io.Reader) error
+}
+
+// readPQ reads a key from an export, without its suite if legacy
+func readPQ(r *errReader, legacy bool, k pqKey) {
+	if r.err != nil {
+		return
+	}
+
+	var err error
+	if legacy {
+		err = k.unmarshalLegacy(r)
+	} else {
+		err = k.Unmarshal(r)
+	}
+	if err != nil && r.err == nil {
+		r.err = err
+	}
+}
@@ -0,0 +1,699 @@
+package tungsten
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/hkdf"
+)
+
+// Ratchet tree mode, see "Ratchet tree" in /design/encryption.adoc. Normally
+// an update encapsulates keys to every member, for every ratchet. In tree mode,
+// members share the keypairs of the parent nodes of a binary tree, whose
+// leaves are the members' own keypairs, and each member knows the private keys
+// of the nodes above their leaf. An update replaces the nodes above the
+// sender's leaf, and only encapsulates the secret of each node to the other
+// child, which costs O(log n) once the tree is full. Ratchets that every member
+// can read are advanced with keys derived from the secret above the root.
+//
+// The leaves are the members in order of UUID, so every member builds the same
+// tree. It is replaced with a blank one whenever the members change, and each
+// node is kept from the latest update that replaced it, so that concurrent
+// updates converge.
+//
+// A node's keypair is of the suite of the sender's new keypair, so the suite of
+// the nodes above a leaf moves with its member.
+
+var TREE_HKDF_INFO = []byte("tree_hkdf")
+var TREE_NODE_DH_INFO = []byte("tree_node_dh")
+var TREE_NODE_KYBER_INFO = []byte("tree_node_kyber")
+var TREE_PATH_HMAC = []byte{0x07}
+
+// The maximum number of replaced node keypairs kept, for opening updates that
+// were sent before they were replaced
+const MAX_RETIRED_NODE_KEYS = 64
+
+// How long a replaced node keypair is kept before it is discarded. Replaced
+// keypairs are never exported.
+const RETIRED_NODE_KEY_LIFETIME = 24 * time.Hour
+
+// The parent nodes of a ratchet tree. There are a power of two leaves, which
+// are blank after the members, and nodes are indexed in order from left to
+// right, so leaf i is node 2i.
+type RatchetTree struct {
+	Members []uuid.UUID
+	Nodes   []*TreeNode // nil for leaves and blank nodes
+
+	// Keypairs of nodes that were replaced
+	Retired []*NodeKeypair
+}
+
+type TreeNode struct {
+	Pubkey    x25519.Key
+	PubkeyPQ  PQPubkey
+	Timestamp int64     // Of the update that set it
+	SenderID  uuid.UUID // Of the update that set it, for ordering updates with the same timestamp
+
+	// Only known for the nodes above our leaf
+	Keypair *NodeKeypair
+}
+
+type NodeKeypair struct {
+	Pubkey    x25519.Key
+	Privkey   x25519.Key
+	PrivkeyPQ PQPrivkey
+	Retired   int64 // unix nanoseconds, when it was replaced
+}
+
+// The secret of a node in an update's path. Each part is encapsulated by its
+// own method, and the node's keypair is derived from both.
+type pathSecret struct {
+	dh DHKey
+	pq PQKey
+}
+
+// next returns the secret of the parent node
+func (s *pathSecret) next() pathSecret {
+	var out pathSecret
+
+	h := hmac.New(sha256.New, s.dh[:])
+	h.Write(TREE_PATH_HMAC)
+	copy(out.dh[:], h.Sum(nil))
+
+	h = hmac.New(sha256.New, s.pq[:])
+	h.Write(TREE_PATH_HMAC)
+	copy(out.pq[:], h.Sum(nil))
+
+	return out
+}
+
+// node derives the node's keypair, of the suite
+func (s *pathSecret) node(suite Suite) (*NodeKeypair, *PQPubkey, error) {
+	seed := Combine(TREE_NODE_COMBINE_LABEL, s.dh, s.pq, binary.BigEndian.AppendUint16(nil, uint16(suite)))
+
+	kp := new(NodeKeypair)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, seed[:], nil, TREE_NODE_DH_INFO), kp.Privkey[:]); err != nil {
+		return nil, nil, err
+	}
+	x25519.KeyGen(&kp.Pubkey, &kp.Privkey)
+
+	seedPQ := make([]byte, suite.seedSize())
+	if _, err := io.ReadFull(hkdf.New(sha256.New, seed[:], nil, TREE_NODE_KYBER_INFO), seedPQ); err != nil {
+		return nil, nil, err
+	}
+	pubPQ, privPQ := pqFromSeed(suite, seedPQ)
+	kp.PrivkeyPQ = privPQ
+	wipe(seedPQ)
+	wipe(seed[:])
+
+	return kp, &pubPQ, nil
+}
+
+// encaps returns the keys that a ratchet is advanced with, from the commit
+// secret of an update
+func (s *pathSecret) encaps(ratchet uuid.UUID) (DHKey, PQKey) {
+	var encap DHKey
+	var encapPQ PQKey
+
+	h := hmac.New(sha256.New, s.dh[:])
+	h.Write(ratchet[:])
+	copy(encap[:], h.Sum(nil))
+
+	h = hmac.New(sha256.New, s.pq[:])
+	h.Write(ratchet[:])
+	copy(encapPQ[:], h.Sum(nil))
+
+	return encap, encapPQ
+}
+
+// headerKey returns the sender's new header key, from the commit secret of an
+// update, see pathContext
+func (s *pathSecret) headerKey(sender *encapAD, timestamp int64, path *UpdatePath) [32]byte {
+	return Combine(HEADER_COMBINE_LABEL, s.dh, s.pq, pathContext(sender, timestamp, path)...)
+}
+
+// SetTreeMode sets whether our updates use the ratchet tree. Members always
+// keep the tree, so it can be enabled by any member at any time.
+func (t *TxSession) SetTreeMode(enabled bool) {
+	t.TreeMode = enabled
+}
+
+// treeLeaves returns the number of leaves in a tree of n members
+func treeLeaves(n int) int {
+	l := 1
+	for l < n {
+		l <<= 1
+	}
+	return l
+}
+
+// level returns the height of node x above the leaves
+func level(x int) int {
+	k := 0
+	for (x>>k)&1 == 1 {
+		k++
+	}
+	return k
+}
+
+func treeParent(x int) int {
+	k := level(x)
+	b := (x >> (k + 1)) & 1
+	return (x | 1<<k) ^ (b << (k + 1))
+}
+
+func treeLeft(x int) int {
+	return x ^ (1 << (level(x) - 1))
+}
+
+func treeRight(x int) int {
+	return x ^ (3 << (level(x) - 1))
+}
+
+func treeSibling(x int) int {
+	p := treeParent(x)
+	if x < p {
+		return treeRight(p)
+	}
+	return treeLeft(p)
+}
+
+// directPath returns the nodes above a leaf, from its parent to the root, and
+// the other child of each
+func (tr *RatchetTree) directPath(leaf int) (path, copath []int) {
+	root := treeLeaves(len(tr.Members)) - 1
+	for x := 2 * leaf; x != root; x = treeParent(x) {
+		path = append(path, treeParent(x))
+		copath = append(copath, treeSibling(x))
+	}
+	return path, copath
+}
+
+// resolution returns the nodes that cover the leaves under x, skipping blank
+// nodes
+func (tr *RatchetTree) resolution(x int) []int {
+	if x%2 == 0 {
+		if x/2 < len(tr.Members) {
+			return []int{x}
+		}
+		return nil
+	}
+	if tr.Nodes[x] != nil {
+		return []int{x}
+	}
+	return append(tr.resolution(treeLeft(x)), tr.resolution(treeRight(x))...)
+}
+
+// leaf returns the leaf of a member, or -1
+func (tr *RatchetTree) leaf(id uuid.UUID) int {
+	for i, v := range tr.Members {
+		if v == id {
+			return i
+		}
+	}
+	return -1
+}
+
+// wins returns whether an update replaces node x
+func (tr *RatchetTree) wins(x int, timestamp int64, sender uuid.UUID) bool {
+	n := tr.Nodes[x]
+	return n == nil || timestamp > n.Timestamp ||
+		(timestamp == n.Timestamp && bytes.Compare(sender[:], n.SenderID[:]) > 0)
+}
+
+// set replaces node x, keeping its keypair for late updates
+func (tr *RatchetTree) set(x int, n *TreeNode, now time.Time) {
+	if old := tr.Nodes[x]; old != nil && old.Keypair != nil {
+		tr.retire(now, old.Keypair)
+	}
+	tr.Nodes[x] = n
+}
+
+func (tr *RatchetTree) retire(now time.Time, kp ...*NodeKeypair) {
+	for _, v := range kp {
+		v.Retired = now.UnixNano()
+	}
+	tr.Retired = append(tr.Retired, kp...)
+	tr.prune(now)
+}
+
+// prune destroys the replaced keypairs that have expired by now, and then the
+// oldest until there are at most MAX_RETIRED_NODE_KEYS
+func (tr *RatchetTree) prune(now time.Time) {
+	kept := tr.Retired[:0]
+	for _, v := range tr.Retired {
+		if now.Sub(time.Unix(0, v.Retired)) > RETIRED_NODE_KEY_LIFETIME {
+			v.destroy()
+		} else {
+			kept = append(kept, v)
+		}
+	}
+	for i := len(kept); i < len(tr.Retired); i++ {
+		tr.Retired[i] = nil
+	}
+	tr.Retired = kept
+
+	if len(tr.Retired) > MAX_RETIRED_NODE_KEYS {
+		for _, v := range tr.Retired[:len(tr.Retired)-MAX_RETIRED_NODE_KEYS] {
+			v.destroy()
+		}
+		tr.Retired = tr.Retired[len(tr.Retired)-MAX_RETIRED_NODE_KEYS:]
+	}
+}
+
+// latest returns the latest timestamp of the nodes above a leaf
+func (tr *RatchetTree) latest(leaf int) int64 {
+	var out int64
+	path, _ := tr.directPath(leaf)
+	for _, x := range path {
+		if n := tr.Nodes[x]; n != nil && n.Timestamp > out {
+			out = n.Timestamp
+		}
+	}
+	return out
+}
+
+// tree returns the ratchet tree, replacing it with a blank one if the members
+// have changed, and discards expired keypairs
+func (t *TxSession) tree() *RatchetTree {
+	now := t.Config.now()
+	members := []uuid.UUID{t.UUID}
+	for _, v := range t.Children {
+		members = append(members, v.UUID)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return bytes.Compare(members[i][:], members[j][:]) < 0
+	})
+
+	if t.Tree != nil && len(t.Tree.Members) == len(members) {
+		same := true
+		for i := range members {
+			same = same && members[i] == t.Tree.Members[i]
+		}
+		if same {
+			t.Tree.prune(now)
+			return t.Tree
+		}
+	}
+
+	tr := &RatchetTree{
+		Members: members,
+		Nodes:   make([]*TreeNode, 2*treeLeaves(len(members))-1),
+	}
+	if t.Tree != nil {
+		tr.Retired = t.Tree.Retired
+		for _, v := range t.Tree.Nodes {
+			if v != nil && v.Keypair != nil {
+				tr.retire(now, v.Keypair)
+			}
+		}
+	}
+
+	t.Tree = tr
+	return tr
+}
+
+// nodePubkeys returns the pubkeys of node x, which must not be blank
+func (t *TxSession) nodePubkeys(tr *RatchetTree, x int) (*x25519.Key, *PQPubkey, error) {
+	if x%2 == 1 {
+		n := tr.Nodes[x]
+		if n == nil {
+			return nil, nil, ErrInvalidArg
+		}
+		return &n.Pubkey, &n.PubkeyPQ, nil
+	}
+
+	id := tr.Members[x/2]
+	if id == t.UUID {
+		var pub x25519.Key
+		x25519.KeyGen(&pub, &t.CurrentPrivkey)
+		return &pub, &t.CurrentPubkeyPQ, nil
+	}
+	r := t.child(id)
+	if r == nil {
+		return nil, nil, ErrUnknownMember
+	}
+	return &r.CurrentPubkey, &r.CurrentPubkeyPQ, nil
+}
+
+// pathNodes derives the nodes above a leaf from the secret of the first, with
+// keypairs of the suite
+func pathNodes(s pathSecret, n int, suite Suite, timestamp int64, sender uuid.UUID) ([]*TreeNode, []pathSecret, error) {
+	nodes := make([]*TreeNode, n)
+	secrets := make([]pathSecret, n)
+	for i := range nodes {
+		if i > 0 {
+			s = s.next()
+		}
+
+		kp, pubPQ, err := s.node(suite)
+		if err != nil {
+			return nil, nil, err
+		}
+		nodes[i] = &TreeNode{Pubkey: kp.Pubkey, PubkeyPQ: *pubPQ, Timestamp: timestamp, SenderID: sender, Keypair: kp}
+		secrets[i] = s
+	}
+	return nodes, secrets, nil
+}
+
+// sealPath generates new nodes above our leaf, of the suite of our new keypair,
+// with each secret encapsulated with our new privkey priv, whose pubkeys are in
+// ad, to the other child. It returns the path, the secret of the first node and the commit secret, and
+// the tree is only changed by mergeOwnPath.
+func (t *TxSession) sealPath(tr *RatchetTree, priv *x25519.Key, suite Suite, timestamp int64, ad *encapAD) (*UpdatePath, pathSecret, pathSecret, error) {
+	var s pathSecret
+	if err := t.Config.read(s.dh[:]); err != nil {
+		return nil, s, s, err
+	}
+	if err := t.Config.read(s.pq[:]); err != nil {
+		return nil, s, s, err
+	}
+
+	leaf := tr.leaf(t.UUID)
+	path, copath := tr.directPath(leaf)
+	nodes, secrets, err := pathNodes(s, len(path), suite, timestamp, t.UUID)
+	if err != nil {
+		return nil, s, s, err
+	}
+	defer func() {
+		for i := range secrets {
+			secrets[i].destroy()
+		}
+	}()
+
+	// The commit secret is the secret above the root
+	commit := s.next()
+	if len(secrets) > 0 {
+		commit = secrets[len(secrets)-1].next()
+	}
+
+	p := &UpdatePath{
+		Leaves: uint32(len(tr.Members)),
+		Leaf:   uint32(leaf),
+		Nodes:  make([]PathNode, len(path)),
+	}
+
+	// Encapsulate the secret of each node to the resolution of the other child
+	var targets, levels []int
+	for i := range path {
+		p.Nodes[i].Pubkey = nodes[i].Pubkey
+		p.Nodes[i].PubkeyPQ = nodes[i].PubkeyPQ
+
+		res := tr.resolution(copath[i])
+		p.Nodes[i].Secrets = make([]NodeSecret, len(res))
+		for _, x := range res {
+			targets = append(targets, x)
+			levels = append(levels, i)
+		}
+	}
+
+	offsets := make([]int, len(path))
+	for i := 1; i < len(path); i++ {
+		offsets[i] = offsets[i-1] + len(p.Nodes[i-1].Secrets)
+	}
+
+	err = t.Config.parallel(len(targets), func(j int) error {
+		i := levels[j]
+		pub, pubPQ, err := t.nodePubkeys(tr, targets[j])
+		if err != nil {
+			return err
+		}
+
+		derived, err := dhKey(priv, pub, TREE_HKDF_INFO)
+		if err != nil {
+			return err
+		}
+
+		// Each secret is bound to the node it is the secret of
+		data := ad.to(pub[:], TREE_HKDF_INFO, p.Nodes[i].Pubkey[:])
+		outDH, err := sealDH(t.Config, &derived, secrets[i].dh, data)
+		wipe(derived[:])
+		if err != nil {
+			return err
+		}
+
+		outPQ, err := sealPQ(t.Config, pubPQ, secrets[i].pq, data)
+		if err != nil {
+			return err
+		}
+
+		p.Nodes[i].Secrets[j-offsets[i]] = NodeSecret{Target: *pub, DH: outDH, PQ: outPQ}
+		return nil
+	})
+	if err != nil {
+		return nil, s, s, err
+	}
+
+	return p, s, commit, nil
+}
+
+// mergeOwnPath replaces the nodes above our leaf with those derived from the
+// secret of the first, as generated by sealPath on this or another device
+func (t *TxSession) mergeOwnPath(tr *RatchetTree, s pathSecret, suite Suite, timestamp int64) error {
+	leaf := tr.leaf(t.UUID)
+	path, _ := tr.directPath(leaf)
+	nodes, _, err := pathNodes(s, len(path), suite, timestamp, t.UUID)
+	if err != nil {
+		return err
+	}
+
+	for i, x := range path {
+		if tr.wins(x, timestamp, t.UUID) {
+			tr.set(x, nodes[i], t.Config.now())
+		}
+	}
+	return nil
+}
+
+// An update path opened by a member
+type openedPath struct {
+	level  int         // The first node whose secret we opened
+	nodes  []*TreeNode // The nodes from level up, with their keypairs
+	commit pathSecret
+}
+
+// keypairs returns every keypair that an update may be encapsulated to
+func (t *TxSession) keypairs(tr *RatchetTree) []*NodeKeypair {
+	out := []*NodeKeypair{
+		{Privkey: t.CurrentPrivkey, PrivkeyPQ: t.CurrentPrivkeyPQ},
+		{Privkey: t.PrevPrivkey, PrivkeyPQ: t.PrevPrivkeyPQ},
+	}
+	for _, v := range out {
+		x25519.KeyGen(&v.Pubkey, &v.Privkey)
+	}
+
+	for _, v := range tr.Nodes {
+		if v != nil && v.Keypair != nil {
+			out = append(out, v.Keypair)
+		}
+	}
+	return append(out, tr.Retired...)
+}
+
+// openPath opens the secret of the first node in an update's path that was
+// encapsulated to one of our keypairs, and derives the nodes above it
+func (t *TxSession) openPath(u *RatchetUpdate) (*openedPath, error) {
+	keypairs := t.keypairs(t.tree())
+
+	for i, n := range u.Path.Nodes {
+		for _, v := range n.Secrets {
+			for _, kp := range keypairs {
+				if kp.Pubkey != v.Target {
+					continue
+				}
+
+				derived, err := dhKey(&kp.Privkey, &u.NewPubkey, TREE_HKDF_INFO)
+				if err != nil {
+					return nil, err
+				}
+
+				var s pathSecret
+				data := u.senderAD().to(v.Target[:], TREE_HKDF_INFO, n.Pubkey[:])
+				s.dh, err = openDH(&derived, v.DH, data)
+				wipe(derived[:])
+				if err != nil {
+					return nil, err
+				}
+				s.pq, err = openPQ(&kp.PrivkeyPQ, v.PQ, data)
+				if err != nil {
+					return nil, err
+				}
+
+				return openedFrom(u, i, s)
+			}
+		}
+	}
+
+	return nil, ErrUnknownSender
+}
+
+// openedFrom derives the nodes of an update's path from the secret of node i,
+// checking that they match the path
+func openedFrom(u *RatchetUpdate, i int, s pathSecret) (*openedPath, error) {
+	nodes, secrets, err := pathNodes(s, len(u.Path.Nodes)-i, u.NewPubkeyPQ.Suite, u.Timestamp, u.SenderID)
+	if err != nil {
+		return nil, err
+	}
+
+	for j, v := range nodes {
+		sent := &u.Path.Nodes[i+j]
+		if v.Pubkey != sent.Pubkey || v.PubkeyPQ != sent.PubkeyPQ {
+			return nil, ErrMACFailure
+		}
+	}
+
+	return &openedPath{level: i, nodes: nodes, commit: secrets[len(secrets)-1].next()}, nil
+}
+
+// mergePath replaces the nodes in an update's path, if the sender's tree has
+// the same members as ours
+func (t *TxSession) mergePath(u *RatchetUpdate, opened *openedPath) {
+	tr := t.tree()
+	leaf := int(u.Path.Leaf)
+	if int(u.Path.Leaves) != len(tr.Members) || leaf >= len(tr.Members) || tr.Members[leaf] != u.SenderID {
+		return
+	}
+
+	path, _ := tr.directPath(leaf)
+	if len(path) != len(u.Path.Nodes) {
+		return
+	}
+
+	for i, x := range path {
+		if !tr.wins(x, u.Timestamp, u.SenderID) {
+			continue
+		}
+
+		n := &TreeNode{
+			Pubkey:    u.Path.Nodes[i].Pubkey,
+			PubkeyPQ:  u.Path.Nodes[i].PubkeyPQ,
+			Timestamp: u.Timestamp,
+			SenderID:  u.SenderID,
+		}
+		if i >= opened.level {
+			n.Keypair = opened.nodes[i-opened.level].Keypair
+		}
+		tr.set(x, n, t.Config.now())
+	}
+}
+
+// exportTree writes the tree section of a tx export
+func exportTree(w io.Writer, t *TxSession) {
+	mode := byte(0)
+	if t.TreeMode {
+		mode = 1
+	}
+	w.Write([]byte{mode})
+
+	tr := t.Tree
+	if tr == nil {
+		tr = new(RatchetTree)
+	}
+
+	binary.Write(w, binary.BigEndian, int64(len(tr.Members)))
+	for _, v := range tr.Members {
+		w.Write(v[:])
+	}
+
+	var count int64
+	for _, v := range tr.Nodes {
+		if v != nil {
+			count++
+		}
+	}
+	binary.Write(w, binary.BigEndian, count)
+	for i, v := range tr.Nodes {
+		if v == nil {
+			continue
+		}
+
+		binary.Write(w, binary.BigEndian, uint32(i))
+		w.Write(v.Pubkey[:])
+		v.PubkeyPQ.Marshal(w)
+		binary.Write(w, binary.BigEndian, v.Timestamp)
+		w.Write(v.SenderID[:])
+
+		if v.Keypair == nil {
+			w.Write([]byte{0})
+		} else {
+			w.Write([]byte{1})
+			writeNodeKeypair(w, v.Keypair)
+		}
+	}
+
+	// Replaced keypairs are only kept in memory, so that an export can't open
+	// updates that were sent before it
+	binary.Write(w, binary.BigEndian, int64(0))
+}
+
+// importTree reads the tree section, whose keys have no suite if legacy
+func importTree(r *errReader, t *TxSession, legacy bool) {
+	b := make([]byte, 1)
+	r.Read(b)
+	t.TreeMode = b[0] == 1
+
+	tr := new(RatchetTree)
+	var l int64
+	binary.Read(r, binary.BigEndian, &l)
+	for i := int64(0); i < l && r.err == nil; i++ {
+		var id uuid.UUID
+		r.Read(id[:])
+		tr.Members = append(tr.Members, id)
+	}
+	if len(tr.Members) == 0 {
+		return
+	}
+	tr.Nodes = make([]*TreeNode, 2*treeLeaves(len(tr.Members))-1)
+
+	binary.Read(r, binary.BigEndian, &l)
+	for i := int64(0); i < l && r.err == nil; i++ {
+		var x uint32
+		binary.Read(r, binary.BigEndian, &x)
+
+		n := new(TreeNode)
+		r.Read(n.Pubkey[:])
+		readPQ(r, legacy, &n.PubkeyPQ)
+		binary.Read(r, binary.BigEndian, &n.Timestamp)
+		r.Read(n.SenderID[:])
+
+		r.Read(b)
+		if b[0] == 1 {
+			n.Keypair = readNodeKeypair(r, legacy)
+		}
+
+		if int(x) >= len(tr.Nodes) || x%2 == 0 {
+			r.err = ErrCorruptExport
+			return
+		}
+		tr.Nodes[x] = n
+	}
+
+	// Older exports have replaced keypairs, which are discarded
+	binary.Read(r, binary.BigEndian, &l)
+	for i := int64(0); i < l && r.err == nil; i++ {
+		readNodeKeypair(r, legacy).destroy()
+	}
+
+	t.Tree = tr
+}
+
+func writeNodeKeypair(w io.Writer, kp *NodeKeypair) {
+	w.Write(kp.Pubkey[:])
+	w.Write(kp.Privkey[:])
+	kp.PrivkeyPQ.Marshal(w)
+}
+
+func readNodeKeypair(r *errReader, legacy bool) *NodeKeypair {
+	kp := new(NodeKeypair)
+	r.Read(kp.Pubkey[:])
+	r.Read(kp.Privkey[:])
+	readPQ(r, legacy, &kp.PrivkeyPQ)
+	return kp
+}
@@ -0,0 +1,277 @@
+package tungsten
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// testTreeGroup returns n sessions in tree mode that are members of each
+// other's group, in order of UUID so that member i has leaf i
+func testTreeGroup(t *testing.T, n int) []*TxSession {
+	t.Helper()
+	group := make([]*TxSession, n)
+	for i := range group {
+		s, err := GenTx(uuid.New())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetTreeMode(true)
+		group[i] = s
+	}
+	sort.Slice(group, func(i, j int) bool {
+		return bytes.Compare(group[i].UUID[:], group[j].UUID[:]) < 0
+	})
+	for _, a := range group {
+		for _, b := range group {
+			if a != b {
+				RxFromTx(a, b)
+			}
+		}
+	}
+	return group
+}
+
+// testBroadcast receives a message from member from by every other member
+func testBroadcast(t *testing.T, group []*TxSession, from int, msg []byte, plain string) {
+	t.Helper()
+	for i, s := range group {
+		if i != from {
+			testReceive(t, s, msg, plain)
+		}
+	}
+}
+
+// testTreesConverged checks that every member has the same tree, and knows the
+// keypairs of exactly the nodes above their leaf
+func testTreesConverged(t *testing.T, group []*TxSession) {
+	t.Helper()
+	first := group[0].tree()
+	for i, s := range group {
+		tr := s.tree()
+		if len(tr.Nodes) != len(first.Nodes) {
+			t.Fatalf("member %d has %d nodes, want %d", i, len(tr.Nodes), len(first.Nodes))
+		}
+
+		path, _ := tr.directPath(tr.leaf(s.UUID))
+		for x, n := range tr.Nodes {
+			if (n == nil) != (first.Nodes[x] == nil) || n != nil && n.Pubkey != first.Nodes[x].Pubkey {
+				t.Fatalf("member %d has another node %d", i, x)
+			}
+			onPath := false
+			for _, y := range path {
+				onPath = onPath || x == y
+			}
+			if n != nil && (n.Keypair != nil) != onPath {
+				t.Fatalf("member %d: node %d has keypair %v, on path %v", i, x, n.Keypair != nil, onPath)
+			}
+			if n != nil && n.Keypair != nil && n.Keypair.Pubkey != n.Pubkey {
+				t.Fatalf("member %d: node %d has another keypair", i, x)
+			}
+		}
+	}
+}
+
+func TestTreeUpdate(t *testing.T) {
+	// Five members leave three blank leaves
+	group := testTreeGroup(t, 5)
+	for round := 0; round < 2; round++ {
+		for i, s := range group {
+			update := testUpdate(t, s)
+			testBroadcast(t, group, i, update, "")
+			testBroadcast(t, group, i, testSend(t, s, "after update"), "after update")
+		}
+	}
+	testTreesConverged(t, group)
+
+	// Only the node above the two last leaves is blank
+	for x, v := range group[0].tree().Nodes {
+		if x%2 == 1 && (v == nil) != (x == 13) {
+			t.Fatalf("node %d is blank: %v", x, v == nil)
+		}
+	}
+}
+
+// Concurrent updates replace the same nodes, and every member keeps the latest
+// whichever order they are received in
+func TestTreeConcurrentUpdates(t *testing.T) {
+	group := testTreeGroup(t, 4)
+	for i, s := range group {
+		testBroadcast(t, group, i, testUpdate(t, s), "")
+	}
+
+	senders := []int{0, 2, 3}
+	var updates [][]byte
+	for _, i := range senders {
+		updates = append(updates, testUpdate(t, group[i]))
+	}
+	for i, s := range group {
+		for k := range updates {
+			if i%2 == 1 {
+				k = len(updates) - 1 - k
+			}
+			if senders[k] != i {
+				testReceive(t, s, updates[k], "")
+			}
+		}
+	}
+	testTreesConverged(t, group)
+
+	for i, s := range group {
+		testBroadcast(t, group, i, testSend(t, s, "converged"), "converged")
+	}
+	if _, err := group[1].ReceiveMessage(updates[0]); err != ErrDuplicate {
+		t.Fatalf("got %v, want ErrDuplicate", err)
+	}
+}
+
+// The tree is replaced with a blank one when the members change, and rebuilt by
+// later updates
+func TestTreeMembershipChange(t *testing.T) {
+	alice, bob := testPair(t)
+	alice.SetTreeMode(true)
+	bob.SetTreeMode(true)
+	testReceive(t, bob, testUpdate(t, alice), "")
+	testReceive(t, alice, testUpdate(t, bob), "")
+	root := alice.tree().Nodes[1]
+	if root == nil || root.Keypair == nil {
+		t.Fatal("update didn't set the root")
+	}
+
+	carol, _ := testAdd(t, alice, bob)
+	carol.SetTreeMode(true)
+	for _, s := range []*TxSession{alice, bob, carol} {
+		tr := s.tree()
+		if len(tr.Members) != 3 || len(tr.Nodes) != 7 {
+			t.Fatalf("tree has %d members and %d nodes", len(tr.Members), len(tr.Nodes))
+		}
+		for _, v := range tr.Nodes {
+			if v != nil {
+				t.Fatal("tree wasn't blanked")
+			}
+		}
+	}
+	retired := alice.tree().Retired
+	if retired[len(retired)-1] != root.Keypair {
+		t.Fatal("keypair of the blanked root wasn't kept")
+	}
+
+	group := []*TxSession{alice, bob, carol}
+	sort.Slice(group, func(i, j int) bool {
+		return bytes.Compare(group[i].UUID[:], group[j].UUID[:]) < 0
+	})
+	for i, s := range group {
+		testBroadcast(t, group, i, testUpdate(t, s), "")
+	}
+	testTreesConverged(t, group)
+
+	// The removed member can't open the update that rebuilds the tree without
+	// them
+	removal, update := new(bytes.Buffer), new(bytes.Buffer)
+	if err := alice.RemoveMember(carol.UUID, removal, update); err != nil {
+		t.Fatal(err)
+	}
+	bobUpdate := new(bytes.Buffer)
+	if err := bob.ApplyRemoval(removal.Bytes(), bobUpdate); err != nil {
+		t.Fatal(err)
+	}
+	testReceive(t, bob, update.Bytes(), "")
+	testReceive(t, alice, bobUpdate.Bytes(), "")
+	testTreesConverged(t, []*TxSession{alice, bob})
+	if len(alice.tree().Members) != 2 {
+		t.Fatal("tree kept the removed member")
+	}
+	testReceive(t, carol, removal.Bytes(), "")
+	if _, err := carol.ReceiveMessage(update.Bytes()); err == nil {
+		t.Fatal("removed member opened the update")
+	}
+	if _, err := carol.ReceiveMessage(testSend(t, alice, "without carol")); err == nil {
+		t.Fatal("removed member read a later message")
+	}
+}
+
+func TestTreeExport(t *testing.T) {
+	group := testTreeGroup(t, 3)
+	for i, s := range group {
+		testBroadcast(t, group, i, testUpdate(t, s), "")
+	}
+	testBroadcast(t, group, 1, testUpdate(t, group[1]), "")
+	if len(group[0].tree().Retired) == 0 {
+		t.Fatal("replaced keypair wasn't kept")
+	}
+
+	// The tree is kept, without the replaced keypairs
+	for i, s := range group {
+		group[i] = testReexport(t, s)
+		if !group[i].TreeMode {
+			t.Fatal("export lost the tree mode")
+		}
+		if len(group[i].Tree.Retired) != 0 {
+			t.Fatal("replaced keypairs were exported")
+		}
+	}
+	testTreesConverged(t, group)
+
+	for i, s := range group {
+		testBroadcast(t, group, i, testUpdate(t, s), "")
+		testBroadcast(t, group, i, testSend(t, s, "after export"), "after export")
+	}
+	testTreesConverged(t, group)
+}
+
+// An update sent before the sender received a newer one is still opened with
+// the replaced keypair, until it has expired
+func TestTreeRetiredKeys(t *testing.T) {
+	for _, expired := range []bool{false, true} {
+		group := testTreeGroup(t, 4)
+		for i, s := range group {
+			testBroadcast(t, group, i, testUpdate(t, s), "")
+		}
+		now := time.Now()
+		group[1].Config = &Config{Now: func() time.Time { return now }}
+
+		// Member 2 encapsulates to node 1, which member 0 is replacing
+		replace := testUpdate(t, group[0])
+		late := testUpdate(t, group[2])
+		retired := len(group[1].tree().Retired)
+		testReceive(t, group[1], replace, "")
+		if len(group[1].tree().Retired) != retired+2 {
+			t.Fatal("replaced keypair wasn't kept")
+		}
+
+		if !expired {
+			testReceive(t, group[1], late, "")
+			continue
+		}
+		now = now.Add(RETIRED_NODE_KEY_LIFETIME + time.Second)
+		if _, err := group[1].ReceiveMessage(late); err == nil {
+			t.Fatal("update opened with an expired keypair")
+		}
+		if len(group[1].tree().Retired) != 0 {
+			t.Fatal("expired keypair wasn't discarded")
+		}
+	}
+}
+
+func TestNodePubkeys(t *testing.T) {
+	alice, bob := testPair(t)
+	tr := &RatchetTree{Members: []uuid.UUID{alice.UUID, bob.UUID}, Nodes: make([]*TreeNode, 3)}
+	pub, _, err := alice.nodePubkeys(tr, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *pub != alice.child(bob.UUID).CurrentPubkey {
+		t.Fatal("got another member's pubkey")
+	}
+
+	if _, _, err := alice.nodePubkeys(tr, 1); err != ErrInvalidArg {
+		t.Fatalf("blank node: got %v, want ErrInvalidArg", err)
+	}
+	tr.Members[1] = uuid.New()
+	if _, _, err := alice.nodePubkeys(tr, 2); err != ErrUnknownMember {
+		t.Fatalf("got %v, want ErrUnknownMember", err)
+	}
+}
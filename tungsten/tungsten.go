@@ -0,0 +1,108 @@
+// Package tungsten implements the Tungsten group ratchet, described in
+// /design/encryption.adoc.
+//
+// The wasm build used by the app lives in cmd/tungsten, and is built with
+//
+//	GOOS=js GOARCH=wasm go build -o ../app/public/tungsten.wasm ./cmd/tungsten
+package tungsten
+
+import (
+	"github.com/cloudflare/circl/dh/x25519"
+	"github.com/cloudflare/circl/sign/ed25519"
+	"github.com/google/uuid"
+)
+
+func GenTx(id uuid.UUID) (*TxSession, error) {
+	return new(Config).GenTx(id)
+}
+
+// GenTx generates a tx session that uses the config
+func (c *Config) GenTx(id uuid.UUID) (*TxSession, error) {
+	t := &TxSession{UUID: id, Policy: DefaultUpdatePolicy, Config: c}
+
+	// Ratchets
+	r, err := newRatchet(c, uuid.Nil)
+	if err != nil {
+		return nil, err
+	}
+	t.Ratchets = []*Ratchet{r}
+
+	// Signing keys
+	_, t.SigningKey, err = ed25519.GenerateKey(c.rand())
+	if err != nil {
+		return nil, ErrRandom
+	}
+
+	t.SigningKeyPQ, err = genSigningPQ(c, c.suite())
+	if err != nil {
+		return nil, err
+	}
+
+	// Key encap keys
+	if err := c.read(t.CurrentPrivkey[:]); err != nil {
+		return nil, err
+	}
+
+	t.CurrentPubkeyPQ, t.CurrentPrivkeyPQ, err = genPQ(c, c.suite())
+	if err != nil {
+		return nil, err
+	}
+
+	// Header key
+	if err := c.read(t.HeaderKey[:]); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+// RxFromTx adds remote as a member of local. Both sessions must be in the
+// same process, see CreateUser for adding a member remotely.
+func RxFromTx(local, remote *TxSession) {
+	rx := remote.asRx(func(r *Ratchet) bool { return r.CanRead(local.UUID) })
+	rx.Parent = local
+	local.Children = append(local.Children, rx)
+}
+
+// AsRx returns the rx session that other members hold for this session, with
+// the ratchets that every member can read
+func (t *TxSession) AsRx() *RxSession {
+	return t.asRx(func(r *Ratchet) bool { return !r.Restricted })
+}
+
+func (t *TxSession) asRx(include func(*Ratchet) bool) *RxSession {
+	var pub x25519.Key
+	x25519.KeyGen(&pub, &t.CurrentPrivkey)
+
+	var ratchets []*Ratchet
+	for _, v := range t.Ratchets {
+		if !include(v) {
+			continue
+		}
+
+		sym := *v.Symmetric
+		ratchets = append(ratchets, &Ratchet{
+			UUID:       v.UUID,
+			Epoch:      v.Epoch,
+			Root:       NewRootRatchet(v.Root.current),
+			Symmetric:  &sym,
+			Restricted: v.Restricted,
+			Recipients: append([]uuid.UUID(nil), v.Recipients...),
+		})
+	}
+
+	return &RxSession{
+		UUID:              t.UUID,
+		VerifyingPubkey:   t.verifyingPubkey(),
+		VerifyingPubkeyPQ: t.verifyingPubkeyPQ(),
+		KeyGeneration:     t.KeyGeneration,
+
+		Ratchets: ratchets,
+
+		CurrentPubkey:   pub,
+		CurrentPubkeyPQ: t.CurrentPubkeyPQ,
+
+		HeaderKey:   *t.sealingKey(),
+		KeysUpdated: t.KeysUpdated,
+	}
+}
@@ -1,19 +1,13 @@
-package main
+package tungsten
 
 import (
-	"crypto/rand"
-	"crypto/sha256"
+	"bytes"
 	"encoding/binary"
-	"errors"
 	"io"
 
 	"github.com/cloudflare/circl/dh/x25519"
-	"github.com/cloudflare/circl/pke/kyber/kyber768"
-	"github.com/cloudflare/circl/sign/dilithium/mode2"
 	"github.com/cloudflare/circl/sign/ed25519"
 	"github.com/google/uuid"
-	"golang.org/x/crypto/hkdf"
-	"golang.org/x/crypto/nacl/secretbox"
 )
 
 var DH_HKDF_INFO = []byte("dh_hkdf")
@@ -21,201 +15,649 @@ var DH_HKDF_INFO = []byte("dh_hkdf")
 type TxSession struct {
 	UUID         uuid.UUID
 	SigningKey   ed25519.PrivateKey
-	SigningKeyPQ mode2.PrivateKey
+	SigningKeyPQ PQSigningKey
+
+	// Number of times the signing keys have been rotated, and the verifying
+	// keys they replaced. See identity.go.
+	KeyGeneration uint32
+	KeyHistory    []PastKey
 
 	Ratchets []*Ratchet
 
 	CurrentPrivkey   x25519.Key
-	CurrentPrivkeyPQ kyber768.PrivateKey
-	CurrentPubkeyPQ  kyber768.PublicKey
+	CurrentPrivkeyPQ PQPrivkey
+	CurrentPubkeyPQ  PQPubkey
+
+	// The keypair replaced by our last update, for updates that other members
+	// generated before receiving it
+	PrevPrivkey   x25519.Key
+	PrevPrivkeyPQ PQPrivkey
+
+	// Key for sealing our messages, shared with every member, and the key it
+	// replaced for messages sealed before our last update
+	HeaderKey     [32]byte
+	PrevHeaderKey [32]byte
+	hints         [2]hintCache // Of HeaderKey and PrevHeaderKey, see header.go
+
+	// Whether the header key was generated when the session was imported from
+	// a layout without one, so members don't have it until our next update. See
+	// header.go.
+	HeaderPending bool
+
+	// Padding policy for our data messages, see padding.go
+	Padding byte
+
+	// When our ratchets should be updated, and when a member last joined
+	// (unix nanoseconds). See policy.go.
+	Policy         UpdatePolicy
+	MembersChanged int64
 
 	Children []*RxSession
+
+	// Whether our updates use the ratchet tree, which is kept whether or not
+	// they do. See tree.go.
+	TreeMode bool
+	Tree     *RatchetTree
+
+	// When the session is shared between our devices, this device, and when
+	// the current keypair was generated (unix nanoseconds). See devices.go.
+	Device      uuid.UUID
+	KeysUpdated int64
+
+	// Keys skipped over in the ratchets of our other devices
+	Skipped SkippedKeys
+
+	// Key material that hasn't been mirrored to our other devices yet
+	Material []KeyMaterial
+
+	// The random source and clock, which aren't exported, so must be set again
+	// after importing. Nil uses the defaults. See config.go.
+	Config *Config
+
+	// Set by Destroy, after which the session can't be used
+	destroyed bool
 }
 
 type Ratchet struct {
 	UUID      uuid.UUID
+	Epoch     uint32
 	Symmetric *SymRatchet
 	Root      *RootRatchet
+
+	// Members allowed to read a restricted ratchet, such as for a private
+	// channel. Otherwise every member can.
+	Restricted bool
+	Recipients []uuid.UUID
+
+	// The device that sends with one of our ratchets
+	Device uuid.UUID
+
+	// When the symmetric ratchet was replaced, by an update or by rekeying it
+	// (unix nanoseconds)
+	Updated int64
 }
 
-func (t *TxSession) SendMessage(ratchet uuid.UUID, msg []byte, w io.Writer) {
-	m := Data{SenderID: t.UUID, RatchetID: ratchet, MsgType: MSG_TYPE_DATA}
-	io.ReadFull(rand.Reader, m.Nonce[:])
+// CanRead returns whether a member is allowed to read the ratchet
+func (r *Ratchet) CanRead(id uuid.UUID) bool {
+	if !r.Restricted {
+		return true
+	}
 
-	for _, v := range t.Ratchets {
-		if v.UUID == ratchet {
-			key := v.Symmetric.Advance()
-			m.Payload = secretbox.Seal(nil, msg, &m.Nonce, (*[32]byte)(&key))
-			break
+	for _, v := range r.Recipients {
+		if v == id {
+			return true
 		}
 	}
+	return false
+}
+
+func (t *TxSession) SendMessage(ratchet uuid.UUID, msg []byte, w io.Writer) error {
+	if t.destroyed {
+		return ErrDestroyed
+	}
+	if t.HeaderPending {
+		return ErrUpdatePending
+	}
 
-	if len(m.Payload) == 0 {
-		panic("couldn't find ratchet for that ratchet id")
+	m := Data{SenderID: t.UUID, RatchetID: ratchet, MsgType: MSG_TYPE_DATA}
+	if err := t.Config.read(m.Nonce[:]); err != nil {
+		return err
 	}
 
+	rat := findRatchet(t.Ratchets, ratchet)
+	if rat == nil {
+		return ErrUnknownRatchet
+	}
+	if rat.Device != t.Device {
+		return ErrOtherDevice
+	}
+
+	m.Epoch = rat.Epoch
+	m.Counter = rat.Symmetric.Index()
+	key := rat.Symmetric.Advance()
+	m.Payload = sealAEAD((*[32]byte)(&key), m.Nonce[:], pad(msg, t.Padding), m.ad())
+	wipe(key[:])
+
 	m.Sign(t.SigningKey, t.SigningKeyPQ)
-	m.Marshal(w)
+	return t.send(&m, w)
 }
 
-func (t *TxSession) ReceiveMessage(msg []byte) ([]byte, error) {
-	var u uuid.UUID
-	copy(u[:], msg)
+// ReceiveMessage opens a message's envelope with the header key of each member
+// in turn, and passes it to the rx session of its sender. See
+// RxSession.ReceiveMessage.
+func (t *TxSession) ReceiveMessage(msg []byte) (*Received, error) {
+	if t.destroyed {
+		return nil, ErrDestroyed
+	}
+
+	e := new(Envelope)
+	if err := e.Unmarshal(bytes.NewReader(msg)); err != nil {
+		return nil, err
+	}
+
+	if inner, ok := e.open(t.UUID, &t.hints, &t.HeaderKey, &t.PrevHeaderKey); ok {
+		return t.receiveOwn(inner)
+	}
 
 	for _, v := range t.Children {
-		if v.UUID == u {
-			return v.ReceiveMessage(msg), nil
+		if inner, ok := e.open(v.UUID, &v.hints, &v.HeaderKey, &v.PrevHeaderKey); ok {
+			return v.ReceiveMessage(inner)
 		}
 	}
 
-	return []byte{}, errors.New("couldn't find rx for message")
+	return nil, ErrUnknownSender
 }
 
-func (t *TxSession) GenerateUpdate(out io.Writer) {
-	// Generate new keypairs
-	io.ReadFull(rand.Reader, t.CurrentPrivkey[:])
-	pub, priv, err := kyber768.GenerateKey(rand.Reader)
+func (t *TxSession) GenerateUpdate(out io.Writer) error {
+	if t.destroyed {
+		return ErrDestroyed
+	}
+
+	// Generate new keypairs, of the config's suite
+	var newPriv x25519.Key
+	if err := t.Config.read(newPriv[:]); err != nil {
+		return err
+	}
+	pub, priv, err := genPQ(t.Config, t.Config.suite())
 	if err != nil {
-		panic(err)
+		return err
 	}
-	t.CurrentPrivkeyPQ = *priv
-	t.CurrentPubkeyPQ = *pub
 
 	// Start message
 	var newPub x25519.Key
-	x25519.KeyGen(&newPub, &t.CurrentPrivkey)
+	x25519.KeyGen(&newPub, &newPriv)
 
 	u := &RatchetUpdate{
 		SenderID:    t.UUID,
 		MsgType:     MSG_TYPE_RATCHET_UPDATE,
 		NewPubkey:   newPub,
-		NewPubkeyPQ: *pub,
+		NewPubkeyPQ: pub,
 	}
 
-	for _, w := range t.Ratchets {
-		// Generate random keys
-		var encap DHKey
-		var encapPQ KyberKey
-		io.ReadFull(rand.Reader, encap[:])
-		io.ReadFull(rand.Reader, encapPQ[:])
-
-		// Encrypt keys to each other user
-		for _, v := range t.Children {
-			// Find DH shared secret and derive symmetric key
-			// Note: we generate these shared secrets multiple times, we should optimise this
-			var shared x25519.Key
-			x25519.Shared(&shared, &t.CurrentPrivkey, &v.CurrentPubkey)
-
-			var derived [32]byte
-			keyReader := hkdf.New(sha256.New, shared[:], nil, DH_HKDF_INFO)
-			_, err = io.ReadFull(keyReader, derived[:])
-			if err != nil {
-				panic(err)
-			}
+	// Members reject updates that aren't later than the last, so the timestamp
+	// must increase even if the clock goes back
+	u.Timestamp = t.Config.now().UnixNano()
+	if u.Timestamp <= t.KeysUpdated {
+		u.Timestamp = t.KeysUpdated + 1
+	}
 
-			// Encapsulate them (nonce is prepended to ciphertext)
-			var outDH DHKeyCiphertext
-			var nonce [24]byte
-			io.ReadFull(rand.Reader, nonce[:])
-			copy(outDH[:], nonce[:])
-			ciphertext := secretbox.Seal(nil, encap[:], &nonce, &derived)
-			copy(outDH[24:], ciphertext)
+	// In tree mode, our nodes are kept by members if our update is the latest
+	// to replace them, so it must be later than the nodes it replaces. The header
+	// key and the ratchets every member can read are derived from the commit
+	// secret.
+	var tr *RatchetTree
+	var leafSecret, commit pathSecret
+	if t.TreeMode {
+		tr = t.tree()
+		if latest := tr.latest(tr.leaf(t.UUID)); u.Timestamp <= latest {
+			u.Timestamp = latest + 1
+		}
+
+		u.Path, leafSecret, commit, err = t.sealPath(tr, &newPriv, pub.Suite, u.Timestamp, u.senderAD())
+		if err != nil {
+			return err
+		}
+	}
+
+	// Ratchets are only advanced once every update has been encrypted. Our other
+	// devices update their own ratchets.
+	rats := t.deviceRatchets()
+	encaps := make([]DHKey, len(rats))
+	encapsPQ := make([]PQKey, len(rats))
+
+	// The update to each member for each ratchet, which are encrypted in
+	// parallel
+	var members []*RxSession
+	var ratchets []int
+	for i, w := range rats {
+		if tr != nil && !w.Restricted {
+			encaps[i], encapsPQ[i] = commit.encaps(w.UUID)
+			u.Path.Ratchets = append(u.Path.Ratchets, TreeRatchetUpdate{
+				RatchetID:   w.UUID,
+				Epoch:       w.Epoch + 1,
+				PrevCounter: w.Symmetric.Index(),
+			})
+			continue
+		}
 
-			var outKyber KyberKeyCiphertext
-			v.CurrentPubkeyPQ.EncryptTo(outKyber[:], encapPQ[:], nil)
+		// Generate random keys
+		if err := t.Config.read(encaps[i][:]); err != nil {
+			return err
+		}
+		if err := t.Config.read(encapsPQ[i][:]); err != nil {
+			return err
+		}
 
-			// Add to message
+		for _, v := range t.recipients(w) {
+			members = append(members, v)
+			ratchets = append(ratchets, i)
 			u.Updates = append(u.Updates, UserRatchetUpdate{
-				UserID:    v.UUID,
-				RatchetID: w.UUID,
-				DH:        outDH,
-				Kyber:     outKyber,
+				UserID:      v.UUID,
+				RatchetID:   w.UUID,
+				Epoch:       w.Epoch + 1,
+				PrevCounter: w.Symmetric.Index(),
 			})
 		}
+	}
 
+	// The shared secret with each member is computed once, for every ratchet
+	// and the header key
+	var shared map[uuid.UUID]*x25519.Key
+	if tr == nil || len(members) > 0 {
+		shared = sharedSecrets(&newPriv, t.Children)
+	}
+	derived, err := deriveKeys(shared, DH_HKDF_INFO)
+	if err != nil {
+		return err
+	}
+
+	// Nothing but our new keys and ratchets is kept once the update is sent
+	var sent bool
+	defer func() {
+		for i := range encaps {
+			wipe(encaps[i][:])
+			wipe(encapsPQ[i][:])
+		}
+		for _, v := range shared {
+			wipe(v[:])
+		}
+		for _, v := range derived {
+			wipe(v[:])
+		}
+		leafSecret.destroy()
+		commit.destroy()
+		wipe(newPriv[:])
+		if !sent {
+			wipe(priv.Key)
+		}
+	}()
+
+	// Encrypt keys to each other user that can read the ratchet
+	ad := u.senderAD()
+	err = t.Config.parallel(len(u.Updates), func(j int) error {
+		v, i := members[j], ratchets[j]
+		data := ad.to(v.UUID[:], DH_HKDF_INFO, ratchetPurpose(u.Updates[j].RatchetID, u.Updates[j].Epoch))
+
+		outDH, err := sealDH(t.Config, derived[v.UUID], encaps[i], data)
+		if err != nil {
+			return err
+		}
+
+		outPQ, err := sealPQ(t.Config, &v.CurrentPubkeyPQ, encapsPQ[i], data)
+		if err != nil {
+			return err
+		}
+
+		u.Updates[j].DH = outDH
+		u.Updates[j].PQ = outPQ
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Replace our header key, encapsulated to every member
+	var headerKey [32]byte
+	if tr != nil {
+		headerKey = commit.headerKey(ad, u.Timestamp, u.Path)
+	} else {
+		headerKey, u.HeaderKeys, err = sealToShared(t.Config, shared, t.Children, HEADER_HKDF_INFO, HEADER_COMBINE_LABEL,
+			ad, timestampPurpose(u.Timestamp))
+		if err != nil {
+			return err
+		}
+	}
+
+	// The update is sealed with the header key that members have now
+	u.Sign(t.SigningKey, t.SigningKeyPQ)
+	msg := new(bytes.Buffer)
+	if err := t.send(u, msg); err != nil {
+		return err
+	}
+
+	var ownPath *pathSecret
+	if tr != nil {
+		if err := t.mergeOwnPath(tr, leafSecret, pub.Suite, u.Timestamp); err != nil {
+			return err
+		}
+		ownPath = &leafSecret
+	}
+	t.recordKeypair(u.Timestamp, newPriv, priv, pub, headerKey, rats, encaps, encapsPQ, ownPath)
+
+	sent = true
+	wipe(t.PrevPrivkey[:])
+	wipe(t.PrevPrivkeyPQ.Key)
+	t.PrevPrivkey = t.CurrentPrivkey
+	t.PrevPrivkeyPQ = t.CurrentPrivkeyPQ
+	t.CurrentPrivkey = newPriv
+	t.CurrentPrivkeyPQ = priv
+	t.CurrentPubkeyPQ = pub
+	if !t.HeaderPending {
+		t.PrevHeaderKey = t.HeaderKey
+	}
+	t.HeaderKey = headerKey
+	t.HeaderPending = false
+	t.KeysUpdated = u.Timestamp
+
+	for i, w := range rats {
 		// Advance our root ratchet
-		chain := w.Root.Advance(encap, encapPQ)
+		chain := w.Root.Advance(encaps[i], encapsPQ[i], ratchetContext(ad, w.UUID, w.Epoch+1))
 
 		// Generate new symmetric ratchet
-		w.Symmetric = NewSymRatchet(chain)
+		w.setChain(&chain)
+		w.Epoch++
+		w.Updated = u.Timestamp
 	}
 
-	u.Sign(t.SigningKey, t.SigningKeyPQ)
-	u.Marshal(out)
+	_, err = msg.WriteTo(out)
+	return err
 }
 
-func (t *TxSession) Export(w io.Writer) {
-	w.Write(t.UUID[:])
-	w.Write(t.SigningKey)
-	w.Write(t.SigningKeyPQ.Bytes())
-
-	binary.Write(w, binary.BigEndian, int64(len(t.Ratchets)))
-	for _, v := range t.Ratchets {
-		w.Write(v.UUID[:])
-		w.Write(v.Symmetric.current[:])
-		w.Write(v.Root.current[:])
+func (t *TxSession) Export(w io.Writer) error {
+	if t.destroyed {
+		return ErrDestroyed
 	}
 
-	w.Write(t.CurrentPrivkey[:])
+	e := newExport(EXPORT_KIND_TX, t.SigningKeyPQ.Suite)
+
+	e.section(EXPORT_SECTION_IDENTITY, func(w io.Writer) {
+		w.Write(t.UUID[:])
+		w.Write(t.SigningKey)
+		t.SigningKeyPQ.Marshal(w)
+	})
+
+	e.section(EXPORT_SECTION_KEY_HISTORY, func(w io.Writer) {
+		exportKeyHistory(w, t.KeyGeneration, t.KeyHistory)
+	})
+
+	e.section(EXPORT_SECTION_RATCHETS, func(w io.Writer) {
+		exportRatchets(w, t.Ratchets)
+	})
+
+	e.section(EXPORT_SECTION_RECIPIENTS, func(w io.Writer) {
+		exportRecipients(w, t.Ratchets)
+	})
+
+	e.section(EXPORT_SECTION_KEYS, func(w io.Writer) {
+		w.Write(t.CurrentPrivkey[:])
+		t.CurrentPrivkeyPQ.Marshal(w)
+		t.CurrentPubkeyPQ.Marshal(w)
+	})
+
+	e.section(EXPORT_SECTION_PREV_KEYS, func(w io.Writer) {
+		w.Write(t.PrevPrivkey[:])
+		t.PrevPrivkeyPQ.Marshal(w)
+	})
+
+	e.section(EXPORT_SECTION_HEADER, func(w io.Writer) {
+		w.Write(t.HeaderKey[:])
+		w.Write(t.PrevHeaderKey[:])
+		if t.HeaderPending {
+			w.Write([]byte{1})
+		}
+	})
+
+	e.section(EXPORT_SECTION_PADDING, func(w io.Writer) {
+		w.Write([]byte{t.Padding})
+	})
+
+	e.section(EXPORT_SECTION_DEVICES, func(w io.Writer) {
+		exportDevices(w, t)
+	})
+
+	e.section(EXPORT_SECTION_POLICY, func(w io.Writer) {
+		exportPolicy(w, t)
+	})
 
-	privPQ := make([]byte, kyber768.PrivateKeySize)
-	t.CurrentPrivkeyPQ.Pack(privPQ)
-	w.Write(privPQ)
+	e.section(EXPORT_SECTION_TREE, func(w io.Writer) {
+		exportTree(w, t)
+	})
 
-	pubPQ := make([]byte, kyber768.PublicKeySize)
-	t.CurrentPubkeyPQ.Pack(pubPQ)
-	w.Write(pubPQ)
+	e.section(EXPORT_SECTION_SKIPPED, func(w io.Writer) {
+		exportSkipped(w, t.Skipped)
+	})
 
-	binary.Write(w, binary.BigEndian, int64(len(t.Children)))
 	for _, v := range t.Children {
-		v.Export(w)
+		child := new(bytes.Buffer)
+		if err := v.Export(child); err != nil {
+			return err
+		}
+
+		e.section(EXPORT_SECTION_CHILD, func(w io.Writer) {
+			w.Write(child.Bytes())
+		})
 	}
+
+	return e.finish(w)
 }
 
-func ImportTx(r io.Reader) *TxSession {
-	t := new(TxSession)
+// ImportTx reads an export of a tx session, either versioned or in the
+// unversioned layout.
+func ImportTx(i io.Reader) (*TxSession, error) {
+	b, err := io.ReadAll(i)
+	if err != nil {
+		return nil, ErrTruncated
+	}
+	defer wipe(b)
+
+	if !isExport(b) {
+		return importTxLegacy(b)
+	}
+
+	version, sections, err := readExport(b, EXPORT_KIND_TX)
+	if err != nil {
+		return nil, err
+	}
+	legacy := version == 1
+
+	t := &TxSession{Skipped: make(SkippedKeys)}
+	var hasIdentity, hasRatchets, hasKeys, hasHeader bool
+	var recipients, devices, policy []byte
+	for _, s := range sections {
+		r := &errReader{r: bytes.NewReader(s.Body)}
+
+		switch s.Tag {
+		case EXPORT_SECTION_IDENTITY:
+			hasIdentity = true
+			r.Read(t.UUID[:])
+
+			t.SigningKey = make(ed25519.PrivateKey, ed25519.PrivateKeySize)
+			r.Read(t.SigningKey)
+			readPQ(r, legacy, &t.SigningKeyPQ)
+
+		case EXPORT_SECTION_RATCHETS:
+			hasRatchets = true
+			t.Ratchets = importRatchets(r)
+
+		case EXPORT_SECTION_KEYS:
+			hasKeys = true
+			r.Read(t.CurrentPrivkey[:])
+			readPQ(r, legacy, &t.CurrentPrivkeyPQ)
+			readPQ(r, legacy, &t.CurrentPubkeyPQ)
+
+		case EXPORT_SECTION_RECIPIENTS:
+			recipients = s.Body
+
+		case EXPORT_SECTION_DEVICES:
+			devices = s.Body
+
+		case EXPORT_SECTION_POLICY:
+			policy = s.Body
+
+		case EXPORT_SECTION_SKIPPED:
+			importSkipped(r, t.Skipped)
+
+		case EXPORT_SECTION_KEY_HISTORY:
+			t.KeyGeneration, t.KeyHistory = importKeyHistory(r, legacy)
+
+		case EXPORT_SECTION_PADDING:
+			b := make([]byte, 1)
+			r.Read(b)
+			t.Padding = b[0]
+
+		case EXPORT_SECTION_HEADER:
+			hasHeader = true
+			r.Read(t.HeaderKey[:])
+			r.Read(t.PrevHeaderKey[:])
+			t.HeaderPending = len(s.Body) > 2*len(t.HeaderKey) && s.Body[2*len(t.HeaderKey)] == 1
+
+		case EXPORT_SECTION_TREE:
+			importTree(r, t, legacy)
 
-	r.Read(t.UUID[:])
+		case EXPORT_SECTION_PREV_KEYS:
+			r.Read(t.PrevPrivkey[:])
+			readPQ(r, legacy, &t.PrevPrivkeyPQ)
 
-	t.SigningKey = make(ed25519.PrivateKey, ed25519.PrivateKeySize)
-	r.Read(t.SigningKey)
+		case EXPORT_SECTION_CHILD:
+			rx, err := ImportRx(bytes.NewReader(s.Body))
+			if err != nil {
+				return nil, err
+			}
+			rx.Parent = t
+			t.Children = append(t.Children, rx)
+		}
+
+		if r.err != nil {
+			return nil, r.err
+		}
+	}
+
+	if !hasIdentity || !hasRatchets || !hasKeys {
+		return nil, ErrCorruptExport
+	}
+	if err := importRecipients(recipients, t.Ratchets); err != nil {
+		return nil, err
+	}
+	if err := importDevices(devices, t); err != nil {
+		return nil, err
+	}
+	if err := importPolicy(policy, t); err != nil {
+		return nil, err
+	}
+	t.stampUpdated()
+	if !hasHeader {
+		if err := t.migrateHeaderKey(); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
 
-	var sigPQ [mode2.PrivateKeySize]byte
-	r.Read(sigPQ[:])
-	t.SigningKeyPQ.Unpack(&sigPQ)
+func exportRatchets(w io.Writer, rats []*Ratchet) {
+	binary.Write(w, binary.BigEndian, int64(len(rats)))
+	for _, v := range rats {
+		exportRatchet(w, v)
+	}
+}
+
+func importRatchets(r *errReader) []*Ratchet {
+	var rats []*Ratchet
 
 	var ratchetCount int64
 	binary.Read(r, binary.BigEndian, &ratchetCount)
-	for i := 0; i < int(ratchetCount); i++ {
-		var rat Ratchet
-		r.Read(rat.UUID[:])
+	for i := int64(0); i < ratchetCount && r.err == nil; i++ {
+		rats = append(rats, importRatchet(r))
+	}
 
-		var symChain ChainKey
-		r.Read(symChain[:])
-		rat.Symmetric = NewSymRatchet(symChain)
+	return rats
+}
 
-		var rootChain ChainKey
-		r.Read(rootChain[:])
-		rat.Root = NewRootRatchet(rootChain)
+// exportRecipients writes the recipients of the restricted ratchets
+func exportRecipients(w io.Writer, rats []*Ratchet) {
+	var restricted []*Ratchet
+	for _, v := range rats {
+		if v.Restricted {
+			restricted = append(restricted, v)
+		}
 	}
 
-	r.Read(t.CurrentPrivkey[:])
+	binary.Write(w, binary.BigEndian, int64(len(restricted)))
+	for _, v := range restricted {
+		w.Write(v.UUID[:])
+		binary.Write(w, binary.BigEndian, int64(len(v.Recipients)))
+		for _, u := range v.Recipients {
+			w.Write(u[:])
+		}
+	}
+}
 
-	privPQ := make([]byte, kyber768.PrivateKeySize)
-	r.Read(privPQ)
-	t.CurrentPrivkeyPQ.Unpack(privPQ)
+// importRecipients reads the recipients section, if there is one, into the
+// ratchets it restricts
+func importRecipients(b []byte, rats []*Ratchet) error {
+	r := &errReader{r: bytes.NewReader(b)}
 
-	pubPQ := make([]byte, kyber768.PublicKeySize)
-	r.Read(pubPQ)
-	t.CurrentPubkeyPQ.Unpack(pubPQ)
+	var count int64
+	if len(b) > 0 {
+		binary.Read(r, binary.BigEndian, &count)
+	}
+	for i := int64(0); i < count && r.err == nil; i++ {
+		var id uuid.UUID
+		r.Read(id[:])
+
+		var recipients []uuid.UUID
+		var l int64
+		binary.Read(r, binary.BigEndian, &l)
+		for j := int64(0); j < l && r.err == nil; j++ {
+			var u uuid.UUID
+			r.Read(u[:])
+			recipients = append(recipients, u)
+		}
 
-	var childrenCount int64
-	binary.Read(r, binary.BigEndian, &childrenCount)
-	for i := 0; i < int(childrenCount); i++ {
-		rx := ImportRx(r)
-		rx.Parent = t
-		t.Children = append(t.Children, rx)
+		rat := findRatchet(rats, id)
+		if rat == nil {
+			return ErrCorruptExport
+		}
+		rat.Restricted = true
+		rat.Recipients = recipients
 	}
 
-	return t
+	return r.err
+}
+
+func exportRatchet(w io.Writer, r *Ratchet) {
+	w.Write(r.UUID[:])
+	binary.Write(w, binary.BigEndian, r.Epoch)
+	binary.Write(w, binary.BigEndian, r.Symmetric.index)
+	w.Write(r.Symmetric.current[:])
+	w.Write(r.Root.current[:])
+}
+
+func importRatchet(r io.Reader) *Ratchet {
+	rat := new(Ratchet)
+	r.Read(rat.UUID[:])
+	binary.Read(r, binary.BigEndian, &rat.Epoch)
+
+	var index uint32
+	binary.Read(r, binary.BigEndian, &index)
+
+	var symChain ChainKey
+	r.Read(symChain[:])
+	rat.Symmetric = NewSymRatchet(symChain)
+	rat.Symmetric.index = index
+
+	var rootChain ChainKey
+	r.Read(rootChain[:])
+	rat.Root = NewRootRatchet(rootChain)
+
+	return rat
 }
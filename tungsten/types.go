@@ -1,11 +1,9 @@
-package main
+package tungsten
 
 import (
 	"crypto/ed25519"
 
-	"github.com/cloudflare/circl/pke/kyber/kyber768"
-	"github.com/cloudflare/circl/sign/dilithium/mode2"
-	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/chacha20poly1305"
 )
 
 type ChainKey [32]byte
@@ -13,11 +11,11 @@ type MessageKey [32]byte
 
 // Keys encapsulated by a method
 type DHKey [32]byte
-type KyberKey [32]byte
+type PQKey [32]byte
 
 // The output of encapsulation by a method
-type DHKeyCiphertext [32 + 24 + secretbox.Overhead]byte // nonce is prepended
-type KyberKeyCiphertext [kyber768.CiphertextSize]byte
+type DHKeyCiphertext [chacha20poly1305.NonceSizeX + 32 + chacha20poly1305.Overhead]byte // nonce is prepended
+type PQKeyCiphertext [PQ_CIPHERTEXT_SIZE + 32 + chacha20poly1305.Overhead]byte          // KEM ciphertext is prepended
 
 type ECSignature [ed25519.SignatureSize]byte
-type DiLiSignature [mode2.SignatureSize]byte
+type PQSignature [PQ_SIGNATURE_SIZE]byte